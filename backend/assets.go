@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Asset kinds, from the top of the tree down. Machines are the rows of the
+// machines table, placed on a line by their lineId; the other kinds are
+// stored in assets.
+const (
+	assetKindSite      = "site"
+	assetKindArea      = "area"
+	assetKindLine      = "line"
+	assetKindMachine   = "machine"
+	assetKindComponent = "component"
+)
+
+// assetParentKinds lists the kinds of node each kind may be placed under,
+// "" being the root. Machines stay at the root until placed on a line, and
+// components may be nested.
+var assetParentKinds = map[string][]string{
+	assetKindSite:      {""},
+	assetKindArea:      {assetKindSite},
+	assetKindLine:      {assetKindArea},
+	assetKindMachine:   {assetKindLine, ""},
+	assetKindComponent: {assetKindMachine, assetKindComponent},
+}
+
+// AssetNode is a node of the asset tree with its subtree. Every node but a
+// component has a Rollup of the machines beneath it, itself included.
+type AssetNode struct {
+	ID       string       `json:"id"`
+	ParentID string       `json:"parentId"`
+	Kind     string       `json:"kind"`
+	Name     string       `json:"name"`
+	Code     string       `json:"code,omitempty"`
+	Model    string       `json:"model,omitempty"`  // machines only
+	Status   string       `json:"status,omitempty"` // machines only
+	Rollup   *AssetRollup `json:"rollup,omitempty"`
+	Children []AssetNode  `json:"children"`
+}
+
+// AssetRollup sums up the machines of a subtree: how many there are by
+// status, their open alarms, maintenances and requests, and their
+// reliability over the requested period.
+type AssetRollup struct {
+	Machines            int                   `json:"machines"`
+	MachineStatus       map[string]int        `json:"machineStatus"`
+	Alarms              int                   `json:"alarms"`
+	CriticalAlarms      int                   `json:"criticalAlarms"`
+	OpenMaintenances    int                   `json:"openMaintenances"`
+	OverdueMaintenances int                   `json:"overdueMaintenances"`
+	OpenRequests        int                   `json:"openRequests"`
+	KPIs                ReliabilityReportItem `json:"kpis"`
+}
+
+// assetTree holds every node of the tree, without subtrees, and the
+// children of each node in name order. Root nodes are children of "".
+type assetTree struct {
+	nodes    map[string]AssetNode
+	children map[string][]string
+}
+
+func loadAssetTree(q queryer) (*assetTree, error) {
+	tree := &assetTree{nodes: map[string]AssetNode{}, children: map[string][]string{}}
+	rows, err := q.Query(`
+		SELECT id, parentId, kind, name, code, '', '' FROM assets
+		UNION ALL
+		SELECT id, lineId, ?, COALESCE(name, ''), '', COALESCE(model, ''), COALESCE(status, '') FROM machines
+		ORDER BY 4`, assetKindMachine)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var order []string
+	for rows.Next() {
+		var n AssetNode
+		if err := rows.Scan(&n.ID, &n.ParentID, &n.Kind, &n.Name, &n.Code, &n.Model, &n.Status); err != nil {
+			return nil, err
+		}
+		tree.nodes[n.ID] = n
+		order = append(order, n.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range order {
+		parentID := tree.nodes[id].ParentID
+		if _, ok := tree.nodes[parentID]; !ok {
+			parentID = ""
+		}
+		tree.children[parentID] = append(tree.children[parentID], id)
+	}
+	return tree, nil
+}
+
+// isDescendant reports whether id is ancestorID or lies beneath it.
+func (t *assetTree) isDescendant(id, ancestorID string) bool {
+	for seen := 0; id != "" && seen <= len(t.nodes); seen++ {
+		if id == ancestorID {
+			return true
+		}
+		id = t.nodes[id].ParentID
+	}
+	return false
+}
+
+// validateAssetParent checks that a node of kind may be placed under
+// parentID without making a cycle.
+func (t *assetTree) validateAssetParent(id, kind, parentID string) error {
+	parentKind := ""
+	if parentID != "" {
+		parent, ok := t.nodes[parentID]
+		if !ok {
+			return fmt.Errorf("parent %q not found", parentID)
+		}
+		parentKind = parent.Kind
+	}
+	allowed := false
+	for _, k := range assetParentKinds[kind] {
+		allowed = allowed || k == parentKind
+	}
+	if !allowed {
+		if parentKind == "" {
+			return fmt.Errorf("%s nodes must be placed under %s nodes", kind, strings.Join(assetParentKinds[kind], " or "))
+		}
+		return fmt.Errorf("%s nodes cannot be placed under %s nodes", kind, parentKind)
+	}
+	if id != "" && parentID != "" && t.isDescendant(parentID, id) {
+		return errors.New("a node cannot be moved beneath itself")
+	}
+	return nil
+}
+
+// assetMachineStats holds the rolled-up figures of each machine.
+type assetMachineStats struct {
+	alarms, critical, open, overdue, requests map[string]int
+	kpis                                      map[string]ReliabilityReportItem
+}
+
+func loadAssetMachineStats(q queryer, from, to time.Time) (*assetMachineStats, error) {
+	stats := &assetMachineStats{
+		alarms: map[string]int{}, critical: map[string]int{}, open: map[string]int{},
+		overdue: map[string]int{}, requests: map[string]int{}, kpis: map[string]ReliabilityReportItem{},
+	}
+
+	// Alarms are the open notifications about a machine's maintenances
+	// and requests
+	rows, err := q.Query(`
+		SELECT COALESCE(m.machineId, mr.machineId), n.severity FROM notifications n
+		LEFT JOIN maintenance m ON n.entityType = 'maintenance' AND m.id = n.entityId
+		LEFT JOIN maintenance_requests mr ON n.entityType = 'maintenance-request' AND mr.id = n.entityId
+		WHERE n.resolvedAt = '' AND COALESCE(m.machineId, mr.machineId) IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var machineID, severity string
+		if err := rows.Scan(&machineID, &severity); err != nil {
+			return nil, err
+		}
+		stats.alarms[machineID]++
+		if severity == "critical" {
+			stats.critical[machineID]++
+		}
+	}
+	rows.Close()
+
+	rows, err = q.Query("SELECT machineId, status, dueDate FROM maintenance WHERE status != ?", maintenanceStatusCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var machineID, status, dueDate string
+		if err := rows.Scan(&machineID, &status, &dueDate); err != nil {
+			return nil, err
+		}
+		stats.open[machineID]++
+		if isOverdue(status, dueDate, now) {
+			stats.overdue[machineID]++
+		}
+	}
+	rows.Close()
+
+	rows, err = q.Query("SELECT machineId, COUNT(*) FROM maintenance_requests WHERE status = ? GROUP BY machineId", requestStatusOpen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var machineID string
+		var count int
+		if err := rows.Scan(&machineID, &count); err != nil {
+			return nil, err
+		}
+		stats.requests[machineID] = count
+	}
+	rows.Close()
+
+	items, err := computeReliability(q, from, to, "machine", "")
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		stats.kpis[item.Key] = item
+	}
+	return stats, nil
+}
+
+// buildAssetNode returns the node id with its subtree and roll-ups.
+func buildAssetNode(tree *assetTree, stats *assetMachineStats, id string) AssetNode {
+	node := tree.nodes[id]
+	node.Children = []AssetNode{}
+	var rollup *AssetRollup
+	if node.Kind != assetKindComponent {
+		rollup = &AssetRollup{MachineStatus: map[string]int{}}
+		rollup.KPIs.Key, rollup.KPIs.Label = node.ID, node.Name
+	}
+	if node.Kind == assetKindMachine {
+		rollup.Machines = 1
+		rollup.MachineStatus[node.Status]++
+		rollup.Alarms = stats.alarms[id]
+		rollup.CriticalAlarms = stats.critical[id]
+		rollup.OpenMaintenances = stats.open[id]
+		rollup.OverdueMaintenances = stats.overdue[id]
+		rollup.OpenRequests = stats.requests[id]
+		addReliability(&rollup.KPIs, stats.kpis[id])
+	}
+
+	for _, childID := range tree.children[id] {
+		child := buildAssetNode(tree, stats, childID)
+		node.Children = append(node.Children, child)
+		if rollup == nil || child.Rollup == nil {
+			continue
+		}
+		rollup.Machines += child.Rollup.Machines
+		for status, count := range child.Rollup.MachineStatus {
+			rollup.MachineStatus[status] += count
+		}
+		rollup.Alarms += child.Rollup.Alarms
+		rollup.CriticalAlarms += child.Rollup.CriticalAlarms
+		rollup.OpenMaintenances += child.Rollup.OpenMaintenances
+		rollup.OverdueMaintenances += child.Rollup.OverdueMaintenances
+		rollup.OpenRequests += child.Rollup.OpenRequests
+		addReliability(&rollup.KPIs, child.Rollup.KPIs)
+	}
+	if rollup != nil {
+		summarizeReliability(&rollup.KPIs)
+	}
+	node.Rollup = rollup
+	return node
+}
+
+// assetSubtrees returns the subtrees of ids with their roll-ups over the
+// period of the from/to query parameters.
+func assetSubtrees(r *http.Request, tree *assetTree, ids []string) ([]AssetNode, int, error) {
+	db := tenantDB(r)
+	from, to, err := parseReportPeriod(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	stats, err := loadAssetMachineStats(db, from, to)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	nodes := []AssetNode{}
+	for _, id := range ids {
+		nodes = append(nodes, buildAssetNode(tree, stats, id))
+	}
+	return nodes, http.StatusOK, nil
+}
+
+// serveAssetNode writes the subtree of a node.
+func serveAssetNode(w http.ResponseWriter, r *http.Request, tree *assetTree, id string) {
+	nodes, status, err := assetSubtrees(r, tree, []string{id})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes[0])
+}
+
+// Asset handlers
+func assetsHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	tree, err := loadAssetTree(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		nodes, status, err := assetSubtrees(r, tree, tree.children[""])
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(nodes)
+	case "POST":
+		var n AssetNode
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.Name = strings.TrimSpace(n.Name)
+		if n.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if n.Kind == assetKindMachine {
+			http.Error(w, "machines are created through /api/machines", http.StatusBadRequest)
+			return
+		}
+		if _, ok := assetParentKinds[n.Kind]; !ok {
+			http.Error(w, fmt.Sprintf("invalid kind %q: must be %q, %q, %q or %q", n.Kind, assetKindSite, assetKindArea, assetKindLine, assetKindComponent), http.StatusBadRequest)
+			return
+		}
+		if err := tree.validateAssetParent("", n.Kind, n.ParentID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.ID = uuid.New().String()
+		_, err := db.Exec("INSERT INTO assets (id, parentId, kind, name, code) VALUES (?, ?, ?, ?, ?)", n.ID, n.ParentID, n.Kind, n.Name, n.Code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n.Children = []AssetNode{}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(n)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// assetHandler serves /api/assets/{id}, the subtree of any node, machines
+// included, and /api/assets/{id}/move.
+func assetHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/assets/"), "/")
+
+	tree, err := loadAssetTree(db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	node, ok := tree.nodes[id]
+	if !ok {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	if sub == "move" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		moveAsset(w, r, tree, node)
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		serveAssetNode(w, r, tree, id)
+	case "PUT":
+		if node.Kind == assetKindMachine {
+			http.Error(w, "machines are edited through /api/machines", http.StatusBadRequest)
+			return
+		}
+		var updated AssetNode
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated.Name = strings.TrimSpace(updated.Name)
+		if updated.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		// The kind is fixed and the parent is changed through /move
+		if _, err := db.Exec("UPDATE assets SET name = ?, code = ? WHERE id = ?", updated.Name, updated.Code, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		node.Name, node.Code = updated.Name, updated.Code
+		tree.nodes[id] = node
+		serveAssetNode(w, r, tree, id)
+	case "DELETE":
+		if node.Kind == assetKindMachine {
+			http.Error(w, "machines are deleted through /api/machines", http.StatusBadRequest)
+			return
+		}
+		if len(tree.children[id]) > 0 {
+			http.Error(w, "The node has children; move or delete them first", http.StatusConflict)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM assets WHERE id = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// moveAsset serves POST /api/assets/{id}/move, placing a node and its
+// subtree under {"parentId"}; an empty parent moves a site or a machine to
+// the root.
+func moveAsset(w http.ResponseWriter, r *http.Request, tree *assetTree, node AssetNode) {
+	db := tenantDB(r)
+	var req struct {
+		ParentID string `json:"parentId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tree.validateAssetParent(node.ID, node.Kind, req.ParentID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if node.Kind == assetKindMachine {
+		_, err = db.Exec("UPDATE machines SET lineId = ?, updatedBy = ?, updatedAt = ? WHERE id = ?",
+			req.ParentID, actorID(r), time.Now().UTC().Format(time.RFC3339), node.ID)
+	} else {
+		_, err = db.Exec("UPDATE assets SET parentId = ? WHERE id = ?", req.ParentID, node.ID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tree, err = loadAssetTree(db); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveAssetNode(w, r, tree, node.ID)
+}
+
+// validateMachineLine checks that the line a machine is placed on exists.
+func validateMachineLine(q queryer, lineID string) error {
+	if lineID == "" {
+		return nil
+	}
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM assets WHERE id = ? AND kind = ?)", lineID, assetKindLine).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("line %q not found", lineID)
+	}
+	return nil
+}
+
+// deleteAssetSubtree deletes the components beneath a deleted machine.
+func deleteAssetSubtree(q queryer, parentID string) error {
+	_, err := q.Exec(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM assets WHERE parentId = ?
+			UNION ALL
+			SELECT a.id FROM assets a JOIN subtree s ON a.parentId = s.id
+		)
+		DELETE FROM assets WHERE id IN (SELECT id FROM subtree)`, parentID)
+	return err
+}
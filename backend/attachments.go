@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Attachment is a file attached to a machine or a maintenance: photos of
+// failures, signed reports, manuals. The content is kept in the attachment
+// storage under StorageKey; SHA256 is the hex checksum of the content.
+type Attachment struct {
+	ID          string `json:"id"`
+	EntityType  string `json:"entityType"` // "machine" or "maintenance"
+	EntityID    string `json:"entityId"`
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Description string `json:"description,omitempty"`
+	UploadedBy  string `json:"uploadedBy"`
+	UploadedAt  string `json:"uploadedAt"`
+	StorageKey  string `json:"-"`
+}
+
+const attachmentColumns = "id, entityType, entityId, fileName, contentType, size, sha256, description, uploadedBy, uploadedAt, storageKey"
+
+func scanAttachment(row rowScanner, a *Attachment) error {
+	return row.Scan(&a.ID, &a.EntityType, &a.EntityID, &a.FileName, &a.ContentType, &a.Size, &a.SHA256, &a.Description, &a.UploadedBy, &a.UploadedAt, &a.StorageKey)
+}
+
+// attachmentStorage keeps the content of attachments.
+type attachmentStorage interface {
+	// Put stores size bytes of body under key. checksum is the hex SHA-256
+	// of the content.
+	Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType, checksum string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes key; removing a key that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	attachmentStore attachmentStorage
+
+	// maxAttachmentBytes limits the size of uploads.
+	maxAttachmentBytes int64 = 20 << 20
+
+	// attachmentContentTypes are the accepted types of attachment content,
+	// as detected from the content itself.
+	attachmentContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "application/pdf", "text/plain"}
+)
+
+// newAttachmentStorage configures the attachment storage from the
+// environment: the local filesystem under ATTACHMENT_DIR by default, or an
+// S3-compatible bucket when ATTACHMENT_STORAGE is "s3".
+func newAttachmentStorage() (attachmentStorage, error) {
+	switch kind := os.Getenv("ATTACHMENT_STORAGE"); kind {
+	case "", "local":
+		dir := os.Getenv("ATTACHMENT_DIR")
+		if dir == "" {
+			dir = "attachments"
+		}
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return nil, err
+		}
+		return localStorage{dir: dir}, nil
+	case "s3":
+		s := &s3Storage{
+			endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+			bucket:    os.Getenv("S3_BUCKET"),
+			region:    os.Getenv("S3_REGION"),
+			accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			client:    &http.Client{Timeout: 5 * time.Minute},
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if s.endpoint == "" || s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+			return nil, errors.New("S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for s3 attachment storage")
+		}
+		if _, err := url.Parse(s.endpoint); err != nil {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT: %v", err)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown ATTACHMENT_STORAGE %q: must be local or s3", kind)
+	}
+}
+
+// localStorage keeps attachments as files under dir.
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s localStorage) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType, checksum string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	// Written under a temporary name so a failed upload leaves nothing behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s localStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s localStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// s3Storage keeps attachments in a bucket of an S3-compatible service, such
+// as MinIO, addressed path-style at endpoint. Requests are signed with AWS
+// Signature Version 4.
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *s3Storage) request(ctx context.Context, method, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/"+url.PathEscape(s.bucket)+"/"+strings.Join(segments, "/"), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the Signature Version 4 authorization of req.
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Error reads the error returned by the service.
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("s3 %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType, checksum string) error {
+	req, err := s.request(ctx, "PUT", key, body, checksum)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.request(ctx, "GET", key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	req, err := s.request(ctx, "DELETE", key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// attachmentEntityTables maps the entity types that take attachments to
+// their table.
+var attachmentEntityTables = map[string]string{
+	"machine":             "machines",
+	"maintenance":         "maintenance",
+	"maintenance-request": "maintenance_requests",
+}
+
+// attachmentsHandler serves /api/machines/{id}/attachments,
+// /api/maintenance/{id}/attachments and
+// /api/maintenance-requests/{id}/attachments: GET lists the attachments and POST
+// uploads one, as the "file" field of a multipart form with an optional
+// "description". GET on /attachments/{attachmentId} downloads the file and
+// DELETE removes it. path is the part of the URL after the collection,
+// "{id}/attachments[/{attachmentId}]".
+func attachmentsHandler(w http.ResponseWriter, r *http.Request, entityType, path string) {
+	db := tenantDB(r)
+	entityID, attachmentID, _ := strings.Cut(path, "/attachments")
+	attachmentID = strings.TrimPrefix(attachmentID, "/")
+
+	tenantMutex(r).Lock()
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+attachmentEntityTables[entityType]+" WHERE id = ?)", entityID).Scan(&exists)
+	tenantMutex(r).Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, strings.ToUpper(entityType[:1])+entityType[1:]+" not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case attachmentID == "" && r.Method == "GET":
+		listAttachments(w, r, entityType, entityID)
+	case attachmentID == "" && r.Method == "POST":
+		uploadAttachment(w, r, entityType, entityID)
+	case attachmentID != "" && r.Method == "GET":
+		downloadAttachment(w, r, entityType, entityID, attachmentID)
+	case attachmentID != "" && r.Method == "DELETE":
+		deleteAttachment(w, r, entityType, entityID, attachmentID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listAttachments(w http.ResponseWriter, r *http.Request, entityType, entityID string) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	attachments, err := queryAttachments(db, entityType, entityID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// queryAttachments returns the attachments of an entity, oldest first.
+func queryAttachments(q queryer, entityType, entityID string) ([]Attachment, error) {
+	rows, err := q.Query("SELECT "+attachmentColumns+" FROM attachments WHERE entityType = ? AND entityId = ? ORDER BY uploadedAt", entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// allowedAttachmentType reports whether content of contentType may be
+// attached.
+func allowedAttachmentType(contentType string) bool {
+	for _, t := range attachmentContentTypes {
+		if strings.EqualFold(t, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadAttachment stores the uploaded file. The content is spooled to a
+// temporary file first, to check its size, type and checksum before it
+// reaches the storage. The type is detected from the content and must agree
+// with the type declared for the part, if any. A client may send the
+// expected checksum in the X-Checksum-SHA256 header.
+func uploadAttachment(w http.ResponseWriter, r *http.Request, entityType, entityID string) {
+	db := tenantDB(r)
+	// Leave room for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentBytes+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
+
+	a := Attachment{ID: uuid.New().String(), EntityType: entityType, EntityID: entityID}
+	var spool *os.File
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+	var declaredType string
+	hash := sha256.New()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+		switch part.FormName() {
+		case "file":
+			if spool != nil {
+				http.Error(w, "only one file can be uploaded at a time", http.StatusBadRequest)
+				return
+			}
+			a.FileName = filepath.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+			declaredType, _, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if spool, err = os.CreateTemp("", "attachment-*"); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			a.Size, err = io.Copy(io.MultiWriter(spool, hash), io.LimitReader(part, maxAttachmentBytes+1))
+			if err != nil {
+				http.Error(w, err.Error(), uploadErrorStatus(err))
+				return
+			}
+			if a.Size > maxAttachmentBytes {
+				http.Error(w, fmt.Sprintf("the file is larger than %d bytes", maxAttachmentBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+		case "description":
+			description, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				http.Error(w, err.Error(), uploadErrorStatus(err))
+				return
+			}
+			a.Description = strings.TrimSpace(string(description))
+		}
+	}
+	if spool == nil || a.Size == 0 {
+		http.Error(w, "a non-empty file is required", http.StatusBadRequest)
+		return
+	}
+	if a.FileName == "" || a.FileName == "." || a.FileName == "/" {
+		a.FileName = a.ID
+	}
+
+	sniff := make([]byte, 512)
+	n, err := spool.ReadAt(sniff, 0)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.ContentType, _, _ = mime.ParseMediaType(http.DetectContentType(sniff[:n]))
+	if !allowedAttachmentType(a.ContentType) {
+		http.Error(w, fmt.Sprintf("files of type %s cannot be attached; allowed types are %s", a.ContentType, strings.Join(attachmentContentTypes, ", ")), http.StatusUnsupportedMediaType)
+		return
+	}
+	if declaredType != "" && declaredType != "application/octet-stream" && !strings.EqualFold(declaredType, a.ContentType) {
+		http.Error(w, fmt.Sprintf("the file was sent as %s but its content is %s", declaredType, a.ContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	a.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if expected := r.Header.Get("X-Checksum-SHA256"); expected != "" && !strings.EqualFold(expected, a.SHA256) {
+		http.Error(w, "the checksum of the file does not match X-Checksum-SHA256", http.StatusBadRequest)
+		return
+	}
+
+	a.StorageKey = tenantStorageKey(requestTenant(r), entityType+"/"+entityID+"/"+a.ID)
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := attachmentStore.Put(r.Context(), a.StorageKey, spool, a.Size, a.ContentType, a.SHA256); err != nil {
+		log.Printf("Failed to store attachment %s: %v", a.ID, err)
+		http.Error(w, "Failed to store the file", http.StatusBadGateway)
+		return
+	}
+
+	a.UploadedBy, a.UploadedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+	tenantMutex(r).Lock()
+	_, err = db.Exec("INSERT INTO attachments ("+attachmentColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.ID, a.EntityType, a.EntityID, a.FileName, a.ContentType, a.Size, a.SHA256, a.Description, a.UploadedBy, a.UploadedAt, a.StorageKey)
+	tenantMutex(r).Unlock()
+	if err != nil {
+		attachmentStore.Delete(context.Background(), a.StorageKey)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// uploadErrorStatus is the status for an error reading an upload.
+func uploadErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func findAttachment(r *http.Request, entityType, entityID, attachmentID string) (Attachment, error) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	var a Attachment
+	err := scanAttachment(tenantDB(r).QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ? AND entityType = ? AND entityId = ?", attachmentID, entityType, entityID), &a)
+	return a, err
+}
+
+func downloadAttachment(w http.ResponseWriter, r *http.Request, entityType, entityID, attachmentID string) {
+	a, err := findAttachment(r, entityType, entityID, attachmentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"` + a.SHA256 + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, err := attachmentStore.Open(r.Context(), a.StorageKey)
+	if err != nil {
+		log.Printf("Failed to read attachment %s: %v", a.ID, err)
+		http.Error(w, "Failed to read the file", http.StatusBadGateway)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Checksum-SHA256", a.SHA256)
+	io.Copy(w, content)
+}
+
+func deleteAttachment(w http.ResponseWriter, r *http.Request, entityType, entityID, attachmentID string) {
+	db := tenantDB(r)
+	a, err := findAttachment(r, entityType, entityID, attachmentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tenantMutex(r).Lock()
+	_, err = db.Exec("DELETE FROM attachments WHERE id = ?", a.ID)
+	tenantMutex(r).Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := attachmentStore.Delete(r.Context(), a.StorageKey); err != nil {
+		log.Printf("Failed to delete the file of attachment %s: %v", a.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// canViewAttachment reports whether the caller may see what an attachment is
+// attached to: a machine, a maintenance, or a maintenance request of their
+// own unless they triage requests.
+func canViewAttachment(q queryer, r *http.Request, a Attachment) (bool, error) {
+	switch a.EntityType {
+	case "machine":
+		return hasPermission(r, permMachinesRead), nil
+	case "maintenance":
+		return hasPermission(r, permMaintenanceRead), nil
+	case "maintenance-request":
+		if canTriageRequests(r) {
+			return true, nil
+		}
+		var reportedBy string
+		err := q.QueryRow("SELECT reportedBy FROM maintenance_requests WHERE id = ?", a.EntityID).Scan(&reportedBy)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return reportedBy == actorID(r), err
+	}
+	return false, nil
+}
+
+// getAttachment serves GET /api/attachments/{id}, the details of an
+// attachment.
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/attachments/")
+
+	tenantMutex(r).Lock()
+	var a Attachment
+	var visible bool
+	err := scanAttachment(db.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id), &a)
+	if err == nil {
+		visible, err = canViewAttachment(db, r, a)
+	}
+	tenantMutex(r).Unlock()
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !visible {
+		http.Error(w, "Not allowed to view the attachments of this "+a.EntityType, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// removeAttachments deletes the attachments of an entity being deleted. The
+// files are removed from the storage on a best-effort basis.
+func removeAttachments(q queryer, entityType, entityID string) error {
+	rows, err := q.Query("SELECT storageKey FROM attachments WHERE entityType = ? AND entityId = ?", entityType, entityID)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := q.Exec("DELETE FROM attachments WHERE entityType = ? AND entityId = ?", entityType, entityID); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := attachmentStore.Delete(context.Background(), key); err != nil {
+			log.Printf("Failed to delete attachment file %s: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 stands in for an S3-compatible service, keeping objects in memory.
+// Requests without a signature are refused, and fail makes every request
+// fail with that status.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]string
+	fail    int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	if f.fail != 0 {
+		http.Error(w, "<Error><Code>InternalError</Code></Error>", f.fail)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "<Error><Code>XAmzContentSHA256Mismatch</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = string(body)
+	case "GET":
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, body)
+	case "DELETE":
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := &fakeS3{objects: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := &s3Storage{endpoint: server.URL, bucket: "attachments", region: "us-east-1", accessKey: "test-key", secretKey: "test-secret", client: server.Client()}
+	ctx := context.Background()
+
+	content := "pump inspection notes"
+	sum := sha256.Sum256([]byte(content))
+	key := "machine/m1/notes 1.txt"
+	if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain", hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, ok := fake.objects["/attachments/machine/m1/notes 1.txt"]; !ok {
+		t.Fatalf("objects = %v, want the key under the bucket", fake.objects)
+	}
+
+	f, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if string(got) != content {
+		t.Errorf("opened %q, want %q", got, content)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Open(ctx, key); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("open after delete: %v, want %v", err, os.ErrNotExist)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("delete of a missing key: %v", err)
+	}
+
+	if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain", emptyPayloadHash); err == nil || !strings.Contains(err.Error(), "XAmzContentSHA256Mismatch") {
+		t.Errorf("put with a wrong checksum: %v, want the error of the service", err)
+	}
+	fake.fail = http.StatusServiceUnavailable
+	if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content)), "text/plain", hex.EncodeToString(sum[:])); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("put to a failing service: %v, want a 503 error", err)
+	}
+	if _, err := s.Open(ctx, key); err == nil || errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("open from a failing service: %v, want the error of the service", err)
+	}
+	if err := s.Delete(ctx, key); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("delete from a failing service: %v, want a 503 error", err)
+	}
+
+	s.accessKey = "other-key"
+	fake.fail = 0
+	if _, err := s.Open(ctx, key); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("open with other credentials: %v, want a 403 error", err)
+	}
+}
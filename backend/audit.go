@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEntry records a change made through the API: who made it, from
+// where, and the entity as it was before and after. Entries are append-only
+// and chained: Hash covers the entry and the hash of the previous one, so
+// changing or removing an entry breaks the chain from that point on.
+type AuditEntry struct {
+	Seq        int64           `json:"seq"`
+	ID         string          `json:"id"`
+	Timestamp  string          `json:"timestamp"`
+	ActorID    string          `json:"actorId"`
+	ActorName  string          `json:"actorName"`
+	Action     string          `json:"action"` // "create", "update" or "delete"
+	EntityType string          `json:"entityType"`
+	EntityID   string          `json:"entityId"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	RequestID  string          `json:"requestId"`
+	ClientIP   string          `json:"clientIp"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	PrevHash   string          `json:"prevHash"`
+	Hash       string          `json:"hash"`
+}
+
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+const auditColumns = "seq, id, timestamp, actorId, actorName, action, entityType, entityId, method, path, requestId, clientIp, before, after, prevHash, hash"
+
+func scanAuditEntry(row rowScanner, e *AuditEntry) error {
+	var before, after string
+	err := row.Scan(&e.Seq, &e.ID, &e.Timestamp, &e.ActorID, &e.ActorName, &e.Action, &e.EntityType, &e.EntityID, &e.Method, &e.Path, &e.RequestID, &e.ClientIP, &before, &after, &e.PrevHash, &e.Hash)
+	e.Before, e.After = json.RawMessage(before), json.RawMessage(after)
+	return err
+}
+
+// computeHash returns the hash of the entry chained to PrevHash. Every field
+// is length-prefixed so that no two different entries hash the same input.
+func (e *AuditEntry) computeHash() string {
+	h := sha256.New()
+	fields := []string{e.PrevHash, strconv.FormatInt(e.Seq, 10), e.ID, e.Timestamp, e.ActorID, e.ActorName, e.Action,
+		e.EntityType, e.EntityID, e.Method, e.Path, e.RequestID, e.ClientIP, string(e.Before), string(e.After)}
+	for _, f := range fields {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// auditRule describes a group of audited routes. The last "*" segment of
+// pattern is the ID of the entity changed, except for create routes, where it is
+// read from the response, and routes with an idField, where it is that
+// field of the request body. snapshot is the path serving the entity, used
+// to record it before and after the change; routes without one record the
+// response instead.
+type auditRule struct {
+	pattern    string
+	entityType string
+	snapshot   string
+	create     bool
+	idField    string
+}
+
+// auditRules are checked in order and the first match applies to POST, PUT,
+// PATCH and DELETE requests.
+var auditRules = []auditRule{
+	{pattern: "/api/machines", entityType: "machine", snapshot: "/api/machines/{id}", create: true},
+	{pattern: "/api/machines/*/sensors", entityType: "sensor", create: true},
+	{pattern: "/api/machines/*/sensors/*/readings", entityType: "sensor-reading", create: true},
+	{pattern: "/api/machines/*/attachments", entityType: "attachment", snapshot: "/api/attachments/{id}", create: true},
+	{pattern: "/api/machines/*/attachments/*", entityType: "attachment", snapshot: "/api/attachments/{id}"},
+	{pattern: "/api/machines/*", entityType: "machine", snapshot: "/api/machines/{id}"},
+	{pattern: "/api/machines/*/status", entityType: "machine", snapshot: "/api/machines/{id}"},
+	{pattern: "/api/machines/*/skills", entityType: "machine", snapshot: "/api/machines/{id}"},
+	{pattern: "/api/assets", entityType: "asset", snapshot: "/api/assets/{id}", create: true},
+	{pattern: "/api/assets/*", entityType: "asset", snapshot: "/api/assets/{id}"},
+	{pattern: "/api/assets/*/move", entityType: "asset", snapshot: "/api/assets/{id}"},
+
+	{pattern: "/api/stock", entityType: "stock", snapshot: "/api/stock/{id}", create: true},
+	{pattern: "/api/stock/transfers", entityType: "stock", snapshot: "/api/stock/{id}", idField: "stockId"},
+	{pattern: "/api/stock/*", entityType: "stock", snapshot: "/api/stock/{id}"},
+	{pattern: "/api/stock/*/receipts", entityType: "stock", snapshot: "/api/stock/{id}"},
+	{pattern: "/api/counts/*/approve", entityType: "count-session", snapshot: "/api/counts/{id}"},
+	{pattern: "/api/purchase-orders/*/receive", entityType: "purchase-order", snapshot: "/api/purchase-orders/{id}"},
+
+	{pattern: "/api/operators", entityType: "operator", snapshot: "/api/operators/{id}", create: true},
+	{pattern: "/api/operators/*", entityType: "operator", snapshot: "/api/operators/{id}"},
+	{pattern: "/api/operators/*/...", entityType: "operator", snapshot: "/api/operators/{id}"},
+
+	{pattern: "/api/maintenance", entityType: "maintenance", snapshot: "/api/maintenance/{id}", create: true},
+	{pattern: "/api/maintenance/*", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+	{pattern: "/api/maintenance/*/attachments", entityType: "attachment", snapshot: "/api/attachments/{id}", create: true},
+	{pattern: "/api/maintenance/*/attachments/*", entityType: "attachment", snapshot: "/api/attachments/{id}"},
+	{pattern: "/api/maintenances/*", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+	{pattern: "/api/maintenances/*/complete", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+	{pattern: "/api/maintenances/*/start", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+	{pattern: "/api/maintenances/*/labor/*", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+	{pattern: "/api/maintenances/*/checklist/...", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+	{pattern: "/api/maintenances/*/checklist", entityType: "maintenance", snapshot: "/api/maintenance/{id}"},
+
+	{pattern: "/api/checklist-templates", entityType: "checklist-template", snapshot: "/api/checklist-templates/{id}", create: true},
+	{pattern: "/api/checklist-templates/*", entityType: "checklist-template", snapshot: "/api/checklist-templates/{id}"},
+	{pattern: "/api/bom", entityType: "bom-item", snapshot: "/api/bom/{id}", create: true},
+	{pattern: "/api/bom/*", entityType: "bom-item", snapshot: "/api/bom/{id}"},
+	{pattern: "/api/sla-targets/*", entityType: "sla-target", snapshot: "/api/sla-targets/{id}"},
+
+	{pattern: "/api/maintenance-requests", entityType: "maintenance-request", snapshot: "/api/maintenance-requests/{id}", create: true},
+	{pattern: "/api/maintenance-requests/*/convert", entityType: "maintenance-request", snapshot: "/api/maintenance-requests/{id}"},
+	{pattern: "/api/maintenance-requests/*/reject", entityType: "maintenance-request", snapshot: "/api/maintenance-requests/{id}"},
+	{pattern: "/api/maintenance-requests/*/attachments", entityType: "attachment", snapshot: "/api/attachments/{id}", create: true},
+	{pattern: "/api/maintenance-requests/*/attachments/*", entityType: "attachment", snapshot: "/api/attachments/{id}"},
+
+	{pattern: "/api/calendar/feeds", entityType: "calendar-feed", snapshot: "/api/calendar/feeds/{id}", create: true},
+	{pattern: "/api/calendar/feeds/*", entityType: "calendar-feed", snapshot: "/api/calendar/feeds/{id}"},
+	{pattern: "/api/calendar/import", entityType: "calendar-import"},
+}
+
+func findAuditRule(method, path string) (auditRule, bool) {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return auditRule{}, false
+	}
+	for _, rule := range auditRules {
+		if matchPath(rule.pattern, path) {
+			return rule, true
+		}
+	}
+	return auditRule{}, false
+}
+
+// pathEntityID returns the segment of path matched by the last "*" of
+// pattern.
+func pathEntityID(pattern, path string) string {
+	pathParts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	var id string
+	for i, part := range strings.Split(pattern, "/") {
+		if part == "*" && i < len(pathParts) {
+			id = pathParts[i]
+		}
+	}
+	return id
+}
+
+// trustProxyHeaders makes the audit log take the client IP from
+// X-Forwarded-For, for deployments behind a reverse proxy.
+var trustProxyHeaders bool
+
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// responseRecorder captures the status and body of a response while passing
+// it on to the client. Without a ResponseWriter it only captures, which is
+// how entity snapshots are taken and how audited responses are held back
+// until their entry is recorded.
+type responseRecorder struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	if rec.ResponseWriter != nil {
+		return rec.ResponseWriter.Header()
+	}
+	if rec.header == nil {
+		rec.header = make(http.Header)
+	}
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	if rec.ResponseWriter != nil {
+		rec.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	if rec.ResponseWriter != nil {
+		return rec.ResponseWriter.Write(b)
+	}
+	return len(b), nil
+}
+
+// compactJSON returns b as compact JSON, nil when it is empty, or b as a JSON
+// string when it is not JSON.
+func compactJSON(b []byte) json.RawMessage {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		quoted, _ := json.Marshal(string(b))
+		return quoted
+	}
+	return buf.Bytes()
+}
+
+// auditSnapshot serves a GET of path through next and returns the body, or
+// nil when the entity does not exist.
+func auditSnapshot(next http.Handler, r *http.Request, path string) json.RawMessage {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path, nil)
+	if err != nil {
+		return nil
+	}
+	rec := &responseRecorder{status: http.StatusOK}
+	next.ServeHTTP(rec, req)
+	if rec.status != http.StatusOK {
+		return nil
+	}
+	return compactJSON(rec.body.Bytes())
+}
+
+// auditChainMutex orders the appends to the audit log, so that every entry
+// is chained to the one before it.
+var auditChainMutex sync.Mutex
+
+// auditLock serializes the audited changes to one entity, so that the
+// snapshots taken around a change to it only show that change. Changes to
+// different entities run side by side.
+type auditLock struct {
+	sync.Mutex
+	waiting int
+}
+
+var (
+	auditLocksMutex sync.Mutex
+	auditLocks      = map[string]*auditLock{}
+)
+
+// lockAuditedEntity locks an entity and returns the function unlocking it.
+func lockAuditedEntity(entityType, id string) func() {
+	key := entityType + "/" + id
+	auditLocksMutex.Lock()
+	l, ok := auditLocks[key]
+	if !ok {
+		l = &auditLock{}
+		auditLocks[key] = l
+	}
+	l.waiting++
+	auditLocksMutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		auditLocksMutex.Lock()
+		if l.waiting--; l.waiting == 0 {
+			delete(auditLocks, key)
+		}
+		auditLocksMutex.Unlock()
+	}
+}
+
+// auditMiddleware tags every request with an X-Request-ID, kept from the
+// request when the client sent one, and records successful changes to the
+// entities covered by auditRules in the audit log. The response of a change
+// is held back until its entry is recorded, and a change that cannot be
+// recorded fails with 500. It runs after authMiddleware so the acting user
+// is known.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if requestID == "" || len(requestID) > 128 {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		rule, ok := findAuditRule(r.Method, r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var entityID string
+		switch {
+		case rule.idField != "":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			var fields map[string]interface{}
+			if json.Unmarshal(body, &fields) == nil {
+				entityID, _ = fields[rule.idField].(string)
+			}
+		case !rule.create:
+			entityID = pathEntityID(rule.pattern, r.URL.Path)
+		}
+
+		if entityID != "" {
+			defer lockAuditedEntity(rule.entityType, entityID)()
+		}
+
+		snapshot := func() json.RawMessage {
+			if rule.snapshot == "" || entityID == "" {
+				return nil
+			}
+			return auditSnapshot(next, r, strings.ReplaceAll(rule.snapshot, "{id}", entityID))
+		}
+
+		before := snapshot()
+		rec := &responseRecorder{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if rec.status < 200 || rec.status >= 300 {
+			w.WriteHeader(rec.status)
+			w.Write(rec.body.Bytes())
+			return
+		}
+
+		entry := AuditEntry{
+			Action:     auditUpdate,
+			EntityType: rule.entityType,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RequestID:  requestID,
+			ClientIP:   clientIP(r),
+			Before:     before,
+		}
+		if rule.create {
+			entry.Action = auditCreate
+			var created struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(rec.body.Bytes(), &created)
+			entityID = created.ID
+		}
+		if r.Method == "DELETE" {
+			entry.Action = auditDelete
+		} else if entry.After = snapshot(); entry.After == nil {
+			entry.After = compactJSON(rec.body.Bytes())
+		}
+		entry.EntityID = entityID
+		if user, ok := currentUser(r); ok {
+			entry.ActorID, entry.ActorName = user.ID, user.Username
+		}
+
+		if err := appendAuditEntry(tenantDB(r), &entry); err != nil {
+			log.Printf("Failed to record audit entry for %s %s (request %s): %v", r.Method, r.URL.Path, requestID, err)
+			http.Error(w, "The change was made but could not be recorded in the audit log: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// appendAuditEntry chains e to the last entry of the audit log and stores it.
+func appendAuditEntry(db *sql.DB, e *AuditEntry) error {
+	auditChainMutex.Lock()
+	defer auditChainMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1").Scan(&e.Seq, &e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	e.Seq++
+	e.ID = uuid.New().String()
+	e.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	if e.Before == nil {
+		e.Before = json.RawMessage("null")
+	}
+	if e.After == nil {
+		e.After = json.RawMessage("null")
+	}
+	e.Hash = e.computeHash()
+
+	_, err = tx.Exec("INSERT INTO audit_log ("+auditColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Seq, e.ID, e.Timestamp, e.ActorID, e.ActorName, e.Action, e.EntityType, e.EntityID, e.Method, e.Path, e.RequestID, e.ClientIP, string(e.Before), string(e.After), e.PrevHash, e.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Audit handlers
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch path := strings.TrimPrefix(r.URL.Path, "/api/audit"); path {
+	case "":
+		listAuditEntries(w, r)
+	case "/verify":
+		verifyAuditLog(w, r)
+	default:
+		getAuditEntry(w, r, strings.TrimPrefix(path, "/"))
+	}
+}
+
+// listAuditEntries serves GET /api/audit, newest entries first. It filters
+// by entityType, entityId, action, actor (ID or username), requestId and a
+// from/to period, and pages with limit (default 100, at most 1000) and
+// offset.
+func listAuditEntries(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	q := r.URL.Query()
+	query := "SELECT " + auditColumns + " FROM audit_log WHERE 1 = 1"
+	args := []interface{}{}
+	for _, filter := range []struct{ param, column string }{
+		{"entityType", "entityType"},
+		{"entityId", "entityId"},
+		{"action", "action"},
+		{"requestId", "requestId"},
+	} {
+		if v := q.Get(filter.param); v != "" {
+			query += " AND " + filter.column + " = ?"
+			args = append(args, v)
+		}
+	}
+	if v := q.Get("actor"); v != "" {
+		query += " AND (actorId = ? OR actorName = ? COLLATE NOCASE)"
+		args = append(args, v, v)
+	}
+	if v := q.Get("from"); v != "" {
+		t, err := parseTimestamp(v)
+		if err != nil {
+			http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		query += " AND timestamp >= ?"
+		args = append(args, t.UTC().Format(time.RFC3339))
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := parseTimestamp(v)
+		if err != nil {
+			http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A plain date includes the whole day
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		query += " AND timestamp < ?"
+		args = append(args, t.UTC().Format(time.RFC3339))
+	}
+
+	limit, offset := 100, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	query += " ORDER BY seq DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := scanAuditEntry(rows, &e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func getAuditEntry(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var e AuditEntry
+	err := scanAuditEntry(db.QueryRow("SELECT "+auditColumns+" FROM audit_log WHERE id = ?", id), &e)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Audit entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// AuditVerification is the result of checking the audit log's hash chain.
+// BrokenAt is the sequence number of the first entry that does not match
+// its hash or does not follow the entry before it.
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Entries  int    `json:"entries"`
+	LastHash string `json:"lastHash,omitempty"`
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// verifyAuditLog serves GET /api/audit/verify, recomputing the hash chain
+// from the first entry.
+func verifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	auditChainMutex.Lock()
+	rows, err := db.Query("SELECT " + auditColumns + " FROM audit_log ORDER BY seq")
+	if err != nil {
+		auditChainMutex.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := AuditVerification{Valid: true}
+	var prevSeq int64
+	var prevHash string
+	for rows.Next() {
+		var e AuditEntry
+		if err := scanAuditEntry(rows, &e); err != nil {
+			rows.Close()
+			auditChainMutex.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.Entries++
+		switch {
+		case e.Seq != prevSeq+1:
+			result.Reason = fmt.Sprintf("entry %d is missing", prevSeq+1)
+		case e.PrevHash != prevHash:
+			result.Reason = "the previous hash does not match the entry before it"
+		case e.computeHash() != e.Hash:
+			result.Reason = "the entry does not match its hash"
+		}
+		if result.Reason != "" {
+			result.Valid = false
+			result.BrokenAt = e.Seq
+			break
+		}
+		prevSeq, prevHash = e.Seq, e.Hash
+	}
+	rows.Close()
+	auditChainMutex.Unlock()
+
+	if result.Valid {
+		result.LastHash = prevHash
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func auditEntries(c *testClient, query string) []AuditEntry {
+	c.t.Helper()
+	rec := c.do("GET", "/api/audit?"+query, "")
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("audit: %d %s", rec.Code, rec.Body)
+	}
+	var entries []AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		c.t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAuditRecordsChanges(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	id := admin.create("/api/machines", `{"name":"Audited press","status":"Operando","model":"AP-1"}`)
+	if rec := admin.do("PUT", "/api/machines/"+id, `{"name":"Audited press","status":"Parada","model":"AP-1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", rec.Code, rec.Body)
+	}
+
+	entries := auditEntries(admin, "entityType=machine&entityId="+id)
+	if len(entries) != 2 || entries[0].Action != auditUpdate || entries[1].Action != auditCreate {
+		t.Fatalf("entries = %+v, want an update after a create", entries)
+	}
+	var before, after Machine
+	json.Unmarshal(entries[0].Before, &before)
+	json.Unmarshal(entries[0].After, &after)
+	if before.Status != "Operando" || after.Status != "Parada" {
+		t.Errorf("status before %q and after %q, want Operando and Parada", before.Status, after.Status)
+	}
+	if entries[0].ActorName != "admin" {
+		t.Errorf("actor = %q, want admin", entries[0].ActorName)
+	}
+}
+
+func TestAuditChainsConcurrentChanges(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	ids := make([]string, 8)
+	for i := range ids {
+		ids[i] = admin.create("/api/machines", `{"name":"Concurrent press `+newTestID()+`","status":"Operando","model":"CP-1"}`)
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, len(ids))
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			codes[i] = admin.do("PUT", "/api/machines/"+id, `{"name":"Concurrent press `+id+`","status":"Parada","model":"CP-1"}`).Code
+		}(i, id)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("update %d: %d", i, code)
+		}
+	}
+
+	rec := admin.do("GET", "/api/audit/verify", "")
+	var result AuditVerification
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid {
+		t.Fatalf("audit log broken at %d: %s", result.BrokenAt, result.Reason)
+	}
+	for _, id := range ids {
+		if entries := auditEntries(admin, "action=update&entityId="+id); len(entries) != 1 {
+			t.Errorf("machine %s has %d update entries, want 1", id, len(entries))
+		}
+	}
+}
+
+func TestAuditFailureFailsTheRequest(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	id := admin.create("/api/machines", `{"name":"Unrecorded press","status":"Operando","model":"UP-1"}`)
+
+	if _, err := admin.db().Exec("CREATE TRIGGER audit_log_read_only BEFORE INSERT ON audit_log BEGIN SELECT RAISE(ABORT, 'audit log is read-only'); END"); err != nil {
+		t.Fatal(err)
+	}
+	rec := admin.do("PUT", "/api/machines/"+id, `{"name":"Unrecorded press","status":"Parada","model":"UP-1"}`)
+	if _, err := admin.db().Exec("DROP TRIGGER audit_log_read_only"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("update with a failing audit log: %d %s, want 500", rec.Code, rec.Body)
+	}
+	var m Machine
+	if json.Unmarshal(rec.Body.Bytes(), &m) == nil {
+		t.Errorf("the response of the unrecorded change was sent: %s", rec.Body)
+	}
+}
+
+func TestAuditRecordsCountApproval(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	sessionID, _ := submittedCount(admin, 6)
+	if rec := admin.do("POST", "/api/counts/"+sessionID+"/approve", ""); rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body)
+	}
+
+	entries := auditEntries(admin, "entityType=count-session&entityId="+sessionID)
+	if len(entries) != 1 || entries[0].Action != auditUpdate {
+		t.Fatalf("entries = %+v, want an update", entries)
+	}
+	var before, after CountSession
+	json.Unmarshal(entries[0].Before, &before)
+	json.Unmarshal(entries[0].After, &after)
+	if before.Status != countSubmitted || after.Status != countApproved {
+		t.Errorf("status before %q and after %q, want %s and %s", before.Status, after.Status, countSubmitted, countApproved)
+	}
+}
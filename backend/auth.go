@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Access tokens are short lived and sent with every request as
+// "Authorization: Bearer <token>". Refresh tokens obtain a new pair through
+// /api/auth/refresh and are rotated on every use. Both are opaque random
+// strings; only their SHA-256 hashes are stored, so sessions can be revoked
+// on logout.
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+const minPasswordLength = 8
+
+// publicPaths are the API routes that can be called without an access token.
+var publicPaths = map[string]bool{
+	"/api/auth/login":   true,
+	"/api/auth/refresh": true,
+}
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// AuthTokens is the response of a login or refresh.
+type AuthTokens struct {
+	AccessToken      string `json:"accessToken"`
+	TokenType        string `json:"tokenType"`
+	ExpiresAt        string `json:"expiresAt"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresAt string `json:"refreshExpiresAt"`
+	User             User   `json:"user"`
+
+	// Tenant is the ID of the user's tenant, to send in X-Tenant on
+	// refresh. It is empty without TENANTS.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// authSession is the authenticated caller of a request.
+type authSession struct {
+	ID          string
+	User        User
+	Permissions map[string]bool
+}
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+
+// currentUser returns the user the request was authenticated as.
+func currentUser(r *http.Request) (User, bool) {
+	s, ok := r.Context().Value(sessionContextKey).(*authSession)
+	if !ok {
+		return User{}, false
+	}
+	return s.User, true
+}
+
+// actorID returns the ID of the user making the request, recorded on the
+// changes it makes. It is empty for requests without a session.
+func actorID(r *http.Request) string {
+	u, _ := currentUser(r)
+	return u.ID
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errors.New("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// issueTokens stores a new session for the user, or rotates the tokens of an
+// existing one when sessionID is set.
+func issueTokens(q queryer, t *Tenant, user User, sessionID string) (AuthTokens, error) {
+	access, err := newToken()
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	refresh, err := newToken()
+	if err != nil {
+		return AuthTokens{}, err
+	}
+	access, refresh = tenantToken(t, access), tenantToken(t, refresh)
+	now := time.Now().UTC()
+	tokens := AuthTokens{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresAt:        now.Add(accessTokenTTL).Format(time.RFC3339),
+		RefreshToken:     refresh,
+		RefreshExpiresAt: now.Add(refreshTokenTTL).Format(time.RFC3339),
+		User:             user,
+		Tenant:           t.ID,
+	}
+
+	if sessionID == "" {
+		_, err = q.Exec("INSERT INTO sessions (id, userId, accessHash, accessExpires, refreshHash, refreshExpires, createdAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			uuid.New().String(), user.ID, hashToken(access), tokens.ExpiresAt, hashToken(refresh), tokens.RefreshExpiresAt, now.Format(time.RFC3339))
+	} else {
+		_, err = q.Exec("UPDATE sessions SET accessHash = ?, accessExpires = ?, refreshHash = ?, refreshExpires = ? WHERE id = ?",
+			hashToken(access), tokens.ExpiresAt, hashToken(refresh), tokens.RefreshExpiresAt, sessionID)
+	}
+	return tokens, err
+}
+
+// lookupSession finds the live session of an access token.
+func lookupSession(q queryer, token string) (*authSession, error) {
+	var s authSession
+	err := scanUser(q.QueryRow(`
+		SELECT `+userColumnsPrefixed+`, se.id
+		FROM sessions se
+		JOIN users u ON se.userId = u.id
+		WHERE se.accessHash = ? AND se.accessExpires > ? AND se.revokedAt = '' AND u.active = 1
+	`, hashToken(token), time.Now().UTC().Format(time.RFC3339)), &s.User, &s.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// revokeSessions ends every session of a user except keep.
+func revokeSessions(q queryer, userID, keep string) error {
+	_, err := q.Exec("UPDATE sessions SET revokedAt = ? WHERE userId = ? AND id != ? AND revokedAt = ''", time.Now().UTC().Format(time.RFC3339), userID, keep)
+	return err
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="m4chinemind"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// authMiddleware requires a valid access token on every /api/ route except
+// login and refresh, or a feed token on the calendar feed, checks the route
+// against the user's role, and makes the session available to the handlers.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := bearerToken(r)
+		lookup := lookupSession
+		if !ok && r.Method == "GET" && r.URL.Path == calendarFeedPath {
+			// Calendar applications authenticate with a feed token.
+			token = r.URL.Query().Get("token")
+			ok, lookup = token != "", lookupCalendarFeed
+		}
+		if !ok {
+			unauthorized(w, "Authentication required")
+			return
+		}
+
+		db := tenantDB(r)
+		tenantMutex(r).Lock()
+		session, err := lookup(db, token)
+		if err == nil {
+			session.Permissions, err = rolePermissions(db, session.User.Role)
+		}
+		tenantMutex(r).Unlock()
+		if err == sql.ErrNoRows {
+			unauthorized(w, "Invalid or expired access token")
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !allowed(session.User.Role, session.Permissions, r.Method, r.URL.Path) {
+			http.Error(w, fmt.Sprintf("Role %s is not allowed to %s %s", session.User.Role, r.Method, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, session)))
+	})
+}
+
+// seedAdminUser creates the first account of a new installation from
+// ADMIN_USERNAME and ADMIN_PASSWORD. Without a password a random one is
+// generated and logged once.
+func seedAdminUser(t *Tenant) {
+	var count int
+	if err := t.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		log.Fatalf("Failed to seed admin user: %v", err)
+	}
+	if count > 0 {
+		return
+	}
+
+	username := os.Getenv("ADMIN_USERNAME")
+	if username == "" {
+		username = "admin"
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		token, err := newToken()
+		if err != nil {
+			log.Fatalf("Failed to seed admin user: %v", err)
+		}
+		password = token[:16]
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Fatalf("Failed to seed admin user: %v", err)
+	}
+	_, err = t.db.Exec("INSERT INTO users (id, username, passwordHash, name, email, role, active, createdAt) VALUES (?, ?, ?, ?, '', ?, 1, ?)",
+		uuid.New().String(), username, hash, "Administrator", roleAdmin, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Fatalf("Failed to seed admin user: %v", err)
+	}
+	if generated {
+		log.Printf("Created user %q%s with password %q; change it after logging in", username, t.label(), password)
+	} else {
+		log.Printf("Created user %q%s", username, t.label())
+	}
+}
+
+// Auth handlers
+func authHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	action := strings.TrimPrefix(r.URL.Path, "/api/auth/")
+
+	switch {
+	case action == "login" && r.Method == "POST":
+		login(w, r)
+	case action == "refresh" && r.Method == "POST":
+		refreshTokens(w, r)
+	case action == "logout" && r.Method == "POST":
+		logout(w, r)
+	case action == "me" && r.Method == "GET":
+		getCurrentUser(w, r)
+	case action == "password" && r.Method == "POST":
+		changePassword(w, r)
+	case action == "login" || action == "refresh" || action == "logout" || action == "me" || action == "password":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// dummyPasswordHash is compared against when the username does not exist, so
+// failed logins take the same time either way.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func login(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	var hash string
+	err := scanUser(db.QueryRow("SELECT "+userColumns+", passwordHash FROM users WHERE username = ? COLLATE NOCASE", strings.TrimSpace(req.Username)), &user, &hash)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		unauthorized(w, errInvalidCredentials.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil || !user.Active {
+		unauthorized(w, errInvalidCredentials.Error())
+		return
+	}
+
+	// Sessions past their refresh expiry can no longer be used
+	if _, err := db.Exec("DELETE FROM sessions WHERE refreshExpires <= ?", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokens, err := issueTokens(db, requestTenant(r), user, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var s authSession
+	err := scanUser(db.QueryRow(`
+		SELECT `+userColumnsPrefixed+`, se.id
+		FROM sessions se
+		JOIN users u ON se.userId = u.id
+		WHERE se.refreshHash = ? AND se.refreshExpires > ? AND se.revokedAt = '' AND u.active = 1
+	`, hashToken(req.RefreshToken), time.Now().UTC().Format(time.RFC3339)), &s.User, &s.ID)
+	if err == sql.ErrNoRows {
+		unauthorized(w, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := issueTokens(db, requestTenant(r), s.User, s.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	session, _ := r.Context().Value(sessionContextKey).(*authSession)
+	if session == nil {
+		unauthorized(w, "Authentication required")
+		return
+	}
+	if _, err := db.Exec("UPDATE sessions SET revokedAt = ? WHERE id = ?", time.Now().UTC().Format(time.RFC3339), session.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getCurrentUser serves GET /api/auth/me, the current user, the
+// permissions of their role and the operator linked to them, if any.
+func getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	session, _ := r.Context().Value(sessionContextKey).(*authSession)
+	if session == nil {
+		unauthorized(w, "Authentication required")
+		return
+	}
+	me := struct {
+		User
+		Permissions []string `json:"permissions"`
+		OperatorID  string   `json:"operatorId,omitempty"`
+	}{User: session.User, Permissions: []string{}}
+	err := db.QueryRow("SELECT id FROM operators WHERE userId = ?", session.User.ID).Scan(&me.OperatorID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for p := range session.Permissions {
+		me.Permissions = append(me.Permissions, p)
+	}
+	sort.Strings(me.Permissions)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(me)
+}
+
+// changePassword sets a new password for the current user and ends their
+// other sessions.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	session, _ := r.Context().Value(sessionContextKey).(*authSession)
+	if session == nil {
+		unauthorized(w, "Authentication required")
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var hash string
+	if err := db.QueryRow("SELECT passwordHash FROM users WHERE id = ?", session.User.ID).Scan(&hash); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.CurrentPassword)) != nil {
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET passwordHash = ? WHERE id = ?", newHash, session.User.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := revokeSessions(db, session.User.ID, session.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// BOMItem lists a spare part as compatible with a machine model. Quantity
+// is the typical quantity used by a maintenance of MaintenanceType, or by
+// any maintenance when the type is empty; a part with no typical quantity
+// is only compatible.
+type BOMItem struct {
+	ID              string  `json:"id"`
+	Model           string  `json:"model"`
+	StockID         string  `json:"stockId"`
+	StockName       string  `json:"stockName,omitempty"` // set by the server
+	MaintenanceType string  `json:"maintenanceType,omitempty"`
+	Quantity        float64 `json:"quantity"`
+	Unit            string  `json:"unit"` // defaults to the stock unit
+	Notes           string  `json:"notes,omitempty"`
+}
+
+const bomItemColumns = "b.id, b.model, b.stockId, COALESCE(s.name, ''), b.maintenanceType, b.quantity, b.unit, b.notes"
+
+const bomItemFrom = " FROM bom_items b LEFT JOIN stock s ON s.id = b.stockId"
+
+func scanBOMItem(row rowScanner, b *BOMItem) error {
+	return row.Scan(&b.ID, &b.Model, &b.StockID, &b.StockName, &b.MaintenanceType, &b.Quantity, &b.Unit, &b.Notes)
+}
+
+// MachineBOM is the BOM of a machine's model: the compatible parts and the
+// used stock suggested for a maintenance of Type.
+type MachineBOM struct {
+	MachineID string          `json:"machineId"`
+	Model     string          `json:"model"`
+	Type      string          `json:"type"`
+	Parts     []BOMItem       `json:"parts"`
+	Suggested []UsedStockItem `json:"suggested"`
+}
+
+func validateBOMItem(q queryer, b *BOMItem) error {
+	b.Model = strings.TrimSpace(b.Model)
+	if b.Model == "" {
+		return errors.New("model is required")
+	}
+	switch b.MaintenanceType {
+	case "", maintenanceTypePreventive, maintenanceTypeCorrective:
+	default:
+		return fmt.Errorf("invalid maintenance type %q: must be %q, %q or empty", b.MaintenanceType, maintenanceTypePreventive, maintenanceTypeCorrective)
+	}
+	if b.Quantity < 0 {
+		return errors.New("quantity cannot be negative")
+	}
+	var stockUnit string
+	if err := q.QueryRow("SELECT unit FROM stock WHERE id = ?", b.StockID).Scan(&stockUnit); err == sql.ErrNoRows {
+		return fmt.Errorf("stock item %q not found", b.StockID)
+	} else if err != nil {
+		return err
+	}
+	if strings.TrimSpace(b.Unit) == "" {
+		b.Unit = stockUnit
+	}
+	if _, err := stockUnitFactor(q, b.StockID, b.Unit); err != nil {
+		return err
+	}
+	var err error
+	b.Unit, err = resolveUnit(q, b.Unit)
+	return err
+}
+
+// BOM handlers
+func bomItemsHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		query := "SELECT " + bomItemColumns + bomItemFrom + " WHERE 1 = 1"
+		args := []interface{}{}
+		if model := r.URL.Query().Get("model"); model != "" {
+			query += " AND b.model = ? COLLATE NOCASE"
+			args = append(args, model)
+		}
+		if stockID := r.URL.Query().Get("stockId"); stockID != "" {
+			query += " AND b.stockId = ?"
+			args = append(args, stockID)
+		}
+		rows, err := db.Query(query+" ORDER BY b.model, s.name, b.maintenanceType", args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		items := []BOMItem{}
+		for rows.Next() {
+			var b BOMItem
+			if err := scanBOMItem(rows, &b); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			items = append(items, b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	case "POST":
+		var b BOMItem
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.ID = uuid.New().String()
+		saveBOMItem(w, r, b, http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func bomItemHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/api/bom/")
+
+	var b BOMItem
+	err := scanBOMItem(db.QueryRow("SELECT "+bomItemColumns+bomItemFrom+" WHERE b.id = ?", id), &b)
+	if err == sql.ErrNoRows {
+		http.Error(w, "BOM item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	case "PUT":
+		var updated BOMItem
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated.ID = id
+		saveBOMItem(w, r, updated, http.StatusOK)
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM bom_items WHERE id = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveBOMItem validates and stores a new or changed BOM item. A part is
+// listed once per model and maintenance type.
+func saveBOMItem(w http.ResponseWriter, r *http.Request, b BOMItem, status int) {
+	db := tenantDB(r)
+	if err := validateBOMItem(db, &b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var duplicate bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM bom_items WHERE model = ? COLLATE NOCASE AND stockId = ? AND maintenanceType = ? AND id != ?)",
+		b.Model, b.StockID, b.MaintenanceType, b.ID).Scan(&duplicate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if duplicate {
+		http.Error(w, "The part is already in the BOM of the model for this maintenance type", http.StatusConflict)
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO bom_items (id, model, stockId, maintenanceType, quantity, unit, notes) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET model = excluded.model, stockId = excluded.stockId, maintenanceType = excluded.maintenanceType,
+		quantity = excluded.quantity, unit = excluded.unit, notes = excluded.notes`,
+		b.ID, b.Model, b.StockID, b.MaintenanceType, b.Quantity, b.Unit, b.Notes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := scanBOMItem(db.QueryRow("SELECT "+bomItemColumns+bomItemFrom+" WHERE b.id = ?", b.ID), &b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(b)
+}
+
+// machineBOMParts returns the BOM items of a machine's model and the model.
+func machineBOMParts(q queryer, machineID string) (string, []BOMItem, error) {
+	var model string
+	if err := q.QueryRow("SELECT model FROM machines WHERE id = ?", machineID).Scan(&model); err != nil {
+		return "", nil, err
+	}
+	rows, err := q.Query("SELECT "+bomItemColumns+bomItemFrom+" WHERE b.model = ? COLLATE NOCASE AND b.model != '' ORDER BY s.name, b.maintenanceType", model)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	parts := []BOMItem{}
+	for rows.Next() {
+		var b BOMItem
+		if err := scanBOMItem(rows, &b); err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, b)
+	}
+	return model, parts, rows.Err()
+}
+
+// suggestUsedStock returns the typical parts of a maintenance of maintType
+// from the BOM. A quantity given for the type takes precedence over one
+// given for any type.
+func suggestUsedStock(parts []BOMItem, maintType string) []UsedStockItem {
+	suggested := []UsedStockItem{}
+	index := map[string]int{}
+	for _, b := range parts {
+		if b.Quantity <= 0 || (b.MaintenanceType != "" && b.MaintenanceType != maintType) {
+			continue
+		}
+		item := UsedStockItem{StockID: b.StockID, Quantity: b.Quantity, Unit: b.Unit}
+		if i, ok := index[b.StockID]; ok {
+			if b.MaintenanceType != "" {
+				suggested[i] = item
+			}
+			continue
+		}
+		index[b.StockID] = len(suggested)
+		suggested = append(suggested, item)
+	}
+	return suggested
+}
+
+// applyBOM pre-fills the used stock of a maintenance without any from the
+// BOM of its machine's model when prefill is set, and warns about used
+// parts that are not in that BOM. Machines whose model has no BOM get no
+// warnings.
+func applyBOM(q queryer, m *Maintenance, prefill bool) error {
+	_, parts, err := machineBOMParts(q, m.MachineID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if prefill && len(m.UsedStock) == 0 {
+		m.UsedStock = suggestUsedStock(parts, m.Type)
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+
+	compatible := map[string]bool{}
+	for _, b := range parts {
+		compatible[b.StockID] = true
+	}
+	for _, item := range m.UsedStock {
+		if compatible[item.StockID] {
+			continue
+		}
+		var name string
+		if err := q.QueryRow("SELECT name FROM stock WHERE id = ?", item.StockID).Scan(&name); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if name == "" {
+			name = item.StockID
+		}
+		m.Warnings = append(m.Warnings, fmt.Sprintf("%s is not in the BOM of the machine's model", name))
+	}
+	return nil
+}
+
+// getMachineBOM serves GET /api/machines/{id}/bom?type=, the compatible
+// parts of the machine and the used stock suggested for a maintenance of
+// type (preventive by default).
+func getMachineBOM(w http.ResponseWriter, r *http.Request, machineID string) {
+	db := tenantDB(r)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maintType := r.URL.Query().Get("type")
+	if maintType == "" {
+		maintType = maintenanceTypePreventive
+	}
+	if maintType != maintenanceTypePreventive && maintType != maintenanceTypeCorrective {
+		http.Error(w, fmt.Sprintf("invalid maintenance type %q", maintType), http.StatusBadRequest)
+		return
+	}
+	model, parts, err := machineBOMParts(db, machineID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MachineBOM{MachineID: machineID, Model: model, Type: maintType, Parts: parts, Suggested: suggestUsedStock(parts, maintType)})
+}
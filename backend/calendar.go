@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The maintenance schedule is published as an iCalendar feed that calendar
+// applications subscribe to. They cannot send an Authorization header, so
+// the feed also accepts a calendar feed token in ?token=. Feed tokens are
+// issued per user, act with that user's role, and only open the feed.
+const calendarFeedPath = "/api/calendar/maintenances.ics"
+
+// calendarBaseURL, when set, is the public URL of the backend used in the
+// feed URLs handed out, e.g. https://m4m.example. Otherwise it is taken from
+// the request.
+var calendarBaseURL string
+
+// maxCalendarImportBytes is the largest calendar accepted by the import.
+const maxCalendarImportBytes = 5 << 20
+
+// CalendarFeed is a token a user subscribes to the feed with. Token and URL
+// are only returned when the feed is created.
+type CalendarFeed struct {
+	ID         string `json:"id"`
+	UserID     string `json:"userId"`
+	Name       string `json:"name"`
+	Token      string `json:"token,omitempty"`
+	URL        string `json:"url,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+	LastUsedAt string `json:"lastUsedAt,omitempty"`
+}
+
+const calendarFeedColumns = "id, userId, name, createdAt, lastUsedAt"
+
+func scanCalendarFeed(row rowScanner, f *CalendarFeed) error {
+	return row.Scan(&f.ID, &f.UserID, &f.Name, &f.CreatedAt, &f.LastUsedAt)
+}
+
+// CalendarImportEvent is the outcome of importing one event: "created",
+// "conflict" or "skipped", or "valid" in a dry run.
+type CalendarImportEvent struct {
+	UID           string             `json:"uid"`
+	Summary       string             `json:"summary"`
+	Start         string             `json:"start,omitempty"`
+	MachineID     string             `json:"machineId,omitempty"`
+	MaintenanceID string             `json:"maintenanceId,omitempty"`
+	Result        string             `json:"result"`
+	Reason        string             `json:"reason,omitempty"`
+	Conflicts     []ScheduleConflict `json:"conflicts,omitempty"`
+}
+
+// CalendarImport is the response of an import.
+type CalendarImport struct {
+	DryRun   bool                  `json:"dryRun"`
+	Created  int                   `json:"created"`
+	Conflict int                   `json:"conflict"`
+	Skipped  int                   `json:"skipped"`
+	Events   []CalendarImportEvent `json:"events"`
+}
+
+// lookupCalendarFeed finds the user of a feed token. The session it returns
+// has no ID, so it cannot be used to log out or refresh.
+func lookupCalendarFeed(q queryer, token string) (*authSession, error) {
+	var s authSession
+	var feedID string
+	err := scanUser(q.QueryRow(`
+		SELECT `+userColumnsPrefixed+`, cf.id
+		FROM calendar_feeds cf
+		JOIN users u ON cf.userId = u.id
+		WHERE cf.tokenHash = ? AND u.active = 1
+	`, hashToken(token)), &s.User, &feedID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec("UPDATE calendar_feeds SET lastUsedAt = ? WHERE id = ?", time.Now().UTC().Format(time.RFC3339), feedID)
+	return &s, err
+}
+
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/calendar/")
+	switch {
+	case r.URL.Path == calendarFeedPath:
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		getCalendarFeed(w, r)
+	case path == "import":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		importCalendar(w, r)
+	case path == "feeds":
+		calendarFeedsHandler(w, r)
+	case strings.HasPrefix(path, "feeds/"):
+		calendarFeedHandler(w, r, strings.TrimPrefix(path, "feeds/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Feed token handlers. Users manage their own feeds.
+func calendarFeedsHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	user, _ := currentUser(r)
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query("SELECT "+calendarFeedColumns+" FROM calendar_feeds WHERE userId = ? ORDER BY createdAt", user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		feeds := []CalendarFeed{}
+		for rows.Next() {
+			var f CalendarFeed
+			if err := scanCalendarFeed(rows, &f); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			feeds = append(feeds, f)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(feeds)
+	case "POST":
+		var f CalendarFeed
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.Name = strings.TrimSpace(f.Name); f.Name == "" {
+			f.Name = "Maintenances"
+		}
+		token, err := newToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		token = tenantToken(requestTenant(r), token)
+		f.ID, f.UserID, f.Token = uuid.New().String(), user.ID, token
+		f.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+		_, err = db.Exec("INSERT INTO calendar_feeds (id, userId, name, tokenHash, createdAt) VALUES (?, ?, ?, ?, ?)",
+			f.ID, f.UserID, f.Name, hashToken(token), f.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		f.URL = calendarFeedURL(r, token)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func calendarFeedHandler(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	user, _ := currentUser(r)
+
+	var f CalendarFeed
+	err := scanCalendarFeed(db.QueryRow("SELECT "+calendarFeedColumns+" FROM calendar_feeds WHERE id = ? AND userId = ?", id, user.ID), &f)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f)
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM calendar_feeds WHERE id = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// calendarFeedURL returns the URL to subscribe to the feed with token.
+func calendarFeedURL(r *http.Request, token string) string {
+	base := strings.TrimRight(calendarBaseURL, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); trustProxyHeaders && proto != "" {
+			scheme = proto
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + calendarFeedPath + "?token=" + token
+}
+
+// getCalendarFeed serves the maintenances as an iCalendar, filtered by
+// machineId, operatorId (an assignee) and status, which may list several
+// statuses separated by commas.
+func getCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+
+	query := `
+		SELECT m.id, m.machineId, COALESCE(mc.name, ''), m.description, m.status, m.type,
+			m.scheduledStart, m.durationMinutes, m.createdAt, m.updatedAt
+		FROM maintenance m
+		LEFT JOIN machines mc ON mc.id = m.machineId
+		WHERE 1 = 1`
+	var args []interface{}
+	if machineID := r.URL.Query().Get("machineId"); machineID != "" {
+		query += " AND m.machineId = ?"
+		args = append(args, machineID)
+	}
+	if operatorID := r.URL.Query().Get("operatorId"); operatorID != "" {
+		query += " AND m.id IN (SELECT maintenanceId FROM maintenance_assignees WHERE operatorId = ?)"
+		args = append(args, operatorID)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		statuses := strings.Split(status, ",")
+		query += " AND m.status IN (?" + strings.Repeat(", ?", len(statuses)-1) + ")"
+		for _, s := range statuses {
+			args = append(args, strings.TrimSpace(s))
+		}
+	}
+	query += " ORDER BY m.scheduledStart"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type feedEvent struct {
+		id, machineID, machineName, description, status, kind string
+		start, createdAt, updatedAt                           string
+		duration                                              int
+		assignees                                             []string
+	}
+	var events []feedEvent
+	for rows.Next() {
+		var e feedEvent
+		if err := rows.Scan(&e.id, &e.machineID, &e.machineName, &e.description, &e.status, &e.kind, &e.start, &e.duration, &e.createdAt, &e.updatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range events {
+		names, err := assigneeNames(db, events[i].id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		events[i].assignees = names
+	}
+
+	ics := &icsWriter{}
+	ics.line("BEGIN:VCALENDAR")
+	ics.line("VERSION:2.0")
+	ics.line("PRODID:-//M4chineMind//Maintenance Schedule//EN")
+	ics.line("CALSCALE:GREGORIAN")
+	ics.line("METHOD:PUBLISH")
+	ics.property("X-WR-CALNAME", "M4chineMind maintenances")
+	ics.line("REFRESH-INTERVAL;VALUE=DURATION:PT15M")
+	ics.line("X-PUBLISHED-TTL:PT15M")
+	now := formatICSTime(time.Now())
+	for _, e := range events {
+		start, err := parseTimestamp(e.start)
+		if err != nil {
+			continue
+		}
+		summary := e.machineName
+		if summary == "" {
+			summary = e.machineID
+		}
+		if e.description != "" {
+			summary += ": " + e.description
+		}
+		details := []string{"Type: " + e.kind, "Status: " + e.status}
+		if len(e.assignees) > 0 {
+			details = append(details, "Assignees: "+strings.Join(e.assignees, ", "))
+		}
+		if e.description != "" {
+			details = append([]string{e.description, ""}, details...)
+		}
+		modified := e.updatedAt
+		if modified == "" {
+			modified = e.createdAt
+		}
+
+		ics.line("BEGIN:VEVENT")
+		ics.property("UID", e.id+"@m4chinemind")
+		ics.line("DTSTAMP:" + now)
+		ics.line("DTSTART:" + formatICSTime(start))
+		ics.line("DTEND:" + formatICSTime(start.Add(time.Duration(e.duration)*time.Minute)))
+		ics.property("SUMMARY", summary)
+		ics.property("LOCATION", e.machineName)
+		ics.property("DESCRIPTION", strings.Join(details, "\n"))
+		ics.property("CATEGORIES", e.kind)
+		ics.line("STATUS:CONFIRMED")
+		if t, err := parseTimestamp(modified); err == nil {
+			ics.line("LAST-MODIFIED:" + formatICSTime(t))
+		}
+		ics.line("END:VEVENT")
+	}
+	ics.line("END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="maintenances.ics"`)
+	io.WriteString(w, ics.String())
+}
+
+// assigneeNames returns the names of the operators assigned to a
+// maintenance.
+func assigneeNames(q queryer, maintenanceID string) ([]string, error) {
+	rows, err := q.Query(`
+		SELECT o.name FROM maintenance_assignees ma
+		JOIN operators o ON o.id = ma.operatorId
+		WHERE ma.maintenanceId = ? ORDER BY o.name`, maintenanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// icsWriter builds an iCalendar (RFC 5545): CRLF line endings, with lines
+// folded at 75 octets.
+type icsWriter struct {
+	strings.Builder
+}
+
+func (b *icsWriter) line(s string) {
+	for len(s) > 75 {
+		cut := 75
+		for cut > 0 && !utf8RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+	}
+	b.WriteString(s + "\r\n")
+}
+
+// property writes a text property, escaped.
+func (b *icsWriter) property(name, value string) {
+	b.line(name + ":" + icsEscaper.Replace(value))
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+var icsUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+func utf8RuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func formatICSTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsProperty is a content line of an iCalendar.
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsEvent holds the properties of a VEVENT by name.
+type icsEvent map[string]icsProperty
+
+func (e icsEvent) text(name string) string {
+	return strings.TrimSpace(icsUnescaper.Replace(e[name].Value))
+}
+
+// parseICSEvents returns the events of an iCalendar. Components nested in
+// events, such as alarms, are ignored.
+func parseICSEvents(r io.Reader) ([]icsEvent, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCalendarImportBytes)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an iCalendar: expected BEGIN:VCALENDAR")
+	}
+
+	var events []icsEvent
+	var event icsEvent
+	depth := 0
+	for _, line := range lines {
+		p, err := parseICSLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case p.Name == "BEGIN" && strings.EqualFold(p.Value, "VEVENT") && event == nil:
+			event, depth = icsEvent{}, 0
+		case event == nil:
+		case p.Name == "BEGIN":
+			depth++
+		case p.Name == "END" && depth > 0:
+			depth--
+		case p.Name == "END":
+			events = append(events, event)
+			event = nil
+		case depth == 0:
+			if _, ok := event[p.Name]; !ok {
+				event[p.Name] = p
+			}
+		}
+	}
+	return events, nil
+}
+
+// parseICSLine splits an unfolded content line into its name, parameters
+// and value.
+func parseICSLine(line string) (icsProperty, error) {
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return icsProperty{}, fmt.Errorf("invalid content line %q", line)
+	}
+	parts := strings.Split(line[:colon], ";")
+	p := icsProperty{Name: strings.ToUpper(parts[0]), Params: map[string]string{}, Value: line[colon+1:]}
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		p.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+	}
+	return p, nil
+}
+
+// parseICSTime reads a DATE-TIME in UTC, in a TZID time zone or floating
+// (taken as UTC), or a DATE. allDay is true for a DATE.
+func parseICSTime(p icsProperty) (t time.Time, allDay bool, err error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == len("20060102") {
+		t, err = time.Parse("20060102", p.Value)
+		return t, true, err
+	}
+	if strings.HasSuffix(p.Value, "Z") {
+		t, err = time.Parse("20060102T150405Z", p.Value)
+		return t, false, err
+	}
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return t, false, fmt.Errorf("unknown time zone %q", tzid)
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", p.Value, loc)
+	return t, false, err
+}
+
+// parseICSDuration reads a DURATION such as PT1H30M or P1D.
+func parseICSDuration(s string) (time.Duration, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(s, "+"), "P")
+	if rest == s || rest == "" || strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var d time.Duration
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour}
+	n := 0
+	digits := false
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n, digits = n*10+int(c-'0'), true
+		case c == 'T':
+			units = map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+		case units[c] != 0 && digits:
+			d += time.Duration(n) * units[c]
+			n, digits = 0, false
+		default:
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if digits {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// calendarMachine is a machine events are mapped to by name or ID.
+type calendarMachine struct {
+	id, name string
+}
+
+// matchCalendarMachine finds the machine an event is for: the machine named
+// by its location, or else by its summary, either exactly or, failing that,
+// the machine with the longest name the summary contains.
+func matchCalendarMachine(machines []calendarMachine, location, summary string) (string, bool) {
+	for _, text := range []string{location, summary} {
+		for _, m := range machines {
+			if text != "" && (strings.EqualFold(text, m.name) || text == m.id) {
+				return m.id, true
+			}
+		}
+	}
+	summary = strings.ToLower(summary)
+	for _, m := range machines {
+		if m.name != "" && strings.Contains(summary, strings.ToLower(m.name)) {
+			return m.id, true
+		}
+	}
+	return "", false
+}
+
+// importCalendar creates a maintenance for every event of an iCalendar
+// body. Events are matched to machines by location or summary, and booked
+// like maintenances created through the API: events that overlap existing
+// bookings are reported as conflicts unless sent with ?force=true. Events
+// imported before, by UID, are skipped. ?dryRun=true only reports what
+// would be created.
+func importCalendar(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	events, err := parseICSEvents(http.MaxBytesReader(w, r.Body, maxCalendarImportBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+	result := CalendarImport{DryRun: r.URL.Query().Get("dryRun") == "true", Events: []CalendarImportEvent{}}
+
+	rows, err := db.Query("SELECT id, name FROM machines")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var machines []calendarMachine
+	for rows.Next() {
+		var m calendarMachine
+		if err := rows.Scan(&m.id, &m.name); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		machines = append(machines, m)
+	}
+	rows.Close()
+	// Prefer the most specific name when a summary contains several.
+	sort.SliceStable(machines, func(i, j int) bool { return len(machines[i].name) > len(machines[j].name) })
+
+	for _, event := range events {
+		outcome, err := importCalendarEvent(r, event, machines, force, result.DryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch outcome.Result {
+		case "created":
+			result.Created++
+		case "conflict":
+			result.Conflict++
+		case "skipped":
+			result.Skipped++
+		}
+		result.Events = append(result.Events, outcome)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// importCalendarEvent books one event. Problems with the event are
+// reported in the outcome; the error is only set when it could not be
+// stored.
+func importCalendarEvent(r *http.Request, event icsEvent, machines []calendarMachine, force, dryRun bool) (CalendarImportEvent, error) {
+	db := tenantDB(r)
+	outcome := CalendarImportEvent{UID: event.text("UID"), Summary: event.text("SUMMARY"), Result: "skipped"}
+	if outcome.UID == "" {
+		outcome.Reason = "the event has no UID"
+		return outcome, nil
+	}
+	if strings.EqualFold(event.text("STATUS"), "CANCELLED") {
+		outcome.Reason = "the event is cancelled"
+		return outcome, nil
+	}
+	if _, ok := event["RRULE"]; ok {
+		outcome.Reason = "recurring events are not supported"
+		return outcome, nil
+	}
+
+	var existing string
+	err := db.QueryRow(`
+		SELECT m.id FROM maintenance m
+		WHERE m.id = ? OR m.id IN (SELECT maintenanceId FROM calendar_imports WHERE uid = ?)`,
+		strings.TrimSuffix(outcome.UID, "@m4chinemind"), outcome.UID).Scan(&existing)
+	if err == nil {
+		outcome.MaintenanceID, outcome.Reason = existing, "the event was imported before"
+		return outcome, nil
+	} else if err != sql.ErrNoRows {
+		return outcome, err
+	}
+
+	machineID, ok := matchCalendarMachine(machines, event.text("LOCATION"), outcome.Summary)
+	if !ok {
+		outcome.Reason = "no machine matches the location or summary"
+		return outcome, nil
+	}
+	outcome.MachineID = machineID
+
+	dtstart, ok := event["DTSTART"]
+	if !ok {
+		outcome.Reason = "the event has no DTSTART"
+		return outcome, nil
+	}
+	start, allDay, err := parseICSTime(dtstart)
+	if err != nil {
+		outcome.Reason = "DTSTART: " + err.Error()
+		return outcome, nil
+	}
+	end := start
+	if dtend, ok := event["DTEND"]; ok {
+		if end, _, err = parseICSTime(dtend); err != nil {
+			outcome.Reason = "DTEND: " + err.Error()
+			return outcome, nil
+		}
+	} else if duration, ok := event["DURATION"]; ok {
+		d, err := parseICSDuration(duration.Value)
+		if err != nil {
+			outcome.Reason = "DURATION: " + err.Error()
+			return outcome, nil
+		}
+		end = start.Add(d)
+	} else if allDay {
+		end = start.AddDate(0, 0, 1)
+	}
+	if end.Before(start) {
+		outcome.Reason = "the event ends before it starts"
+		return outcome, nil
+	}
+
+	maint := Maintenance{
+		ID:              uuid.New().String(),
+		MachineID:       machineID,
+		Start:           start.UTC().Format(time.RFC3339),
+		DurationMinutes: int(end.Sub(start) / time.Minute),
+		Description:     event.text("DESCRIPTION"),
+		Type:            maintenanceTypePreventive,
+		Status:          maintenanceStatusScheduled,
+	}
+	if maint.Description == "" {
+		maint.Description = outcome.Summary
+	}
+	if strings.Contains(strings.ToLower(event.text("CATEGORIES")), maintenanceTypeCorrective) {
+		maint.Type = maintenanceTypeCorrective
+	}
+	outcome.Start = maint.Start
+	if err := normalizeMaintenanceSchedule(&maint); err != nil {
+		outcome.Reason = err.Error()
+		return outcome, nil
+	}
+	if err := normalizeMaintenanceSLA(db, &maint); err != nil {
+		outcome.Reason = err.Error()
+		return outcome, nil
+	}
+	templateID, err := findChecklistTemplate(db, &maint)
+	if err != nil {
+		outcome.Reason = err.Error()
+		return outcome, nil
+	}
+	maint.CreatedBy, maint.CreatedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+
+	// The conflicts are checked in the transaction storing the booking
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		return outcome, err
+	}
+	conflicts, err := findScheduleConflicts(tx, &maint)
+	if err != nil {
+		tx.Rollback()
+		return outcome, err
+	}
+	if len(conflicts) > 0 && !force {
+		tx.Rollback()
+		outcome.Result, outcome.Reason, outcome.Conflicts = "conflict", scheduleConflictError(conflicts).Error(), conflicts
+		return outcome, nil
+	}
+	if dryRun {
+		tx.Rollback()
+		outcome.Result, outcome.Conflicts = "valid", conflicts
+		return outcome, nil
+	}
+	if err := insertMaintenance(tx, &maint, templateID, conflicts); err != nil {
+		tx.Rollback()
+		return outcome, err
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO calendar_imports (uid, maintenanceId, importedBy, importedAt) VALUES (?, ?, ?, ?)",
+		outcome.UID, maint.ID, maint.CreatedBy, maint.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		return outcome, err
+	}
+	if err := tx.Commit(); err != nil {
+		return outcome, err
+	}
+	outcome.Result, outcome.MaintenanceID, outcome.Conflicts = "created", maint.ID, conflicts
+	return outcome, nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Checklist step kinds
+const (
+	stepCheck       = "check"       // passed or failed
+	stepMeasurement = "measurement" // a value, which passes when within Min and Max
+	stepNote        = "note"        // free text
+)
+
+// Checklist step results
+const (
+	stepPass = "pass"
+	stepFail = "fail"
+)
+
+// ChecklistTemplate is a reusable procedure. Maintenances of machines of
+// MachineModel get it when they are created, limited to maintenances of
+// MaintenanceType when it is set; a template can also be picked explicitly.
+type ChecklistTemplate struct {
+	ID              string          `json:"id"`
+	Name            string          `json:"name"`
+	MachineModel    string          `json:"machineModel,omitempty"`
+	MaintenanceType string          `json:"maintenanceType,omitempty"`
+	Steps           []ChecklistStep `json:"steps"`
+}
+
+// ChecklistStep is a step of a checklist template, in order. Min and Max
+// are the limits of measurements; either may be left open. Optional steps
+// do not have to be recorded before the maintenance is completed.
+type ChecklistStep struct {
+	Title    string   `json:"title"`
+	Kind     string   `json:"kind"`
+	Unit     string   `json:"unit,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Optional bool     `json:"optional,omitempty"`
+}
+
+// ChecklistItem is a step of the checklist of a maintenance, copied from its
+// template, with what was recorded for it.
+type ChecklistItem struct {
+	ID       string `json:"id"`
+	Position int    `json:"position"`
+	ChecklistStep
+	Result      string   `json:"result,omitempty"` // "pass" or "fail"; set from the limits for measurements
+	Value       *float64 `json:"value,omitempty"`
+	Note        string   `json:"note,omitempty"`
+	Done        bool     `json:"done"`
+	CompletedBy string   `json:"completedBy,omitempty"`
+	CompletedAt string   `json:"completedAt,omitempty"`
+}
+
+const checklistItemColumns = "id, position, title, kind, unit, min, max, optional, result, value, note, completedBy, completedAt"
+
+func scanChecklistItem(row rowScanner, item *ChecklistItem) error {
+	var min, max, value sql.NullFloat64
+	err := row.Scan(&item.ID, &item.Position, &item.Title, &item.Kind, &item.Unit, &min, &max, &item.Optional, &item.Result, &value, &item.Note, &item.CompletedBy, &item.CompletedAt)
+	item.Min, item.Max, item.Value = nullFloat(min), nullFloat(max), nullFloat(value)
+	item.Done = item.CompletedAt != ""
+	return err
+}
+
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+func validateChecklistTemplate(t *ChecklistTemplate) error {
+	t.Name = strings.TrimSpace(t.Name)
+	t.MachineModel = strings.TrimSpace(t.MachineModel)
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.MaintenanceType != "" && t.MaintenanceType != maintenanceTypePreventive && t.MaintenanceType != maintenanceTypeCorrective {
+		return fmt.Errorf("invalid maintenance type %q: must be %q or %q", t.MaintenanceType, maintenanceTypePreventive, maintenanceTypeCorrective)
+	}
+	if len(t.Steps) == 0 {
+		return errors.New("a checklist needs at least one step")
+	}
+	for i := range t.Steps {
+		step := &t.Steps[i]
+		step.Title = strings.TrimSpace(step.Title)
+		if step.Title == "" {
+			return fmt.Errorf("step %d: title is required", i+1)
+		}
+		switch step.Kind {
+		case stepCheck, stepNote:
+			step.Unit, step.Min, step.Max = "", nil, nil
+		case stepMeasurement:
+			if step.Min != nil && step.Max != nil && *step.Min > *step.Max {
+				return fmt.Errorf("step %d: min cannot be greater than max", i+1)
+			}
+		default:
+			return fmt.Errorf("step %d: invalid kind %q: must be %q, %q or %q", i+1, step.Kind, stepCheck, stepMeasurement, stepNote)
+		}
+	}
+	return nil
+}
+
+func loadChecklistTemplate(q queryer, id string) (ChecklistTemplate, error) {
+	var t ChecklistTemplate
+	err := q.QueryRow("SELECT id, name, machineModel, maintenanceType FROM checklist_templates WHERE id = ?", id).
+		Scan(&t.ID, &t.Name, &t.MachineModel, &t.MaintenanceType)
+	if err != nil {
+		return t, err
+	}
+
+	rows, err := q.Query("SELECT title, kind, unit, min, max, optional FROM checklist_template_steps WHERE templateId = ? ORDER BY position", id)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+
+	t.Steps = make([]ChecklistStep, 0)
+	for rows.Next() {
+		var step ChecklistStep
+		var min, max sql.NullFloat64
+		if err := rows.Scan(&step.Title, &step.Kind, &step.Unit, &min, &max, &step.Optional); err != nil {
+			return t, err
+		}
+		step.Min, step.Max = nullFloat(min), nullFloat(max)
+		t.Steps = append(t.Steps, step)
+	}
+	return t, rows.Err()
+}
+
+func saveChecklistTemplate(tx *sql.Tx, t ChecklistTemplate) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO checklist_templates (id, name, machineModel, maintenanceType) VALUES (?, ?, ?, ?)", t.ID, t.Name, t.MachineModel, t.MaintenanceType)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM checklist_template_steps WHERE templateId = ?", t.ID); err != nil {
+		return err
+	}
+	for i, step := range t.Steps {
+		_, err := tx.Exec("INSERT INTO checklist_template_steps (templateId, position, title, kind, unit, min, max, optional) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			t.ID, i+1, step.Title, step.Kind, step.Unit, step.Min, step.Max, step.Optional)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checklist template handlers
+func checklistTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		query := "SELECT id FROM checklist_templates"
+		args := []interface{}{}
+		if model := r.URL.Query().Get("machineModel"); model != "" {
+			query += " WHERE machineModel = ? COLLATE NOCASE"
+			args = append(args, model)
+		}
+		rows, err := db.Query(query+" ORDER BY name", args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		templates := []ChecklistTemplate{}
+		for _, id := range ids {
+			t, err := loadChecklistTemplate(db, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			templates = append(templates, t)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(templates)
+	case "POST":
+		var t ChecklistTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.ID = uuid.New().String()
+		writeChecklistTemplate(w, r, t, http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func checklistTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/api/checklist-templates/")
+
+	t, err := loadChecklistTemplate(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Checklist template not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	case "PUT":
+		// Maintenances keep the checklist they were given
+		var updated ChecklistTemplate
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated.ID = id
+		writeChecklistTemplate(w, r, updated, http.StatusOK)
+	case "DELETE":
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec("DELETE FROM checklist_template_steps WHERE templateId = ?", id)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM checklist_templates WHERE id = ?", id)
+		}
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeChecklistTemplate(w http.ResponseWriter, r *http.Request, t ChecklistTemplate, status int) {
+	db := tenantDB(r)
+	if err := validateChecklistTemplate(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveChecklistTemplate(tx, t); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(t)
+}
+
+// findChecklistTemplate returns the template for a new maintenance: the one
+// requested, or else the template for the machine's model and the
+// maintenance type, preferring one made for that type. It returns an empty
+// ID when there is none.
+func findChecklistTemplate(q queryer, m *Maintenance) (string, error) {
+	if m.ChecklistTemplateID != "" {
+		var exists bool
+		if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM checklist_templates WHERE id = ?)", m.ChecklistTemplateID).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("checklist template %s not found", m.ChecklistTemplateID)
+		}
+		return m.ChecklistTemplateID, nil
+	}
+
+	var id string
+	err := q.QueryRow(`
+		SELECT t.id FROM checklist_templates t
+		JOIN machines m ON m.model = t.machineModel COLLATE NOCASE
+		WHERE m.id = ? AND t.machineModel != '' AND (t.maintenanceType = '' OR t.maintenanceType = ?)
+		ORDER BY t.maintenanceType DESC, t.name LIMIT 1`, m.MachineID, m.Type).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// instantiateChecklist replaces the checklist of a maintenance with the
+// steps of a template.
+func instantiateChecklist(tx *sql.Tx, maintenanceID, templateID string) error {
+	if _, err := tx.Exec("DELETE FROM maintenance_checklist_items WHERE maintenanceId = ?", maintenanceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE maintenance SET checklistTemplateId = ? WHERE id = ?", templateID, maintenanceID); err != nil {
+		return err
+	}
+	if templateID == "" {
+		return nil
+	}
+	t, err := loadChecklistTemplate(tx, templateID)
+	if err != nil {
+		return err
+	}
+	for i, step := range t.Steps {
+		_, err := tx.Exec("INSERT INTO maintenance_checklist_items (id, maintenanceId, position, title, kind, unit, min, max, optional) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			uuid.New().String(), maintenanceID, i+1, step.Title, step.Kind, step.Unit, step.Min, step.Max, step.Optional)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadChecklist returns the checklist of a maintenance, in order.
+func loadChecklist(q queryer, maintenanceID string) ([]ChecklistItem, error) {
+	rows, err := q.Query("SELECT "+checklistItemColumns+" FROM maintenance_checklist_items WHERE maintenanceId = ? ORDER BY position", maintenanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]ChecklistItem, 0)
+	for rows.Next() {
+		var item ChecklistItem
+		if err := scanChecklistItem(rows, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// validateChecklistComplete returns an error listing the required steps of
+// a maintenance's checklist that have not been recorded.
+func validateChecklistComplete(q queryer, maintenanceID string) (int, error) {
+	items, err := loadChecklist(q, maintenanceID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	var missing []string
+	for _, item := range items {
+		if !item.Done && !item.Optional {
+			missing = append(missing, fmt.Sprintf("%d. %s", item.Position, item.Title))
+		}
+	}
+	if len(missing) > 0 {
+		return http.StatusConflict, fmt.Errorf("The checklist is not complete: %s", strings.Join(missing, "; "))
+	}
+	return 0, nil
+}
+
+// ChecklistRequest picks the template of a maintenance's checklist.
+type ChecklistRequest struct {
+	TemplateID string `json:"templateId"`
+}
+
+// ChecklistItemRecord is what is recorded for a checklist step.
+type ChecklistItemRecord struct {
+	Result string   `json:"result"`
+	Value  *float64 `json:"value"`
+	Note   string   `json:"note"`
+}
+
+// checklistHandler serves /api/maintenances/{id}/checklist: GET lists the
+// checklist, POST replaces it with the steps of another template (only
+// before any step is recorded), and PUT on /checklist/{itemId} records a
+// step.
+func checklistHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	path := strings.TrimPrefix(r.URL.Path, "/api/maintenances/")
+	id, itemID, _ := strings.Cut(path, "/checklist")
+	itemID = strings.TrimPrefix(itemID, "/")
+
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+
+	var maint Maintenance
+	err := scanMaintenance(db.QueryRow("SELECT "+maintenanceColumns+" FROM maintenance WHERE id = ?", id), &maint)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Maintenance not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case itemID == "" && r.Method == "GET":
+		items, err := loadChecklist(db, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	case itemID == "" && r.Method == "POST":
+		var req ChecklistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		replaceChecklist(w, r, maint, req.TemplateID)
+	case itemID != "" && r.Method == "PUT":
+		var rec ChecklistItemRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recordChecklistItem(w, r, maint, itemID, rec)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func replaceChecklist(w http.ResponseWriter, r *http.Request, maint Maintenance, templateID string) {
+	db := tenantDB(r)
+	if maint.Status == maintenanceStatusCompleted {
+		http.Error(w, "The maintenance is already completed", http.StatusConflict)
+		return
+	}
+	var recorded bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM maintenance_checklist_items WHERE maintenanceId = ? AND completedAt != '')", maint.ID).Scan(&recorded); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if recorded {
+		http.Error(w, "Steps of the checklist were already recorded", http.StatusConflict)
+		return
+	}
+	if templateID != "" {
+		if _, err := findChecklistTemplate(db, &Maintenance{ChecklistTemplateID: templateID}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := instantiateChecklist(tx, maint.ID, templateID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	items, err := loadChecklist(db, maint.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+func recordChecklistItem(w http.ResponseWriter, r *http.Request, maint Maintenance, itemID string, rec ChecklistItemRecord) {
+	db := tenantDB(r)
+	if maint.Status == maintenanceStatusCompleted {
+		http.Error(w, "The maintenance is already completed", http.StatusConflict)
+		return
+	}
+
+	var item ChecklistItem
+	err := scanChecklistItem(db.QueryRow("SELECT "+checklistItemColumns+" FROM maintenance_checklist_items WHERE id = ? AND maintenanceId = ?", itemID, maint.ID), &item)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Checklist step not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	item.Note = strings.TrimSpace(rec.Note)
+	item.Value = nil
+	switch item.Kind {
+	case stepCheck:
+		if rec.Result != stepPass && rec.Result != stepFail {
+			http.Error(w, fmt.Sprintf("result must be %q or %q", stepPass, stepFail), http.StatusBadRequest)
+			return
+		}
+		item.Result = rec.Result
+	case stepMeasurement:
+		if rec.Value == nil {
+			http.Error(w, "value is required for a measurement", http.StatusBadRequest)
+			return
+		}
+		item.Value = rec.Value
+		item.Result = stepPass
+		if (item.Min != nil && *rec.Value < *item.Min) || (item.Max != nil && *rec.Value > *item.Max) {
+			item.Result = stepFail
+		}
+	case stepNote:
+		if item.Note == "" {
+			http.Error(w, "note is required", http.StatusBadRequest)
+			return
+		}
+		item.Result = ""
+	}
+	item.Done = true
+	item.CompletedBy, item.CompletedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+
+	_, err = db.Exec("UPDATE maintenance_checklist_items SET result = ?, value = ?, note = ?, completedBy = ?, completedAt = ? WHERE id = ?",
+		item.Result, item.Value, item.Note, item.CompletedBy, item.CompletedAt, item.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
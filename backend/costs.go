@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// LaborEntry records hours worked by an operator on a maintenance. Rate is
+// the operator's hourly rate snapshotted when the entry was recorded.
+// Entries logged with the labor timer also have the time they were started
+// and stopped (RFC 3339); Hours is zero while the timer runs.
+type LaborEntry struct {
+	ID         string  `json:"id"`
+	OperatorID string  `json:"operatorId"`
+	Hours      float64 `json:"hours"`
+	Rate       float64 `json:"rate"`
+	StartedAt  string  `json:"startedAt,omitempty"`
+	StoppedAt  string  `json:"stoppedAt,omitempty"`
+}
+
+// MaintenanceCostReportItem aggregates maintenance costs for one combination
+// of the requested grouping dimensions. Dimensions that are not part of the
+// grouping are left empty.
+type MaintenanceCostReportItem struct {
+	MachineID    string  `json:"machineId,omitempty"`
+	MachineName  string  `json:"machineName,omitempty"`
+	Month        string  `json:"month,omitempty"`
+	Type         string  `json:"type,omitempty"`
+	Maintenances int     `json:"maintenances"`
+	PartsCost    float64 `json:"partsCost"`
+	LaborHours   float64 `json:"laborHours"`
+	LaborCost    float64 `json:"laborCost"`
+	ExternalCost float64 `json:"externalCost"`
+	TotalCost    float64 `json:"totalCost"`
+}
+
+// loadMaintenanceDetails fills the used stock, labor entries, assignees,
+// checklist and schedule overrides of m.
+func loadMaintenanceDetails(q queryer, m *Maintenance) error {
+	rows, err := q.Query(`
+		SELECT ms.stockId, ms.quantity, COALESCE(s.unit, ''), ms.unitCost, ms.issued, ms.warehouseId, ms.binId
+		FROM maintenance_stock ms
+		LEFT JOIN stock s ON ms.stockId = s.id
+		WHERE ms.maintenanceId = ?`, m.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	m.UsedStock = make([]UsedStockItem, 0)
+	for rows.Next() {
+		var item UsedStockItem
+		if err := rows.Scan(&item.StockID, &item.Quantity, &item.Unit, &item.UnitCost, &item.Issued, &item.WarehouseID, &item.BinID); err != nil {
+			return err
+		}
+		m.UsedStock = append(m.UsedStock, item)
+	}
+	rows.Close()
+
+	if err := loadUsedStockLots(q, m.ID, m.UsedStock); err != nil {
+		return err
+	}
+
+	laborRows, err := q.Query("SELECT id, operatorId, hours, rate, startedAt, stoppedAt FROM maintenance_labor WHERE maintenanceId = ? ORDER BY startedAt", m.ID)
+	if err != nil {
+		return err
+	}
+	defer laborRows.Close()
+
+	m.Labor = make([]LaborEntry, 0)
+	m.LaborHours = 0
+	for laborRows.Next() {
+		var entry LaborEntry
+		if err := laborRows.Scan(&entry.ID, &entry.OperatorID, &entry.Hours, &entry.Rate, &entry.StartedAt, &entry.StoppedAt); err != nil {
+			return err
+		}
+		m.Labor = append(m.Labor, entry)
+		m.LaborHours += entry.Hours
+	}
+	if err := laborRows.Err(); err != nil {
+		return err
+	}
+	laborRows.Close()
+
+	if m.Assignees, err = loadAssignees(q, m.ID); err != nil {
+		return err
+	}
+	if m.Checklist, err = loadChecklist(q, m.ID); err != nil {
+		return err
+	}
+	m.ScheduleOverrides, err = loadScheduleOverrides(q, m.ID)
+	return err
+}
+
+// insertLabor stores the labor entries of a maintenance. Entries that keep
+// their ID keep the rate they were recorded with; new entries snapshot the
+// operator's current hourly rate.
+func insertLabor(tx *sql.Tx, maintenanceID string, entries []LaborEntry, previous map[string]float64) error {
+	for i, entry := range entries {
+		rate, ok := previous[entry.ID]
+		if !ok {
+			entry.ID = uuid.New().String()
+			err := tx.QueryRow("SELECT hourlyRate FROM operators WHERE id = ?", entry.OperatorID).Scan(&rate)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		_, err := tx.Exec("INSERT INTO maintenance_labor(id, maintenanceId, operatorId, hours, rate, startedAt, stoppedAt) VALUES(?, ?, ?, ?, ?, ?, ?)", entry.ID, maintenanceID, entry.OperatorID, entry.Hours, rate, entry.StartedAt, entry.StoppedAt)
+		if err != nil {
+			return err
+		}
+		entries[i].ID = entry.ID
+		entries[i].Rate = rate
+	}
+	return nil
+}
+
+// previousLaborRates returns the snapshotted rates of the labor entries of an
+// existing maintenance, by entry ID.
+func previousLaborRates(tx *sql.Tx, maintenanceID string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	rows, err := tx.Query("SELECT id, rate FROM maintenance_labor WHERE maintenanceId = ?", maintenanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var rate float64
+		if err := rows.Scan(&id, &rate); err != nil {
+			return nil, err
+		}
+		rates[id] = rate
+	}
+	return rates, rows.Err()
+}
+
+// getMaintenanceCostReport serves /api/reports/maintenance-costs. The groupBy
+// parameter is a comma separated list of machine, month and type; all three
+// are used by default.
+func getMaintenanceCostReport(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	from, to, err := parseReportPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := map[string]bool{"machine": true, "month": true, "type": true}
+	if v := r.URL.Query().Get("groupBy"); v != "" {
+		groupBy = map[string]bool{}
+		for _, dim := range strings.Split(v, ",") {
+			dim = strings.TrimSpace(dim)
+			if dim != "machine" && dim != "month" && dim != "type" {
+				http.Error(w, "groupBy must be a comma separated list of machine, month and type", http.StatusBadRequest)
+				return
+			}
+			groupBy[dim] = true
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT maint.id, maint.machineId, COALESCE(m.name, ''), maint.date, maint.type, maint.externalCost,
+			COALESCE((SELECT SUM(ms.quantity * ms.unitCost) FROM maintenance_stock ms WHERE ms.maintenanceId = maint.id), 0),
+			COALESCE((SELECT SUM(ml.hours) FROM maintenance_labor ml WHERE ml.maintenanceId = maint.id), 0),
+			COALESCE((SELECT SUM(ml.hours * ml.rate) FROM maintenance_labor ml WHERE ml.maintenanceId = maint.id), 0)
+		FROM maintenance maint
+		LEFT JOIN machines m ON maint.machineId = m.id
+	`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*MaintenanceCostReportItem)
+	for rows.Next() {
+		var id, date string
+		var line MaintenanceCostReportItem
+		if err := rows.Scan(&id, &line.MachineID, &line.MachineName, &date, &line.Type, &line.ExternalCost, &line.PartsCost, &line.LaborHours, &line.LaborCost); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		when, err := parseTimestamp(date)
+		if err != nil || when.Before(from) || !when.Before(to) {
+			continue
+		}
+		line.Month = when.Format("2006-01")
+
+		if !groupBy["machine"] {
+			line.MachineID, line.MachineName = "", ""
+		}
+		if !groupBy["month"] {
+			line.Month = ""
+		}
+		if !groupBy["type"] {
+			line.Type = ""
+		}
+
+		key := line.MachineID + "|" + line.Month + "|" + line.Type
+		group, ok := groups[key]
+		if !ok {
+			group = &MaintenanceCostReportItem{MachineID: line.MachineID, MachineName: line.MachineName, Month: line.Month, Type: line.Type}
+			groups[key] = group
+		}
+		group.Maintenances++
+		group.PartsCost += line.PartsCost
+		group.LaborHours += line.LaborHours
+		group.LaborCost += line.LaborCost
+		group.ExternalCost += line.ExternalCost
+		group.TotalCost += line.PartsCost + line.LaborCost + line.ExternalCost
+	}
+
+	report := make([]MaintenanceCostReportItem, 0, len(groups))
+	for _, group := range groups {
+		report = append(report, *group)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Month != report[j].Month {
+			return report[i].Month < report[j].Month
+		}
+		if report[i].MachineName != report[j].MachineName {
+			return report[i].MachineName < report[j].MachineName
+		}
+		return report[i].Type < report[j].Type
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Count session statuses. A session is counted while open, reviewed once
+// submitted, and its variances are posted to the ledger when approved.
+const (
+	countOpen      = "open"
+	countSubmitted = "submitted"
+	countApproved  = "approved"
+	countCancelled = "cancelled"
+)
+
+// allowQuantityEdits lets PUT /api/stock/{id} overwrite quantities. When off,
+// quantities can only be corrected through count sessions.
+var allowQuantityEdits = true
+
+// CountSession is a physical count of the stock at a warehouse (or one of its
+// bins). Expected quantities are snapshotted when the session is created.
+type CountSession struct {
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Status      string      `json:"status"`
+	WarehouseID string      `json:"warehouseId"`
+	BinID       string      `json:"binId,omitempty"`
+	CreatedAt   string      `json:"createdAt"`
+	SubmittedAt string      `json:"submittedAt,omitempty"`
+	ApprovedAt  string      `json:"approvedAt,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+	Lines       []CountLine `json:"lines"`
+
+	// StockIDs restricts a new session to some items; it is not stored.
+	StockIDs []string `json:"stockIds,omitempty"`
+}
+
+// CountLine is the count of one stock item at one location. Counted is nil
+// until the item has been counted. For lot and serial tracked items, Lots
+// names the lots or serial numbers that make up the variance.
+type CountLine struct {
+	ID       string        `json:"id"`
+	StockID  string        `json:"stockId"`
+	Name     string        `json:"name"`
+	Unit     string        `json:"unit"`
+	Expected float64       `json:"expected"`
+	Counted  *float64      `json:"counted"`
+	Variance float64       `json:"variance"`
+	Reason   string        `json:"reason,omitempty"`
+	Lots     []LotQuantity `json:"lots,omitempty"`
+
+	StockLocation
+}
+
+func countSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listCountSessions(w, r)
+	case "POST":
+		createCountSession(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// countSessionHandler serves /api/counts/{id}, the counted values under
+// /api/counts/{id}/lines and the workflow actions /submit, /reopen, /approve
+// and /cancel.
+func countSessionHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/counts/")
+	id, action, _ := strings.Cut(path, "/")
+
+	var s CountSession
+	err := loadCountSession(db, id, &s)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Count session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch action {
+	case "":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "lines":
+		if r.Method != "PUT" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		recordCounts(w, r, &s)
+	case "submit", "reopen", "approve", "cancel":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch action {
+		case "submit":
+			changeCountStatus(w, r, &s, countOpen, countSubmitted)
+		case "reopen":
+			changeCountStatus(w, r, &s, countSubmitted, countOpen)
+		case "approve":
+			approveCountSession(w, r, &s)
+		case "cancel":
+			if s.Status == countApproved || s.Status == countCancelled {
+				http.Error(w, "Count session is already closed", http.StatusConflict)
+				return
+			}
+			changeCountStatus(w, r, &s, s.Status, countCancelled)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const countSessionColumns = "id, name, status, warehouseId, binId, createdAt, submittedAt, approvedAt, reason"
+
+func scanCountSession(row rowScanner, s *CountSession) error {
+	return row.Scan(&s.ID, &s.Name, &s.Status, &s.WarehouseID, &s.BinID, &s.CreatedAt, &s.SubmittedAt, &s.ApprovedAt, &s.Reason)
+}
+
+func loadCountLines(q queryer, s *CountSession) error {
+	rows, err := q.Query(`
+		SELECT cl.id, cl.stockId, COALESCE(st.name, ''), COALESCE(st.unit, ''), cl.warehouseId, cl.binId, cl.expected, cl.counted, cl.reason
+		FROM count_lines cl
+		LEFT JOIN stock st ON cl.stockId = st.id
+		WHERE cl.sessionId = ?
+		ORDER BY st.name, cl.rowid
+	`, s.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.Lines = []CountLine{}
+	for rows.Next() {
+		var l CountLine
+		var counted sql.NullFloat64
+		if err := rows.Scan(&l.ID, &l.StockID, &l.Name, &l.Unit, &l.WarehouseID, &l.BinID, &l.Expected, &counted, &l.Reason); err != nil {
+			return err
+		}
+		if counted.Valid {
+			c := counted.Float64
+			l.Counted = &c
+			l.Variance = c - l.Expected
+		}
+		s.Lines = append(s.Lines, l)
+	}
+	rows.Close()
+
+	lotRows, err := q.Query("SELECT lineId, lot, quantity FROM count_line_lots WHERE lineId IN (SELECT id FROM count_lines WHERE sessionId = ?) ORDER BY rowid", s.ID)
+	if err != nil {
+		return err
+	}
+	defer lotRows.Close()
+
+	index := make(map[string]int)
+	for i, l := range s.Lines {
+		index[l.ID] = i
+	}
+	for lotRows.Next() {
+		var lineID string
+		var lot LotQuantity
+		if err := lotRows.Scan(&lineID, &lot.Lot, &lot.Quantity); err != nil {
+			return err
+		}
+		if i, ok := index[lineID]; ok {
+			s.Lines[i].Lots = append(s.Lines[i].Lots, lot)
+		}
+	}
+	return lotRows.Err()
+}
+
+func loadCountSession(q queryer, id string, s *CountSession) error {
+	if err := scanCountSession(q.QueryRow("SELECT "+countSessionColumns+" FROM count_sessions WHERE id = ?", id), s); err != nil {
+		return err
+	}
+	return loadCountLines(q, s)
+}
+
+func listCountSessions(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	query := "SELECT " + countSessionColumns + " FROM count_sessions WHERE 1 = 1"
+	args := []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if warehouseID := r.URL.Query().Get("warehouseId"); warehouseID != "" {
+		query += " AND warehouseId = ?"
+		args = append(args, warehouseID)
+	}
+	query += " ORDER BY createdAt DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []CountSession{}
+	for rows.Next() {
+		var s CountSession
+		if err := scanCountSession(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sessions = append(sessions, s)
+	}
+	rows.Close()
+
+	for i := range sessions {
+		if err := loadCountLines(db, &sessions[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// createCountSession opens a session for a warehouse or bin and snapshots
+// the quantity of every item held there. Items listed in stockIds that are
+// not held at the location are added with an expected quantity of zero.
+func createCountSession(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var s CountSession
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.WarehouseID == "" {
+		http.Error(w, "warehouseId is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateLocation(db, StockLocation{WarehouseID: s.WarehouseID, BinID: s.BinID}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.ID = uuid.New().String()
+	s.Status = countOpen
+	s.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	if s.Name == "" {
+		s.Name = "Count " + s.CreatedAt[:10]
+	}
+
+	query := "SELECT stockId, warehouseId, binId, quantity FROM stock_levels WHERE warehouseId = ?"
+	args := []interface{}{s.WarehouseID}
+	if s.BinID != "" {
+		query += " AND binId = ?"
+		args = append(args, s.BinID)
+	}
+	if len(s.StockIDs) > 0 {
+		query += " AND stockId IN (?" + strings.Repeat(", ?", len(s.StockIDs)-1) + ")"
+		for _, id := range s.StockIDs {
+			args = append(args, id)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO count_sessions ("+countSessionColumns+") VALUES (?, ?, ?, ?, ?, ?, '', '', '')", s.ID, s.Name, s.Status, s.WarehouseID, s.BinID, s.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var lines []CountLine
+	snapshotted := make(map[string]bool)
+	for rows.Next() {
+		var l CountLine
+		if err := rows.Scan(&l.StockID, &l.WarehouseID, &l.BinID, &l.Expected); err != nil {
+			rows.Close()
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snapshotted[l.StockID] = true
+		lines = append(lines, l)
+	}
+	rows.Close()
+	for _, id := range s.StockIDs {
+		if !snapshotted[id] {
+			lines = append(lines, CountLine{StockID: id, StockLocation: StockLocation{WarehouseID: s.WarehouseID, BinID: s.BinID}})
+			snapshotted[id] = true
+		}
+	}
+
+	for _, l := range lines {
+		_, err := tx.Exec("INSERT INTO count_lines (id, sessionId, stockId, warehouseId, binId, expected, counted, reason) VALUES (?, ?, ?, ?, ?, ?, NULL, '')",
+			uuid.New().String(), s.ID, l.StockID, l.WarehouseID, l.BinID, l.Expected)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := loadCountLines(tx, &s); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.StockIDs = nil
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// recordCounts serves PUT /api/counts/{id}/lines. Counters send the lines
+// they counted; a null count clears a line.
+func recordCounts(w http.ResponseWriter, r *http.Request, s *CountSession) {
+	db := tenantDB(r)
+	if s.Status != countOpen {
+		http.Error(w, "Counts can only be entered while the session is open", http.StatusConflict)
+		return
+	}
+
+	var updates []CountLine
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines := make(map[string]*CountLine)
+	for i := range s.Lines {
+		lines[s.Lines[i].ID] = &s.Lines[i]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, u := range updates {
+		line, ok := lines[u.ID]
+		if !ok {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("line %s not found in count session", u.ID), http.StatusBadRequest)
+			return
+		}
+		if u.Counted != nil && *u.Counted < 0 {
+			tx.Rollback()
+			http.Error(w, "counted quantities cannot be negative", http.StatusBadRequest)
+			return
+		}
+
+		_, err := tx.Exec("UPDATE count_lines SET counted = ?, reason = ? WHERE id = ?", u.Counted, u.Reason, u.ID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM count_line_lots WHERE lineId = ?", u.ID)
+		}
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, lot := range u.Lots {
+			if _, err := tx.Exec("INSERT INTO count_line_lots (lineId, lot, quantity) VALUES (?, ?, ?)", u.ID, lot.Lot, lot.Quantity); err != nil {
+				tx.Rollback()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		line.Counted = u.Counted
+		line.Reason = u.Reason
+		line.Lots = u.Lots
+	}
+	if err := loadCountLines(tx, s); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func changeCountStatus(w http.ResponseWriter, r *http.Request, s *CountSession, from, to string) {
+	db := tenantDB(r)
+	if s.Status != from {
+		http.Error(w, fmt.Sprintf("Count session is %s", s.Status), http.StatusConflict)
+		return
+	}
+	s.Status = to
+	if to == countSubmitted {
+		s.SubmittedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if _, err := db.Exec("UPDATE count_sessions SET status = ?, submittedAt = ? WHERE id = ?", s.Status, s.SubmittedAt, s.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// approveCountSession posts an adjustment for every counted line whose count
+// differs from the snapshot. The reason given with the approval applies to
+// lines without a reason of their own. Lines that were not counted are left
+// alone.
+func approveCountSession(w http.ResponseWriter, r *http.Request, s *CountSession) {
+	db := tenantDB(r)
+	if s.Status != countSubmitted {
+		http.Error(w, "Only submitted count sessions can be approved", http.StatusConflict)
+		return
+	}
+
+	// The body is optional when no variance needs a reason
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, l := range s.Lines {
+		if l.Counted != nil && l.Variance != 0 && l.Reason == "" && strings.TrimSpace(body.Reason) == "" {
+			http.Error(w, "a reason is required to approve the variances", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, l := range s.Lines {
+		if l.Counted == nil || l.Variance == 0 {
+			continue
+		}
+		reason := l.Reason
+		if reason == "" {
+			reason = body.Reason
+		}
+		reference := fmt.Sprintf("count %s: %s", s.Name, reason)
+		if err := adjustStock(tx, actorID(r), l.StockID, l.Variance, reference, l.StockLocation, l.Lots); err != nil {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("%s: %v", l.Name, err), stockErrorStatus(err))
+			return
+		}
+	}
+
+	s.Status = countApproved
+	s.ApprovedAt = time.Now().UTC().Format(time.RFC3339)
+	s.Reason = body.Reason
+	if _, err := tx.Exec("UPDATE count_sessions SET status = ?, approvedAt = ?, reason = ? WHERE id = ?", s.Status, s.ApprovedAt, s.Reason, s.ID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// submittedCount counts a new stock item of quantity 5 as counted, with a
+// line reason, and submits the session.
+func submittedCount(c *testClient, counted float64) (sessionID, stockID string) {
+	c.t.Helper()
+	stockID = c.create("/api/stock", `{"name":"Counted filter `+newTestID()+`","unit":"un","quantity":5,"value":10}`)
+	var warehouseID string
+	if err := c.db().QueryRow("SELECT warehouseId FROM stock_levels WHERE stockId = ?", stockID).Scan(&warehouseID); err != nil {
+		c.t.Fatal(err)
+	}
+	sessionID = c.create("/api/counts", `{"warehouseId":"`+warehouseID+`","stockIds":["`+stockID+`"]}`)
+
+	var s CountSession
+	json.Unmarshal(c.do("GET", "/api/counts/"+sessionID, "").Body.Bytes(), &s)
+	if len(s.Lines) != 1 {
+		c.t.Fatalf("count session has %d lines, want 1", len(s.Lines))
+	}
+	lines, _ := json.Marshal([]CountLine{{ID: s.Lines[0].ID, Counted: &counted, Reason: "found behind the shelf"}})
+	if rec := c.do("PUT", "/api/counts/"+sessionID+"/lines", string(lines)); rec.Code != http.StatusOK {
+		c.t.Fatalf("count: %d %s", rec.Code, rec.Body)
+	}
+	if rec := c.do("POST", "/api/counts/"+sessionID+"/submit", ""); rec.Code != http.StatusOK {
+		c.t.Fatalf("submit: %d %s", rec.Code, rec.Body)
+	}
+	return sessionID, stockID
+}
+
+func TestApproveCountWithoutBody(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	sessionID, stockID := submittedCount(admin, 6)
+
+	if rec := admin.do("POST", "/api/counts/"+sessionID+"/approve", ""); rec.Code != http.StatusOK {
+		t.Fatalf("approve without a body: %d %s", rec.Code, rec.Body)
+	}
+	var item StockItem
+	json.Unmarshal(admin.do("GET", "/api/stock/"+stockID, "").Body.Bytes(), &item)
+	if !sameQuantity(item.Quantity, 6) {
+		t.Errorf("quantity after the count = %g, want 6", item.Quantity)
+	}
+}
@@ -2,6 +2,9 @@ module m4chine-mind-corp/project-m4chine-mind-2.0/backend
 
 go 1.22.1
 
-require github.com/google/uuid v1.6.0
-
-require github.com/mattn/go-sqlite3 v1.14.33 // indirect
+require (
+	github.com/boombuler/barcode v1.0.2
+	github.com/google/uuid v1.6.0
+	github.com/mattn/go-sqlite3 v1.14.33
+	golang.org/x/crypto v0.31.0
+)
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
+)
+
+const (
+	symbologyQR      = "qr"
+	symbologyCode128 = "code128"
+)
+
+// labelBaseURL, when set, makes labels encode a URL such as
+// https://m4m.example/scan/machine/{id} instead of the bare "machine:{id}".
+// Both forms resolve through /api/scan.
+var labelBaseURL string
+
+// labelKind describes an entity that can be labelled. query selects the id,
+// display name and parent id (the machine of a sensor, the warehouse of a
+// bin) of every entity of the kind.
+type labelKind struct {
+	query    string
+	idColumn string
+	path     func(id, parentID string) string
+}
+
+var labelKinds = map[string]labelKind{
+	"machine": {
+		query:    "SELECT id, COALESCE(name, ''), '' FROM machines",
+		idColumn: "id",
+		path:     func(id, _ string) string { return "/api/machines/" + id },
+	},
+	"sensor": {
+		query:    "SELECT id, COALESCE(name, ''), COALESCE(machineId, '') FROM sensors",
+		idColumn: "id",
+		path:     func(_, machineID string) string { return "/api/machines/" + machineID + "/sensors" },
+	},
+	"stock": {
+		query:    "SELECT id, COALESCE(name, ''), '' FROM stock",
+		idColumn: "id",
+		path:     func(id, _ string) string { return "/api/stock/" + id },
+	},
+	"warehouse": {
+		query:    "SELECT id, COALESCE(name, ''), '' FROM warehouses",
+		idColumn: "id",
+		path:     func(id, _ string) string { return "/api/warehouses/" + id },
+	},
+	"bin": {
+		query:    "SELECT b.id, COALESCE(w.name, '') || ' / ' || COALESCE(b.code, ''), b.warehouseId FROM bins b LEFT JOIN warehouses w ON b.warehouseId = w.id",
+		idColumn: "b.id",
+		path:     func(id, warehouseID string) string { return "/api/warehouses/" + warehouseID + "/bins/" + id },
+	},
+}
+
+// labelKindOrder is the order in which a bare scanned id is looked up.
+var labelKindOrder = []string{"machine", "sensor", "stock", "warehouse", "bin"}
+
+// LabelRef names one entity to print a label for.
+type LabelRef struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// ScanResult is the entity a scanned code resolves to. Path is the API
+// resource that describes it.
+type ScanResult struct {
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId,omitempty"`
+	Path     string `json:"path"`
+	Code     string `json:"code"`
+}
+
+// labelPayload is the text encoded in the label of an entity.
+func labelPayload(kind, id string) string {
+	if labelBaseURL != "" {
+		return strings.TrimRight(labelBaseURL, "/") + "/scan/" + kind + "/" + id
+	}
+	return kind + ":" + id
+}
+
+// resolveLabel loads the entity of the given kind and id.
+func resolveLabel(q queryer, kind, id string) (ScanResult, error) {
+	k, ok := labelKinds[kind]
+	if !ok {
+		return ScanResult{}, fmt.Errorf("unknown label kind %q", kind)
+	}
+	res := ScanResult{Kind: kind}
+	err := q.QueryRow(k.query+" WHERE "+k.idColumn+" = ?", id).Scan(&res.ID, &res.Name, &res.ParentID)
+	if err != nil {
+		return res, err
+	}
+	res.Path = k.path(res.ID, res.ParentID)
+	res.Code = labelPayload(kind, res.ID)
+	return res, nil
+}
+
+// listLabels returns every entity of a kind.
+func listLabels(q queryer, kind string) ([]ScanResult, error) {
+	k, ok := labelKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown label kind %q", kind)
+	}
+	rows, err := q.Query(k.query + " ORDER BY 2")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []ScanResult{}
+	for rows.Next() {
+		res := ScanResult{Kind: kind}
+		if err := rows.Scan(&res.ID, &res.Name, &res.ParentID); err != nil {
+			return nil, err
+		}
+		res.Path = k.path(res.ID, res.ParentID)
+		res.Code = labelPayload(kind, res.ID)
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// parseScanCode splits a scanned code into kind and id. It accepts the URL
+// form (.../scan/{kind}/{id}), "kind:id" and a bare id, for which kind is
+// empty.
+func parseScanCode(code string) (kind, id string) {
+	code = strings.TrimSpace(code)
+	if u, err := url.Parse(code); err == nil && u.Scheme != "" && u.Host != "" {
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) >= 2 {
+			return parts[len(parts)-2], parts[len(parts)-1]
+		}
+		return "", ""
+	}
+	if kind, id, ok := strings.Cut(code, ":"); ok {
+		if _, known := labelKinds[kind]; known {
+			return kind, id
+		}
+	}
+	return "", code
+}
+
+// labelSymbol is a barcode as dark rectangles on a grid of modules,
+// quiet zone included.
+type labelSymbol struct {
+	width, height int
+	rects         []image.Rectangle
+}
+
+func newLabelSymbol(symbology, payload string) (*labelSymbol, error) {
+	var bc barcode.Barcode
+	var err error
+	quiet := 4
+	switch symbology {
+	case symbologyQR:
+		bc, err = qr.Encode(payload, qr.M, qr.Auto)
+	case symbologyCode128:
+		bc, err = code128.Encode(payload)
+		quiet = 10
+	default:
+		return nil, fmt.Errorf("symbology must be qr or code128")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := bc.Bounds()
+	s := &labelSymbol{width: bounds.Dx() + 2*quiet, height: bounds.Dy() + 2*quiet}
+	// Linear codes are a single row of bars, drawn a quarter as tall as wide.
+	rowHeight := 1
+	if bc.Metadata().Dimensions == 1 {
+		rowHeight = bounds.Dx() / 4
+		s.height = rowHeight + 2*quiet
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		start := -1
+		for x := bounds.Min.X; x <= bounds.Max.X; x++ {
+			dark := x < bounds.Max.X && color.GrayModel.Convert(bc.At(x, y)).(color.Gray).Y < 128
+			if dark && start < 0 {
+				start = x
+			} else if !dark && start >= 0 {
+				top := quiet + (y-bounds.Min.Y)*rowHeight
+				s.rects = append(s.rects, image.Rect(quiet+start-bounds.Min.X, top, quiet+x-bounds.Min.X, top+rowHeight))
+				start = -1
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *labelSymbol) writePNG(w io.Writer, scale int) error {
+	img := image.NewGray(image.Rect(0, 0, s.width*scale, s.height*scale))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for _, r := range s.rects {
+		draw.Draw(img, image.Rect(r.Min.X*scale, r.Min.Y*scale, r.Max.X*scale, r.Max.Y*scale), image.Black, image.Point{}, draw.Src)
+	}
+	return png.Encode(w, img)
+}
+
+func (s *labelSymbol) writeSVG(w io.Writer, scale int) error {
+	var path strings.Builder
+	for _, r := range s.rects {
+		fmt.Fprintf(&path, "M%d %dh%dv%dh-%dz", r.Min.X, r.Min.Y, r.Dx(), r.Dy(), r.Dx())
+	}
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges"><rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		s.width, s.height, s.width*scale, s.height*scale, s.width, s.height, path.String())
+	return err
+}
+
+// Label handlers
+func labelsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/labels/")
+
+	if path == "sheet" {
+		switch r.Method {
+		case "GET", "POST":
+			getLabelSheet(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	kind, id, _ := strings.Cut(path, "/")
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	getLabel(w, r, kind, id)
+}
+
+// getLabel serves GET /api/labels/{kind}/{id}: the code of one entity as a
+// PNG (default) or SVG image. symbology is qr (default) or code128 and size
+// the approximate width in pixels.
+func getLabel(w http.ResponseWriter, r *http.Request, kind, id string) {
+	db := tenantDB(r)
+	if _, ok := labelKinds[kind]; !ok {
+		http.Error(w, fmt.Sprintf("unknown label kind %q", kind), http.StatusNotFound)
+		return
+	}
+	label, err := resolveLabel(db, kind, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Entity not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	symbology := r.URL.Query().Get("symbology")
+	if symbology == "" {
+		symbology = symbologyQR
+	}
+	symbol, err := newLabelSymbol(symbology, label.Code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scale := 4
+	if symbology == symbologyCode128 {
+		scale = 2
+	}
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 || size > 4096 {
+			http.Error(w, "size must be between 1 and 4096", http.StatusBadRequest)
+			return
+		}
+		scale = max(1, size/symbol.width)
+	}
+
+	var buf bytes.Buffer
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "png":
+		format = "png"
+		w.Header().Set("Content-Type", "image/png")
+		err = symbol.writePNG(&buf, scale)
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = symbol.writeSVG(&buf, scale)
+	default:
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", kind+"-"+id+"."+format))
+	w.Write(buf.Bytes())
+}
+
+// getLabelSheet serves the printable label sheet, a PDF of A4 pages with 3x8
+// labels. GET takes ?kind=machine and optionally &ids=a,b (all entities of
+// the kind otherwise); POST takes {"symbology": ..., "labels": [{kind, id}]}.
+func getLabelSheet(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var req struct {
+		Symbology string     `json:"symbology"`
+		Labels    []LabelRef `json:"labels"`
+	}
+	var labels []ScanResult
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Symbology = r.URL.Query().Get("symbology")
+		kind := r.URL.Query().Get("kind")
+		if _, ok := labelKinds[kind]; !ok {
+			http.Error(w, "kind must be machine, sensor, stock, warehouse or bin", http.StatusBadRequest)
+			return
+		}
+		if ids := r.URL.Query().Get("ids"); ids != "" {
+			for _, id := range strings.Split(ids, ",") {
+				req.Labels = append(req.Labels, LabelRef{Kind: kind, ID: strings.TrimSpace(id)})
+			}
+		} else {
+			all, err := listLabels(db, kind)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			labels = all
+		}
+	}
+	if req.Symbology == "" {
+		req.Symbology = symbologyQR
+	}
+
+	for _, ref := range req.Labels {
+		label, err := resolveLabel(db, ref.Kind, ref.ID)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("%s %s not found", ref.Kind, ref.ID), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		labels = append(labels, label)
+	}
+	if len(labels) == 0 {
+		http.Error(w, "no labels to print", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writeLabelSheet(&buf, labels, req.Symbology); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="labels.pdf"`)
+	w.Write(buf.Bytes())
+}
+
+// Label sheet geometry in points: A4 with 3 columns and 8 rows of 70 x 37 mm
+// labels.
+const (
+	sheetWidth   = 595.28
+	sheetHeight  = 841.89
+	sheetColumns = 3
+	sheetRows    = 8
+	labelWidth   = sheetWidth / sheetColumns
+	labelHeight  = sheetHeight / sheetRows
+	labelPadding = 8.0
+)
+
+// writeLabelSheet writes labels as a PDF. The codes are drawn as vector
+// rectangles and captioned with the entity's name and id in Helvetica.
+func writeLabelSheet(w io.Writer, labels []ScanResult, symbology string) error {
+	var pages []*bytes.Buffer
+	for i, label := range labels {
+		symbol, err := newLabelSymbol(symbology, label.Code)
+		if err != nil {
+			return err
+		}
+		slot := i % (sheetColumns * sheetRows)
+		if slot == 0 {
+			pages = append(pages, &bytes.Buffer{})
+		}
+		page := pages[len(pages)-1]
+		left := float64(slot%sheetColumns) * labelWidth
+		top := sheetHeight - float64(slot/sheetColumns)*labelHeight
+
+		var textLeft, textTop, codeWidth, codeHeight float64
+		if symbology == symbologyQR {
+			codeHeight = labelHeight - 2*labelPadding
+			codeWidth = codeHeight
+			textLeft = left + labelPadding + codeWidth + 4
+			textTop = top - labelPadding - 10
+		} else {
+			codeWidth = labelWidth - 2*labelPadding
+			codeHeight = labelHeight/2 - labelPadding
+			textLeft = left + labelPadding
+			textTop = top - labelPadding - codeHeight - 10
+		}
+		sx := codeWidth / float64(symbol.width)
+		sy := codeHeight / float64(symbol.height)
+		for _, r := range symbol.rects {
+			fmt.Fprintf(page, "%s %s %s %s re\n", pdfNum(left+labelPadding+float64(r.Min.X)*sx), pdfNum(top-labelPadding-float64(r.Max.Y)*sy),
+				pdfNum(float64(r.Dx())*sx), pdfNum(float64(r.Dy())*sy))
+		}
+		page.WriteString("f\n")
+
+		textWidth := left + labelWidth - labelPadding - textLeft
+		lines := []struct {
+			size float64
+			text string
+		}{
+			{10, label.Name},
+			{7, label.Kind},
+			{4.5, label.ID},
+		}
+		y := textTop
+		for _, line := range lines {
+			// Helvetica averages about half an em per character
+			maxChars := int(textWidth / (line.size * 0.5))
+			text := []rune(line.text)
+			if len(text) > maxChars {
+				text = append(text[:max(maxChars-1, 0)], '…')
+			}
+			fmt.Fprintf(page, "BT /F1 %s Tf %s %s Td (%s) Tj ET\n", pdfNum(line.size), pdfNum(textLeft), pdfNum(y), pdfString(string(text)))
+			y -= line.size + 4
+		}
+	}
+
+	// Objects: 1 catalog, 2 page tree, 3 font, then a page and its content
+	// stream for every page.
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfNum(sheetWidth), pdfNum(sheetHeight), 5+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func pdfNum(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// pdfString escapes text for a PDF string literal in WinAnsiEncoding.
+// Characters outside Latin-1 (other than the ellipsis) print as '?'.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '…':
+			b.WriteString(`\205`)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// scanHandler serves GET /api/scan?code=X, resolving a scanned label (URL,
+// "kind:id" or a bare id) to its entity.
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind, id := parseScanCode(r.URL.Query().Get("code"))
+	if id == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	kinds := labelKindOrder
+	if kind != "" {
+		if _, ok := labelKinds[kind]; !ok {
+			http.Error(w, fmt.Sprintf("unknown label kind %q", kind), http.StatusNotFound)
+			return
+		}
+		kinds = []string{kind}
+	}
+
+	for _, k := range kinds {
+		res, err := resolveLabel(db, k, id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	http.Error(w, "No entity found for code", http.StatusNotFound)
+}
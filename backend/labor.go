@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loadAssignees returns the operators assigned to a maintenance.
+func loadAssignees(q queryer, maintenanceID string) ([]string, error) {
+	rows, err := q.Query("SELECT operatorId FROM maintenance_assignees WHERE maintenanceId = ? ORDER BY rowid", maintenanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignees := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		assignees = append(assignees, id)
+	}
+	return assignees, rows.Err()
+}
+
+// saveAssignees replaces the operators assigned to a maintenance.
+func saveAssignees(tx *sql.Tx, maintenanceID string, assignees []string) error {
+	if _, err := tx.Exec("DELETE FROM maintenance_assignees WHERE maintenanceId = ?", maintenanceID); err != nil {
+		return err
+	}
+	for _, operatorID := range assignees {
+		if _, err := tx.Exec("INSERT INTO maintenance_assignees(maintenanceId, operatorId) VALUES(?, ?)", maintenanceID, operatorID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// laborHours is the time between two timestamps in hours, rounded to the
+// hundredth.
+func laborHours(start, stop time.Time) float64 {
+	return math.Round(stop.Sub(start).Hours()*100) / 100
+}
+
+// validateMaintenanceLabor checks the labor entries and assigns the
+// operators who logged them. Entries with a start and stop time get their
+// hours from them; an entry with only a start time is a timer still running.
+func validateMaintenanceLabor(m *Maintenance) error {
+	seen := make(map[string]bool)
+	assignees := make([]string, 0, len(m.Assignees))
+	operatorIDs := append([]string{}, m.Assignees...)
+	for _, entry := range m.Labor {
+		operatorIDs = append(operatorIDs, entry.OperatorID)
+	}
+	for _, id := range operatorIDs {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		assignees = append(assignees, id)
+	}
+	m.Assignees = assignees
+
+	if m.EstimatedHours < 0 {
+		return errors.New("estimatedHours cannot be negative")
+	}
+
+	m.LaborHours = 0
+	running := make(map[string]bool)
+	for i := range m.Labor {
+		entry := &m.Labor[i]
+		if entry.OperatorID == "" {
+			return errors.New("every labor entry needs an operatorId")
+		}
+		if entry.StoppedAt != "" && entry.StartedAt == "" {
+			return errors.New("a labor entry with stoppedAt needs startedAt")
+		}
+		if entry.StartedAt != "" {
+			start, err := parseTimestamp(entry.StartedAt)
+			if err != nil {
+				return fmt.Errorf("labor startedAt: %v", err)
+			}
+			if entry.StoppedAt == "" {
+				if running[entry.OperatorID] {
+					return errors.New("an operator can only have one running labor entry per maintenance")
+				}
+				running[entry.OperatorID] = true
+				entry.Hours = 0
+			} else {
+				stop, err := parseTimestamp(entry.StoppedAt)
+				if err != nil {
+					return fmt.Errorf("labor stoppedAt: %v", err)
+				}
+				if stop.Before(start) {
+					return errors.New("labor stoppedAt cannot be before startedAt")
+				}
+				entry.Hours = laborHours(start, stop)
+			}
+		}
+		if entry.Hours < 0 {
+			return errors.New("labor hours cannot be negative")
+		}
+		m.LaborHours += entry.Hours
+	}
+	return nil
+}
+
+// operatorForUser returns the operator linked to a user account.
+func operatorForUser(q queryer, userID string) (string, error) {
+	var id string
+	err := q.QueryRow("SELECT id FROM operators WHERE userId = ? AND userId != ''", userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, err
+}
+
+// LaborTimerRequest is the body of the labor start and stop requests. The
+// operator defaults to the one linked to the current user.
+type LaborTimerRequest struct {
+	OperatorID string `json:"operatorId"`
+}
+
+// laborTimerHandler serves POST /api/maintenances/{id}/labor/start and
+// /labor/stop. Starting a timer assigns the operator to the maintenance if
+// needed; an operator can only clock in on one maintenance at a time.
+// Stopping it records the hours worked.
+func laborTimerHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/maintenances/")
+	id, action, _ := strings.Cut(path, "/labor/")
+
+	var req LaborTimerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+
+	var maint Maintenance
+	err := scanMaintenance(db.QueryRow("SELECT "+maintenanceColumns+" FROM maintenance WHERE id = ?", id), &maint)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Maintenance not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.OperatorID == "" {
+		req.OperatorID, err = operatorForUser(db, actorID(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.OperatorID == "" {
+			http.Error(w, "operatorId is required: the current user is not linked to an operator", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	var entry LaborEntry
+	var status int
+	switch action {
+	case "start":
+		entry, status, err = startLabor(db, maint, req.OperatorID, now)
+	case "stop":
+		entry, status, err = stopLabor(db, maint, req.OperatorID, now)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(entry)
+}
+
+func startLabor(db *sql.DB, maint Maintenance, operatorID string, now time.Time) (LaborEntry, int, error) {
+	if maint.Status == maintenanceStatusCompleted {
+		return LaborEntry{}, http.StatusConflict, errors.New("The maintenance is already completed")
+	}
+
+	var model string
+	if err := db.QueryRow("SELECT model FROM machines WHERE id = ?", maint.MachineID).Scan(&model); err != nil && err != sql.ErrNoRows {
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+	if status, err := validateOperatorQualified(db, operatorID, maint.MachineID, model, now.Format("2006-01-02")); err != nil {
+		return LaborEntry{}, status, err
+	}
+
+	var running string
+	err := db.QueryRow("SELECT maintenanceId FROM maintenance_labor WHERE operatorId = ? AND startedAt != '' AND stoppedAt = ''", operatorID).Scan(&running)
+	if err == nil {
+		return LaborEntry{}, http.StatusConflict, fmt.Errorf("The operator is already clocked in on maintenance %s", running)
+	}
+	if err != sql.ErrNoRows {
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+	entries := []LaborEntry{{OperatorID: operatorID, StartedAt: now.Format(time.RFC3339)}}
+	err = insertLabor(tx, maint.ID, entries, nil)
+	if err == nil {
+		_, err = tx.Exec("INSERT OR IGNORE INTO maintenance_assignees(maintenanceId, operatorId) VALUES(?, ?)", maint.ID, operatorID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+	if err := tx.Commit(); err != nil {
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+	return entries[0], http.StatusCreated, nil
+}
+
+func stopLabor(q queryer, maint Maintenance, operatorID string, now time.Time) (LaborEntry, int, error) {
+	var entry LaborEntry
+	err := q.QueryRow("SELECT id, operatorId, hours, rate, startedAt, stoppedAt FROM maintenance_labor WHERE maintenanceId = ? AND operatorId = ? AND startedAt != '' AND stoppedAt = ''", maint.ID, operatorID).
+		Scan(&entry.ID, &entry.OperatorID, &entry.Hours, &entry.Rate, &entry.StartedAt, &entry.StoppedAt)
+	if err == sql.ErrNoRows {
+		return LaborEntry{}, http.StatusConflict, errors.New("The operator has no running labor entry on this maintenance")
+	}
+	if err != nil {
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+	if err := stopLaborEntry(q, &entry, now); err != nil {
+		return LaborEntry{}, http.StatusInternalServerError, err
+	}
+	return entry, http.StatusOK, nil
+}
+
+func stopLaborEntry(q queryer, entry *LaborEntry, now time.Time) error {
+	start, err := parseTimestamp(entry.StartedAt)
+	if err != nil {
+		return err
+	}
+	if now.Before(start) {
+		now = start
+	}
+	entry.StoppedAt = now.UTC().Format(time.RFC3339)
+	entry.Hours = laborHours(start, now)
+	_, err = q.Exec("UPDATE maintenance_labor SET stoppedAt = ?, hours = ? WHERE id = ?", entry.StoppedAt, entry.Hours, entry.ID)
+	return err
+}
+
+// stopRunningLabor stops the labor timers still running on a maintenance,
+// as happens when it is completed.
+func stopRunningLabor(tx *sql.Tx, maintenanceID string, now time.Time) error {
+	rows, err := tx.Query("SELECT id, startedAt FROM maintenance_labor WHERE maintenanceId = ? AND startedAt != '' AND stoppedAt = ''", maintenanceID)
+	if err != nil {
+		return err
+	}
+	var entries []LaborEntry
+	for rows.Next() {
+		var entry LaborEntry
+		if err := rows.Scan(&entry.ID, &entry.StartedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range entries {
+		if err := stopLaborEntry(tx, &entries[i], now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WorkloadMaintenance is a maintenance counted in a technician's workload.
+type WorkloadMaintenance struct {
+	ID          string  `json:"id"`
+	MachineID   string  `json:"machineId"`
+	Description string  `json:"description"`
+	Status      string  `json:"status"`
+	Hours       float64 `json:"hours"`
+}
+
+// WorkloadDay is a technician's workload on one day. Allocated counts each
+// maintenance scheduled that day with the hours logged on it once it is
+// completed, and otherwise with its estimate or the hours logged so far,
+// whichever is more. Logged is the labor clocked that day on any
+// maintenance.
+type WorkloadDay struct {
+	OperatorID    string                `json:"operatorId"`
+	OperatorName  string                `json:"operatorName"`
+	Date          string                `json:"date"`
+	Capacity      float64               `json:"capacity"`
+	Allocated     float64               `json:"allocated"`
+	Logged        float64               `json:"logged"`
+	OverAllocated bool                  `json:"overAllocated"`
+	Maintenances  []WorkloadMaintenance `json:"maintenances"`
+}
+
+// getWorkload serves GET /api/workload, the daily workload of every
+// technician from ?from= to ?to= (the coming week by default), optionally
+// limited to ?operatorId=. Days over capacity are flagged; with
+// ?overAllocated=true only those are returned.
+func getWorkload(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+
+	from, to, err := parseCalendarPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	workload, err := queryWorkload(db, from, to, r.URL.Query().Get("operatorId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("overAllocated") == "true" {
+		over := make([]WorkloadDay, 0)
+		for _, day := range workload {
+			if day.OverAllocated {
+				over = append(over, day)
+			}
+		}
+		workload = over
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workload)
+}
+
+func queryWorkload(q queryer, from, to time.Time, operatorID string) ([]WorkloadDay, error) {
+	query := "SELECT id, name FROM operators"
+	args := []interface{}{}
+	if operatorID != "" {
+		query += " WHERE id = ?"
+		args = append(args, operatorID)
+	}
+	rows, err := q.Query(query+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	var operators []Operator
+	for rows.Next() {
+		var op Operator
+		if err := rows.Scan(&op.ID, &op.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		operators = append(operators, op)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	days := make(map[string]*WorkloadDay)
+	key := func(operatorID, date string) string { return operatorID + "|" + date }
+	workload := make([]WorkloadDay, 0)
+	for _, op := range operators {
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			capacity, err := operatorCapacity(q, op.ID, d)
+			if err != nil {
+				return nil, err
+			}
+			workload = append(workload, WorkloadDay{
+				OperatorID:   op.ID,
+				OperatorName: op.Name,
+				Date:         d.Format("2006-01-02"),
+				Capacity:     capacity,
+				Maintenances: make([]WorkloadMaintenance, 0),
+			})
+		}
+	}
+	for i := range workload {
+		days[key(workload[i].OperatorID, workload[i].Date)] = &workload[i]
+	}
+
+	fromDay, toDay := from.Format("2006-01-02"), to.Format("2006-01-02")
+
+	// Maintenances scheduled in the period, per assignee
+	rows, err = q.Query(`
+		SELECT ma.operatorId, m.id, m.machineId, m.description, m.status, substr(m.date, 1, 10), m.estimatedHours,
+			COALESCE((SELECT SUM(ml.hours) FROM maintenance_labor ml WHERE ml.maintenanceId = m.id AND ml.operatorId = ma.operatorId), 0)
+		FROM maintenance_assignees ma
+		JOIN maintenance m ON m.id = ma.maintenanceId
+		WHERE substr(m.date, 1, 10) BETWEEN ? AND ?
+		ORDER BY m.date`, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var operatorID, date string
+		var m WorkloadMaintenance
+		var estimated, logged float64
+		if err := rows.Scan(&operatorID, &m.ID, &m.MachineID, &m.Description, &m.Status, &date, &estimated, &logged); err != nil {
+			return nil, err
+		}
+		day, ok := days[key(operatorID, date)]
+		if !ok {
+			continue
+		}
+		m.Hours = logged
+		if m.Status != maintenanceStatusCompleted && estimated > logged {
+			m.Hours = estimated
+		}
+		day.Allocated += m.Hours
+		day.Maintenances = append(day.Maintenances, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Labor clocked in the period. Entries without times count on the
+	// maintenance date.
+	rows, err = q.Query(`
+		SELECT ml.operatorId, CASE WHEN ml.startedAt != '' THEN substr(ml.startedAt, 1, 10) ELSE substr(m.date, 1, 10) END AS day, SUM(ml.hours)
+		FROM maintenance_labor ml
+		JOIN maintenance m ON m.id = ml.maintenanceId
+		GROUP BY ml.operatorId, day
+		HAVING day BETWEEN ? AND ?`, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var operatorID, date string
+		var hours float64
+		if err := rows.Scan(&operatorID, &date, &hours); err != nil {
+			return nil, err
+		}
+		if day, ok := days[key(operatorID, date)]; ok {
+			day.Logged = hours
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range workload {
+		day := &workload[i]
+		day.Allocated = math.Round(day.Allocated*100) / 100
+		day.OverAllocated = day.Allocated > day.Capacity || day.Logged > day.Capacity
+	}
+	sort.SliceStable(workload, func(i, j int) bool { return workload[i].Date < workload[j].Date })
+	return workload, nil
+}
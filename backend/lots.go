@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Tracking modes of a stock item. Every movement of a tracked item names the
+// lots or serial numbers it moves, so each unit can be traced to the
+// maintenance and machine it was used on.
+const (
+	trackingNone   = ""
+	trackingLot    = "lot"
+	trackingSerial = "serial"
+)
+
+// LotQuantity is a quantity of one lot, or a single serial number, of a
+// tracked stock item. Serial numbers always have a quantity of 1.
+type LotQuantity struct {
+	Lot      string  `json:"lot"`
+	Quantity float64 `json:"quantity"`
+}
+
+// LotTraceEntry is a movement of a lot or serial number: where it came from
+// and which maintenance (and machine) it went to.
+type LotTraceEntry struct {
+	Date            string  `json:"date"`
+	StockID         string  `json:"stockId"`
+	StockName       string  `json:"stockName"`
+	Lot             string  `json:"lot"`
+	Type            string  `json:"type"`
+	Quantity        float64 `json:"quantity"`
+	Reference       string  `json:"reference,omitempty"`
+	PurchaseOrderID string  `json:"purchaseOrderId,omitempty"`
+	MaintenanceID   string  `json:"maintenanceId,omitempty"`
+	MachineID       string  `json:"machineId,omitempty"`
+	MachineName     string  `json:"machineName,omitempty"`
+}
+
+func validTracking(tracking string) bool {
+	return tracking == trackingNone || tracking == trackingLot || tracking == trackingSerial
+}
+
+// normalizeLots checks that lots account for exactly quantity units of an
+// item with the given tracking. Serial numbers without a quantity count as
+// one unit.
+func normalizeLots(tracking string, quantity float64, lots []LotQuantity) error {
+	if tracking == trackingNone {
+		if len(lots) > 0 {
+			return fmt.Errorf("stock item is not lot or serial tracked")
+		}
+		return nil
+	}
+	if len(lots) == 0 {
+		return fmt.Errorf("stock item is %s tracked: the %ss must be given", tracking, tracking)
+	}
+
+	total := 0.0
+	seen := make(map[string]bool)
+	for i := range lots {
+		lot := &lots[i]
+		lot.Lot = strings.TrimSpace(lot.Lot)
+		if lot.Lot == "" {
+			return fmt.Errorf("%s numbers cannot be empty", tracking)
+		}
+		if seen[lot.Lot] {
+			return fmt.Errorf("%s %s is listed more than once", tracking, lot.Lot)
+		}
+		seen[lot.Lot] = true
+		if tracking == trackingSerial && lot.Quantity == 0 {
+			lot.Quantity = 1
+		}
+		if lot.Quantity <= 0 || (tracking == trackingSerial && lot.Quantity != 1) {
+			return fmt.Errorf("invalid quantity for %s %s", tracking, lot.Lot)
+		}
+		total += lot.Quantity
+	}
+	if !sameQuantity(total, quantity) {
+		return fmt.Errorf("%ss account for %g units, expected %g", tracking, total, quantity)
+	}
+	return nil
+}
+
+// sameLots reports whether a and b hold the same quantities of the same lots.
+func sameLots(a, b []LotQuantity) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	quantities := make(map[string]float64)
+	for _, lot := range a {
+		quantities[lot.Lot] += lot.Quantity
+	}
+	for _, lot := range b {
+		if !sameQuantity(quantities[lot.Lot], lot.Quantity) {
+			return false
+		}
+	}
+	return true
+}
+
+func stockTracking(q queryer, stockID string) (string, error) {
+	var tracking string
+	err := q.QueryRow("SELECT tracking FROM stock WHERE id = ?", stockID).Scan(&tracking)
+	return tracking, err
+}
+
+// applyLots records the lots of a movement and updates the lots on hand.
+// Transfers move stock between locations and leave lots untouched. Lots that
+// are missing, or not in stock, are reported as a stockError.
+func applyLots(tx *sql.Tx, m *StockMovement) error {
+	tracking, err := stockTracking(tx, m.StockID)
+	if err != nil {
+		return err
+	}
+	if m.Type == movementTransfer {
+		m.Lots = nil
+		return nil
+	}
+	quantity := m.Quantity
+	if quantity < 0 {
+		quantity = -quantity
+	}
+	if err := normalizeLots(tracking, quantity, m.Lots); err != nil {
+		return &stockError{http.StatusBadRequest, err}
+	}
+
+	for _, lot := range m.Lots {
+		var onHand float64
+		err := tx.QueryRow("SELECT quantity FROM stock_lots WHERE stockId = ? AND lot = ?", m.StockID, lot.Lot).Scan(&onHand)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		delta := lot.Quantity
+		if m.Quantity < 0 {
+			delta = -delta
+			if onHand < lot.Quantity-quantityEpsilon {
+				return &stockError{http.StatusConflict, fmt.Errorf("%s %s: only %g in stock", tracking, lot.Lot, onHand)}
+			}
+		} else if tracking == trackingSerial && onHand > 0 {
+			return &stockError{http.StatusConflict, fmt.Errorf("serial %s is already in stock", lot.Lot)}
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO stock_lots (stockId, lot, quantity, firstReceived) VALUES (?, ?, ?, ?)
+			ON CONFLICT(stockId, lot) DO UPDATE SET quantity = quantity + excluded.quantity
+		`, m.StockID, lot.Lot, delta, m.Date)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO movement_lots (movementId, lot, quantity) VALUES (?, ?, ?)", m.ID, lot.Lot, lot.Quantity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMovementLots fills the lots of the given movements of a stock item.
+func loadMovementLots(q queryer, stockID string, movements []StockMovement) error {
+	rows, err := q.Query(`
+		SELECT ml.movementId, ml.lot, ml.quantity
+		FROM movement_lots ml
+		JOIN stock_movements sm ON ml.movementId = sm.id
+		WHERE sm.stockId = ?
+		ORDER BY ml.rowid
+	`, stockID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[string]int)
+	for i, m := range movements {
+		index[m.ID] = i
+	}
+	for rows.Next() {
+		var movementID string
+		var lot LotQuantity
+		if err := rows.Scan(&movementID, &lot.Lot, &lot.Quantity); err != nil {
+			return err
+		}
+		if i, ok := index[movementID]; ok {
+			movements[i].Lots = append(movements[i].Lots, lot)
+		}
+	}
+	return rows.Err()
+}
+
+// loadStockLots returns the lots of a stock item currently in stock.
+func loadStockLots(q queryer, stockID string) ([]LotQuantity, error) {
+	rows, err := q.Query("SELECT lot, quantity FROM stock_lots WHERE stockId = ? AND quantity > 0 ORDER BY firstReceived, lot", stockID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lots := []LotQuantity{}
+	for rows.Next() {
+		var lot LotQuantity
+		if err := rows.Scan(&lot.Lot, &lot.Quantity); err != nil {
+			return nil, err
+		}
+		lots = append(lots, lot)
+	}
+	return lots, rows.Err()
+}
+
+// loadUsedStockLots fills the lots of the stock lines of a maintenance.
+func loadUsedStockLots(q queryer, maintenanceID string, items []UsedStockItem) error {
+	rows, err := q.Query("SELECT stockId, lot, quantity FROM maintenance_stock_lots WHERE maintenanceId = ? ORDER BY rowid", maintenanceID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stockID string
+		var lot LotQuantity
+		if err := rows.Scan(&stockID, &lot.Lot, &lot.Quantity); err != nil {
+			return err
+		}
+		for i := range items {
+			if items[i].StockID == stockID {
+				items[i].Lots = append(items[i].Lots, lot)
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// getLotTrace serves GET /api/stock/trace?serial=X (or ?lot=X), the history
+// of a lot or serial number: when it was received and which maintenances and
+// machines it was issued to. stockId narrows the search to one item.
+func getLotTrace(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lot := r.URL.Query().Get("serial")
+	if lot == "" {
+		lot = r.URL.Query().Get("lot")
+	}
+	if lot == "" {
+		http.Error(w, "serial or lot is required", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		SELECT sm.date, sm.stockId, COALESCE(s.name, ''), ml.lot, sm.type, ml.quantity, sm.reference, sm.purchaseOrderId,
+			sm.maintenanceId, COALESCE(m.machineId, ''), COALESCE(mc.name, '')
+		FROM movement_lots ml
+		JOIN stock_movements sm ON ml.movementId = sm.id
+		LEFT JOIN stock s ON sm.stockId = s.id
+		LEFT JOIN maintenance m ON sm.maintenanceId != '' AND sm.maintenanceId = m.id
+		LEFT JOIN machines mc ON m.machineId = mc.id
+		WHERE ml.lot = ?`
+	args := []interface{}{lot}
+	if stockID := r.URL.Query().Get("stockId"); stockID != "" {
+		query += " AND sm.stockId = ?"
+		args = append(args, stockID)
+	}
+	query += " ORDER BY sm.date, sm.rowid"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []LotTraceEntry{}
+	for rows.Next() {
+		var e LotTraceEntry
+		if err := rows.Scan(&e.Date, &e.StockID, &e.StockName, &e.Lot, &e.Type, &e.Quantity, &e.Reference, &e.PurchaseOrderID, &e.MaintenanceID, &e.MachineID, &e.MachineName); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -6,9 +6,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,6 +25,15 @@ type Machine struct {
 	Status       string   `json:"status"`
 	OperatorID   string   `json:"operatorId,omitempty"`
 	Sensors      []Sensor `json:"sensors"`
+
+	// LineID places the machine on a line of the asset tree. It is set when
+	// the machine is created and changed through /api/assets/{id}/move.
+	LineID string `json:"lineId,omitempty"`
+
+	// UpdatedBy is the user who last created or changed the machine, at
+	// UpdatedAt. Both are set by the server.
+	UpdatedBy string `json:"updatedBy,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
 }
 
 type Sensor struct {
@@ -36,15 +45,53 @@ type Sensor struct {
 type StockItem struct {
 	ID       string  `json:"id"`
 	Name     string  `json:"name"`
-	Quantity int     `json:"quantity"`
-	Unit     string  `json:"unit"`
-	Value    float64 `json:"value"`
-	Location string  `json:"location"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"`     // stock unit, a code from /api/units
+	Value    float64 `json:"value"`    // current unit cost, maintained by the stock ledger
+	Location string  `json:"location"` // free-text description; quantities per location are in Levels
+
+	// PurchaseUnit is the unit the item is ordered in, holding PurchaseFactor
+	// stock units (a box of 12). Empty when it is bought in the stock unit.
+	PurchaseUnit   string  `json:"purchaseUnit"`
+	PurchaseFactor float64 `json:"purchaseFactor"`
+
+	// ValuationMethod is "fifo" or "average" (moving weighted average).
+	ValuationMethod string `json:"valuationMethod"`
+
+	// Replenishment policy: an alert is raised when the available quantity
+	// reaches ReorderPoint, and it becomes critical at MinLevel.
+	MinLevel        float64 `json:"minLevel"`
+	ReorderPoint    float64 `json:"reorderPoint"`
+	ReorderQuantity float64 `json:"reorderQuantity"`
+
+	// Levels breaks Quantity down by warehouse and bin. It is only filled
+	// when requested with ?breakdown=location.
+	Levels []StockLevel `json:"levels,omitempty"`
+
+	// Tracking is "lot", "serial" or empty for untracked items. Lots lists
+	// the lots or serial numbers on hand; on creation it names those of the
+	// initial quantity.
+	Tracking string        `json:"tracking"`
+	Lots     []LotQuantity `json:"lots,omitempty"`
+
+	// UpdatedBy is the user who last created or edited the item, at
+	// UpdatedAt. Quantity changes are attributed in the stock ledger.
+	UpdatedBy string `json:"updatedBy,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
 }
 
 type Operator struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	HourlyRate float64 `json:"hourlyRate"`
+
+	// UserID is the login account of the operator, if they have one.
+	UserID string `json:"userId,omitempty"`
+
+	// Shifts and Certifications are only filled when a single operator is
+	// read; they are managed under /api/operators/{id}/.
+	Shifts         []ShiftAssignment `json:"shifts,omitempty"`
+	Certifications []Certification   `json:"certifications,omitempty"`
 }
 
 // Maintenance represents a maintenance schedule for a machine.
@@ -54,59 +101,223 @@ type Maintenance struct {
 	Date        string          `json:"date"`
 	Description string          `json:"description"`
 	Status      string          `json:"status"`
+	Type        string          `json:"type"` // "preventive" or "corrective"
 	UsedStock   []UsedStockItem `json:"usedStock"`
+	Labor       []LaborEntry    `json:"labor"`
+
+	// Assignees are the operators assigned to the maintenance. Operators
+	// who log labor on it are assigned automatically.
+	Assignees []string `json:"assignees"`
+
+	// EstimatedHours is the planned work per assignee, used by the workload
+	// view. LaborHours is the total of the labor entries, set by the server.
+	EstimatedHours float64 `json:"estimatedHours"`
+	LaborHours     float64 `json:"laborHours"`
+
+	// Checklist is the procedure to follow, copied from a checklist template
+	// when the maintenance is created. Its required steps must be recorded
+	// before the maintenance can be completed.
+	ChecklistTemplateID string          `json:"checklistTemplateId,omitempty"`
+	Checklist           []ChecklistItem `json:"checklist"`
+
+	// Start (RFC 3339) and DurationMinutes book the machine and the
+	// assignees; End is derived from them. Date follows Start. Bookings may
+	// not overlap unless forced, which is recorded in ScheduleOverrides.
+	Start             string             `json:"start"`
+	DurationMinutes   int                `json:"durationMinutes"`
+	End               string             `json:"end"`
+	ScheduleOverrides []ScheduleOverride `json:"scheduleOverrides,omitempty"`
+
+	// Priority sets the SLA target the maintenance is due by: DueDate
+	// defaults to Start plus the resolution hours of the priority.
+	// OverdueAt and EscalatedAt record when it was found overdue and
+	// escalated to planners, and are set by the server.
+	Priority    string `json:"priority"`
+	DueDate     string `json:"dueDate"`
+	Overdue     bool   `json:"overdue"`
+	OverdueAt   string `json:"overdueAt,omitempty"`
+	EscalatedAt string `json:"escalatedAt,omitempty"`
+
+	// RequestID is the maintenance request the maintenance was converted
+	// from, if any.
+	RequestID string `json:"requestId,omitempty"`
+
+	// Warnings lists the used parts that are not in the BOM of the
+	// machine's model. They are set by the server and not stored.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// ExternalCost is the cost of services bought from third parties.
+	ExternalCost float64 `json:"externalCost"`
+
+	// Breakdown timestamps (RFC 3339), recorded for corrective maintenances
+	// and used by the reliability report.
+	FailureStart string `json:"failureStart,omitempty"`
+	RepairStart  string `json:"repairStart,omitempty"`
+	RepairEnd    string `json:"repairEnd,omitempty"`
+
+	// Who created, started, completed and last edited the maintenance, and
+	// when (RFC 3339). They are set by the server.
+	CreatedBy   string `json:"createdBy,omitempty"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+	StartedBy   string `json:"startedBy,omitempty"`
+	StartedAt   string `json:"startedAt,omitempty"`
+	CompletedBy string `json:"completedBy,omitempty"`
+	CompletedAt string `json:"completedAt,omitempty"`
+	UpdatedBy   string `json:"updatedBy,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
 }
 
-// UsedStockItem represents a stock item used in a maintenance.
-type UsedStockItem struct {
-	StockID  string `json:"stockId"`
-	Quantity int    `json:"quantity"`
-}
+const (
+	maintenanceTypePreventive = "preventive"
+	maintenanceTypeCorrective = "corrective"
 
-var (
-	db    *sql.DB
-	mutex = &sync.Mutex{}
+	maintenanceStatusScheduled  = "scheduled"
+	maintenanceStatusInProgress = "in_progress"
+	maintenanceStatusCompleted  = "Completed"
 )
 
+// UsedStockItem represents a stock item used in a maintenance. Items are
+// reserved while the maintenance is open and issued from stock when it is
+// completed. UnitCost is the value of the item when it was issued and is set
+// by the server.
+type UsedStockItem struct {
+	StockID  string  `json:"stockId"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit"` // defaults to the stock unit; stored converted to it
+	UnitCost float64 `json:"unitCost"`
+	Issued   bool    `json:"issued"`
+
+	// Location the goods are drawn from. When empty, the location holding
+	// the most of the item is used.
+	StockLocation
+
+	// Lots or serial numbers used, required for tracked items once issued.
+	Lots []LotQuantity `json:"lots,omitempty"`
+}
+
 func main() {
-	var err error
-	db, err = sql.Open("sqlite3", "./m4chinemind.db")
+	err := openTenants(setupDatabase)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer closeTenants()
+
+	allowQuantityEdits = envBool("ALLOW_STOCK_QUANTITY_EDITS", true)
+	labelBaseURL = os.Getenv("LABEL_BASE_URL")
+	trustProxyHeaders = envBool("TRUST_PROXY_HEADERS", false)
+	certificationWarningDays = envInt("CERTIFICATION_WARNING_DAYS", certificationWarningDays)
+	accessTokenTTL = envDuration("ACCESS_TOKEN_TTL", accessTokenTTL)
+	refreshTokenTTL = envDuration("REFRESH_TOKEN_TTL", refreshTokenTTL)
+	defaultMaintenanceDuration = envDuration("MAINTENANCE_DEFAULT_DURATION", defaultMaintenanceDuration)
+	calendarBaseURL = os.Getenv("CALENDAR_BASE_URL")
+	maxAttachmentBytes = int64(envInt("ATTACHMENT_MAX_BYTES", int(maxAttachmentBytes)))
+	if types := os.Getenv("ATTACHMENT_CONTENT_TYPES"); types != "" {
+		attachmentContentTypes = strings.Split(strings.ReplaceAll(types, " ", ""), ",")
+	}
+	if attachmentStore, err = newAttachmentStorage(); err != nil {
+		log.Fatalf("Failed to set up attachment storage: %v", err)
+	}
+	forEachTenant(func(t *Tenant) {
+		seedRoles(t.db)
+		seedAdminUser(t)
+	})
+
+	startLowStockMonitor(envDuration("LOW_STOCK_CHECK_INTERVAL", 15*time.Minute))
+	startCertificationMonitor(envDuration("CERTIFICATION_CHECK_INTERVAL", 24*time.Hour))
+	startOverdueMonitor(envDuration("OVERDUE_CHECK_INTERVAL", 15*time.Minute))
 
-	createTables()
+	log.Println("Server starting on port 8080...")
+	if err := http.ListenAndServe(":8080", newRouter()); err != nil {
+		log.Fatalf("Could not start server: %s\n", err)
+	}
+}
 
+// newRouter returns the API routes behind the CORS, tenant, authentication
+// and audit middleware.
+func newRouter() http.Handler {
 	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/", authHandler)
+	mux.HandleFunc("/api/users", usersHandler)
+	mux.HandleFunc("/api/users/", userHandler)
+	mux.HandleFunc("/api/roles", rolesHandler)
+	mux.HandleFunc("/api/roles/", roleHandler)
+	mux.HandleFunc("/api/permissions", getPermissions)
+	mux.HandleFunc("/api/audit", auditHandler)
+	mux.HandleFunc("/api/audit/", auditHandler)
 	mux.HandleFunc("/api/machines", machinesHandler)
 	mux.HandleFunc("/api/machines/", machineHandler)
+	mux.HandleFunc("/api/assets", assetsHandler)
+	mux.HandleFunc("/api/assets/", assetHandler)
 	mux.HandleFunc("/api/stock", stockHandler)
 	mux.HandleFunc("/api/stock/", stockItemHandler)
+	mux.HandleFunc("/api/stock/replenishment", getStockReplenishment)
+	mux.HandleFunc("/api/stock/alerts", getStockAlerts)
+	mux.HandleFunc("/api/stock/transfers", createStockTransfer)
+	mux.HandleFunc("/api/stock/trace", getLotTrace)
+	mux.HandleFunc("/api/units", unitsHandler)
+	mux.HandleFunc("/api/units/", unitHandler)
+	mux.HandleFunc("/api/labels/", labelsHandler)
+	mux.HandleFunc("/api/scan", scanHandler)
+	mux.HandleFunc("/api/warehouses", warehousesHandler)
+	mux.HandleFunc("/api/warehouses/", warehouseHandler)
+	mux.HandleFunc("/api/counts", countSessionsHandler)
+	mux.HandleFunc("/api/counts/", countSessionHandler)
+	mux.HandleFunc("/api/notifications", notificationsHandler)
+	mux.HandleFunc("/api/notifications/", notificationHandler)
+	mux.HandleFunc("/api/suppliers", suppliersHandler)
+	mux.HandleFunc("/api/suppliers/", supplierHandler)
+	mux.HandleFunc("/api/purchase-orders", purchaseOrdersHandler)
+	mux.HandleFunc("/api/purchase-orders/", purchaseOrderHandler)
 	mux.HandleFunc("/api/operators", operatorsHandler)
 	mux.HandleFunc("/api/operators/", operatorHandler)
+	mux.HandleFunc("/api/shifts", shiftsHandler)
+	mux.HandleFunc("/api/shifts/", shiftHandler)
+	mux.HandleFunc("/api/skills", skillsHandler)
+	mux.HandleFunc("/api/skills/", skillHandler)
+	mux.HandleFunc("/api/checklist-templates", checklistTemplatesHandler)
+	mux.HandleFunc("/api/checklist-templates/", checklistTemplateHandler)
+	mux.HandleFunc("/api/bom", bomItemsHandler)
+	mux.HandleFunc("/api/bom/", bomItemHandler)
+	mux.HandleFunc("/api/sla-targets", slaTargetsHandler)
+	mux.HandleFunc("/api/sla-targets/", slaTargetHandler)
+	mux.HandleFunc("/api/maintenance-requests", maintenanceRequestsHandler)
+	mux.HandleFunc("/api/maintenance-requests/", maintenanceRequestHandler)
 	mux.HandleFunc("/api/maintenance", maintenanceRootHandler)
 	mux.HandleFunc("/api/maintenance/", maintenanceIdHandler)
 	mux.HandleFunc("/api/reports/", reportsHandler)
+	mux.HandleFunc("/api/workload", getWorkload)
+	mux.HandleFunc("/api/attachments/", getAttachment)
+	mux.HandleFunc("/api/calendar/", calendarHandler)
 
 	// Rota para marcar manutenção como concluída
 	mux.HandleFunc("/api/maintenances/", func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/complete") {
+		if strings.Contains(r.URL.Path, "/labor/") {
+			laborTimerHandler(w, r)
+		} else if strings.Contains(r.URL.Path, "/checklist") {
+			checklistHandler(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/complete") {
 			completeMaintenanceHandler(w, r)
+		} else if strings.HasSuffix(r.URL.Path, "/start") {
+			startMaintenanceHandler(w, r)
 		} else {
 			maintenanceIdHandler(w, r)
 		}
 	})
 
-	handler := corsMiddleware(mux)
+	return corsMiddleware(tenantMiddleware(authMiddleware(auditMiddleware(mux))))
+}
 
-	log.Println("Server starting on port 8080...")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
-	}
+// setupDatabase creates the tables of a new database, upgrades those of an
+// existing one and seeds what they lack.
+func setupDatabase(db *sql.DB) {
+	createTables(db)
+	seedOpeningBalances(db)
+	seedCostLayers(db)
+	seedStockLevels(db)
+	seedUnits(db)
 }
 
-func createTables() {
+func createTables(db *sql.DB) {
 	createOperatorsTable := `
 	CREATE TABLE IF NOT EXISTS operators (
 		id TEXT PRIMARY KEY,
@@ -116,6 +327,8 @@ func createTables() {
 	if err != nil {
 		log.Fatalf("Failed to create operators table: %v", err)
 	}
+	addColumnIfMissing(db, "operators", "hourlyRate", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "operators", "userId", "TEXT NOT NULL DEFAULT ''")
 
 	createMachinesTable := `
 	CREATE TABLE IF NOT EXISTS machines (
@@ -129,6 +342,11 @@ func createTables() {
 	if err != nil {
 		log.Fatalf("Failed to create machines table: %v", err)
 	}
+	addColumnIfMissing(db, "machines", "model", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "machines", "manufacturer", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "machines", "year", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "machines", "updatedBy", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "machines", "updatedAt", "TEXT NOT NULL DEFAULT ''")
 
 	createSensorsTable := `
 	CREATE TABLE IF NOT EXISTS sensors (
@@ -147,7 +365,7 @@ func createTables() {
 	CREATE TABLE IF NOT EXISTS stock (
 		id TEXT PRIMARY KEY,
 		name TEXT,
-		quantity INTEGER,
+		quantity REAL,
 		unit TEXT,
 		value REAL,
 		location TEXT
@@ -156,6 +374,48 @@ func createTables() {
 	if err != nil {
 		log.Fatalf("Failed to create stock table: %v", err)
 	}
+	addColumnIfMissing(db, "stock", "valuationMethod", "TEXT NOT NULL DEFAULT 'average'")
+	addColumnIfMissing(db, "stock", "minLevel", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "stock", "reorderPoint", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "stock", "reorderQuantity", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "stock", "tracking", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "stock", "purchaseUnit", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "stock", "purchaseFactor", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "stock", "updatedBy", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "stock", "updatedAt", "TEXT NOT NULL DEFAULT ''")
+
+	createUnitsTable := `
+	CREATE TABLE IF NOT EXISTS units (
+		code TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		dimension TEXT NOT NULL DEFAULT '',
+		factor REAL NOT NULL DEFAULT 1
+	);`
+	_, err = db.Exec(createUnitsTable)
+	if err != nil {
+		log.Fatalf("Failed to create units table: %v", err)
+	}
+
+	createStockMovementsTable := `
+	CREATE TABLE IF NOT EXISTS stock_movements (
+		id TEXT PRIMARY KEY,
+		stockId TEXT,
+		date TEXT,
+		type TEXT,
+		quantity REAL,
+		unitCost REAL,
+		reference TEXT,
+		maintenanceId TEXT,
+		FOREIGN KEY(stockId) REFERENCES stock(id)
+	);`
+	_, err = db.Exec(createStockMovementsTable)
+	if err != nil {
+		log.Fatalf("Failed to create stock_movements table: %v", err)
+	}
+	addColumnIfMissing(db, "stock_movements", "purchaseOrderId", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "stock_movements", "warehouseId", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "stock_movements", "binId", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "stock_movements", "userId", "TEXT NOT NULL DEFAULT ''")
 
 	createMaintenanceTable := `
 	CREATE TABLE IF NOT EXISTS maintenance (
@@ -170,12 +430,20 @@ func createTables() {
 	if err != nil {
 		log.Fatalf("Failed to create maintenance table: %v", err)
 	}
+	addColumnIfMissing(db, "maintenance", "type", "TEXT NOT NULL DEFAULT 'preventive'")
+	addColumnIfMissing(db, "maintenance", "failureStart", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance", "repairStart", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance", "repairEnd", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance", "externalCost", "REAL NOT NULL DEFAULT 0")
+	for _, column := range []string{"createdBy", "createdAt", "startedBy", "startedAt", "completedBy", "completedAt", "updatedBy", "updatedAt"} {
+		addColumnIfMissing(db, "maintenance", column, "TEXT NOT NULL DEFAULT ''")
+	}
 
 	createMaintenanceStockTable := `
 	CREATE TABLE IF NOT EXISTS maintenance_stock (
 		maintenanceId TEXT,
 		stockId TEXT,
-		quantity INTEGER,
+		quantity REAL,
 		PRIMARY KEY(maintenanceId, stockId),
 		FOREIGN KEY(maintenanceId) REFERENCES maintenance(id),
 		FOREIGN KEY(stockId) REFERENCES stock(id)
@@ -184,13 +452,789 @@ func createTables() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Lines recorded before reservations existed were taken out of stock when
+	// the maintenance was created.
+	addColumnIfMissing(db, "maintenance_stock", "issued", "INTEGER NOT NULL DEFAULT 1")
+	addColumnIfMissing(db, "maintenance_stock", "warehouseId", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance_stock", "binId", "TEXT NOT NULL DEFAULT ''")
+	if addColumnIfMissing(db, "maintenance_stock", "unitCost", "REAL NOT NULL DEFAULT 0") {
+		// Best effort for lines recorded before costs were snapshotted.
+		_, err = db.Exec("UPDATE maintenance_stock SET unitCost = COALESCE((SELECT value FROM stock WHERE stock.id = maintenance_stock.stockId), 0)")
+		if err != nil {
+			log.Fatalf("Failed to backfill maintenance stock costs: %v", err)
+		}
+	}
+
+	createMaintenanceLaborTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_labor (
+		id TEXT PRIMARY KEY,
+		maintenanceId TEXT,
+		operatorId TEXT,
+		hours REAL,
+		rate REAL,
+		FOREIGN KEY(maintenanceId) REFERENCES maintenance(id),
+		FOREIGN KEY(operatorId) REFERENCES operators(id)
+	);`
+	_, err = db.Exec(createMaintenanceLaborTable)
+	if err != nil {
+		log.Fatalf("Failed to create maintenance_labor table: %v", err)
+	}
+	addColumnIfMissing(db, "maintenance_labor", "startedAt", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance_labor", "stoppedAt", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance", "estimatedHours", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "maintenance", "checklistTemplateId", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance", "scheduledStart", "TEXT NOT NULL DEFAULT ''")
+	if addColumnIfMissing(db, "maintenance", "durationMinutes", "INTEGER NOT NULL DEFAULT 0") {
+		// Existing maintenances start at their date and last their estimate
+		_, err = db.Exec("UPDATE maintenance SET scheduledStart = date, durationMinutes = CASE WHEN estimatedHours > 0 THEN CAST(round(estimatedHours * 60) AS INTEGER) ELSE 60 END")
+		if err != nil {
+			log.Fatalf("Failed to backfill maintenance schedules: %v", err)
+		}
+	}
+
+	createScheduleOverridesTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_schedule_overrides (
+		id TEXT PRIMARY KEY,
+		maintenanceId TEXT NOT NULL,
+		conflicts TEXT NOT NULL,
+		forcedBy TEXT NOT NULL DEFAULT '',
+		forcedAt TEXT NOT NULL,
+		FOREIGN KEY(maintenanceId) REFERENCES maintenance(id)
+	);`
+	_, err = db.Exec(createScheduleOverridesTable)
+	if err != nil {
+		log.Fatalf("Failed to create maintenance_schedule_overrides table: %v", err)
+	}
+
+	createMaintenanceAssigneesTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_assignees (
+		maintenanceId TEXT NOT NULL,
+		operatorId TEXT NOT NULL,
+		PRIMARY KEY (maintenanceId, operatorId),
+		FOREIGN KEY(maintenanceId) REFERENCES maintenance(id),
+		FOREIGN KEY(operatorId) REFERENCES operators(id)
+	);`
+	_, err = db.Exec(createMaintenanceAssigneesTable)
+	if err != nil {
+		log.Fatalf("Failed to create maintenance_assignees table: %v", err)
+	}
+
+	createNotificationsTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id TEXT PRIMARY KEY,
+		kind TEXT,
+		severity TEXT,
+		entityType TEXT,
+		entityId TEXT,
+		message TEXT,
+		audience TEXT,
+		createdAt TEXT,
+		readAt TEXT,
+		resolvedAt TEXT
+	);`
+	_, err = db.Exec(createNotificationsTable)
+	if err != nil {
+		log.Fatalf("Failed to create notifications table: %v", err)
+	}
+
+	createSuppliersTable := `
+	CREATE TABLE IF NOT EXISTS suppliers (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		contact TEXT,
+		email TEXT,
+		phone TEXT,
+		leadTimeDays INTEGER NOT NULL DEFAULT 0
+	);`
+	_, err = db.Exec(createSuppliersTable)
+	if err != nil {
+		log.Fatalf("Failed to create suppliers table: %v", err)
+	}
+
+	createSupplierItemsTable := `
+	CREATE TABLE IF NOT EXISTS supplier_items (
+		supplierId TEXT,
+		stockId TEXT,
+		supplierSku TEXT,
+		unitPrice REAL NOT NULL DEFAULT 0,
+		leadTimeDays INTEGER NOT NULL DEFAULT 0,
+		preferred INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (supplierId, stockId),
+		FOREIGN KEY (supplierId) REFERENCES suppliers(id),
+		FOREIGN KEY (stockId) REFERENCES stock(id)
+	);`
+	_, err = db.Exec(createSupplierItemsTable)
+	if err != nil {
+		log.Fatalf("Failed to create supplier_items table: %v", err)
+	}
+
+	createPurchaseOrdersTable := `
+	CREATE TABLE IF NOT EXISTS purchase_orders (
+		id TEXT PRIMARY KEY,
+		supplierId TEXT,
+		status TEXT,
+		createdAt TEXT,
+		sentAt TEXT,
+		expectedDate TEXT,
+		notes TEXT,
+		FOREIGN KEY (supplierId) REFERENCES suppliers(id)
+	);`
+	_, err = db.Exec(createPurchaseOrdersTable)
+	if err != nil {
+		log.Fatalf("Failed to create purchase_orders table: %v", err)
+	}
+
+	createPurchaseOrderLinesTable := `
+	CREATE TABLE IF NOT EXISTS purchase_order_lines (
+		id TEXT PRIMARY KEY,
+		orderId TEXT,
+		stockId TEXT,
+		quantity REAL,
+		unitPrice REAL NOT NULL DEFAULT 0,
+		receivedQuantity REAL NOT NULL DEFAULT 0,
+		FOREIGN KEY (orderId) REFERENCES purchase_orders(id),
+		FOREIGN KEY (stockId) REFERENCES stock(id)
+	);`
+	_, err = db.Exec(createPurchaseOrderLinesTable)
+	if err != nil {
+		log.Fatalf("Failed to create purchase_order_lines table: %v", err)
+	}
+	addColumnIfMissing(db, "purchase_order_lines", "unit", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "purchase_order_lines", "unitFactor", "REAL NOT NULL DEFAULT 1")
+
+	createWarehousesTable := `
+	CREATE TABLE IF NOT EXISTS warehouses (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		address TEXT
+	);`
+	_, err = db.Exec(createWarehousesTable)
+	if err != nil {
+		log.Fatalf("Failed to create warehouses table: %v", err)
+	}
+
+	createBinsTable := `
+	CREATE TABLE IF NOT EXISTS bins (
+		id TEXT PRIMARY KEY,
+		warehouseId TEXT,
+		code TEXT,
+		description TEXT,
+		FOREIGN KEY (warehouseId) REFERENCES warehouses(id)
+	);`
+	_, err = db.Exec(createBinsTable)
+	if err != nil {
+		log.Fatalf("Failed to create bins table: %v", err)
+	}
+
+	// Quantity of each stock item per location. stock.quantity is kept as
+	// the total over all locations. binId is '' for stock kept directly in a
+	// warehouse.
+	createStockLevelsTable := `
+	CREATE TABLE IF NOT EXISTS stock_levels (
+		stockId TEXT,
+		warehouseId TEXT,
+		binId TEXT NOT NULL DEFAULT '',
+		quantity REAL NOT NULL DEFAULT 0,
+		PRIMARY KEY (stockId, warehouseId, binId),
+		FOREIGN KEY (stockId) REFERENCES stock(id),
+		FOREIGN KEY (warehouseId) REFERENCES warehouses(id)
+	);`
+	_, err = db.Exec(createStockLevelsTable)
+	if err != nil {
+		log.Fatalf("Failed to create stock_levels table: %v", err)
+	}
+
+	createStockLotsTable := `
+	CREATE TABLE IF NOT EXISTS stock_lots (
+		stockId TEXT,
+		lot TEXT,
+		quantity REAL NOT NULL DEFAULT 0,
+		firstReceived TEXT,
+		PRIMARY KEY (stockId, lot),
+		FOREIGN KEY (stockId) REFERENCES stock(id)
+	);`
+	_, err = db.Exec(createStockLotsTable)
+	if err != nil {
+		log.Fatalf("Failed to create stock_lots table: %v", err)
+	}
+
+	createMovementLotsTable := `
+	CREATE TABLE IF NOT EXISTS movement_lots (
+		movementId TEXT,
+		lot TEXT,
+		quantity REAL,
+		FOREIGN KEY (movementId) REFERENCES stock_movements(id)
+	);`
+	_, err = db.Exec(createMovementLotsTable)
+	if err != nil {
+		log.Fatalf("Failed to create movement_lots table: %v", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_movement_lots_lot ON movement_lots(lot)")
+	if err != nil {
+		log.Fatalf("Failed to create movement_lots index: %v", err)
+	}
+
+	createMaintenanceStockLotsTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_stock_lots (
+		maintenanceId TEXT,
+		stockId TEXT,
+		lot TEXT,
+		quantity REAL,
+		FOREIGN KEY (maintenanceId) REFERENCES maintenance(id),
+		FOREIGN KEY (stockId) REFERENCES stock(id)
+	);`
+	_, err = db.Exec(createMaintenanceStockLotsTable)
+	if err != nil {
+		log.Fatalf("Failed to create maintenance_stock_lots table: %v", err)
+	}
+
+	createCountSessionsTable := `
+	CREATE TABLE IF NOT EXISTS count_sessions (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		status TEXT,
+		warehouseId TEXT,
+		binId TEXT,
+		createdAt TEXT,
+		submittedAt TEXT,
+		approvedAt TEXT,
+		reason TEXT,
+		FOREIGN KEY (warehouseId) REFERENCES warehouses(id)
+	);`
+	_, err = db.Exec(createCountSessionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create count_sessions table: %v", err)
+	}
+
+	// counted is NULL until the line has been counted
+	createCountLinesTable := `
+	CREATE TABLE IF NOT EXISTS count_lines (
+		id TEXT PRIMARY KEY,
+		sessionId TEXT,
+		stockId TEXT,
+		warehouseId TEXT,
+		binId TEXT,
+		expected REAL,
+		counted REAL,
+		reason TEXT,
+		FOREIGN KEY (sessionId) REFERENCES count_sessions(id),
+		FOREIGN KEY (stockId) REFERENCES stock(id)
+	);`
+	_, err = db.Exec(createCountLinesTable)
+	if err != nil {
+		log.Fatalf("Failed to create count_lines table: %v", err)
+	}
+
+	createCountLineLotsTable := `
+	CREATE TABLE IF NOT EXISTS count_line_lots (
+		lineId TEXT,
+		lot TEXT,
+		quantity REAL,
+		FOREIGN KEY (lineId) REFERENCES count_lines(id)
+	);`
+	_, err = db.Exec(createCountLineLotsTable)
+	if err != nil {
+		log.Fatalf("Failed to create count_line_lots table: %v", err)
+	}
+
+	createUsersTable := `
+	CREATE TABLE IF NOT EXISTS users (
+		id TEXT PRIMARY KEY,
+		username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		passwordHash TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT '',
+		active INTEGER NOT NULL DEFAULT 1,
+		createdAt TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createUsersTable)
+	if err != nil {
+		log.Fatalf("Failed to create users table: %v", err)
+	}
+	// Accounts created before roles existed had full access
+	if addColumnIfMissing(db, "users", "role", "TEXT NOT NULL DEFAULT 'operator'") {
+		if _, err := db.Exec("UPDATE users SET role = 'admin'"); err != nil {
+			log.Fatalf("Failed to migrate user roles: %v", err)
+		}
+	}
+
+	createRolesTable := `
+	CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createRolesTable)
+	if err != nil {
+		log.Fatalf("Failed to create roles table: %v", err)
+	}
+
+	createRolePermissionsTable := `
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role, permission),
+		FOREIGN KEY (role) REFERENCES roles(name)
+	);`
+	_, err = db.Exec(createRolePermissionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create role_permissions table: %v", err)
+	}
+
+	createSessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		userId TEXT NOT NULL,
+		accessHash TEXT NOT NULL UNIQUE,
+		accessExpires TEXT NOT NULL,
+		refreshHash TEXT NOT NULL UNIQUE,
+		refreshExpires TEXT NOT NULL,
+		createdAt TEXT NOT NULL,
+		revokedAt TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (userId) REFERENCES users(id)
+	);`
+	_, err = db.Exec(createSessionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create sessions table: %v", err)
+	}
+
+	// The audit log is append-only: the triggers reject any change to an
+	// entry, and the hash chain reveals changes made around them.
+	createAuditLogTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		seq INTEGER PRIMARY KEY,
+		id TEXT NOT NULL UNIQUE,
+		timestamp TEXT NOT NULL,
+		actorId TEXT NOT NULL DEFAULT '',
+		actorName TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		entityType TEXT NOT NULL,
+		entityId TEXT NOT NULL DEFAULT '',
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		requestId TEXT NOT NULL DEFAULT '',
+		clientIp TEXT NOT NULL DEFAULT '',
+		before TEXT NOT NULL DEFAULT 'null',
+		after TEXT NOT NULL DEFAULT 'null',
+		prevHash TEXT NOT NULL DEFAULT '',
+		hash TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_entity ON audit_log (entityType, entityId);
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log entries cannot be changed');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log entries cannot be deleted');
+	END;`
+	_, err = db.Exec(createAuditLogTable)
+	if err != nil {
+		log.Fatalf("Failed to create audit_log table: %v", err)
+	}
+
+	createShiftsTable := `
+	CREATE TABLE IF NOT EXISTS shifts (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		startTime TEXT NOT NULL,
+		endTime TEXT NOT NULL,
+		days TEXT NOT NULL DEFAULT '',
+		breakMinutes INTEGER NOT NULL DEFAULT 0
+	);`
+	_, err = db.Exec(createShiftsTable)
+	if err != nil {
+		log.Fatalf("Failed to create shifts table: %v", err)
+	}
+
+	createOperatorShiftsTable := `
+	CREATE TABLE IF NOT EXISTS operator_shifts (
+		id TEXT PRIMARY KEY,
+		operatorId TEXT NOT NULL,
+		shiftId TEXT NOT NULL,
+		validFrom TEXT NOT NULL,
+		validTo TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (operatorId) REFERENCES operators(id),
+		FOREIGN KEY (shiftId) REFERENCES shifts(id)
+	);`
+	_, err = db.Exec(createOperatorShiftsTable)
+	if err != nil {
+		log.Fatalf("Failed to create operator_shifts table: %v", err)
+	}
+
+	createCalendarExceptionsTable := `
+	CREATE TABLE IF NOT EXISTS calendar_exceptions (
+		id TEXT PRIMARY KEY,
+		operatorId TEXT NOT NULL,
+		date TEXT NOT NULL,
+		shiftId TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		UNIQUE (operatorId, date),
+		FOREIGN KEY (operatorId) REFERENCES operators(id)
+	);`
+	_, err = db.Exec(createCalendarExceptionsTable)
+	if err != nil {
+		log.Fatalf("Failed to create calendar_exceptions table: %v", err)
+	}
+
+	createSkillsTable := `
+	CREATE TABLE IF NOT EXISTS skills (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		machineModel TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createSkillsTable)
+	if err != nil {
+		log.Fatalf("Failed to create skills table: %v", err)
+	}
+
+	createCertificationsTable := `
+	CREATE TABLE IF NOT EXISTS certifications (
+		id TEXT PRIMARY KEY,
+		operatorId TEXT NOT NULL,
+		skillId TEXT NOT NULL,
+		issuedAt TEXT NOT NULL,
+		expiresAt TEXT NOT NULL DEFAULT '',
+		reference TEXT NOT NULL DEFAULT '',
+		UNIQUE (operatorId, skillId),
+		FOREIGN KEY (operatorId) REFERENCES operators(id),
+		FOREIGN KEY (skillId) REFERENCES skills(id)
+	);`
+	_, err = db.Exec(createCertificationsTable)
+	if err != nil {
+		log.Fatalf("Failed to create certifications table: %v", err)
+	}
+
+	createMachineSkillsTable := `
+	CREATE TABLE IF NOT EXISTS machine_skills (
+		machineId TEXT NOT NULL,
+		skillId TEXT NOT NULL,
+		PRIMARY KEY (machineId, skillId),
+		FOREIGN KEY (machineId) REFERENCES machines(id),
+		FOREIGN KEY (skillId) REFERENCES skills(id)
+	);`
+	_, err = db.Exec(createMachineSkillsTable)
+	if err != nil {
+		log.Fatalf("Failed to create machine_skills table: %v", err)
+	}
+
+	createChecklistTemplatesTable := `
+	CREATE TABLE IF NOT EXISTS checklist_templates (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		machineModel TEXT NOT NULL DEFAULT '',
+		maintenanceType TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createChecklistTemplatesTable)
+	if err != nil {
+		log.Fatalf("Failed to create checklist_templates table: %v", err)
+	}
+
+	createChecklistTemplateStepsTable := `
+	CREATE TABLE IF NOT EXISTS checklist_template_steps (
+		templateId TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		unit TEXT NOT NULL DEFAULT '',
+		min REAL,
+		max REAL,
+		optional INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (templateId, position),
+		FOREIGN KEY (templateId) REFERENCES checklist_templates(id)
+	);`
+	_, err = db.Exec(createChecklistTemplateStepsTable)
+	if err != nil {
+		log.Fatalf("Failed to create checklist_template_steps table: %v", err)
+	}
+
+	createMaintenanceChecklistItemsTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_checklist_items (
+		id TEXT PRIMARY KEY,
+		maintenanceId TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		unit TEXT NOT NULL DEFAULT '',
+		min REAL,
+		max REAL,
+		optional INTEGER NOT NULL DEFAULT 0,
+		result TEXT NOT NULL DEFAULT '',
+		value REAL,
+		note TEXT NOT NULL DEFAULT '',
+		completedBy TEXT NOT NULL DEFAULT '',
+		completedAt TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (maintenanceId) REFERENCES maintenance(id)
+	);`
+	_, err = db.Exec(createMaintenanceChecklistItemsTable)
+	if err != nil {
+		log.Fatalf("Failed to create maintenance_checklist_items table: %v", err)
+	}
+
+	createAttachmentsTable := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT PRIMARY KEY,
+		entityType TEXT NOT NULL,
+		entityId TEXT NOT NULL,
+		fileName TEXT NOT NULL,
+		contentType TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		uploadedBy TEXT NOT NULL DEFAULT '',
+		uploadedAt TEXT NOT NULL,
+		storageKey TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_entity ON attachments(entityType, entityId);`
+	_, err = db.Exec(createAttachmentsTable)
+	if err != nil {
+		log.Fatalf("Failed to create attachments table: %v", err)
+	}
+
+	createCalendarFeedsTable := `
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		id TEXT PRIMARY KEY,
+		userId TEXT NOT NULL,
+		name TEXT NOT NULL,
+		tokenHash TEXT NOT NULL UNIQUE,
+		createdAt TEXT NOT NULL,
+		lastUsedAt TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createCalendarFeedsTable)
+	if err != nil {
+		log.Fatalf("Failed to create calendar_feeds table: %v", err)
+	}
+
+	// calendar_imports remembers the UID of imported events, so that
+	// importing the same calendar again does not duplicate them.
+	createCalendarImportsTable := `
+	CREATE TABLE IF NOT EXISTS calendar_imports (
+		uid TEXT PRIMARY KEY,
+		maintenanceId TEXT NOT NULL,
+		importedBy TEXT NOT NULL DEFAULT '',
+		importedAt TEXT NOT NULL
+	);`
+	_, err = db.Exec(createCalendarImportsTable)
+	if err != nil {
+		log.Fatalf("Failed to create calendar_imports table: %v", err)
+	}
+
+	createSLATargetsTable := `
+	CREATE TABLE IF NOT EXISTS sla_targets (
+		priority TEXT PRIMARY KEY,
+		resolutionHours REAL NOT NULL,
+		escalateAfterHours REAL NOT NULL
+	);`
+	_, err = db.Exec(createSLATargetsTable)
+	if err != nil {
+		log.Fatalf("Failed to create sla_targets table: %v", err)
+	}
+	if err := seedSLATargets(db); err != nil {
+		log.Fatalf("Failed to seed SLA targets: %v", err)
+	}
+	addColumnIfMissing(db, "maintenance", "priority", "TEXT NOT NULL DEFAULT 'medium'")
+	addColumnIfMissing(db, "maintenance", "overdueAt", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "maintenance", "escalatedAt", "TEXT NOT NULL DEFAULT ''")
+	if addColumnIfMissing(db, "maintenance", "dueDate", "TEXT NOT NULL DEFAULT ''") {
+		// Existing maintenances are due by the target of their priority
+		_, err = db.Exec(`UPDATE maintenance SET dueDate = strftime('%Y-%m-%dT%H:%M:%SZ', scheduledStart,
+			'+' || (SELECT CAST(round(resolutionHours * 60) AS INTEGER) FROM sla_targets WHERE sla_targets.priority = maintenance.priority) || ' minutes')
+			WHERE scheduledStart != ''`)
+		if err != nil {
+			log.Fatalf("Failed to backfill maintenance due dates: %v", err)
+		}
+	}
+
+	createMaintenanceRequestsTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_requests (
+		id TEXT PRIMARY KEY,
+		machineId TEXT NOT NULL,
+		symptom TEXT NOT NULL,
+		severity TEXT NOT NULL,
+		observedAt TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		reportedBy TEXT NOT NULL,
+		reportedAt TEXT NOT NULL,
+		operatorId TEXT NOT NULL DEFAULT '',
+		triagedBy TEXT NOT NULL DEFAULT '',
+		triagedAt TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		maintenanceId TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createMaintenanceRequestsTable)
+	if err != nil {
+		log.Fatalf("Failed to create maintenance_requests table: %v", err)
+	}
+	addColumnIfMissing(db, "maintenance", "requestId", "TEXT NOT NULL DEFAULT ''")
+
+	createBOMItemsTable := `
+	CREATE TABLE IF NOT EXISTS bom_items (
+		id TEXT PRIMARY KEY,
+		model TEXT NOT NULL COLLATE NOCASE,
+		stockId TEXT NOT NULL,
+		maintenanceType TEXT NOT NULL DEFAULT '',
+		quantity REAL NOT NULL DEFAULT 0,
+		unit TEXT NOT NULL,
+		notes TEXT NOT NULL DEFAULT '',
+		UNIQUE(model, stockId, maintenanceType)
+	);`
+	_, err = db.Exec(createBOMItemsTable)
+	if err != nil {
+		log.Fatalf("Failed to create bom_items table: %v", err)
+	}
+
+	createAssetsTable := `
+	CREATE TABLE IF NOT EXISTS assets (
+		id TEXT PRIMARY KEY,
+		parentId TEXT NOT NULL DEFAULT '',
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		code TEXT NOT NULL DEFAULT ''
+	);`
+	_, err = db.Exec(createAssetsTable)
+	if err != nil {
+		log.Fatalf("Failed to create assets table: %v", err)
+	}
+	addColumnIfMissing(db, "machines", "lineId", "TEXT NOT NULL DEFAULT ''")
+
+	createStockCostLayersTable := `
+	CREATE TABLE IF NOT EXISTS stock_cost_layers (
+		stockId TEXT NOT NULL,
+		quantity REAL NOT NULL,
+		unitCost REAL NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_stock_cost_layers_stock ON stock_cost_layers(stockId);`
+	_, err = db.Exec(createStockCostLayersTable)
+	if err != nil {
+		log.Fatalf("Failed to create stock_cost_layers table: %v", err)
+	}
+
+	createSensorReadingsTable := `
+	CREATE TABLE IF NOT EXISTS sensor_readings (
+		id TEXT PRIMARY KEY,
+		sensorId TEXT NOT NULL,
+		value REAL NOT NULL,
+		unit TEXT NOT NULL DEFAULT '',
+		notes TEXT NOT NULL DEFAULT '',
+		readAt TEXT NOT NULL,
+		recordedBy TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(sensorId) REFERENCES sensors(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_sensor_readings_sensor ON sensor_readings(sensorId, readAt);`
+	_, err = db.Exec(createSensorReadingsTable)
+	if err != nil {
+		log.Fatalf("Failed to create sensor_readings table: %v", err)
+	}
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of
+// the schema and reports whether it had to be added. CREATE TABLE IF NOT
+// EXISTS leaves existing tables untouched, so new columns have to be added
+// explicitly.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) bool {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		log.Fatalf("Failed to inspect %s table: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			log.Fatalf("Failed to inspect %s table: %v", table, err)
+		}
+		if name == column {
+			return false
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		log.Fatalf("Failed to add column %s to %s table: %v", column, table, err)
+	}
+	return true
+}
+
+// envDuration reads a duration such as "15m" from the environment.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s %q, using %s", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// startMonitor runs check on each tenant now and then every interval,
+// logging its failures under name.
+func startMonitor(name string, interval time.Duration, check func(db *sql.DB) error) {
+	run := func() {
+		forEachTenant(func(t *Tenant) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if err := check(t.db); err != nil {
+				log.Printf("%s failed%s: %v", name, t.label(), err)
+			}
+		})
+	}
+
+	run()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			run()
+		}
+	}()
+}
+
+// envInt reads a non-negative integer from the environment.
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("Ignoring invalid %s %q, using %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// envBool reads a boolean environment variable such as "true" or "0",
+// falling back when it is unset or invalid.
+func envBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s %q, using %t", key, v, fallback)
+		return fallback
+	}
+	return b
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, "+tenantHeader)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -201,8 +1245,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 // Machine Handlers
 func machinesHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	switch r.Method {
 	case "GET":
 		listMachines(w, r)
@@ -214,10 +1258,28 @@ func machinesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func machineHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	db := tenantDB(r)
+	// Uploads and downloads take the lock only to read and write the
+	// database, not while the file is transferred
+	if strings.Contains(r.URL.Path, "/attachments") {
+		attachmentsHandler(w, r, "machine", strings.TrimPrefix(r.URL.Path, "/api/machines/"))
+		return
+	}
+
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	id := strings.TrimPrefix(r.URL.Path, "/api/machines/")
+	id, sensorID, bySensor := strings.Cut(id, "/sensors/") // Handle /sensors/{sensorId}/readings
+	if bySensor && !strings.HasSuffix(sensorID, "/readings") {
+		http.NotFound(w, r)
+		return
+	}
+	sensorID = strings.TrimSuffix(sensorID, "/readings")
 	id = strings.TrimSuffix(id, "/sensors") // Handle /sensors endpoint
+	id = strings.TrimSuffix(id, "/status")
+	id = strings.TrimSuffix(id, "/skills")
+	id = strings.TrimSuffix(id, "/qualified-operators")
+	id = strings.TrimSuffix(id, "/bom")
 
 	// Check if machine exists
 	var exists bool
@@ -231,6 +1293,11 @@ func machineHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if bySensor {
+		sensorReadingsHandler(w, r, id, sensorID)
+		return
+	}
+
 	if strings.HasSuffix(r.URL.Path, "/sensors") {
 		switch r.Method {
 		case "GET":
@@ -243,6 +1310,30 @@ func machineHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if strings.HasSuffix(r.URL.Path, "/skills") {
+		machineSkillsHandler(w, r, id)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/qualified-operators") {
+		getQualifiedOperators(w, r, id)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/bom") {
+		getMachineBOM(w, r, id)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/status") {
+		if r.Method == "PUT" {
+			updateMachineStatus(w, r, id)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		getMachine(w, r, id)
@@ -255,8 +1346,8 @@ func machineHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 func operatorsHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	switch r.Method {
 	case "GET":
 		listOperators(w, r)
@@ -268,9 +1359,11 @@ func operatorsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func operatorHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	id := strings.TrimPrefix(r.URL.Path, "/api/operators/")
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/operators/")
+	id, sub, _ := strings.Cut(path, "/")
 
 	// Check if operator exists
 	var exists bool
@@ -284,6 +1377,11 @@ func operatorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if sub != "" {
+		operatorSubHandler(w, r, id, sub)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		getOperator(w, r, id)
@@ -297,7 +1395,8 @@ func operatorHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func listOperators(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name FROM operators")
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT id, name, hourlyRate, userId FROM operators")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -307,7 +1406,7 @@ func listOperators(w http.ResponseWriter, r *http.Request) {
 	operators := []Operator{}
 	for rows.Next() {
 		var op Operator
-		if err := rows.Scan(&op.ID, &op.Name); err != nil {
+		if err := rows.Scan(&op.ID, &op.Name, &op.HourlyRate, &op.UserID); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -317,15 +1416,43 @@ func listOperators(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(operators)
 }
 
+// validateOperatorUser checks that the user an operator is linked to exists
+// and is not linked to another operator.
+func validateOperatorUser(q queryer, op Operator) (int, error) {
+	if op.UserID == "" {
+		return 0, nil
+	}
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", op.UserID).Scan(&exists); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !exists {
+		return http.StatusBadRequest, fmt.Errorf("unknown user %q", op.UserID)
+	}
+	var linked bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM operators WHERE userId = ? AND id != ?)", op.UserID, op.ID).Scan(&linked); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if linked {
+		return http.StatusConflict, fmt.Errorf("user %q is already linked to another operator", op.UserID)
+	}
+	return 0, nil
+}
+
 func createOperator(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	var op Operator
 	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	op.ID = uuid.New().String()
+	if status, err := validateOperatorUser(db, op); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	_, err := db.Exec("INSERT INTO operators (id, name) VALUES (?, ?)", op.ID, op.Name)
+	_, err := db.Exec("INSERT INTO operators (id, name, hourlyRate, userId) VALUES (?, ?, ?, ?)", op.ID, op.Name, op.HourlyRate, op.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -336,8 +1463,9 @@ func createOperator(w http.ResponseWriter, r *http.Request) {
 }
 
 func getOperator(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var op Operator
-	err := db.QueryRow("SELECT id, name FROM operators WHERE id = ?", id).Scan(&op.ID, &op.Name)
+	err := db.QueryRow("SELECT id, name, hourlyRate, userId FROM operators WHERE id = ?", id).Scan(&op.ID, &op.Name, &op.HourlyRate, &op.UserID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Operator not found", http.StatusNotFound)
@@ -346,28 +1474,41 @@ func getOperator(w http.ResponseWriter, r *http.Request, id string) {
 		}
 		return
 	}
+	if op.Shifts, err = loadShiftAssignments(db, id); err == nil {
+		op.Certifications, err = loadCertifications(db, id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(op)
 }
 
 func updateOperator(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var op Operator
 	if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	op.ID = id
+	if status, err := validateOperatorUser(db, op); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	_, err := db.Exec("UPDATE operators SET name = ? WHERE id = ?", op.Name, id)
+	_, err := db.Exec("UPDATE operators SET name = ?, hourlyRate = ?, userId = ? WHERE id = ?", op.Name, op.HourlyRate, op.UserID, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	op.ID = id
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(op)
 }
 
 func deleteOperator(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	// Optional: Unassign operator from any machines before deleting
 	_, err := db.Exec("UPDATE machines SET operatorId = NULL WHERE operatorId = ?", id)
 	if err != nil {
@@ -375,6 +1516,25 @@ func deleteOperator(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
+	// Their shifts, calendar, certifications and assignments go with them
+	certs, err := loadCertifications(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, c := range certs {
+		if err := resolveNotification(db, notificationCertificationExpiring, c.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, table := range []string{"operator_shifts", "calendar_exceptions", "certifications", "maintenance_assignees"} {
+		if _, err := db.Exec("DELETE FROM "+table+" WHERE operatorId = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	_, err = db.Exec("DELETE FROM operators WHERE id = ?", id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -384,7 +1544,8 @@ func deleteOperator(w http.ResponseWriter, r *http.Request, id string) {
 }
 
 func listMachines(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name, status, operatorId FROM machines")
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT id, name, model, manufacturer, year, status, operatorId, lineId, updatedBy, updatedAt FROM machines")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -395,7 +1556,7 @@ func listMachines(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var m Machine
 		var operatorID sql.NullString
-		if err := rows.Scan(&m.ID, &m.Name, &m.Status, &operatorID); err != nil {
+		if err := rows.Scan(&m.ID, &m.Name, &m.Model, &m.Manufacturer, &m.Year, &m.Status, &operatorID, &m.LineID, &m.UpdatedBy, &m.UpdatedAt); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -404,14 +1565,12 @@ func listMachines(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Check for maintenance today
-		var maintenanceCount int
-		today := time.Now().Format("2006-01-02")
-		err := db.QueryRow("SELECT COUNT(*) FROM maintenance WHERE machineId = ? AND date = ?", m.ID, today).Scan(&maintenanceCount)
+		inMaintenance, err := bookedToday(db, m.ID, time.Now())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if maintenanceCount > 0 {
+		if inMaintenance {
 			m.Status = "Em manutenção"
 		}
 
@@ -440,12 +1599,24 @@ func listMachines(w http.ResponseWriter, r *http.Request) {
 }
 
 func createMachine(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	var m Machine
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	m.ID = uuid.New().String()
+	m.UpdatedBy, m.UpdatedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+	if m.OperatorID != "" {
+		if status, err := validateOperatorQualified(db, m.OperatorID, "", m.Model, m.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	if err := validateMachineLine(db, m.LineID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -453,7 +1624,7 @@ func createMachine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.Exec("INSERT INTO machines (id, name, status, operatorId) VALUES (?, ?, ?, ?)", m.ID, m.Name, m.Status, m.OperatorID)
+	_, err = tx.Exec("INSERT INTO machines (id, name, model, manufacturer, year, status, operatorId, lineId, updatedBy, updatedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", m.ID, m.Name, m.Model, m.Manufacturer, m.Year, m.Status, m.OperatorID, m.LineID, m.UpdatedBy, m.UpdatedAt)
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -481,9 +1652,10 @@ func createMachine(w http.ResponseWriter, r *http.Request) {
 }
 
 func getMachine(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var m Machine
 	var operatorID sql.NullString
-	err := db.QueryRow("SELECT id, name, status, operatorId FROM machines WHERE id = ?", id).Scan(&m.ID, &m.Name, &m.Status, &operatorID)
+	err := db.QueryRow("SELECT id, name, model, manufacturer, year, status, operatorId, lineId, updatedBy, updatedAt FROM machines WHERE id = ?", id).Scan(&m.ID, &m.Name, &m.Model, &m.Manufacturer, &m.Year, &m.Status, &operatorID, &m.LineID, &m.UpdatedBy, &m.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Machine not found", http.StatusNotFound)
@@ -497,14 +1669,12 @@ func getMachine(w http.ResponseWriter, r *http.Request, id string) {
 	}
 
 	// Check for maintenance today
-	var maintenanceCount int
-	today := time.Now().Format("2006-01-02")
-	err = db.QueryRow("SELECT COUNT(*) FROM maintenance WHERE machineId = ? AND date = ?", m.ID, today).Scan(&maintenanceCount)
+	inMaintenance, err := bookedToday(db, m.ID, time.Now())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if maintenanceCount > 0 {
+	if inMaintenance {
 		m.Status = "Em manutenção"
 	}
 
@@ -531,11 +1701,19 @@ func getMachine(w http.ResponseWriter, r *http.Request, id string) {
 }
 
 func updateMachine(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var m Machine
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	m.UpdatedBy, m.UpdatedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+	if m.OperatorID != "" {
+		if status, err := validateOperatorQualified(db, m.OperatorID, id, m.Model, m.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -543,13 +1721,20 @@ func updateMachine(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
-	_, err = tx.Exec("UPDATE machines SET name = ?, status = ?, operatorId = ? WHERE id = ?", m.Name, m.Status, m.OperatorID, id)
+	_, err = tx.Exec("UPDATE machines SET name = ?, model = ?, manufacturer = ?, year = ?, status = ?, operatorId = ?, updatedBy = ?, updatedAt = ? WHERE id = ?", m.Name, m.Model, m.Manufacturer, m.Year, m.Status, m.OperatorID, m.UpdatedBy, m.UpdatedAt, id)
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The machine stays where it is in the asset tree
+	if err := tx.QueryRow("SELECT lineId FROM machines WHERE id = ?", id).Scan(&m.LineID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	_, err = tx.Exec("DELETE FROM sensors WHERE machineId = ?", id)
 	if err != nil {
 		tx.Rollback()
@@ -577,14 +1762,57 @@ func updateMachine(w http.ResponseWriter, r *http.Request, id string) {
 	json.NewEncoder(w).Encode(m)
 }
 
+// updateMachineStatus serves PUT /api/machines/{id}/status, letting operators
+// report the status of a machine without editing the rest of it.
+func updateMachineStatus(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Status) == "" {
+		http.Error(w, "status is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE machines SET status = ?, updatedBy = ?, updatedAt = ? WHERE id = ?", req.Status, actorID(r), time.Now().UTC().Format(time.RFC3339), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	getMachine(w, r, id)
+}
+
 func deleteMachine(w http.ResponseWriter, r *http.Request, id string) {
-	// First, delete associated sensors
+	db := tenantDB(r)
+	// First, delete associated sensors and their readings
+	if err := deleteSensorReadings(db, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	_, err := db.Exec("DELETE FROM sensors WHERE machineId = ?", id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if _, err := db.Exec("DELETE FROM machine_skills WHERE machineId = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeAttachments(db, "machine", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := deleteAssetSubtree(db, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Then, delete the machine
 	_, err = db.Exec("DELETE FROM machines WHERE id = ?", id)
 	if err != nil {
@@ -595,6 +1823,7 @@ func deleteMachine(w http.ResponseWriter, r *http.Request, id string) {
 }
 
 func getMachineSensors(w http.ResponseWriter, r *http.Request, machineID string) {
+	db := tenantDB(r)
 	rows, err := db.Query("SELECT id, name, type FROM sensors WHERE machineId = ?", machineID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -616,6 +1845,7 @@ func getMachineSensors(w http.ResponseWriter, r *http.Request, machineID string)
 }
 
 func createMachineSensor(w http.ResponseWriter, r *http.Request, machineID string) {
+	db := tenantDB(r)
 	var s Sensor
 	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -633,7 +1863,32 @@ func createMachineSensor(w http.ResponseWriter, r *http.Request, machineID strin
 	json.NewEncoder(w).Encode(s)
 }
 
+// maintenanceColumns is the column list read by scanMaintenance.
+const maintenanceColumns = "id, machineId, date, description, status, type, failureStart, repairStart, repairEnd, externalCost, estimatedHours, checklistTemplateId, scheduledStart, durationMinutes, priority, dueDate, overdueAt, escalatedAt, requestId, createdBy, createdAt, startedBy, startedAt, completedBy, completedAt, updatedBy, updatedAt"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanMaintenance scans a row selected with maintenanceColumns.
+func scanMaintenance(row rowScanner, m *Maintenance) error {
+	err := row.Scan(&m.ID, &m.MachineID, &m.Date, &m.Description, &m.Status, &m.Type, &m.FailureStart, &m.RepairStart, &m.RepairEnd, &m.ExternalCost, &m.EstimatedHours, &m.ChecklistTemplateID,
+		&m.Start, &m.DurationMinutes, &m.Priority, &m.DueDate, &m.OverdueAt, &m.EscalatedAt, &m.RequestID, &m.CreatedBy, &m.CreatedAt, &m.StartedBy, &m.StartedAt, &m.CompletedBy, &m.CompletedAt, &m.UpdatedBy, &m.UpdatedAt)
+	m.End = maintenanceEnd(m.Start, m.DurationMinutes)
+	m.Overdue = isOverdue(m.Status, m.DueDate, time.Now())
+	return err
+}
+
 func getMaintenances(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	month := r.URL.Query().Get("month")
 	year := r.URL.Query().Get("year")
 
@@ -642,7 +1897,7 @@ func getMaintenances(w http.ResponseWriter, r *http.Request) {
 
 	if month != "" && year != "" {
 		query := `
-			SELECT id, machineId, date, description, status 
+			SELECT ` + maintenanceColumns + `
 			FROM maintenance 
 			WHERE strftime('%m', date) = ? AND strftime('%Y', date) = ?
 		`
@@ -650,7 +1905,7 @@ func getMaintenances(w http.ResponseWriter, r *http.Request) {
 		monthInt, _ := strconv.Atoi(month)
 		rows, err = db.Query(query, fmt.Sprintf("%02d", monthInt), year)
 	} else {
-		rows, err = db.Query("SELECT id, machineId, date, description, status FROM maintenance")
+		rows, err = db.Query("SELECT " + maintenanceColumns + " FROM maintenance")
 	}
 
 	if err != nil {
@@ -662,28 +1917,15 @@ func getMaintenances(w http.ResponseWriter, r *http.Request) {
 	maintenances := make([]Maintenance, 0)
 	for rows.Next() {
 		var m Maintenance
-		if err := rows.Scan(&m.ID, &m.MachineID, &m.Date, &m.Description, &m.Status); err != nil {
+		if err := scanMaintenance(rows, &m); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		stockRows, err := db.Query("SELECT stockId, quantity FROM maintenance_stock WHERE maintenanceId = ?", m.ID)
-		if err != nil {
+		if err := loadMaintenanceDetails(db, &m); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer stockRows.Close()
-
-		usedStock := make([]UsedStockItem, 0)
-		for stockRows.Next() {
-			var item UsedStockItem
-			if err := stockRows.Scan(&item.StockID, &item.Quantity); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			usedStock = append(usedStock, item)
-		}
-		m.UsedStock = usedStock
 
 		maintenances = append(maintenances, m)
 	}
@@ -704,7 +1946,12 @@ func maintenanceRootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func maintenanceIdHandler(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/maintenance/")
+	// Also served as /api/maintenances/{id}
+	id := strings.TrimPrefix(strings.Replace(r.URL.Path, "/api/maintenances/", "/api/maintenance/", 1), "/api/maintenance/")
+	if strings.Contains(id, "/attachments") {
+		attachmentsHandler(w, r, "maintenance", id)
+		return
+	}
 	if id == "" {
 		if r.Method == "GET" {
 			getMaintenances(w, r)
@@ -726,6 +1973,7 @@ func maintenanceIdHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func completeMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	if r.Method != http.MethodPatch {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -734,20 +1982,121 @@ func completeMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/maintenances/")
 	id := strings.TrimSuffix(path, "/complete")
 
-	stmt, err := db.Prepare("UPDATE maintenance SET status = ? WHERE id = ?")
+	var maint Maintenance
+	err := scanMaintenance(db.QueryRow("SELECT "+maintenanceColumns+" FROM maintenance WHERE id = ?", id), &maint)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Maintenance not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = loadMaintenanceDetails(db, &maint)
+	}
 	if err != nil {
-		log.Printf("Error preparing statement: %v", err)
+		log.Printf("Error loading maintenance: %v", err)
 		http.Error(w, "Failed to update maintenance status", http.StatusInternalServerError)
 		return
 	}
-	defer stmt.Close()
+	if maint.Status == maintenanceStatusCompleted {
+		http.Error(w, "The maintenance is already completed", http.StatusConflict)
+		return
+	}
+	if status, err := validateChecklistComplete(db, id); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	_, err = stmt.Exec("Completed", id)
+	userID := actorID(r)
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A corrective maintenance completed without an explicit repair end is
+	// considered repaired now, which ends its downtime. It only counts
+	// towards MTTR when its repair start is known, set by /start or by hand.
+	res, err := tx.Exec("UPDATE maintenance SET status = ?, repairEnd = CASE WHEN type = ? AND repairEnd = '' THEN ? ELSE repairEnd END, completedBy = ?, completedAt = ? WHERE id = ? AND status != ?", maintenanceStatusCompleted, maintenanceTypeCorrective, now, userID, now, id, maintenanceStatusCompleted)
 	if err != nil {
+		tx.Rollback()
 		log.Printf("Error executing statement: %v", err)
 		http.Error(w, "Failed to update maintenance status", http.StatusInternalServerError)
 		return
 	}
+	// Another request may have completed it since it was loaded
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		http.Error(w, "The maintenance is already completed", http.StatusConflict)
+		return
+	}
+
+	// Reserved stock is consumed when the maintenance is completed
+	if err := syncUsedStock(tx, userID, id, maint.UsedStock, true); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), stockErrorStatus(err))
+		return
+	}
+
+	// and labor timers still running are stopped
+	if err := stopRunningLabor(tx, id, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := resolveNotification(tx, notificationMaintenanceOverdue, id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startMaintenanceHandler serves PATCH /api/maintenances/{id}/start, putting
+// a scheduled maintenance in progress and recording who started it. The
+// repair of a corrective maintenance starts now unless it was already given.
+func startMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/maintenances/")
+	id := strings.TrimSuffix(path, "/start")
+
+	var maint Maintenance
+	err := scanMaintenance(db.QueryRow("SELECT "+maintenanceColumns+" FROM maintenance WHERE id = ?", id), &maint)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Maintenance not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if maint.Status == maintenanceStatusCompleted {
+		http.Error(w, "The maintenance is already completed", http.StatusConflict)
+		return
+	}
+	if maint.StartedAt != "" {
+		http.Error(w, "The maintenance was already started", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err = db.Exec("UPDATE maintenance SET status = ?, repairStart = CASE WHEN type = ? AND repairStart = '' THEN ? ELSE repairStart END, startedBy = ?, startedAt = ? WHERE id = ?", maintenanceStatusInProgress, maintenanceTypeCorrective, now, actorID(r), now, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -758,25 +2107,39 @@ func reportsHandler(w http.ResponseWriter, r *http.Request) {
 		getUsedStockReport(w, r)
 	} else if path == "/api/reports/scheduled-maintenances" {
 		getScheduledMaintenancesReport(w, r)
+	} else if path == "/api/reports/reliability" {
+		getReliabilityReport(w, r)
+	} else if path == "/api/reports/maintenance-costs" {
+		getMaintenanceCostReport(w, r)
+	} else if path == "/api/reports/inventory-valuation" {
+		getInventoryValuationReport(w, r)
+	} else if path == "/api/reports/expiring-certifications" {
+		getExpiringCertificationsReport(w, r)
+	} else if path == "/api/reports/overdue-maintenances" {
+		getOverdueReport(w, r)
+	} else if path == "/api/reports/pm-compliance" {
+		getPMComplianceReport(w, r)
 	} else {
 		http.NotFound(w, r)
 	}
 }
 
 func getUsedStockReport(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	month := r.URL.Query().Get("month")
 	year := r.URL.Query().Get("year")
 
 	query := `
-		SELECT s.name, ms.quantity, m.date
+		SELECT s.name, ms.quantity, s.unit, ms.unitCost, m.date
 		FROM maintenance_stock ms
 		JOIN stock s ON ms.stockId = s.id
 		JOIN maintenance m ON ms.maintenanceId = m.id
+		WHERE ms.issued = 1
 	`
 	args := []interface{}{}
 
 	if month != "" && year != "" {
-		query += " WHERE CAST(strftime('%m', m.date) AS INTEGER) = ? AND CAST(strftime('%Y', m.date) AS INTEGER) = ?"
+		query += " AND CAST(strftime('%m', m.date) AS INTEGER) = ? AND CAST(strftime('%Y', m.date) AS INTEGER) = ?"
 		args = append(args, month, year)
 	}
 
@@ -790,20 +2153,27 @@ func getUsedStockReport(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	report := make([]struct {
-		ItemName string `json:"itemName"`
-		Quantity int    `json:"quantity"`
-		Date     string `json:"date"`
+		ItemName  string  `json:"itemName"`
+		Quantity  float64 `json:"quantity"`
+		Unit      string  `json:"unit"`
+		UnitCost  float64 `json:"unitCost"`
+		TotalCost float64 `json:"totalCost"`
+		Date      string  `json:"date"`
 	}, 0)
 	for rows.Next() {
 		var item struct {
-			ItemName string `json:"itemName"`
-			Quantity int    `json:"quantity"`
-			Date     string `json:"date"`
+			ItemName  string  `json:"itemName"`
+			Quantity  float64 `json:"quantity"`
+			Unit      string  `json:"unit"`
+			UnitCost  float64 `json:"unitCost"`
+			TotalCost float64 `json:"totalCost"`
+			Date      string  `json:"date"`
 		}
-		if err := rows.Scan(&item.ItemName, &item.Quantity, &item.Date); err != nil {
+		if err := rows.Scan(&item.ItemName, &item.Quantity, &item.Unit, &item.UnitCost, &item.Date); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		item.TotalCost = item.Quantity * item.UnitCost
 		report = append(report, item)
 	}
 
@@ -812,6 +2182,7 @@ func getUsedStockReport(w http.ResponseWriter, r *http.Request) {
 }
 
 func getScheduledMaintenancesReport(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	month := r.URL.Query().Get("month")
 	year := r.URL.Query().Get("year")
 
@@ -819,7 +2190,7 @@ func getScheduledMaintenancesReport(w http.ResponseWriter, r *http.Request) {
 		SELECT maint.id, m.name, maint.date, maint.description
 		FROM maintenance maint
 		JOIN machines m ON maint.machineId = m.id
-		WHERE maint.status = 'scheduled'
+		WHERE maint.status IN ('scheduled', 'in_progress')
 	`
 	args := []interface{}{}
 
@@ -862,7 +2233,8 @@ func getScheduledMaintenancesReport(w http.ResponseWriter, r *http.Request) {
 }
 
 func listMaintenances(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, machineId, description, date, status FROM maintenance")
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT " + maintenanceColumns + " FROM maintenance")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -872,29 +2244,15 @@ func listMaintenances(w http.ResponseWriter, r *http.Request) {
 	maintenances := []Maintenance{}
 	for rows.Next() {
 		var m Maintenance
-		if err := rows.Scan(&m.ID, &m.MachineID, &m.Description, &m.Date, &m.Status); err != nil {
+		if err := scanMaintenance(rows, &m); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// Fetch used stock for each maintenance
-		stockRows, err := db.Query("SELECT stockId, quantity FROM maintenance_stock WHERE maintenanceId = ?", m.ID)
-		if err != nil {
+		// Fetch used stock and labor for each maintenance
+		if err := loadMaintenanceDetails(db, &m); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		usedStock := []UsedStockItem{}
-		for stockRows.Next() {
-			var item UsedStockItem
-			if err := stockRows.Scan(&item.StockID, &item.Quantity); err != nil {
-				stockRows.Close()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			usedStock = append(usedStock, item)
-		}
-		stockRows.Close()
-		m.UsedStock = usedStock
 		maintenances = append(maintenances, m)
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -902,6 +2260,7 @@ func listMaintenances(w http.ResponseWriter, r *http.Request) {
 }
 
 func reportUsedStock(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	rows, err := db.Query(`
 		SELECT si.name, usi.quantity, m.date 
 		FROM used_stock_items usi
@@ -915,9 +2274,9 @@ func reportUsedStock(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	type UsedStockReportItem struct {
-		ItemName string `json:"itemName"`
-		Quantity int    `json:"quantity"`
-		Date     string `json:"date"`
+		ItemName string  `json:"itemName"`
+		Quantity float64 `json:"quantity"`
+		Date     string  `json:"date"`
 	}
 
 	var report []UsedStockReportItem
@@ -935,6 +2294,7 @@ func reportUsedStock(w http.ResponseWriter, r *http.Request) {
 }
 
 func reportScheduledMaintenances(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	rows, err := db.Query(`
 		SELECT m.id, m.date, m.description, ma.name 
 		FROM maintenance m
@@ -968,78 +2328,120 @@ func reportScheduledMaintenances(w http.ResponseWriter, r *http.Request) {
 }
 
 func createMaintenance(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	var maint Maintenance
 	if err := json.NewDecoder(r.Body).Decode(&maint); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	maint.ID = uuid.New().String()
+	query := r.URL.Query()
+	templateID, status, err := prepareNewMaintenance(db, &maint, query.Get("prefillStock") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	maint.CreatedBy, maint.CreatedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
 
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	stmt, err := tx.Prepare("INSERT INTO maintenance(id, machineId, date, description, status) VALUES(?, ?, ?, ?, ?)")
+	conflicts, status, err := checkScheduleConflicts(tx, &maint, query.Get("force") == "true")
 	if err != nil {
 		tx.Rollback()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), status)
 		return
 	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(maint.ID, maint.MachineID, maint.Date, maint.Description, "scheduled")
-	if err != nil {
+	if err := insertMaintenance(tx, &maint, templateID, conflicts); err != nil {
 		tx.Rollback()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), stockErrorStatus(err))
 		return
 	}
 
-	if len(maint.UsedStock) > 0 {
-		stockStmt, err := tx.Prepare("INSERT INTO maintenance_stock(maintenanceId, stockId, quantity) VALUES(?, ?, ?)")
-		if err != nil {
-			tx.Rollback()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer stockStmt.Close()
+	tx.Commit()
 
-		for _, item := range maint.UsedStock {
-			_, err = stockStmt.Exec(maint.ID, item.StockID, item.Quantity)
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maint)
+}
 
-			// Update stock quantity
-			updateStockStmt, err := tx.Prepare("UPDATE stock SET quantity = quantity - ? WHERE id = ?")
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer updateStockStmt.Close()
+// prepareNewMaintenance validates a maintenance to create, fills its
+// defaults and finds its checklist template. With prefillStock, a
+// maintenance without used stock gets the typical parts of the BOM. The
+// bookings it conflicts with are checked when it is stored; see
+// checkScheduleConflicts.
+func prepareNewMaintenance(q queryer, maint *Maintenance, prefillStock bool) (string, int, error) {
+	if err := validateMaintenanceReliability(maint); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if err := validateMaintenanceLabor(maint); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	// Operators are checked against the date set from the start
+	if err := normalizeMaintenanceSchedule(maint); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if status, err := validateMaintenanceOperators(q, maint); err != nil {
+		return "", status, err
+	}
+	if err := normalizeMaintenanceSLA(q, maint); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	if err := applyBOM(q, maint, prefillStock); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	templateID, err := findChecklistTemplate(q, maint)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	maint.ID = uuid.New().String()
+	maint.Status = maintenanceStatusScheduled
+	return templateID, http.StatusOK, nil
+}
+
+// insertMaintenance stores a new, validated maintenance with its used stock,
+// labor, assignees and checklist, and records the conflicts it was forced
+// through.
+func insertMaintenance(tx *sql.Tx, maint *Maintenance, templateID string, conflicts []ScheduleConflict) error {
+	_, err := tx.Exec("INSERT INTO maintenance(id, machineId, date, description, status, type, failureStart, repairStart, repairEnd, externalCost, estimatedHours, scheduledStart, durationMinutes, priority, dueDate, requestId, createdBy, createdAt) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		maint.ID, maint.MachineID, maint.Date, maint.Description, maint.Status, maint.Type, maint.FailureStart, maint.RepairStart, maint.RepairEnd, maint.ExternalCost, maint.EstimatedHours, maint.Start, maint.DurationMinutes, maint.Priority, maint.DueDate, maint.RequestID, maint.CreatedBy, maint.CreatedAt)
+	if err != nil {
+		return err
+	}
 
-			_, err = updateStockStmt.Exec(item.Quantity, item.StockID)
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	// Reserve the used stock until the maintenance is completed
+	if err := syncUsedStock(tx, maint.CreatedBy, maint.ID, maint.UsedStock, false); err != nil {
+		return err
+	}
+	if err := insertLabor(tx, maint.ID, maint.Labor, nil); err != nil {
+		return err
+	}
+	if err := saveAssignees(tx, maint.ID, maint.Assignees); err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		if err := recordScheduleOverride(tx, maint.ID, maint.CreatedBy, conflicts); err != nil {
+			return err
+		}
+		if maint.ScheduleOverrides, err = loadScheduleOverrides(tx, maint.ID); err != nil {
+			return err
 		}
 	}
-
-	tx.Commit()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(maint)
+	if err := instantiateChecklist(tx, maint.ID, templateID); err != nil {
+		return err
+	}
+	maint.ChecklistTemplateID = templateID
+	maint.Overdue = isOverdue(maint.Status, maint.DueDate, time.Now())
+	maint.Checklist, err = loadChecklist(tx, maint.ID)
+	return err
 }
 
 func getMaintenance(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var maint Maintenance
-	err := db.QueryRow("SELECT id, machineId, date, description, status FROM maintenance WHERE id = ?", id).Scan(&maint.ID, &maint.MachineID, &maint.Date, &maint.Description, &maint.Status)
+	err := scanMaintenance(db.QueryRow("SELECT "+maintenanceColumns+" FROM maintenance WHERE id = ?", id), &maint)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.NotFound(w, r)
@@ -1049,70 +2451,150 @@ func getMaintenance(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
-	rows, err := db.Query("SELECT stockId, quantity FROM maintenance_stock WHERE maintenanceId = ?", id)
-	if err != nil {
+	if err := loadMaintenanceDetails(db, &maint); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var usedStock UsedStockItem
-		if err := rows.Scan(&usedStock.StockID, &usedStock.Quantity); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		maint.UsedStock = append(maint.UsedStock, usedStock)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(maint)
 }
 
 func updateMaintenance(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM maintenance WHERE id = ?)", id).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Maintenance not found", http.StatusNotFound)
+		return
+	}
 	var maint Maintenance
 	if err := json.NewDecoder(r.Body).Decode(&maint); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := validateMaintenanceReliability(&maint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateMaintenanceLabor(&maint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maint.ID = id
+	if err := normalizeMaintenanceSchedule(&maint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := validateMaintenanceOperators(db, &maint); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if maint.Status == maintenanceStatusCompleted {
+		if status, err := validateChecklistComplete(db, id); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	if err := normalizeMaintenanceSLA(db, &maint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applyBOM(db, &maint, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	conflicts, status, err := checkScheduleConflicts(tx, &maint, r.URL.Query().Get("force") == "true")
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	_, err = tx.Exec("UPDATE maintenance SET machineId = ?, date = ?, description = ?, status = ? WHERE id = ?", maint.MachineID, maint.Date, maint.Description, maint.Status, id)
+	laborRates, err := previousLaborRates(tx, id)
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	_, err = tx.Exec("DELETE FROM maintenance_stock WHERE maintenanceId = ?", id)
+	// Completing a maintenance through an edit is recorded like /complete
+	userID := actorID(r)
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err = tx.Exec(`UPDATE maintenance SET machineId = ?, date = ?, description = ?, status = ?, type = ?, failureStart = ?, repairStart = ?, repairEnd = ?, externalCost = ?, estimatedHours = ?, scheduledStart = ?, durationMinutes = ?, priority = ?, dueDate = ?,
+		completedBy = CASE WHEN ? = ? AND status != ? THEN ? ELSE completedBy END,
+		completedAt = CASE WHEN ? = ? AND status != ? THEN ? ELSE completedAt END,
+		updatedBy = ?, updatedAt = ? WHERE id = ?`,
+		maint.MachineID, maint.Date, maint.Description, maint.Status, maint.Type, maint.FailureStart, maint.RepairStart, maint.RepairEnd, maint.ExternalCost, maint.EstimatedHours, maint.Start, maint.DurationMinutes, maint.Priority, maint.DueDate,
+		maint.Status, maintenanceStatusCompleted, maintenanceStatusCompleted, userID,
+		maint.Status, maintenanceStatusCompleted, maintenanceStatusCompleted, now,
+		userID, now, id)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The checklist is kept; it is changed through /checklist
+	err = tx.QueryRow("SELECT checklistTemplateId, overdueAt, escalatedAt, requestId, createdBy, createdAt, startedBy, startedAt, completedBy, completedAt, updatedBy, updatedAt FROM maintenance WHERE id = ?", id).
+		Scan(&maint.ChecklistTemplateID, &maint.OverdueAt, &maint.EscalatedAt, &maint.RequestID, &maint.CreatedBy, &maint.CreatedAt, &maint.StartedBy, &maint.StartedAt, &maint.CompletedBy, &maint.CompletedAt, &maint.UpdatedBy, &maint.UpdatedAt)
+	if err == nil {
+		maint.Overdue = isOverdue(maint.Status, maint.DueDate, time.Now())
+		maint.Checklist, err = loadChecklist(tx, id)
+	}
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if len(maint.UsedStock) > 0 {
-		stockStmt, err := tx.Prepare("INSERT INTO maintenance_stock(maintenanceId, stockId, quantity) VALUES(?, ?, ?)")
-		if err != nil {
+	// Issue or return the difference in used stock
+	if err := syncUsedStock(tx, userID, id, maint.UsedStock, maint.Status == maintenanceStatusCompleted); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), stockErrorStatus(err))
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM maintenance_labor WHERE maintenanceId = ?", id)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := insertLabor(tx, id, maint.Labor, laborRates); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := saveAssignees(tx, id, maint.Assignees); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(conflicts) > 0 {
+		if err := recordScheduleOverride(tx, id, userID, conflicts); err != nil {
 			tx.Rollback()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer stockStmt.Close()
-
-		for _, item := range maint.UsedStock {
-			_, err = stockStmt.Exec(id, item.StockID, item.Quantity)
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
+	}
+	if maint.ScheduleOverrides, err = loadScheduleOverrides(tx, id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	tx.Commit()
@@ -1122,51 +2604,69 @@ func updateMaintenance(w http.ResponseWriter, r *http.Request, id string) {
 }
 
 func deleteMaintenance(w http.ResponseWriter, r *http.Request, id string) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Restore stock quantities
-	var usedStock []UsedStockItem
-	rows, err := tx.Query("SELECT stockId, quantity FROM maintenance_stock WHERE maintenanceId = ?", id)
+	// Restore stock quantities and delete from maintenance_stock
+	if err := syncUsedStock(tx, actorID(r), id, nil, false); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), stockErrorStatus(err))
+		return
+	}
+
+	// Delete from maintenance_labor
+	_, err = tx.Exec("DELETE FROM maintenance_labor WHERE maintenanceId = ?", id)
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	for rows.Next() {
-		var item UsedStockItem
-		if err := rows.Scan(&item.StockID, &item.Quantity); err != nil {
-			rows.Close()
-			tx.Rollback()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		usedStock = append(usedStock, item)
+
+	if err := saveAssignees(tx, id, nil); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	rows.Close()
 
-	for _, item := range usedStock {
-		_, err = tx.Exec("UPDATE stock SET quantity = quantity + ? WHERE id = ?", item.Quantity, item.StockID)
-		if err != nil {
-			tx.Rollback()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	_, err = tx.Exec("DELETE FROM maintenance_checklist_items WHERE maintenanceId = ?", id)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM maintenance_schedule_overrides WHERE maintenanceId = ?", id)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Delete from maintenance_stock
-	_, err = tx.Exec("DELETE FROM maintenance_stock WHERE maintenanceId = ?", id)
+	_, err = tx.Exec("DELETE FROM calendar_imports WHERE maintenanceId = ?", id)
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if err := resolveNotification(tx, notificationMaintenanceOverdue, id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := reopenMaintenanceRequest(tx, id); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Delete from maintenance
 	_, err = tx.Exec("DELETE FROM maintenance WHERE id = ?", id)
 	if err != nil {
@@ -1180,12 +2680,17 @@ func deleteMaintenance(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
+	if err := removeAttachments(db, "maintenance", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func stockHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
 	switch r.Method {
 	case "GET":
 		listStock(w, r)
@@ -1197,9 +2702,11 @@ func stockHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func stockItemHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	id := strings.TrimPrefix(r.URL.Path, "/api/stock/")
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/stock/")
+	id, sub, _ := strings.Cut(path, "/")
 
 	// Check if stock item exists
 	var exists bool
@@ -1213,6 +2720,27 @@ func stockItemHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch sub {
+	case "":
+	case "receipts":
+		if r.Method == "POST" {
+			createStockReceipt(w, r, id)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	case "movements":
+		if r.Method == "GET" {
+			listStockMovements(w, r, id)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		getStockItem(w, r, id)
@@ -1225,8 +2753,19 @@ func stockItemHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// stockColumns is the column list read by scanStockItem.
+const stockColumns = "id, name, quantity, unit, value, location, valuationMethod, minLevel, reorderPoint, reorderQuantity, tracking, purchaseUnit, purchaseFactor, updatedBy, updatedAt"
+
+// scanStockItem scans a row selected with stockColumns.
+func scanStockItem(row rowScanner, item *StockItem) error {
+	return row.Scan(&item.ID, &item.Name, &item.Quantity, &item.Unit, &item.Value, &item.Location, &item.ValuationMethod, &item.MinLevel, &item.ReorderPoint, &item.ReorderQuantity, &item.Tracking, &item.PurchaseUnit, &item.PurchaseFactor, &item.UpdatedBy, &item.UpdatedAt)
+}
+
+// listStock lists stock items with their total quantities, broken down by
+// location with ?breakdown=location.
 func listStock(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, name, quantity, unit, value, location FROM stock")
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT " + stockColumns + " FROM stock")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1234,28 +2773,93 @@ func listStock(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	stock := []StockItem{}
+	index := make(map[string]int)
 	for rows.Next() {
 		var item StockItem
-		if err := rows.Scan(&item.ID, &item.Name, &item.Quantity, &item.Unit, &item.Value, &item.Location); err != nil {
+		if err := scanStockItem(rows, &item); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		index[item.ID] = len(stock)
 		stock = append(stock, item)
 	}
+	rows.Close()
+
+	if r.URL.Query().Get("breakdown") == "location" {
+		levels, err := queryStockLevels(db, "1 = 1")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range stock {
+			stock[i].Levels = []StockLevel{}
+		}
+		for _, l := range levels {
+			if i, ok := index[l.StockID]; ok {
+				stock[i].Levels = append(stock[i].Levels, l)
+			}
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stock)
 }
 
 func createStockItem(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
 	var item StockItem
 	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if item.ValuationMethod == "" {
+		item.ValuationMethod = valuationAverage
+	}
+	if !validValuationMethod(item.ValuationMethod) {
+		http.Error(w, "valuationMethod must be fifo or average", http.StatusBadRequest)
+		return
+	}
+	if item.MinLevel < 0 || item.ReorderPoint < 0 || item.ReorderQuantity < 0 {
+		http.Error(w, "minLevel, reorderPoint and reorderQuantity cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if !validTracking(item.Tracking) {
+		http.Error(w, "tracking must be lot, serial or empty", http.StatusBadRequest)
+		return
+	}
+	if err := normalizeLots(item.Tracking, item.Quantity, item.Lots); item.Quantity != 0 && err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := resolveItemUnits(db, &item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	item.ID = uuid.New().String()
+	item.UpdatedBy, item.UpdatedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	_, err := db.Exec("INSERT INTO stock (id, name, quantity, unit, value, location) VALUES (?, ?, ?, ?, ?, ?)", item.ID, item.Name, item.Quantity, item.Unit, item.Value, item.Location)
+	// The initial quantity is recorded as an opening movement at the given value
+	_, err = tx.Exec("INSERT INTO stock (id, name, quantity, unit, value, location, valuationMethod, minLevel, reorderPoint, reorderQuantity, tracking, purchaseUnit, purchaseFactor, updatedBy, updatedAt) VALUES (?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", item.ID, item.Name, item.Unit, item.Value, item.Location, item.ValuationMethod, item.MinLevel, item.ReorderPoint, item.ReorderQuantity, item.Tracking, item.PurchaseUnit, item.PurchaseFactor, item.UpdatedBy, item.UpdatedAt)
 	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if item.Quantity != 0 {
+		err = postMovement(tx, &StockMovement{StockID: item.ID, Type: movementOpening, Quantity: item.Quantity, UnitCost: item.Value, Reference: "opening balance", Lots: item.Lots, UserID: item.UpdatedBy})
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), stockErrorStatus(err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -1265,8 +2869,9 @@ func createStockItem(w http.ResponseWriter, r *http.Request) {
 }
 
 func getStockItem(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var item StockItem
-	err := db.QueryRow("SELECT id, name, quantity, unit, value, location FROM stock WHERE id = ?", id).Scan(&item.ID, &item.Name, &item.Quantity, &item.Unit, &item.Value, &item.Location)
+	err := scanStockItem(db.QueryRow("SELECT "+stockColumns+" FROM stock WHERE id = ?", id), &item)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Stock item not found", http.StatusNotFound)
@@ -1275,19 +2880,113 @@ func getStockItem(w http.ResponseWriter, r *http.Request, id string) {
 		}
 		return
 	}
+	if r.URL.Query().Get("breakdown") == "location" {
+		if item.Levels, err = queryStockLevels(db, "sl.stockId = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if item.Tracking != trackingNone {
+		if item.Lots, err = loadStockLots(db, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(item)
 }
 
 func updateStockItem(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
 	var item StockItem
 	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if item.ValuationMethod == "" {
+		item.ValuationMethod = valuationAverage
+	}
+	if !validValuationMethod(item.ValuationMethod) {
+		http.Error(w, "valuationMethod must be fifo or average", http.StatusBadRequest)
+		return
+	}
+	if item.MinLevel < 0 || item.ReorderPoint < 0 || item.ReorderQuantity < 0 {
+		http.Error(w, "minLevel, reorderPoint and reorderQuantity cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if !validTracking(item.Tracking) {
+		http.Error(w, "tracking must be lot, serial or empty", http.StatusBadRequest)
+		return
+	}
+	if err := resolveItemUnits(db, &item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var quantity, value float64
+	var tracking, unit, valuationMethod string
+	if err := tx.QueryRow("SELECT quantity, value, tracking, unit, valuationMethod FROM stock WHERE id = ?", id).Scan(&quantity, &value, &tracking, &unit, &valuationMethod); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Lots are only known for stock received while the item was tracked
+	if item.Tracking != tracking && quantity != 0 {
+		tx.Rollback()
+		http.Error(w, "Tracking can only be changed while the item is out of stock", http.StatusConflict)
+		return
+	}
+	// The stock on hand was valued, and its issues costed, with the method
+	if item.ValuationMethod != valuationMethod && quantity != 0 {
+		tx.Rollback()
+		http.Error(w, "The valuation method can only be changed while the item is out of stock", http.StatusConflict)
+		return
+	}
+	// and its unit value is kept by the ledger
+	if quantity > 0 {
+		item.Value = value
+	}
+	// Quantities and costs on record are in the current stock unit
+	if item.Unit != unit && quantity != 0 {
+		tx.Rollback()
+		http.Error(w, "The stock unit can only be changed while the item is out of stock", http.StatusConflict)
+		return
+	}
+	if tracking != trackingNone && item.Quantity != quantity {
+		tx.Rollback()
+		http.Error(w, "The quantity of a lot or serial tracked item changes through receipts and issues only", http.StatusConflict)
+		return
+	}
+	if !allowQuantityEdits && item.Quantity != quantity {
+		tx.Rollback()
+		http.Error(w, "Quantities are corrected through count sessions (/api/counts)", http.StatusConflict)
+		return
+	}
 
-	_, err := db.Exec("UPDATE stock SET name = ?, quantity = ?, unit = ?, value = ?, location = ? WHERE id = ?", item.Name, item.Quantity, item.Unit, item.Value, item.Location, id)
+	item.UpdatedBy, item.UpdatedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+	_, err = tx.Exec("UPDATE stock SET name = ?, unit = ?, value = ?, location = ?, valuationMethod = ?, minLevel = ?, reorderPoint = ?, reorderQuantity = ?, tracking = ?, purchaseUnit = ?, purchaseFactor = ?, updatedBy = ?, updatedAt = ? WHERE id = ?", item.Name, item.Unit, item.Value, item.Location, item.ValuationMethod, item.MinLevel, item.ReorderPoint, item.ReorderQuantity, item.Tracking, item.PurchaseUnit, item.PurchaseFactor, item.UpdatedBy, item.UpdatedAt, id)
 	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Quantity changes are posted to the ledger as adjustments
+	if delta := item.Quantity - quantity; delta != 0 {
+		if err := adjustStock(tx, item.UpdatedBy, id, delta, "manual edit", StockLocation{}, nil); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), stockErrorStatus(err))
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -1296,8 +2995,30 @@ func updateStockItem(w http.ResponseWriter, r *http.Request, id string) {
 	json.NewEncoder(w).Encode(item)
 }
 
+// deleteStockItem deletes an item that was never moved. Items with stock or
+// a ledger history are kept, so that their movements keep pointing at them.
 func deleteStockItem(w http.ResponseWriter, r *http.Request, id string) {
-	_, err := db.Exec("DELETE FROM stock WHERE id = ?", id)
+	db := tenantDB(r)
+	var quantity float64
+	var moved bool
+	err := db.QueryRow("SELECT quantity, EXISTS(SELECT 1 FROM stock_movements WHERE stockId = stock.id) FROM stock WHERE id = ?", id).Scan(&quantity, &moved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !sameQuantity(quantity, 0) || moved {
+		http.Error(w, "Stock item has stock or movements and cannot be deleted", http.StatusConflict)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM stock_levels WHERE stockId = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM bom_items WHERE stockId = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("DELETE FROM stock WHERE id = ?", id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
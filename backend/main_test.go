@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testAdminPassword = "test-admin-secret"
+
+// The tests run with two tenants; those not about tenants use the first.
+const (
+	testTenant      = "plant-a"
+	testOtherTenant = "plant-b"
+)
+
+// testRouter serves the tests, set up by TestMain on the databases of a
+// temporary directory.
+var testRouter http.Handler
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "m4chinemind-test-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("ADMIN_PASSWORD", testAdminPassword)
+	os.Setenv("TENANTS", testTenant+","+testOtherTenant)
+	log.SetOutput(io.Discard)
+
+	if err := openTenants(setupDatabase); err != nil {
+		log.Fatal(err)
+	}
+	if attachmentStore, err = newAttachmentStorage(); err != nil {
+		log.Fatal(err)
+	}
+	forEachTenant(func(t *Tenant) {
+		seedRoles(t.db)
+		seedAdminUser(t)
+	})
+	testRouter = newRouter()
+
+	code := m.Run()
+	closeTenants()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testClient makes requests through testRouter as a user.
+type testClient struct {
+	t      *testing.T
+	tenant string
+	token  string
+}
+
+// signIn signs in to tenant as a user.
+func signIn(t *testing.T, tenant, username, password string) *testClient {
+	t.Helper()
+	c := &testClient{t: t, tenant: tenant}
+	rec := c.do("POST", "/api/auth/login", fmt.Sprintf(`{"username":%q,"password":%q}`, username, password))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login as %s: %d %s", username, rec.Code, rec.Body)
+	}
+	var tokens AuthTokens
+	if err := json.Unmarshal(rec.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	c.token = tokens.AccessToken
+	return c
+}
+
+func signInAdmin(t *testing.T, tenant string) *testClient {
+	return signIn(t, tenant, "admin", testAdminPassword)
+}
+
+// newUser creates a user with role and signs in as it.
+func (c *testClient) newUser(role string) *testClient {
+	c.t.Helper()
+	username := role + "-" + newTestID()
+	c.create("/api/users", fmt.Sprintf(`{"username":%q,"name":"Test user","role":%q,"active":true,"password":"password-123"}`, username, role))
+	return signIn(c.t, c.tenant, username, "password-123")
+}
+
+// db returns the database of the tenant of the client.
+func (c *testClient) db() *sql.DB {
+	return tenantsByID[c.tenant].db
+}
+
+func (c *testClient) request(method, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tenant != "" {
+		req.Header.Set(tenantHeader, c.tenant)
+	}
+	rec := httptest.NewRecorder()
+	testRouter.ServeHTTP(rec, req)
+	return rec
+}
+
+func (c *testClient) do(method, path, body string) *httptest.ResponseRecorder {
+	return c.request(method, path, strings.NewReader(body), "application/json")
+}
+
+// upload posts a file as a multipart form.
+func (c *testClient) upload(path, filename, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+	return c.request("POST", path, &body, form.FormDataContentType())
+}
+
+// create posts body to path, fails the test unless it succeeds and returns
+// the ID of what was created.
+func (c *testClient) create(path, body string) string {
+	c.t.Helper()
+	rec := c.do("POST", path, body)
+	return c.createdID(path, rec)
+}
+
+func (c *testClient) createdID(path string, rec *httptest.ResponseRecorder) string {
+	c.t.Helper()
+	if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		c.t.Fatalf("POST %s: %d %s", path, rec.Code, rec.Body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		c.t.Fatalf("POST %s: %v", path, err)
+	}
+	return created.ID
+}
+
+var testIDs int
+
+// newTestID returns a new suffix for unique names.
+func newTestID() string {
+	testIDs++
+	return fmt.Sprint(testIDs)
+}
+
+func TestCORSPreflightAllowsEveryMethod(t *testing.T) {
+	rec := (&testClient{t: t}).do("OPTIONS", "/api/maintenances/some-id/start", "")
+	allowed := rec.Header().Get("Access-Control-Allow-Methods")
+	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
+		if !strings.Contains(allowed, method) {
+			t.Errorf("Access-Control-Allow-Methods = %q, missing %s", allowed, method)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCompleteMaintenanceOnce(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	technician := admin.newUser(roleTechnician)
+	machine := admin.create("/api/machines", `{"name":"Completed press","status":"Operando","model":"CP-2"}`)
+	id := admin.create("/api/maintenance", `{"machineId":"`+machine+`","date":"2031-05-01","description":"Completed twice","durationMinutes":30}`)
+	completed := func() Maintenance {
+		rec := admin.do("GET", "/api/maintenance/"+id, "")
+		var m Maintenance
+		if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+			t.Fatalf("maintenance: %d %s", rec.Code, rec.Body)
+		}
+		return m
+	}
+
+	if rec := technician.do("PATCH", "/api/maintenances/"+id+"/complete", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("complete: %d %s", rec.Code, rec.Body)
+	}
+	first := completed()
+	if rec := admin.do("PATCH", "/api/maintenances/"+id+"/complete", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("complete again: %d %s, want 409", rec.Code, rec.Body)
+	}
+	if again := completed(); again.CompletedBy != first.CompletedBy || again.CompletedAt != first.CompletedAt {
+		t.Errorf("completed by %q at %q, then by %q at %q", first.CompletedBy, first.CompletedAt, again.CompletedBy, again.CompletedAt)
+	}
+}
+
+func TestUpdateUnknownMaintenance(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	machine := admin.create("/api/machines", `{"name":"Updated press","status":"Operando","model":"UP-2"}`)
+	rec := admin.do("PUT", "/api/maintenance/"+newTestID(), `{"machineId":"`+machine+`","date":"2031-05-01","description":"Unknown","durationMinutes":30}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("update of an unknown maintenance: %d %s, want 404", rec.Code, rec.Body)
+	}
+}
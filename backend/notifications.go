@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification is an alert raised by the system, such as a low-stock
+// warning. Open notifications are resolved automatically once the condition
+// that raised them no longer holds.
+type Notification struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	Severity   string `json:"severity"` // "info", "warning" or "critical"
+	EntityType string `json:"entityType"`
+	EntityID   string `json:"entityId"`
+	Message    string `json:"message"`
+	Audience   string `json:"audience,omitempty"` // role the notification is meant for
+	CreatedAt  string `json:"createdAt"`
+	ReadAt     string `json:"readAt,omitempty"`
+	ResolvedAt string `json:"resolvedAt,omitempty"`
+}
+
+const notificationColumns = "id, kind, severity, entityType, entityId, message, audience, createdAt, readAt, resolvedAt"
+
+func scanNotification(row rowScanner, n *Notification) error {
+	return row.Scan(&n.ID, &n.Kind, &n.Severity, &n.EntityType, &n.EntityID, &n.Message, &n.Audience, &n.CreatedAt, &n.ReadAt, &n.ResolvedAt)
+}
+
+// raiseNotification opens a notification for the entity, or refreshes the
+// severity and message of the one already open for the same kind.
+func raiseNotification(q queryer, n Notification) error {
+	var id string
+	err := q.QueryRow("SELECT id FROM notifications WHERE kind = ? AND entityId = ? AND resolvedAt = ''", n.Kind, n.EntityID).Scan(&id)
+	if err == nil {
+		_, err = q.Exec("UPDATE notifications SET severity = ?, message = ? WHERE id = ?", n.Severity, n.Message, id)
+		return err
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = q.Exec("INSERT INTO notifications ("+notificationColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', '')",
+		uuid.New().String(), n.Kind, n.Severity, n.EntityType, n.EntityID, n.Message, n.Audience, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// resolveNotification closes the open notification of the given kind for
+// the entity, if any.
+func resolveNotification(q queryer, kind, entityID string) error {
+	_, err := q.Exec("UPDATE notifications SET resolvedAt = ? WHERE kind = ? AND entityId = ? AND resolvedAt = ''", time.Now().UTC().Format(time.RFC3339), kind, entityID)
+	return err
+}
+
+// queryNotifications lists notifications, newest first. Only open ones are
+// returned unless includeResolved is set, and only those meant for everyone
+// or for the audience role when one is given.
+func queryNotifications(q queryer, kind string, includeResolved bool, audience string) ([]Notification, error) {
+	query := "SELECT " + notificationColumns + " FROM notifications WHERE 1 = 1"
+	args := []interface{}{}
+	if audience != "" {
+		query += " AND audience IN ('', ?)"
+		args = append(args, audience)
+	}
+	if kind != "" {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	if !includeResolved {
+		query += " AND resolvedAt = ''"
+	}
+	query += " ORDER BY createdAt DESC"
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := scanNotification(rows, &n); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	notifications, err := queryNotifications(db, r.URL.Query().Get("kind"), r.URL.Query().Get("status") == "all", notificationAudience(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// notificationAudience returns the role whose notifications the caller sees,
+// or "" for administrators, who see them all.
+func notificationAudience(r *http.Request) string {
+	u, _ := currentUser(r)
+	if u.Role == roleAdmin {
+		return ""
+	}
+	return u.Role
+}
+
+// notificationHandler serves POST /api/notifications/{id}/read.
+func notificationHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/notifications/")
+	id, sub, _ := strings.Cut(path, "/")
+	if sub != "read" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	audience := notificationAudience(r)
+	res, err := db.Exec("UPDATE notifications SET readAt = ? WHERE id = ? AND readAt = '' AND (? = '' OR audience IN ('', ?))", time.Now().UTC().Format(time.RFC3339), id, audience, audience)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM notifications WHERE id = ? AND (? = '' OR audience IN ('', ?)))", id, audience, audience).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,828 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Purchase order statuses. Orders are edited as drafts, sent to the
+// supplier, and received in one or more deliveries.
+const (
+	purchaseOrderDraft             = "draft"
+	purchaseOrderSent              = "sent"
+	purchaseOrderPartiallyReceived = "partially_received"
+	purchaseOrderReceived          = "received"
+	purchaseOrderCancelled         = "cancelled"
+)
+
+// Supplier is a company spare parts are bought from. LeadTimeDays is the
+// default delivery time for its items.
+type Supplier struct {
+	ID           string         `json:"id"`
+	Name         string         `json:"name"`
+	Contact      string         `json:"contact"`
+	Email        string         `json:"email"`
+	Phone        string         `json:"phone"`
+	LeadTimeDays int            `json:"leadTimeDays"`
+	Items        []SupplierItem `json:"items"`
+}
+
+// SupplierItem is the price and lead time of a stock item at a supplier. A
+// zero LeadTimeDays means the supplier's default applies.
+type SupplierItem struct {
+	StockID      string  `json:"stockId"`
+	SupplierSKU  string  `json:"supplierSku"`
+	UnitPrice    float64 `json:"unitPrice"`
+	LeadTimeDays int     `json:"leadTimeDays"`
+	Preferred    bool    `json:"preferred"`
+}
+
+type PurchaseOrder struct {
+	ID           string              `json:"id"`
+	SupplierID   string              `json:"supplierId"`
+	Status       string              `json:"status"`
+	CreatedAt    string              `json:"createdAt"`
+	SentAt       string              `json:"sentAt,omitempty"`
+	ExpectedDate string              `json:"expectedDate,omitempty"`
+	Notes        string              `json:"notes"`
+	Lines        []PurchaseOrderLine `json:"lines"`
+}
+
+// PurchaseOrderLine orders Quantity of a stock item in Unit, the item's
+// purchase unit unless given. UnitPrice and ReceivedQuantity are in the same
+// unit; UnitFactor is the number of stock units per ordered unit.
+type PurchaseOrderLine struct {
+	ID               string  `json:"id"`
+	StockID          string  `json:"stockId"`
+	Quantity         float64 `json:"quantity"`
+	Unit             string  `json:"unit"`
+	UnitFactor       float64 `json:"unitFactor"`
+	UnitPrice        float64 `json:"unitPrice"`
+	ReceivedQuantity float64 `json:"receivedQuantity"`
+}
+
+// PurchaseOrderReceipt is the body of POST /api/purchase-orders/{id}/receive.
+// UnitCost defaults to the line's unit price. The goods are put away at the
+// given location, if any.
+type PurchaseOrderReceipt struct {
+	Date      string `json:"date"`
+	Reference string `json:"reference"`
+	Lines     []struct {
+		LineID   string        `json:"lineId"`
+		Quantity float64       `json:"quantity"`
+		UnitCost *float64      `json:"unitCost"`
+		Lots     []LotQuantity `json:"lots"`
+	} `json:"lines"`
+
+	StockLocation
+}
+
+// Supplier handlers
+func suppliersHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listSuppliers(w, r)
+	case "POST":
+		createSupplier(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func supplierHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/api/suppliers/")
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM suppliers WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Supplier not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		getSupplier(w, r, id)
+	case "PUT":
+		updateSupplier(w, r, id)
+	case "DELETE":
+		deleteSupplier(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const supplierColumns = "id, name, contact, email, phone, leadTimeDays"
+
+func scanSupplier(row rowScanner, s *Supplier) error {
+	return row.Scan(&s.ID, &s.Name, &s.Contact, &s.Email, &s.Phone, &s.LeadTimeDays)
+}
+
+func loadSupplierItems(q queryer, s *Supplier) error {
+	rows, err := q.Query("SELECT stockId, supplierSku, unitPrice, leadTimeDays, preferred FROM supplier_items WHERE supplierId = ?", s.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.Items = []SupplierItem{}
+	for rows.Next() {
+		var item SupplierItem
+		if err := rows.Scan(&item.StockID, &item.SupplierSKU, &item.UnitPrice, &item.LeadTimeDays, &item.Preferred); err != nil {
+			return err
+		}
+		s.Items = append(s.Items, item)
+	}
+	return rows.Err()
+}
+
+// saveSupplierItems replaces the item list of a supplier. Marking an item as
+// preferred here clears the flag at the other suppliers of the same item.
+func saveSupplierItems(tx *sql.Tx, s *Supplier) error {
+	if _, err := tx.Exec("DELETE FROM supplier_items WHERE supplierId = ?", s.ID); err != nil {
+		return err
+	}
+	for _, item := range s.Items {
+		if item.UnitPrice < 0 || item.LeadTimeDays < 0 {
+			return errors.New("unitPrice and leadTimeDays cannot be negative")
+		}
+		if item.Preferred {
+			if _, err := tx.Exec("UPDATE supplier_items SET preferred = 0 WHERE stockId = ?", item.StockID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("INSERT INTO supplier_items (supplierId, stockId, supplierSku, unitPrice, leadTimeDays, preferred) VALUES (?, ?, ?, ?, ?, ?)",
+			s.ID, item.StockID, item.SupplierSKU, item.UnitPrice, item.LeadTimeDays, item.Preferred)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listSuppliers(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT " + supplierColumns + " FROM suppliers ORDER BY name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	suppliers := []Supplier{}
+	for rows.Next() {
+		var s Supplier
+		if err := scanSupplier(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		suppliers = append(suppliers, s)
+	}
+	rows.Close()
+
+	for i := range suppliers {
+		if err := loadSupplierItems(db, &suppliers[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suppliers)
+}
+
+func createSupplier(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var s Supplier
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.LeadTimeDays < 0 {
+		http.Error(w, "leadTimeDays cannot be negative", http.StatusBadRequest)
+		return
+	}
+	s.ID = uuid.New().String()
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO suppliers ("+supplierColumns+") VALUES (?, ?, ?, ?, ?, ?)", s.ID, s.Name, s.Contact, s.Email, s.Phone, s.LeadTimeDays)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveSupplierItems(tx, &s); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if s.Items == nil {
+		s.Items = []SupplierItem{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func getSupplier(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var s Supplier
+	err := scanSupplier(db.QueryRow("SELECT "+supplierColumns+" FROM suppliers WHERE id = ?", id), &s)
+	if err == nil {
+		err = loadSupplierItems(db, &s)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func updateSupplier(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var s Supplier
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.LeadTimeDays < 0 {
+		http.Error(w, "leadTimeDays cannot be negative", http.StatusBadRequest)
+		return
+	}
+	s.ID = id
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE suppliers SET name = ?, contact = ?, email = ?, phone = ?, leadTimeDays = ? WHERE id = ?", s.Name, s.Contact, s.Email, s.Phone, s.LeadTimeDays, id)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveSupplierItems(tx, &s); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if s.Items == nil {
+		s.Items = []SupplierItem{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func deleteSupplier(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var orders int
+	if err := db.QueryRow("SELECT COUNT(*) FROM purchase_orders WHERE supplierId = ?", id).Scan(&orders); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if orders > 0 {
+		http.Error(w, "Supplier has purchase orders and cannot be deleted", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM supplier_items WHERE supplierId = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM suppliers WHERE id = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Purchase order handlers
+func purchaseOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listPurchaseOrders(w, r)
+	case "POST":
+		createPurchaseOrder(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// purchaseOrderHandler serves /api/purchase-orders/{id} and the workflow
+// actions /send, /receive and /cancel.
+func purchaseOrderHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/purchase-orders/")
+	id, action, _ := strings.Cut(path, "/")
+
+	var po PurchaseOrder
+	err := loadPurchaseOrder(db, id, &po)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Purchase order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if action != "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch action {
+		case "send":
+			sendPurchaseOrder(w, r, &po)
+		case "receive":
+			receivePurchaseOrder(w, r, &po)
+		case "cancel":
+			cancelPurchaseOrder(w, r, &po)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(po)
+	case "PUT":
+		updatePurchaseOrder(w, r, &po)
+	case "DELETE":
+		deletePurchaseOrder(w, r, &po)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const purchaseOrderColumns = "id, supplierId, status, createdAt, sentAt, expectedDate, notes"
+
+func scanPurchaseOrder(row rowScanner, po *PurchaseOrder) error {
+	return row.Scan(&po.ID, &po.SupplierID, &po.Status, &po.CreatedAt, &po.SentAt, &po.ExpectedDate, &po.Notes)
+}
+
+func loadPurchaseOrderLines(q queryer, po *PurchaseOrder) error {
+	rows, err := q.Query("SELECT id, stockId, quantity, unit, unitFactor, unitPrice, receivedQuantity FROM purchase_order_lines WHERE orderId = ? ORDER BY rowid", po.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	po.Lines = []PurchaseOrderLine{}
+	for rows.Next() {
+		var line PurchaseOrderLine
+		if err := rows.Scan(&line.ID, &line.StockID, &line.Quantity, &line.Unit, &line.UnitFactor, &line.UnitPrice, &line.ReceivedQuantity); err != nil {
+			return err
+		}
+		po.Lines = append(po.Lines, line)
+	}
+	return rows.Err()
+}
+
+func loadPurchaseOrder(q queryer, id string, po *PurchaseOrder) error {
+	if err := scanPurchaseOrder(q.QueryRow("SELECT "+purchaseOrderColumns+" FROM purchase_orders WHERE id = ?", id), po); err != nil {
+		return err
+	}
+	return loadPurchaseOrderLines(q, po)
+}
+
+// savePurchaseOrderLines replaces the lines of a draft order. Lines without a
+// unit are ordered in the item's purchase unit, and lines without a unit price
+// use the supplier's price for the item (which is per purchase unit).
+func savePurchaseOrderLines(tx *sql.Tx, po *PurchaseOrder) error {
+	if _, err := tx.Exec("DELETE FROM purchase_order_lines WHERE orderId = ?", po.ID); err != nil {
+		return err
+	}
+	for i := range po.Lines {
+		line := &po.Lines[i]
+		if line.Quantity <= 0 {
+			return errors.New("line quantities must be positive")
+		}
+		var stockUnit, purchaseUnit string
+		err := tx.QueryRow("SELECT unit, purchaseUnit FROM stock WHERE id = ?", line.StockID).Scan(&stockUnit, &purchaseUnit)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("stock item %s not found", line.StockID)
+		}
+		if err != nil {
+			return err
+		}
+		if line.Unit == "" {
+			line.Unit = purchaseUnit
+		}
+		if line.Unit == "" {
+			line.Unit = stockUnit
+		}
+		if line.Unit, err = resolveUnit(tx, line.Unit); err != nil {
+			return err
+		}
+		if line.UnitFactor, err = stockUnitFactor(tx, line.StockID, line.Unit); err != nil {
+			return err
+		}
+		if line.UnitPrice == 0 && (line.Unit == purchaseUnit || (purchaseUnit == "" && line.Unit == stockUnit)) {
+			err := tx.QueryRow("SELECT unitPrice FROM supplier_items WHERE supplierId = ? AND stockId = ?", po.SupplierID, line.StockID).Scan(&line.UnitPrice)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		line.ID = uuid.New().String()
+		line.ReceivedQuantity = 0
+		_, err = tx.Exec("INSERT INTO purchase_order_lines (id, orderId, stockId, quantity, unit, unitFactor, unitPrice, receivedQuantity) VALUES (?, ?, ?, ?, ?, ?, ?, 0)",
+			line.ID, po.ID, line.StockID, line.Quantity, line.Unit, line.UnitFactor, line.UnitPrice)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listPurchaseOrders(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	query := "SELECT " + purchaseOrderColumns + " FROM purchase_orders WHERE 1 = 1"
+	args := []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if supplierID := r.URL.Query().Get("supplierId"); supplierID != "" {
+		query += " AND supplierId = ?"
+		args = append(args, supplierID)
+	}
+	query += " ORDER BY createdAt DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orders := []PurchaseOrder{}
+	for rows.Next() {
+		var po PurchaseOrder
+		if err := scanPurchaseOrder(rows, &po); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, po)
+	}
+	rows.Close()
+
+	for i := range orders {
+		if err := loadPurchaseOrderLines(db, &orders[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func createPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var po PurchaseOrder
+	if err := json.NewDecoder(r.Body).Decode(&po); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM suppliers WHERE id = ?)", po.SupplierID).Scan(&exists); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Supplier not found", http.StatusBadRequest)
+		return
+	}
+
+	po.ID = uuid.New().String()
+	po.Status = purchaseOrderDraft
+	po.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	po.SentAt = ""
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO purchase_orders ("+purchaseOrderColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)", po.ID, po.SupplierID, po.Status, po.CreatedAt, po.SentAt, po.ExpectedDate, po.Notes)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := savePurchaseOrderLines(tx, &po); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if po.Lines == nil {
+		po.Lines = []PurchaseOrderLine{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(po)
+}
+
+// updatePurchaseOrder edits a draft order. Orders that were sent can only be
+// received or cancelled.
+func updatePurchaseOrder(w http.ResponseWriter, r *http.Request, current *PurchaseOrder) {
+	db := tenantDB(r)
+	if current.Status != purchaseOrderDraft {
+		http.Error(w, "Only draft purchase orders can be edited", http.StatusConflict)
+		return
+	}
+
+	var po PurchaseOrder
+	if err := json.NewDecoder(r.Body).Decode(&po); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	po.ID = current.ID
+	po.Status = current.Status
+	po.CreatedAt = current.CreatedAt
+	if po.SupplierID == "" {
+		po.SupplierID = current.SupplierID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE purchase_orders SET supplierId = ?, expectedDate = ?, notes = ? WHERE id = ?", po.SupplierID, po.ExpectedDate, po.Notes, po.ID)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := savePurchaseOrderLines(tx, &po); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if po.Lines == nil {
+		po.Lines = []PurchaseOrderLine{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+func deletePurchaseOrder(w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	db := tenantDB(r)
+	if po.Status != purchaseOrderDraft {
+		http.Error(w, "Only draft purchase orders can be deleted", http.StatusConflict)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM purchase_order_lines WHERE orderId = ?", po.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM purchase_orders WHERE id = ?", po.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendPurchaseOrder marks a draft as sent to the supplier. Without an
+// expected date, delivery is expected after the longest lead time of its
+// items.
+func sendPurchaseOrder(w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	db := tenantDB(r)
+	if po.Status != purchaseOrderDraft {
+		http.Error(w, "Only draft purchase orders can be sent", http.StatusConflict)
+		return
+	}
+	if len(po.Lines) == 0 {
+		http.Error(w, "Purchase order has no lines", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	if po.ExpectedDate == "" {
+		var leadTime int
+		err := db.QueryRow(`
+			SELECT COALESCE(MAX(CASE WHEN si.leadTimeDays > 0 THEN si.leadTimeDays ELSE s.leadTimeDays END), s.leadTimeDays)
+			FROM suppliers s
+			LEFT JOIN supplier_items si ON si.supplierId = s.id
+				AND si.stockId IN (SELECT stockId FROM purchase_order_lines WHERE orderId = ?)
+			WHERE s.id = ?
+		`, po.ID, po.SupplierID).Scan(&leadTime)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		po.ExpectedDate = now.AddDate(0, 0, leadTime).Format("2006-01-02")
+	}
+	po.Status = purchaseOrderSent
+	po.SentAt = now.Format(time.RFC3339)
+
+	_, err := db.Exec("UPDATE purchase_orders SET status = ?, sentAt = ?, expectedDate = ? WHERE id = ?", po.Status, po.SentAt, po.ExpectedDate, po.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// receivePurchaseOrder books a delivery: each received quantity is added to
+// stock as a receipt at the line's cost, and the order becomes partially
+// received or received.
+func receivePurchaseOrder(w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	db := tenantDB(r)
+	if po.Status != purchaseOrderSent && po.Status != purchaseOrderPartiallyReceived {
+		http.Error(w, "Only sent purchase orders can be received", http.StatusConflict)
+		return
+	}
+
+	var receipt PurchaseOrderReceipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(receipt.Lines) == 0 {
+		http.Error(w, "No lines to receive", http.StatusBadRequest)
+		return
+	}
+	if receipt.Date != "" {
+		t, err := parseTimestamp(receipt.Date)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		receipt.Date = t.UTC().Format(time.RFC3339)
+	}
+	if receipt.WarehouseID != "" || receipt.BinID != "" {
+		if err := resolveLocation(db, "", &receipt.StockLocation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reference := receipt.Reference
+	if reference == "" {
+		reference = "PO " + po.ID
+	}
+
+	lines := make(map[string]*PurchaseOrderLine)
+	for i := range po.Lines {
+		lines[po.Lines[i].ID] = &po.Lines[i]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, received := range receipt.Lines {
+		line, ok := lines[received.LineID]
+		if !ok {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("line %s not found in purchase order", received.LineID), http.StatusBadRequest)
+			return
+		}
+		if received.Quantity <= 0 || line.ReceivedQuantity+received.Quantity > line.Quantity+quantityEpsilon {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("line %s: quantity must be positive and at most the %g %s still outstanding", line.ID, line.Quantity-line.ReceivedQuantity, line.Unit), http.StatusBadRequest)
+			return
+		}
+		// Prices and quantities are per ordered unit; stock is kept in the
+		// item's stock unit. Lots are always given in stock units.
+		factor := line.UnitFactor
+		if factor <= 0 {
+			factor = 1
+		}
+		unitCost := line.UnitPrice
+		if received.UnitCost != nil {
+			unitCost = *received.UnitCost
+		}
+		tracking, err := stockTracking(tx, line.StockID)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := normalizeLots(tracking, received.Quantity*factor, received.Lots); err != nil {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("line %s: %v", line.ID, err), http.StatusBadRequest)
+			return
+		}
+		if status, err := validateMovementDate(tx, line.StockID, receipt.Date); err != nil {
+			tx.Rollback()
+			http.Error(w, fmt.Sprintf("line %s: %v", line.ID, err), status)
+			return
+		}
+
+		err = postMovement(tx, &StockMovement{
+			StockID:         line.StockID,
+			Date:            receipt.Date,
+			Type:            movementReceipt,
+			Quantity:        received.Quantity * factor,
+			UnitCost:        unitCost / factor,
+			Reference:       reference,
+			PurchaseOrderID: po.ID,
+			StockLocation:   receipt.StockLocation,
+			Lots:            received.Lots,
+			UserID:          actorID(r),
+		})
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), stockErrorStatus(err))
+			return
+		}
+		line.ReceivedQuantity += received.Quantity
+		// Fractional receipts add up to the ordered quantity only roughly
+		if sameQuantity(line.ReceivedQuantity, line.Quantity) {
+			line.ReceivedQuantity = line.Quantity
+		}
+		if _, err := tx.Exec("UPDATE purchase_order_lines SET receivedQuantity = ? WHERE id = ?", line.ReceivedQuantity, line.ID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	po.Status = purchaseOrderReceived
+	for _, line := range po.Lines {
+		if line.ReceivedQuantity < line.Quantity && !sameQuantity(line.ReceivedQuantity, line.Quantity) {
+			po.Status = purchaseOrderPartiallyReceived
+			break
+		}
+	}
+	if _, err := tx.Exec("UPDATE purchase_orders SET status = ? WHERE id = ?", po.Status, po.ID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
+
+// cancelPurchaseOrder closes an order that will not be (fully) delivered.
+// Goods already received stay in stock.
+func cancelPurchaseOrder(w http.ResponseWriter, r *http.Request, po *PurchaseOrder) {
+	db := tenantDB(r)
+	if po.Status == purchaseOrderReceived || po.Status == purchaseOrderCancelled {
+		http.Error(w, "Purchase order is already closed", http.StatusConflict)
+		return
+	}
+	po.Status = purchaseOrderCancelled
+	if _, err := db.Exec("UPDATE purchase_orders SET status = ? WHERE id = ?", po.Status, po.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(po)
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Built-in roles. The admin role always holds every permission; the others
+// start with defaultRolePermissions and can be changed through /api/roles.
+const (
+	roleOperator   = "operator"
+	roleTechnician = "technician"
+	rolePlanner    = "planner"
+	roleAdmin      = "admin"
+)
+
+// Permissions checked by the route rules.
+const (
+	permMachinesRead        = "machines.read"
+	permMachinesStatus      = "machines.status"
+	permMachinesWrite       = "machines.write"
+	permMaintenanceRead     = "maintenance.read"
+	permMaintenanceSchedule = "maintenance.schedule"
+	permMaintenanceExecute  = "maintenance.execute"
+	permStockRead           = "stock.read"
+	permStockWrite          = "stock.write"
+	permOperatorsRead       = "operators.read"
+	permOperatorsWrite      = "operators.write"
+	permReportsRead         = "reports.read"
+	permNotificationsRead   = "notifications.read"
+	permLabelsRead          = "labels.read"
+	permUsersManage         = "users.manage"
+	permRolesManage         = "roles.manage"
+	permAuditRead           = "audit.read"
+)
+
+// permissionDescriptions lists every permission a role can hold.
+var permissionDescriptions = map[string]string{
+	permMachinesRead:        "View machines and sensors",
+	permMachinesStatus:      "Report the status and sensor readings of a machine",
+	permMachinesWrite:       "Create, edit and delete machines and sensors",
+	permMaintenanceRead:     "View maintenances",
+	permMaintenanceSchedule: "Schedule, edit, reschedule and delete maintenances",
+	permMaintenanceExecute:  "Start and complete maintenances, fill in their checklists and time their labor",
+	permStockRead:           "View stock, warehouses, suppliers and purchase orders",
+	permStockWrite:          "Manage stock, units, warehouses, counts, suppliers and purchase orders",
+	permOperatorsRead:       "View operators, their shifts and certifications",
+	permOperatorsWrite:      "Manage operators, shifts, skills and certifications",
+	permReportsRead:         "View reports",
+	permNotificationsRead:   "View and acknowledge notifications",
+	permLabelsRead:          "Print labels and resolve scanned codes",
+	permUsersManage:         "Manage user accounts",
+	permRolesManage:         "Manage roles and their permissions",
+	permAuditRead:           "View and verify the audit log",
+}
+
+var defaultRolePermissions = map[string][]string{
+	roleOperator: {permMachinesRead, permMachinesStatus, permLabelsRead},
+	roleTechnician: {permMachinesRead, permMachinesStatus, permMaintenanceRead, permMaintenanceExecute,
+		permStockRead, permOperatorsRead, permNotificationsRead, permLabelsRead},
+	rolePlanner: {permMachinesRead, permMaintenanceRead, permMaintenanceSchedule, permStockRead, permStockWrite,
+		permOperatorsRead, permReportsRead, permNotificationsRead, permLabelsRead},
+}
+
+// routeRule grants access to requests whose method and path match. methods
+// is a space separated list or "*"; in pattern, "*" matches one path segment
+// and a trailing "/..." any remainder. Any one of permissions suffices; a
+// rule without permissions admits every authenticated user.
+type routeRule struct {
+	methods     string
+	pattern     string
+	permissions []string
+}
+
+// routeRules are checked in order and the first match decides. Requests no
+// rule matches are denied to everyone but admins.
+var routeRules = []routeRule{
+	{"*", "/api/auth/...", nil},
+
+	{"*", "/api/users", []string{permUsersManage}},
+	{"*", "/api/users/...", []string{permUsersManage}},
+	{"*", "/api/roles", []string{permRolesManage}},
+	{"*", "/api/roles/...", []string{permRolesManage}},
+	{"GET", "/api/permissions", []string{permRolesManage}},
+	{"GET", "/api/audit", []string{permAuditRead}},
+	{"GET", "/api/audit/...", []string{permAuditRead}},
+
+	{"GET", "/api/machines", []string{permMachinesRead}},
+	{"GET", "/api/machines/...", []string{permMachinesRead}},
+	{"PUT", "/api/machines/*/status", []string{permMachinesStatus}},
+	{"POST", "/api/machines/*/sensors/*/readings", []string{permMachinesStatus}},
+	{"POST", "/api/machines/*/attachments", []string{permMachinesWrite, permMaintenanceExecute}},
+	{"POST PUT DELETE", "/api/machines", []string{permMachinesWrite}},
+	{"POST PUT DELETE", "/api/machines/...", []string{permMachinesWrite}},
+	{"GET", "/api/assets", []string{permMachinesRead}},
+	{"GET", "/api/assets/*", []string{permMachinesRead}},
+	{"POST", "/api/assets", []string{permMachinesWrite}},
+	{"PUT DELETE", "/api/assets/*", []string{permMachinesWrite}},
+	{"POST", "/api/assets/*/move", []string{permMachinesWrite}},
+
+	{"GET", "/api/maintenance", []string{permMaintenanceRead}},
+	{"GET", "/api/maintenance/...", []string{permMaintenanceRead}},
+	{"POST", "/api/maintenance", []string{permMaintenanceSchedule}},
+	{"PUT", "/api/maintenance/*", []string{permMaintenanceSchedule}},
+	{"DELETE", "/api/maintenance/*", []string{permMaintenanceSchedule}},
+	{"POST", "/api/maintenance/*/attachments", []string{permMaintenanceSchedule, permMaintenanceExecute}},
+	{"DELETE", "/api/maintenance/*/attachments/*", []string{permMaintenanceSchedule, permMaintenanceExecute}},
+	{"GET", "/api/attachments/*", nil}, // checked against what it is attached to
+	{"PATCH", "/api/maintenances/*/complete", []string{permMaintenanceExecute}},
+	{"PATCH", "/api/maintenances/*/start", []string{permMaintenanceExecute}},
+	{"POST", "/api/maintenances/*/labor/*", []string{permMaintenanceExecute}},
+	{"POST", "/api/maintenances/*/checklist", []string{permMaintenanceSchedule}},
+	{"PUT", "/api/maintenances/*/checklist/*", []string{permMaintenanceExecute}},
+	{"GET", "/api/checklist-templates", []string{permMaintenanceRead}},
+	{"GET", "/api/checklist-templates/...", []string{permMaintenanceRead}},
+	{"POST", "/api/checklist-templates", []string{permMaintenanceSchedule}},
+	{"PUT DELETE", "/api/checklist-templates/*", []string{permMaintenanceSchedule}},
+	{"GET", "/api/bom", []string{permStockRead, permMaintenanceRead}},
+	{"GET", "/api/bom/*", []string{permStockRead, permMaintenanceRead}},
+	{"POST", "/api/bom", []string{permMaintenanceSchedule, permStockWrite}},
+	{"PUT DELETE", "/api/bom/*", []string{permMaintenanceSchedule, permStockWrite}},
+	{"GET", "/api/workload", []string{permMaintenanceRead}},
+	{"GET POST", "/api/maintenance-requests", nil},
+	{"GET", "/api/maintenance-requests/*", nil},
+	{"POST", "/api/maintenance-requests/*/convert", []string{permMaintenanceSchedule}},
+	{"POST", "/api/maintenance-requests/*/reject", []string{permMaintenanceSchedule}},
+	{"GET POST", "/api/maintenance-requests/*/attachments", nil},
+	{"GET", "/api/maintenance-requests/*/attachments/*", nil},
+	{"DELETE", "/api/maintenance-requests/*/attachments/*", []string{permMaintenanceSchedule}},
+	{"GET", "/api/sla-targets", []string{permMaintenanceRead}},
+	{"GET", "/api/sla-targets/*", []string{permMaintenanceRead}},
+	{"PUT", "/api/sla-targets/*", []string{permMaintenanceSchedule}},
+	{"GET", "/api/calendar/maintenances.ics", []string{permMaintenanceRead}},
+	{"GET POST", "/api/calendar/feeds", []string{permMaintenanceRead}},
+	{"GET DELETE", "/api/calendar/feeds/*", []string{permMaintenanceRead}},
+	{"POST", "/api/calendar/import", []string{permMaintenanceSchedule}},
+	{"GET", "/api/maintenances/...", []string{permMaintenanceRead}},
+	{"PUT", "/api/maintenances/*", []string{permMaintenanceSchedule}},
+	{"DELETE", "/api/maintenances/*", []string{permMaintenanceSchedule}},
+
+	{"GET", "/api/stock", []string{permStockRead}},
+	{"GET", "/api/stock/...", []string{permStockRead}},
+	{"POST PUT DELETE", "/api/stock", []string{permStockWrite}},
+	{"POST PUT DELETE", "/api/stock/...", []string{permStockWrite}},
+	{"GET", "/api/units", []string{permStockRead}},
+	{"POST PUT DELETE", "/api/units", []string{permStockWrite}},
+	{"POST PUT DELETE", "/api/units/...", []string{permStockWrite}},
+	{"GET", "/api/warehouses", []string{permStockRead}},
+	{"GET", "/api/warehouses/...", []string{permStockRead}},
+	{"POST PUT DELETE", "/api/warehouses", []string{permStockWrite}},
+	{"POST PUT DELETE", "/api/warehouses/...", []string{permStockWrite}},
+	{"GET", "/api/counts", []string{permStockRead}},
+	{"GET", "/api/counts/...", []string{permStockRead}},
+	{"POST PUT DELETE", "/api/counts", []string{permStockWrite}},
+	{"POST PUT DELETE", "/api/counts/...", []string{permStockWrite}},
+	{"GET", "/api/suppliers", []string{permStockRead}},
+	{"GET", "/api/suppliers/...", []string{permStockRead}},
+	{"POST PUT DELETE", "/api/suppliers", []string{permStockWrite}},
+	{"POST PUT DELETE", "/api/suppliers/...", []string{permStockWrite}},
+	{"GET", "/api/purchase-orders", []string{permStockRead}},
+	{"GET", "/api/purchase-orders/...", []string{permStockRead}},
+	{"POST PUT DELETE", "/api/purchase-orders", []string{permStockWrite}},
+	{"POST PUT DELETE", "/api/purchase-orders/...", []string{permStockWrite}},
+
+	{"GET", "/api/operators", []string{permOperatorsRead}},
+	{"GET", "/api/operators/...", []string{permOperatorsRead}},
+	{"POST PUT DELETE", "/api/operators", []string{permOperatorsWrite}},
+	{"POST PUT DELETE", "/api/operators/...", []string{permOperatorsWrite}},
+	{"GET", "/api/shifts", []string{permOperatorsRead}},
+	{"GET", "/api/shifts/...", []string{permOperatorsRead}},
+	{"POST PUT DELETE", "/api/shifts", []string{permOperatorsWrite}},
+	{"POST PUT DELETE", "/api/shifts/...", []string{permOperatorsWrite}},
+	{"GET", "/api/skills", []string{permOperatorsRead}},
+	{"GET", "/api/skills/...", []string{permOperatorsRead}},
+	{"POST PUT DELETE", "/api/skills", []string{permOperatorsWrite}},
+	{"POST PUT DELETE", "/api/skills/...", []string{permOperatorsWrite}},
+
+	{"GET", "/api/reports/...", []string{permReportsRead}},
+	{"GET", "/api/notifications", []string{permNotificationsRead}},
+	{"POST", "/api/notifications/*/read", []string{permNotificationsRead}},
+	{"GET", "/api/labels/...", []string{permLabelsRead}},
+	{"POST", "/api/labels/sheet", []string{permLabelsRead}},
+	{"GET", "/api/scan", []string{permLabelsRead}},
+}
+
+func matchPath(pattern, path string) bool {
+	patternParts := strings.Split(strings.TrimSuffix(pattern, "/"), "/")
+	pathParts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if patternParts[len(patternParts)-1] == "..." {
+		patternParts = patternParts[:len(patternParts)-1]
+		if len(pathParts) <= len(patternParts) {
+			return false
+		}
+		pathParts = pathParts[:len(patternParts)]
+	}
+	if len(patternParts) != len(pathParts) {
+		return false
+	}
+	for i, part := range patternParts {
+		if part != "*" && part != pathParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// findRouteRule returns the rule that decides access to a request.
+func findRouteRule(method, path string) (routeRule, bool) {
+	for _, rule := range routeRules {
+		if rule.methods != "*" && !strings.Contains(" "+rule.methods+" ", " "+method+" ") {
+			continue
+		}
+		if matchPath(rule.pattern, path) {
+			return rule, true
+		}
+	}
+	return routeRule{}, false
+}
+
+// allowed reports whether a role holding permissions may make the request.
+func allowed(role string, permissions map[string]bool, method, path string) bool {
+	if role == roleAdmin {
+		return true
+	}
+	rule, ok := findRouteRule(method, path)
+	if !ok {
+		return false
+	}
+	if len(rule.permissions) == 0 {
+		return true
+	}
+	for _, p := range rule.permissions {
+		if permissions[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPermission reports whether the caller of an authenticated request holds
+// permission.
+func hasPermission(r *http.Request, permission string) bool {
+	s, ok := r.Context().Value(sessionContextKey).(*authSession)
+	return ok && (s.User.Role == roleAdmin || s.Permissions[permission])
+}
+
+// rolePermissions loads the permissions of a role.
+func rolePermissions(q queryer, role string) (map[string]bool, error) {
+	permissions := make(map[string]bool)
+	if role == roleAdmin {
+		for p := range permissionDescriptions {
+			permissions[p] = true
+		}
+		return permissions, nil
+	}
+	rows, err := q.Query("SELECT permission FROM role_permissions WHERE role = ?", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		permissions[p] = true
+	}
+	return permissions, rows.Err()
+}
+
+func roleExists(q queryer, role string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM roles WHERE name = ?)", role).Scan(&exists)
+	return exists, err
+}
+
+// seedRoles creates the built-in roles on first start.
+func seedRoles(db *sql.DB) {
+	for _, role := range []string{roleOperator, roleTechnician, rolePlanner, roleAdmin} {
+		res, err := db.Exec("INSERT OR IGNORE INTO roles (name, description) VALUES (?, ?)", role, "")
+		if err != nil {
+			log.Fatalf("Failed to seed roles: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		for _, p := range defaultRolePermissions[role] {
+			if _, err := db.Exec("INSERT INTO role_permissions (role, permission) VALUES (?, ?)", role, p); err != nil {
+				log.Fatalf("Failed to seed roles: %v", err)
+			}
+		}
+	}
+}
+
+// Role is a named set of permissions assigned to users.
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+func loadRole(q queryer, name string) (Role, error) {
+	role := Role{Name: name}
+	if err := q.QueryRow("SELECT description FROM roles WHERE name = ?", name).Scan(&role.Description); err != nil {
+		return role, err
+	}
+	permissions, err := rolePermissions(q, name)
+	if err != nil {
+		return role, err
+	}
+	role.Permissions = []string{}
+	for p := range permissions {
+		role.Permissions = append(role.Permissions, p)
+	}
+	sort.Strings(role.Permissions)
+	return role, nil
+}
+
+func saveRolePermissions(tx *sql.Tx, role Role) error {
+	for _, p := range role.Permissions {
+		if _, ok := permissionDescriptions[p]; !ok {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = ?", role.Name); err != nil {
+		return err
+	}
+	for _, p := range role.Permissions {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO role_permissions (role, permission) VALUES (?, ?)", role.Name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Role handlers
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listRoles(w, r)
+	case "POST":
+		createRole(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func roleHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/api/roles/")
+
+	role, err := loadRole(db, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Role not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(role)
+	case "PUT":
+		updateRole(w, r, role)
+	case "DELETE":
+		deleteRole(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listRoles(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT name FROM roles ORDER BY name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	roles := []Role{}
+	for _, name := range names {
+		role, err := loadRole(db, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		roles = append(roles, role)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+func createRole(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var role Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	role.Name = strings.TrimSpace(role.Name)
+	if role.Name == "" || strings.Contains(role.Name, "/") {
+		http.Error(w, "name is required and cannot contain '/'", http.StatusBadRequest)
+		return
+	}
+	exists, err := roleExists(db, role.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		http.Error(w, "Role already exists", http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("INSERT INTO roles (name, description) VALUES (?, ?)", role.Name, role.Description); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := saveRolePermissions(tx, role); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(role)
+}
+
+// updateRole changes the description and permissions of a role. The admin
+// role's permissions are fixed so that it cannot lock itself out.
+func updateRole(w http.ResponseWriter, r *http.Request, existing Role) {
+	db := tenantDB(r)
+	var role Role
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	role.Name = existing.Name
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE roles SET description = ? WHERE name = ?", role.Description, role.Name); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role.Name == roleAdmin {
+		role.Permissions = existing.Permissions
+	} else if err := saveRolePermissions(tx, role); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+func deleteRole(w http.ResponseWriter, r *http.Request, name string) {
+	db := tenantDB(r)
+	if _, builtIn := defaultRolePermissions[name]; builtIn || name == roleAdmin {
+		http.Error(w, "Built-in roles cannot be deleted", http.StatusConflict)
+		return
+	}
+	var used bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE role = ?)", name).Scan(&used); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if used {
+		http.Error(w, "Role is assigned to users", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM role_permissions WHERE role = ?", name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM roles WHERE name = ?", name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Permission is an entry of GET /api/permissions.
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func getPermissions(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	permissions := []Permission{}
+	for name, description := range permissionDescriptions {
+		permissions = append(permissions, Permission{Name: name, Description: description})
+	}
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(permissions)
+}
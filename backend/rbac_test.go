@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// rbacFixtures creates, on first use, the entities the requests of a case
+// refer to as {name} in their path or body.
+type rbacFixtures struct {
+	admin  *testClient
+	caller *testClient
+	ids    map[string]string
+}
+
+var rbacFixtureRefs = regexp.MustCompile(`\{([a-zA-Z]+)\}`)
+
+func (f *rbacFixtures) expand(s string) string {
+	return rbacFixtureRefs.ReplaceAllStringFunc(s, func(ref string) string {
+		return f.get(ref[1 : len(ref)-1])
+	})
+}
+
+func (f *rbacFixtures) get(name string) string {
+	if id, ok := f.ids[name]; ok {
+		return id
+	}
+	create, ok := rbacFixtureCreators[name]
+	if !ok {
+		f.admin.t.Fatalf("unknown fixture %s", name)
+	}
+	id := create(f)
+	f.ids[name] = id
+	return id
+}
+
+func (f *rbacFixtures) create(path, body string) string {
+	return f.admin.create(f.expand(path), f.expand(body))
+}
+
+var rbacFixtureCreators map[string]func(f *rbacFixtures) string
+
+func init() {
+	rbacFixtureCreators = map[string]func(f *rbacFixtures) string{
+		"machine": func(f *rbacFixtures) string {
+			return f.create("/api/machines", `{"name":"RBAC machine `+newTestID()+`","status":"Operando","model":"RBAC-1"}`)
+		},
+		"sensor": func(f *rbacFixtures) string {
+			return f.create("/api/machines/{machine}/sensors", `{"name":"Temperature","type":"temperature"}`)
+		},
+		"maintenance": func(f *rbacFixtures) string {
+			return f.create("/api/maintenance", `{"machineId":"{machine}","start":"2031-01-06T08:00:00Z","description":"RBAC","type":"preventive","status":"scheduled"}`)
+		},
+		"template": func(f *rbacFixtures) string {
+			return f.create("/api/checklist-templates", `{"name":"RBAC checklist `+newTestID()+`","steps":[{"title":"Check the belt","kind":"check"}]}`)
+		},
+		"checklistItem": func(f *rbacFixtures) string {
+			rec := f.admin.do("POST", f.expand("/api/maintenances/{maintenance}/checklist"), f.expand(`{"templateId":"{template}"}`))
+			var items []ChecklistItem
+			if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil || len(items) == 0 {
+				f.admin.t.Fatalf("checklist: %d %s", rec.Code, rec.Body)
+			}
+			return items[0].ID
+		},
+		"operator": func(f *rbacFixtures) string {
+			return f.create("/api/operators", `{"name":"RBAC operator `+newTestID()+`"}`)
+		},
+		"shift": func(f *rbacFixtures) string {
+			return f.create("/api/shifts", `{"name":"RBAC shift `+newTestID()+`","start":"06:00","end":"14:00","days":[1,2,3,4,5]}`)
+		},
+		"skill": func(f *rbacFixtures) string {
+			return f.create("/api/skills", `{"name":"RBAC skill `+newTestID()+`"}`)
+		},
+		"stock": func(f *rbacFixtures) string {
+			return f.create("/api/stock", `{"name":"RBAC part `+newTestID()+`","unit":"un","quantity":10,"value":2}`)
+		},
+		"unusedStock": func(f *rbacFixtures) string {
+			return f.create("/api/stock", `{"name":"RBAC unused part `+newTestID()+`","unit":"un","quantity":0,"value":0}`)
+		},
+		"bom": func(f *rbacFixtures) string {
+			return f.create("/api/bom", `{"model":"RBAC-1","stockId":"{stock}","quantity":1}`)
+		},
+		"stockWarehouse": func(f *rbacFixtures) string {
+			var warehouseID string
+			if err := f.admin.db().QueryRow("SELECT warehouseId FROM stock_levels WHERE stockId = ?", f.get("stock")).Scan(&warehouseID); err != nil {
+				f.admin.t.Fatal(err)
+			}
+			return warehouseID
+		},
+		"warehouse": func(f *rbacFixtures) string {
+			return f.create("/api/warehouses", `{"name":"RBAC warehouse `+newTestID()+`"}`)
+		},
+		"count": func(f *rbacFixtures) string {
+			return f.create("/api/counts", `{"warehouseId":"{warehouse}"}`)
+		},
+		"supplier": func(f *rbacFixtures) string {
+			return f.create("/api/suppliers", `{"name":"RBAC supplier `+newTestID()+`"}`)
+		},
+		"order": func(f *rbacFixtures) string {
+			return f.create("/api/purchase-orders", `{"supplierId":"{supplier}","lines":[{"stockId":"{stock}","quantity":5,"unitPrice":2}]}`)
+		},
+		"sentOrder": func(f *rbacFixtures) string {
+			id := f.create("/api/purchase-orders", `{"supplierId":"{supplier}","lines":[{"stockId":"{stock}","quantity":5,"unitPrice":2}]}`)
+			if rec := f.admin.do("POST", "/api/purchase-orders/"+id+"/send", ""); rec.Code != http.StatusOK {
+				f.admin.t.Fatalf("send order: %d %s", rec.Code, rec.Body)
+			}
+			return id
+		},
+		"orderLine": func(f *rbacFixtures) string {
+			rec := f.admin.do("GET", "/api/purchase-orders/"+f.get("sentOrder"), "")
+			var po PurchaseOrder
+			if err := json.Unmarshal(rec.Body.Bytes(), &po); err != nil || len(po.Lines) == 0 {
+				f.admin.t.Fatalf("order: %d %s", rec.Code, rec.Body)
+			}
+			return po.Lines[0].ID
+		},
+		"unit": func(f *rbacFixtures) string {
+			code := "rbac" + newTestID()
+			f.create("/api/units", `{"code":"`+code+`","name":"RBAC unit","dimension":"count","factor":3}`)
+			return code
+		},
+		"asset": func(f *rbacFixtures) string {
+			return f.create("/api/assets", `{"kind":"site","name":"RBAC site `+newTestID()+`"}`)
+		},
+		// Requests are only shown to those who triage them and to the user
+		// that reported them
+		"request": func(f *rbacFixtures) string {
+			return f.caller.create("/api/maintenance-requests", f.expand(`{"machineId":"{machine}","symptom":"Noisy bearing","severity":"medium"}`))
+		},
+		"machineAttachment": func(f *rbacFixtures) string {
+			return f.admin.createdID("upload", f.admin.upload(f.expand("/api/machines/{machine}/attachments"), "manual.txt", "manual"))
+		},
+		"maintenanceAttachment": func(f *rbacFixtures) string {
+			return f.admin.createdID("upload", f.admin.upload(f.expand("/api/maintenance/{maintenance}/attachments"), "photo.txt", "photo"))
+		},
+		"requestAttachment": func(f *rbacFixtures) string {
+			return f.admin.createdID("upload", f.admin.upload(f.expand("/api/maintenance-requests/{request}/attachments"), "photo.txt", "photo"))
+		},
+		// Feeds belong to the user that created them
+		"feed": func(f *rbacFixtures) string {
+			owner := f.caller
+			if rec := owner.do("GET", "/api/calendar/feeds", ""); rec.Code != http.StatusOK {
+				owner = f.admin
+			}
+			return owner.create("/api/calendar/feeds", `{"name":"RBAC feed"}`)
+		},
+		"notification": func(f *rbacFixtures) string {
+			id := "rbac-" + newTestID()
+			err := raiseNotification(f.admin.db(), Notification{Kind: "rbac-test", Severity: "info", EntityType: "machine", EntityID: id, Message: "RBAC"})
+			if err != nil {
+				f.admin.t.Fatal(err)
+			}
+			var notificationID string
+			if err := f.admin.db().QueryRow("SELECT id FROM notifications WHERE entityId = ?", id).Scan(&notificationID); err != nil {
+				f.admin.t.Fatal(err)
+			}
+			return notificationID
+		},
+		"user": func(f *rbacFixtures) string {
+			return f.create("/api/users", `{"username":"rbac-user-`+newTestID()+`","name":"RBAC user","role":"operator","active":true,"password":"password-123"}`)
+		},
+		"role": func(f *rbacFixtures) string {
+			name := "rbac-role-" + newTestID()
+			f.create("/api/roles", `{"name":"`+name+`","permissions":["machines.read"]}`)
+			return name
+		},
+	}
+}
+
+const (
+	rbacOperator   = "operator"
+	rbacTechnician = "technician"
+	rbacPlanner    = "planner"
+)
+
+// rbacCase is a request and the roles, besides admin, allowed to make it
+// with their default permissions.
+type rbacCase struct {
+	method string
+	path   string
+	body   string
+	roles  string
+}
+
+var everyone = rbacOperator + " " + rbacTechnician + " " + rbacPlanner
+
+var rbacCases = []rbacCase{
+	{"GET", "/api/auth/me", "", everyone},
+
+	{"GET", "/api/users", "", ""},
+	{"POST", "/api/users", `{"username":"new-user-{machine}","role":"operator","active":true,"password":"password-123"}`, ""},
+	{"GET", "/api/users/{user}", "", ""},
+	{"PUT", "/api/users/{user}", `{"username":"renamed-{user}","name":"Renamed","role":"operator","active":true}`, ""},
+	{"DELETE", "/api/users/{user}", "", ""},
+	{"GET", "/api/roles", "", ""},
+	{"POST", "/api/roles", `{"name":"new-role-{machine}","permissions":["machines.read"]}`, ""},
+	{"GET", "/api/roles/{role}", "", ""},
+	{"PUT", "/api/roles/{role}", `{"description":"Changed","permissions":["machines.read"]}`, ""},
+	{"DELETE", "/api/roles/{role}", "", ""},
+	{"GET", "/api/permissions", "", ""},
+	{"GET", "/api/audit", "", ""},
+	{"GET", "/api/audit/verify", "", ""},
+
+	{"GET", "/api/machines", "", everyone},
+	{"GET", "/api/machines/{machine}", "", everyone},
+	{"POST", "/api/machines", `{"name":"New machine","status":"Operando"}`, ""},
+	{"PUT", "/api/machines/{machine}", `{"name":"Renamed machine","status":"Operando"}`, ""},
+	{"DELETE", "/api/machines/{machine}", "", ""},
+	{"PUT", "/api/machines/{machine}/status", `{"status":"Parada"}`, rbacOperator + " " + rbacTechnician},
+	{"GET", "/api/machines/{machine}/sensors", "", everyone},
+	{"POST", "/api/machines/{machine}/sensors", `{"name":"Pressure","type":"pressure"}`, ""},
+	{"GET", "/api/machines/{machine}/sensors/{sensor}/readings", "", everyone},
+	{"POST", "/api/machines/{machine}/sensors/{sensor}/readings", `{"value":71.5,"unit":"C"}`, rbacOperator + " " + rbacTechnician},
+	{"GET", "/api/machines/{machine}/skills", "", everyone},
+	{"PUT", "/api/machines/{machine}/skills", `[]`, ""},
+	{"GET", "/api/machines/{machine}/qualified-operators", "", everyone},
+	{"GET", "/api/machines/{machine}/bom", "", everyone},
+	{"GET", "/api/machines/{machine}/attachments", "", everyone},
+	{"GET", "/api/attachments/{machineAttachment}", "", everyone},
+	{"DELETE", "/api/machines/{machine}/attachments/{machineAttachment}", "", ""},
+	{"GET", "/api/assets", "", everyone},
+	{"GET", "/api/assets/{asset}", "", everyone},
+	{"POST", "/api/assets", `{"kind":"site","name":"New site"}`, ""},
+	{"PUT", "/api/assets/{asset}", `{"name":"Renamed site","code":"S1"}`, ""},
+	{"DELETE", "/api/assets/{asset}", "", ""},
+
+	{"GET", "/api/maintenance", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/maintenance/{maintenance}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/maintenance", `{"machineId":"{machine}","start":"2031-02-03T08:00:00Z","description":"New","type":"preventive","status":"scheduled"}`, rbacPlanner},
+	{"PUT", "/api/maintenance/{maintenance}", `{"machineId":"{machine}","start":"2031-01-07T08:00:00Z","description":"Rescheduled","type":"preventive","status":"scheduled"}`, rbacPlanner},
+	{"DELETE", "/api/maintenance/{maintenance}", "", rbacPlanner},
+	{"GET", "/api/maintenance/{maintenance}/attachments", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/attachments/{maintenanceAttachment}", "", rbacTechnician + " " + rbacPlanner},
+	{"DELETE", "/api/maintenance/{maintenance}/attachments/{maintenanceAttachment}", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/maintenances/{maintenance}", "", rbacTechnician + " " + rbacPlanner},
+	{"PUT", "/api/maintenances/{maintenance}", `{"machineId":"{machine}","start":"2031-01-08T08:00:00Z","description":"Rescheduled","type":"preventive","status":"scheduled"}`, rbacPlanner},
+	{"DELETE", "/api/maintenances/{maintenance}", "", rbacPlanner},
+	{"PATCH", "/api/maintenances/{maintenance}/start", "", rbacTechnician},
+	{"PATCH", "/api/maintenances/{maintenance}/complete", "", rbacTechnician},
+	{"POST", "/api/maintenances/{maintenance}/labor/start", `{"operatorId":"{operator}"}`, rbacTechnician},
+	{"GET", "/api/maintenances/{maintenance}/checklist", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/maintenances/{maintenance}/checklist", `{"templateId":"{template}"}`, rbacPlanner},
+	{"PUT", "/api/maintenances/{maintenance}/checklist/{checklistItem}", `{"result":"pass"}`, rbacTechnician},
+	{"GET", "/api/checklist-templates", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/checklist-templates/{template}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/checklist-templates", `{"name":"New checklist {machine}","steps":[{"title":"Check","kind":"check"}]}`, rbacPlanner},
+	{"PUT", "/api/checklist-templates/{template}", `{"name":"Renamed checklist {template}","steps":[{"title":"Check","kind":"check"}]}`, rbacPlanner},
+	{"DELETE", "/api/checklist-templates/{template}", "", rbacPlanner},
+	{"GET", "/api/bom", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/bom/{bom}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/bom", `{"model":"RBAC-2","stockId":"{stock}","quantity":2}`, rbacPlanner},
+	{"PUT", "/api/bom/{bom}", `{"model":"RBAC-1","stockId":"{stock}","quantity":3}`, rbacPlanner},
+	{"DELETE", "/api/bom/{bom}", "", rbacPlanner},
+	{"GET", "/api/workload", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/sla-targets", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/sla-targets/high", "", rbacTechnician + " " + rbacPlanner},
+	{"PUT", "/api/sla-targets/high", `{"resolutionHours":24,"escalateAfterHours":8}`, rbacPlanner},
+
+	{"GET", "/api/maintenance-requests", "", everyone},
+	{"POST", "/api/maintenance-requests", `{"machineId":"{machine}","symptom":"Leaking oil","severity":"high"}`, everyone},
+	{"GET", "/api/maintenance-requests/{request}", "", everyone},
+	{"POST", "/api/maintenance-requests/{request}/convert", `{"start":"2031-03-03T08:00:00Z"}`, rbacPlanner},
+	{"POST", "/api/maintenance-requests/{request}/reject", `{"reason":"Duplicate"}`, rbacPlanner},
+	{"GET", "/api/maintenance-requests/{request}/attachments", "", everyone},
+	{"GET", "/api/attachments/{requestAttachment}", "", everyone},
+	{"DELETE", "/api/maintenance-requests/{request}/attachments/{requestAttachment}", "", rbacPlanner},
+
+	{"GET", "/api/calendar/maintenances.ics", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/calendar/feeds", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/calendar/feeds", `{"name":"My feed"}`, rbacTechnician + " " + rbacPlanner},
+	{"DELETE", "/api/calendar/feeds/{feed}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/calendar/import", "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nEND:VCALENDAR\r\n", rbacPlanner},
+
+	{"GET", "/api/stock", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/stock/{stock}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/stock", `{"name":"New part {machine}","unit":"un","quantity":1,"value":1}`, rbacPlanner},
+	{"PUT", "/api/stock/{stock}", `{"name":"Renamed part {stock}","unit":"un","quantity":10,"value":2}`, rbacPlanner},
+	{"DELETE", "/api/stock/{unusedStock}", "", rbacPlanner},
+	{"POST", "/api/stock/{stock}/receipts", `{"quantity":2,"unitCost":3}`, rbacPlanner},
+	{"GET", "/api/stock/{stock}/movements", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/stock/replenishment", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/stock/alerts", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/stock/trace?lot=none", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/stock/transfers", `{"stockId":"{stock}","from":{"warehouseId":"{stockWarehouse}"},"to":{"warehouseId":"{warehouse}"},"quantity":1}`, rbacPlanner},
+	{"GET", "/api/units", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/units", `{"code":"box{machine}","name":"Box","dimension":"count","factor":12}`, rbacPlanner},
+	{"PUT", "/api/units/{unit}", `{"name":"Triple","dimension":"count","factor":3}`, rbacPlanner},
+	{"DELETE", "/api/units/{unit}", "", rbacPlanner},
+	{"GET", "/api/warehouses", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/warehouses/{warehouse}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/warehouses", `{"name":"New warehouse {machine}"}`, rbacPlanner},
+	{"PUT", "/api/warehouses/{warehouse}", `{"name":"Renamed warehouse {warehouse}"}`, rbacPlanner},
+	{"DELETE", "/api/warehouses/{warehouse}", "", rbacPlanner},
+	{"GET", "/api/warehouses/{warehouse}/stock", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/warehouses/{warehouse}/bins", `{"code":"A-01"}`, rbacPlanner},
+	{"GET", "/api/counts", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/counts/{count}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/counts", `{"warehouseId":"{warehouse}"}`, rbacPlanner},
+	{"POST", "/api/counts/{count}/cancel", "", rbacPlanner},
+	{"GET", "/api/suppliers", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/suppliers/{supplier}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/suppliers", `{"name":"New supplier {machine}"}`, rbacPlanner},
+	{"PUT", "/api/suppliers/{supplier}", `{"name":"Renamed supplier {supplier}"}`, rbacPlanner},
+	{"DELETE", "/api/suppliers/{supplier}", "", rbacPlanner},
+	{"GET", "/api/purchase-orders", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/purchase-orders/{order}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/purchase-orders", `{"supplierId":"{supplier}","lines":[{"stockId":"{stock}","quantity":1,"unitPrice":2}]}`, rbacPlanner},
+	{"PUT", "/api/purchase-orders/{order}", `{"supplierId":"{supplier}","lines":[{"stockId":"{stock}","quantity":2,"unitPrice":2}]}`, rbacPlanner},
+	{"DELETE", "/api/purchase-orders/{order}", "", rbacPlanner},
+	{"POST", "/api/purchase-orders/{order}/send", "", rbacPlanner},
+	{"POST", "/api/purchase-orders/{sentOrder}/receive", `{"lines":[{"lineId":"{orderLine}","quantity":1}]}`, rbacPlanner},
+	{"POST", "/api/purchase-orders/{order}/cancel", "", rbacPlanner},
+
+	{"GET", "/api/operators", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/operators/{operator}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/operators", `{"name":"New operator"}`, ""},
+	{"PUT", "/api/operators/{operator}", `{"name":"Renamed operator"}`, ""},
+	{"DELETE", "/api/operators/{operator}", "", ""},
+	{"GET", "/api/operators/{operator}/certifications", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/shifts", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/shifts/{shift}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/shifts", `{"name":"Night {machine}","start":"22:00","end":"06:00","days":[1,2,3,4,5]}`, ""},
+	{"PUT", "/api/shifts/{shift}", `{"name":"Early {shift}","start":"05:00","end":"13:00","days":[1,2,3,4,5]}`, ""},
+	{"DELETE", "/api/shifts/{shift}", "", ""},
+	{"GET", "/api/skills", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/skills/{skill}", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/skills", `{"name":"New skill {machine}"}`, ""},
+	{"PUT", "/api/skills/{skill}", `{"name":"Renamed skill {skill}"}`, ""},
+	{"DELETE", "/api/skills/{skill}", "", ""},
+
+	{"GET", "/api/reports/reliability", "", rbacPlanner},
+	{"GET", "/api/reports/maintenance-costs", "", rbacPlanner},
+	{"GET", "/api/reports/inventory-valuation", "", rbacPlanner},
+	{"GET", "/api/reports/used-stock", "", rbacPlanner},
+	{"GET", "/api/reports/scheduled-maintenances", "", rbacPlanner},
+	{"GET", "/api/reports/overdue-maintenances", "", rbacPlanner},
+	{"GET", "/api/reports/pm-compliance", "", rbacPlanner},
+	{"GET", "/api/reports/expiring-certifications", "", rbacPlanner},
+	{"GET", "/api/notifications", "", rbacTechnician + " " + rbacPlanner},
+	{"POST", "/api/notifications/{notification}/read", "", rbacTechnician + " " + rbacPlanner},
+	{"GET", "/api/labels/machine/{machine}", "", everyone},
+	{"POST", "/api/labels/sheet", `{"labels":[{"kind":"machine","id":"{machine}"}]}`, everyone},
+	{"GET", "/api/scan?code=machine:{machine}", "", everyone},
+
+	{"GET", "/api/not-a-route", "", ""},
+}
+
+// TestRoleMatrix makes every request of rbacCases through the full handler
+// chain as a user of each built-in role and checks that the roles allowed
+// to make it succeed and the others are refused.
+func TestRoleMatrix(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	callers := map[string]*testClient{roleAdmin: admin}
+	for _, role := range []string{rbacOperator, rbacTechnician, rbacPlanner} {
+		callers[role] = admin.newUser(role)
+	}
+
+	for _, c := range rbacCases {
+		for _, role := range []string{rbacOperator, rbacTechnician, rbacPlanner, roleAdmin} {
+			caller := callers[role]
+			fixtures := &rbacFixtures{admin: admin, caller: caller, ids: map[string]string{}}
+			path, body := fixtures.expand(c.path), fixtures.expand(c.body)
+
+			rec := caller.do(c.method, path, body)
+			allowed := role == roleAdmin || strings.Contains(" "+c.roles+" ", " "+role+" ")
+			switch {
+			case c.path == "/api/not-a-route":
+				if !allowed && rec.Code != http.StatusForbidden {
+					t.Errorf("%s %s as %s: got %d, want 403", c.method, c.path, role, rec.Code)
+				}
+			case allowed && (rec.Code < 200 || rec.Code > 299):
+				t.Errorf("%s %s as %s: got %d, want 2xx: %s", c.method, c.path, role, rec.Code, strings.TrimSpace(rec.Body.String()))
+			case !allowed && rec.Code != http.StatusForbidden:
+				t.Errorf("%s %s as %s: got %d, want 403", c.method, c.path, role, rec.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SensorReading is a value read off a machine sensor, reported by the
+// operator of the machine or by the sensor itself.
+type SensorReading struct {
+	ID         string  `json:"id"`
+	SensorID   string  `json:"sensorId"`
+	Value      float64 `json:"value"`
+	Unit       string  `json:"unit,omitempty"`
+	Notes      string  `json:"notes,omitempty"`
+	ReadAt     string  `json:"readAt"`               // defaults to now
+	RecordedBy string  `json:"recordedBy,omitempty"` // set by the server
+}
+
+const sensorReadingColumns = "id, sensorId, value, unit, notes, readAt, recordedBy"
+
+func scanSensorReading(row rowScanner, s *SensorReading) error {
+	return row.Scan(&s.ID, &s.SensorID, &s.Value, &s.Unit, &s.Notes, &s.ReadAt, &s.RecordedBy)
+}
+
+// sensorReadingsHandler serves /api/machines/{id}/sensors/{sensorId}/readings:
+// GET lists the readings of a sensor, newest first, optionally from and to
+// the given timestamps; POST reports a reading.
+func sensorReadingsHandler(w http.ResponseWriter, r *http.Request, machineID, sensorID string) {
+	db := tenantDB(r)
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sensors WHERE id = ? AND machineId = ?)", sensorID, machineID).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Sensor not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		listSensorReadings(w, r, sensorID)
+	case "POST":
+		createSensorReading(w, r, sensorID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listSensorReadings(w http.ResponseWriter, r *http.Request, sensorID string) {
+	db := tenantDB(r)
+	query := "SELECT " + sensorReadingColumns + " FROM sensor_readings WHERE sensorId = ?"
+	args := []interface{}{sensorID}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		v := r.URL.Query().Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimestamp(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query += " AND readAt " + bound.op + " ?"
+		args = append(args, t.UTC().Format(time.RFC3339))
+	}
+
+	rows, err := db.Query(query+" ORDER BY readAt DESC", args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	readings := []SensorReading{}
+	for rows.Next() {
+		var s SensorReading
+		if err := scanSensorReading(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		readings = append(readings, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
+
+func createSensorReading(w http.ResponseWriter, r *http.Request, sensorID string) {
+	db := tenantDB(r)
+	var s SensorReading
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.ReadAt == "" {
+		s.ReadAt = time.Now().UTC().Format(time.RFC3339)
+	} else {
+		t, err := parseTimestamp(s.ReadAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ReadAt = t.UTC().Format(time.RFC3339)
+	}
+	s.ID = uuid.New().String()
+	s.SensorID = sensorID
+	s.Unit = strings.TrimSpace(s.Unit)
+	s.RecordedBy = actorID(r)
+
+	_, err := db.Exec("INSERT INTO sensor_readings ("+sensorReadingColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		s.ID, s.SensorID, s.Value, s.Unit, s.Notes, s.ReadAt, s.RecordedBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// deleteSensorReadings removes the readings of the sensors of a machine.
+func deleteSensorReadings(q queryer, machineID string) error {
+	_, err := q.Exec("DELETE FROM sensor_readings WHERE sensorId IN (SELECT id FROM sensors WHERE machineId = ?)", machineID)
+	return err
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ReliabilityReportItem holds the reliability metrics of one machine, model or
+// manufacturer over the requested period. Durations are expressed in hours.
+type ReliabilityReportItem struct {
+	Key               string   `json:"key"`
+	Label             string   `json:"label"`
+	Machines          int      `json:"machines"`
+	Failures          int      `json:"failures"`
+	Repairs           int      `json:"repairs"`
+	PeriodHours       float64  `json:"periodHours"`
+	UptimeHours       float64  `json:"uptimeHours"`
+	DowntimeHours     float64  `json:"downtimeHours"`
+	RepairHours       float64  `json:"repairHours"`
+	MTBFHours         *float64 `json:"mtbfHours"`
+	MTTRHours         *float64 `json:"mttrHours"`
+	MeanDowntimeHours *float64 `json:"meanDowntimeHours"`
+	Availability      float64  `json:"availability"`
+
+	// Requests counts the maintenance requests reported in the period and
+	// MeanResponseHours the mean time from a request to the start of the
+	// maintenance it was converted into.
+	Requests          int      `json:"requests"`
+	MeanResponseHours *float64 `json:"meanResponseHours"`
+	responses         int
+	responseHours     float64
+}
+
+// timestampLayouts are the formats accepted for maintenance timestamps. The
+// frontend sends ISO strings; plain dates are accepted for convenience.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
+
+// validateMaintenanceReliability normalizes the maintenance type and checks
+// that the breakdown timestamps are valid and in chronological order.
+func validateMaintenanceReliability(m *Maintenance) error {
+	if m.Type == "" {
+		m.Type = maintenanceTypePreventive
+	}
+	if m.Type != maintenanceTypePreventive && m.Type != maintenanceTypeCorrective {
+		return fmt.Errorf("invalid maintenance type %q: must be %q or %q", m.Type, maintenanceTypePreventive, maintenanceTypeCorrective)
+	}
+
+	var times []time.Time
+	for _, field := range []struct{ name, value string }{
+		{"failureStart", m.FailureStart},
+		{"repairStart", m.RepairStart},
+		{"repairEnd", m.RepairEnd},
+	} {
+		if field.value == "" {
+			continue
+		}
+		t, err := parseTimestamp(field.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field.name, err)
+		}
+		if len(times) > 0 && t.Before(times[len(times)-1]) {
+			return errors.New("failureStart, repairStart and repairEnd must be in chronological order")
+		}
+		times = append(times, t)
+	}
+
+	if m.Type == maintenanceTypeCorrective && m.FailureStart == "" && (m.RepairStart != "" || m.RepairEnd != "") {
+		return errors.New("failureStart is required when repair times are recorded")
+	}
+	return nil
+}
+
+// parseReportPeriod reads the from/to query parameters. A date-only "to" is
+// inclusive, so the period ends at midnight of the following day. The default
+// period is the last 90 days.
+func parseReportPeriod(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := parseTimestamp(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to: %v", err)
+		}
+		if len(v) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -90)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := parseTimestamp(v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from: %v", err)
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+func getReliabilityReport(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	from, to, err := parseReportPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := r.URL.Query().Get("groupBy")
+	if groupBy == "" {
+		groupBy = "machine"
+	}
+	if groupBy != "machine" && groupBy != "model" && groupBy != "manufacturer" {
+		http.Error(w, "groupBy must be machine, model or manufacturer", http.StatusBadRequest)
+		return
+	}
+
+	report, err := computeReliability(db, from, to, groupBy, r.URL.Query().Get("machineId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// computeReliability calculates MTBF, MTTR and availability for every machine
+// in [from, to) and aggregates the result by groupBy. Only corrective
+// maintenances with a recorded failure start count as failures.
+func computeReliability(q queryer, from, to time.Time, groupBy, machineID string) ([]ReliabilityReportItem, error) {
+	query := "SELECT id, name, model, manufacturer FROM machines"
+	args := []interface{}{}
+	if machineID != "" {
+		query += " WHERE id = ?"
+		args = append(args, machineID)
+	}
+	query += " ORDER BY name"
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periodHours := to.Sub(from).Hours()
+	items := make(map[string]*ReliabilityReportItem)
+	machineGroup := make(map[string]*ReliabilityReportItem)
+	order := []string{}
+	for rows.Next() {
+		var id, name, model, manufacturer string
+		if err := rows.Scan(&id, &name, &model, &manufacturer); err != nil {
+			return nil, err
+		}
+
+		key, label := id, name
+		switch groupBy {
+		case "model":
+			key, label = model, model
+		case "manufacturer":
+			key, label = manufacturer, manufacturer
+		}
+
+		item, ok := items[key]
+		if !ok {
+			item = &ReliabilityReportItem{Key: key, Label: label}
+			items[key] = item
+			order = append(order, key)
+		}
+		item.Machines++
+		item.PeriodHours += periodHours
+		machineGroup[id] = item
+	}
+	rows.Close()
+
+	maintRows, err := q.Query("SELECT machineId, failureStart, repairStart, repairEnd FROM maintenance WHERE type = ? AND failureStart != ''", maintenanceTypeCorrective)
+	if err != nil {
+		return nil, err
+	}
+	defer maintRows.Close()
+
+	// Breakdowns of a machine may overlap, and the machine is down once
+	// during the overlap, so the downtime adds up the merged windows.
+	downtimes := make(map[string][]downtimeWindow)
+	for maintRows.Next() {
+		var machine, failureStart, repairStart, repairEnd string
+		if err := maintRows.Scan(&machine, &failureStart, &repairStart, &repairEnd); err != nil {
+			return nil, err
+		}
+		item, ok := machineGroup[machine]
+		if !ok {
+			continue
+		}
+
+		failedAt, err := parseTimestamp(failureStart)
+		if err != nil {
+			continue
+		}
+		// A breakdown that has not been repaired yet keeps the machine down
+		// until the end of the period.
+		restoredAt := to
+		if repairEnd != "" {
+			if t, err := parseTimestamp(repairEnd); err == nil {
+				restoredAt = t
+			}
+		}
+
+		if !failedAt.Before(from) && failedAt.Before(to) {
+			item.Failures++
+		}
+		downtimes[machine] = append(downtimes[machine], downtimeWindow{failedAt, restoredAt})
+
+		if repairStart != "" && repairEnd != "" && !restoredAt.Before(from) && restoredAt.Before(to) {
+			if startedAt, err := parseTimestamp(repairStart); err == nil {
+				item.Repairs++
+				item.RepairHours += restoredAt.Sub(startedAt).Hours()
+			}
+		}
+	}
+
+	for machine, windows := range downtimes {
+		for _, window := range mergeDowntimeWindows(windows) {
+			machineGroup[machine].DowntimeHours += overlapHours(window.start, window.end, from, to)
+		}
+	}
+
+	requestRows, err := q.Query(`
+		SELECT mr.machineId, mr.reportedAt, COALESCE(NULLIF(m.startedAt, ''), m.repairStart, '')
+		FROM maintenance_requests mr
+		LEFT JOIN maintenance m ON m.id = mr.maintenanceId`)
+	if err != nil {
+		return nil, err
+	}
+	defer requestRows.Close()
+
+	for requestRows.Next() {
+		var machine, reportedAt, startedAt string
+		if err := requestRows.Scan(&machine, &reportedAt, &startedAt); err != nil {
+			return nil, err
+		}
+		item, ok := machineGroup[machine]
+		if !ok {
+			continue
+		}
+		reported, err := parseTimestamp(reportedAt)
+		if err != nil || reported.Before(from) || !reported.Before(to) {
+			continue
+		}
+		item.Requests++
+		if started, err := parseTimestamp(startedAt); err == nil && !started.Before(reported) {
+			item.responses++
+			item.responseHours += started.Sub(reported).Hours()
+		}
+	}
+
+	report := make([]ReliabilityReportItem, 0, len(order))
+	for _, key := range order {
+		item := items[key]
+		summarizeReliability(item)
+		report = append(report, *item)
+	}
+	return report, nil
+}
+
+// summarizeReliability derives the uptime, availability and means of an
+// item from its counts and hours.
+func summarizeReliability(item *ReliabilityReportItem) {
+	item.UptimeHours = item.PeriodHours - item.DowntimeHours
+	if item.PeriodHours > 0 {
+		item.Availability = item.UptimeHours / item.PeriodHours
+	}
+	if item.Failures > 0 {
+		mtbf := item.UptimeHours / float64(item.Failures)
+		mdt := item.DowntimeHours / float64(item.Failures)
+		item.MTBFHours = &mtbf
+		item.MeanDowntimeHours = &mdt
+	}
+	if item.Repairs > 0 {
+		mttr := item.RepairHours / float64(item.Repairs)
+		item.MTTRHours = &mttr
+	}
+	if item.responses > 0 {
+		response := item.responseHours / float64(item.responses)
+		item.MeanResponseHours = &response
+	}
+}
+
+// addReliability adds the counts and hours of other to item. The derived
+// metrics are left to summarizeReliability.
+func addReliability(item *ReliabilityReportItem, other ReliabilityReportItem) {
+	item.Machines += other.Machines
+	item.Failures += other.Failures
+	item.Repairs += other.Repairs
+	item.PeriodHours += other.PeriodHours
+	item.DowntimeHours += other.DowntimeHours
+	item.RepairHours += other.RepairHours
+	item.Requests += other.Requests
+	item.responses += other.responses
+	item.responseHours += other.responseHours
+}
+
+// downtimeWindow is a span [start, end) during which a machine was down.
+type downtimeWindow struct {
+	start, end time.Time
+}
+
+// mergeDowntimeWindows joins the overlapping windows of one machine.
+func mergeDowntimeWindows(windows []downtimeWindow) []downtimeWindow {
+	sort.Slice(windows, func(i, j int) bool { return windows[i].start.Before(windows[j].start) })
+	merged := []downtimeWindow{}
+	for _, window := range windows {
+		if last := len(merged) - 1; last >= 0 && !window.start.After(merged[last].end) {
+			if window.end.After(merged[last].end) {
+				merged[last].end = window.end
+			}
+			continue
+		}
+		merged = append(merged, window)
+	}
+	return merged
+}
+
+// overlapHours returns how many hours of [start, end) fall inside [from, to).
+func overlapHours(start, end, from, to time.Time) float64 {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start).Hours()
+}
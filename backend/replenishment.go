@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const notificationLowStock = "low-stock"
+
+// ReplenishmentSuggestion describes the projected level of a stock item and
+// how much of it should be ordered. Reserved is stock held by open
+// maintenances that are already due; UpcomingDemand is stock needed by
+// maintenances scheduled within the planning horizon; OnOrder is the
+// quantity still outstanding on purchase orders sent to suppliers; drafts
+// nobody has sent are not counted.
+type ReplenishmentSuggestion struct {
+	StockID           string  `json:"stockId"`
+	Name              string  `json:"name"`
+	Unit              string  `json:"unit"`
+	OnHand            float64 `json:"onHand"`
+	Reserved          float64 `json:"reserved"`
+	Available         float64 `json:"available"`
+	UpcomingDemand    float64 `json:"upcomingDemand"`
+	OnOrder           float64 `json:"onOrder"`
+	Projected         float64 `json:"projected"`
+	MinLevel          float64 `json:"minLevel"`
+	ReorderPoint      float64 `json:"reorderPoint"`
+	ReorderQuantity   float64 `json:"reorderQuantity"`
+	BelowMinimum      bool    `json:"belowMinimum"`
+	NeedsReorder      bool    `json:"needsReorder"`
+	SuggestedQuantity float64 `json:"suggestedQuantity"`
+
+	// The suggestion rounded up to whole purchase units, when the item is
+	// bought in a unit other than its stock unit.
+	PurchaseUnit              string  `json:"purchaseUnit,omitempty"`
+	PurchaseFactor            float64 `json:"purchaseFactor,omitempty"`
+	SuggestedPurchaseQuantity float64 `json:"suggestedPurchaseQuantity,omitempty"`
+
+	// Preferred supplier of the item, if one is set.
+	SupplierID   string  `json:"supplierId,omitempty"`
+	SupplierName string  `json:"supplierName,omitempty"`
+	LeadTimeDays int     `json:"leadTimeDays,omitempty"`
+	UnitPrice    float64 `json:"unitPrice,omitempty"`
+}
+
+// computeReplenishment projects the level of every stock item at the end of
+// the horizon, counting open purchase orders as incoming. An item needs
+// reordering when its projected level is at or below its reorder point; the
+// suggestion tops it up to the reorder point plus the reorder quantity.
+// Quantities are in stock units.
+func computeReplenishment(q queryer, now time.Time, horizonDays int) ([]ReplenishmentSuggestion, error) {
+	rows, err := q.Query("SELECT id, name, unit, quantity, minLevel, reorderPoint, reorderQuantity, purchaseUnit, purchaseFactor FROM stock ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []ReplenishmentSuggestion{}
+	index := make(map[string]int)
+	for rows.Next() {
+		var s ReplenishmentSuggestion
+		if err := rows.Scan(&s.StockID, &s.Name, &s.Unit, &s.OnHand, &s.MinLevel, &s.ReorderPoint, &s.ReorderQuantity, &s.PurchaseUnit, &s.PurchaseFactor); err != nil {
+			return nil, err
+		}
+		index[s.StockID] = len(suggestions)
+		suggestions = append(suggestions, s)
+	}
+	rows.Close()
+
+	endOfToday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, 1)
+	horizon := endOfToday.AddDate(0, 0, horizonDays)
+
+	demandRows, err := q.Query(`
+		SELECT ms.stockId, ms.quantity, m.date
+		FROM maintenance_stock ms
+		JOIN maintenance m ON ms.maintenanceId = m.id
+		WHERE ms.issued = 0 AND m.status != ?
+	`, maintenanceStatusCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer demandRows.Close()
+
+	for demandRows.Next() {
+		var stockID, date string
+		var quantity float64
+		if err := demandRows.Scan(&stockID, &quantity, &date); err != nil {
+			return nil, err
+		}
+		i, ok := index[stockID]
+		if !ok {
+			continue
+		}
+		// Maintenances without a usable date are treated as due now.
+		when, err := parseTimestamp(date)
+		switch {
+		case err != nil || when.Before(endOfToday):
+			suggestions[i].Reserved += quantity
+		case when.Before(horizon):
+			suggestions[i].UpcomingDemand += quantity
+		}
+	}
+
+	orderRows, err := q.Query(`
+		SELECT l.stockId, SUM((l.quantity - l.receivedQuantity) * l.unitFactor)
+		FROM purchase_order_lines l
+		JOIN purchase_orders po ON l.orderId = po.id
+		WHERE po.status IN (?, ?)
+		GROUP BY l.stockId
+	`, purchaseOrderSent, purchaseOrderPartiallyReceived)
+	if err != nil {
+		return nil, err
+	}
+	defer orderRows.Close()
+
+	for orderRows.Next() {
+		var stockID string
+		var quantity float64
+		if err := orderRows.Scan(&stockID, &quantity); err != nil {
+			return nil, err
+		}
+		if i, ok := index[stockID]; ok {
+			suggestions[i].OnOrder = quantity
+		}
+	}
+	orderRows.Close()
+
+	supplierRows, err := q.Query(`
+		SELECT si.stockId, s.id, s.name, CASE WHEN si.leadTimeDays > 0 THEN si.leadTimeDays ELSE s.leadTimeDays END, si.unitPrice
+		FROM supplier_items si
+		JOIN suppliers s ON si.supplierId = s.id
+		WHERE si.preferred = 1
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer supplierRows.Close()
+
+	for supplierRows.Next() {
+		var stockID string
+		var supplier ReplenishmentSuggestion
+		if err := supplierRows.Scan(&stockID, &supplier.SupplierID, &supplier.SupplierName, &supplier.LeadTimeDays, &supplier.UnitPrice); err != nil {
+			return nil, err
+		}
+		if i, ok := index[stockID]; ok {
+			s := &suggestions[i]
+			s.SupplierID, s.SupplierName, s.LeadTimeDays, s.UnitPrice = supplier.SupplierID, supplier.SupplierName, supplier.LeadTimeDays, supplier.UnitPrice
+		}
+	}
+
+	for i := range suggestions {
+		s := &suggestions[i]
+		s.Available = s.OnHand - s.Reserved
+		s.Projected = s.Available - s.UpcomingDemand + s.OnOrder
+		s.BelowMinimum = s.MinLevel > 0 && s.Available <= s.MinLevel
+		if s.ReorderPoint > 0 || s.ReorderQuantity > 0 {
+			if s.Projected <= s.ReorderPoint {
+				s.SuggestedQuantity = s.ReorderPoint + s.ReorderQuantity - s.Projected
+			}
+		}
+		s.NeedsReorder = s.SuggestedQuantity > 0
+		if s.PurchaseUnit != "" && s.PurchaseFactor > 0 && s.NeedsReorder {
+			s.SuggestedPurchaseQuantity = math.Ceil(s.SuggestedQuantity/s.PurchaseFactor - quantityEpsilon)
+		}
+	}
+	return suggestions, nil
+}
+
+// getStockReplenishment serves GET /api/stock/replenishment. Only items that
+// need reordering are returned unless all=true.
+func getStockReplenishment(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	horizonDays := 30
+	if v := r.URL.Query().Get("horizonDays"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			http.Error(w, "horizonDays must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		horizonDays = days
+	}
+
+	suggestions, err := computeReplenishment(db, time.Now(), horizonDays)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("all") != "true" {
+		filtered := []ReplenishmentSuggestion{}
+		for _, s := range suggestions {
+			if s.NeedsReorder || s.BelowMinimum {
+				filtered = append(filtered, s)
+			}
+		}
+		suggestions = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+// getStockAlerts serves GET /api/stock/alerts, the open low-stock alerts.
+func getStockAlerts(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	alerts, err := queryNotifications(db, notificationLowStock, false, notificationAudience(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// checkLowStock raises a low-stock alert for every item whose available
+// quantity is at or below its reorder point, and resolves the alerts of
+// items that have recovered.
+func checkLowStock(db *sql.DB) error {
+	suggestions, err := computeReplenishment(db, time.Now(), 0)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range suggestions {
+		low := s.BelowMinimum || ((s.ReorderPoint > 0 || s.ReorderQuantity > 0) && s.Available <= s.ReorderPoint)
+		if !low {
+			if err := resolveNotification(db, notificationLowStock, s.StockID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		severity := "warning"
+		if s.BelowMinimum {
+			severity = "critical"
+		}
+		err := raiseNotification(db, Notification{
+			Kind:       notificationLowStock,
+			Severity:   severity,
+			EntityType: "stock",
+			EntityID:   s.StockID,
+			Message:    fmt.Sprintf("%s: %g %s available (reorder point %g, minimum %g)", s.Name, s.Available, s.Unit, s.ReorderPoint, s.MinLevel),
+			Audience:   rolePlanner,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startLowStockMonitor runs checkLowStock now and then every interval.
+func startLowStockMonitor(interval time.Duration) {
+	startMonitor("Low stock check", interval, checkLowStock)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStockAlertsFollowTheirAudience(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	id := admin.create("/api/stock", `{"name":"Scarce belt","unit":"un","quantity":1,"value":1,"reorderPoint":5,"reorderQuantity":10}`)
+	if err := checkLowStock(admin.db()); err != nil {
+		t.Fatal(err)
+	}
+
+	alerted := func(c *testClient) bool {
+		rec := c.do("GET", "/api/stock/alerts", "")
+		var alerts []Notification
+		if err := json.Unmarshal(rec.Body.Bytes(), &alerts); err != nil {
+			t.Fatalf("alerts: %d %s", rec.Code, rec.Body)
+		}
+		for _, a := range alerts {
+			if a.EntityID == id {
+				return true
+			}
+		}
+		return false
+	}
+	if !alerted(admin.newUser(rolePlanner)) {
+		t.Error("planner does not see the low-stock alert")
+	}
+	if alerted(admin.newUser(roleTechnician)) {
+		t.Error("technician sees the low-stock alert meant for planners")
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const notificationMaintenanceRequest = "maintenance-request"
+
+// Statuses of a maintenance request. Open requests are triaged by a planner,
+// who converts them into a maintenance or rejects them.
+const (
+	requestStatusOpen      = "open"
+	requestStatusConverted = "converted"
+	requestStatusRejected  = "rejected"
+)
+
+// MaintenanceRequest is a problem reported from the shop floor. Anyone can
+// report one; planners triage it. A converted request is linked to the
+// maintenance it became, whose failure starts when the problem was
+// observed, so that the reliability report counts the time until it was
+// handled.
+type MaintenanceRequest struct {
+	ID            string `json:"id"`
+	MachineID     string `json:"machineId"`
+	Symptom       string `json:"symptom"`
+	Severity      string `json:"severity"`             // a maintenance priority
+	ObservedAt    string `json:"observedAt,omitempty"` // RFC 3339, when the problem started; defaults to ReportedAt
+	Status        string `json:"status"`
+	ReportedBy    string `json:"reportedBy"`
+	ReportedAt    string `json:"reportedAt"`
+	OperatorID    string `json:"operatorId,omitempty"` // the operator of ReportedBy, if any
+	TriagedBy     string `json:"triagedBy,omitempty"`
+	TriagedAt     string `json:"triagedAt,omitempty"`
+	Reason        string `json:"reason,omitempty"` // why it was rejected
+	MaintenanceID string `json:"maintenanceId,omitempty"`
+
+	// Attachments, such as photos of the problem, are uploaded to
+	// /api/maintenance-requests/{id}/attachments.
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+const maintenanceRequestColumns = "id, machineId, symptom, severity, observedAt, status, reportedBy, reportedAt, operatorId, triagedBy, triagedAt, reason, maintenanceId"
+
+func scanMaintenanceRequest(row rowScanner, mr *MaintenanceRequest) error {
+	return row.Scan(&mr.ID, &mr.MachineID, &mr.Symptom, &mr.Severity, &mr.ObservedAt, &mr.Status, &mr.ReportedBy, &mr.ReportedAt, &mr.OperatorID, &mr.TriagedBy, &mr.TriagedAt, &mr.Reason, &mr.MaintenanceID)
+}
+
+// canTriageRequests reports whether the caller sees every request, rather
+// than only those they reported.
+func canTriageRequests(r *http.Request) bool {
+	return hasPermission(r, permMaintenanceRead) || hasPermission(r, permMaintenanceSchedule)
+}
+
+func validateMaintenanceRequest(q queryer, mr *MaintenanceRequest) (int, error) {
+	mr.Symptom = strings.TrimSpace(mr.Symptom)
+	if mr.Symptom == "" {
+		return http.StatusBadRequest, errors.New("symptom is required")
+	}
+	if mr.Severity == "" {
+		mr.Severity = priorityMedium
+	}
+	if !validPriority(mr.Severity) {
+		return http.StatusBadRequest, fmt.Errorf("severity must be one of %s", strings.Join(maintenancePriorities, ", "))
+	}
+	if mr.ObservedAt != "" {
+		t, err := parseTimestamp(mr.ObservedAt)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("observedAt: %v", err)
+		}
+		mr.ObservedAt = t.UTC().Format(time.RFC3339)
+	}
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM machines WHERE id = ?)", mr.MachineID).Scan(&exists); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !exists {
+		return http.StatusBadRequest, fmt.Errorf("machine %q not found", mr.MachineID)
+	}
+	return http.StatusOK, nil
+}
+
+// Maintenance request handlers
+func maintenanceRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listMaintenanceRequests(w, r)
+	case "POST":
+		createMaintenanceRequest(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listMaintenanceRequests serves GET /api/maintenance-requests, newest
+// first, filtered by status and machineId. Reporters who cannot triage only
+// see their own requests.
+func listMaintenanceRequests(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	query := "SELECT " + maintenanceRequestColumns + " FROM maintenance_requests WHERE 1 = 1"
+	var args []interface{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if machineID := r.URL.Query().Get("machineId"); machineID != "" {
+		query += " AND machineId = ?"
+		args = append(args, machineID)
+	}
+	if !canTriageRequests(r) {
+		query += " AND reportedBy = ?"
+		args = append(args, actorID(r))
+	}
+	query += " ORDER BY reportedAt DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []MaintenanceRequest{}
+	for rows.Next() {
+		var mr MaintenanceRequest
+		if err := scanMaintenanceRequest(rows, &mr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, mr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+func createMaintenanceRequest(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var mr MaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&mr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := validateMaintenanceRequest(db, &mr); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	user, _ := currentUser(r)
+	operatorID, err := operatorForUser(db, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mr.ID, mr.Status, mr.OperatorID = uuid.New().String(), requestStatusOpen, operatorID
+	mr.ReportedBy, mr.ReportedAt = user.ID, time.Now().UTC().Format(time.RFC3339)
+	mr.TriagedBy, mr.TriagedAt, mr.Reason, mr.MaintenanceID = "", "", "", ""
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO maintenance_requests ("+maintenanceRequestColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', '', '', '')",
+		mr.ID, mr.MachineID, mr.Symptom, mr.Severity, mr.ObservedAt, mr.Status, mr.ReportedBy, mr.ReportedAt, mr.OperatorID)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := notifyMaintenanceRequest(tx, mr, user.Username); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(mr)
+}
+
+// notifyMaintenanceRequest tells planners a request awaits triage.
+func notifyMaintenanceRequest(q queryer, mr MaintenanceRequest, reporter string) error {
+	var machineName string
+	if err := q.QueryRow("SELECT name FROM machines WHERE id = ?", mr.MachineID).Scan(&machineName); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	severity := "info"
+	switch mr.Severity {
+	case priorityHigh:
+		severity = "warning"
+	case priorityCritical:
+		severity = "critical"
+	}
+	return raiseNotification(q, Notification{
+		Kind:       notificationMaintenanceRequest,
+		Severity:   severity,
+		EntityType: "maintenance-request",
+		EntityID:   mr.ID,
+		Message:    fmt.Sprintf("%s reported a %s severity problem on %s: %s", reporter, mr.Severity, machineName, mr.Symptom),
+		Audience:   rolePlanner,
+	})
+}
+
+// maintenanceRequestHandler serves /api/maintenance-requests/{id}, its
+// attachments and the /convert and /reject triage actions.
+func maintenanceRequestHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	path := strings.TrimPrefix(r.URL.Path, "/api/maintenance-requests/")
+	id, action, _ := strings.Cut(path, "/")
+
+	tenantMutex(r).Lock()
+	var mr MaintenanceRequest
+	err := scanMaintenanceRequest(db.QueryRow("SELECT "+maintenanceRequestColumns+" FROM maintenance_requests WHERE id = ?", id), &mr)
+	tenantMutex(r).Unlock()
+	if err == sql.ErrNoRows || (err == nil && mr.ReportedBy != actorID(r) && !canTriageRequests(r)) {
+		http.Error(w, "Maintenance request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "attachments" || strings.HasPrefix(action, "attachments/"):
+		attachmentsHandler(w, r, "maintenance-request", path)
+	case action == "" && r.Method == "GET":
+		getMaintenanceRequest(w, r, mr)
+	case action == "convert" && r.Method == "POST":
+		convertMaintenanceRequest(w, r, mr)
+	case action == "reject" && r.Method == "POST":
+		rejectMaintenanceRequest(w, r, mr)
+	case action == "" || action == "convert" || action == "reject":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func getMaintenanceRequest(w http.ResponseWriter, r *http.Request, mr MaintenanceRequest) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	attachments, err := queryAttachments(db, "maintenance-request", mr.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mr.Attachments = attachments
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mr)
+}
+
+// convertMaintenanceRequest serves POST /api/maintenance-requests/{id}/convert.
+// The body is the maintenance to create, booked like POST /api/maintenance
+// (including ?force=true); the machine, description, priority and the
+// failure timestamps default to those of the request, and the type to
+// corrective.
+func convertMaintenanceRequest(w http.ResponseWriter, r *http.Request, mr MaintenanceRequest) {
+	db := tenantDB(r)
+	if mr.Status != requestStatusOpen {
+		http.Error(w, fmt.Sprintf("Maintenance request is already %s", mr.Status), http.StatusConflict)
+		return
+	}
+	var maint Maintenance
+	if err := json.NewDecoder(r.Body).Decode(&maint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	observedAt := mr.ObservedAt
+	if observedAt == "" {
+		observedAt = mr.ReportedAt
+	}
+	if maint.MachineID == "" {
+		maint.MachineID = mr.MachineID
+	}
+	if maint.Description == "" {
+		maint.Description = mr.Symptom
+	}
+	if maint.Priority == "" {
+		maint.Priority = mr.Severity
+	}
+	if maint.Type == "" {
+		maint.Type = maintenanceTypeCorrective
+	}
+	if maint.Type == maintenanceTypeCorrective && maint.FailureStart == "" {
+		maint.FailureStart = observedAt
+	}
+	if maint.Start == "" && maint.Date == "" {
+		maint.Start = time.Now().UTC().Format(time.RFC3339)
+	}
+	maint.RequestID = mr.ID
+
+	query := r.URL.Query()
+	templateID, status, err := prepareNewMaintenance(db, &maint, query.Get("prefillStock") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	maint.CreatedBy, maint.CreatedAt = actorID(r), now
+
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conflicts, status, err := checkScheduleConflicts(tx, &maint, query.Get("force") == "true")
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// The status is checked again in the transaction, in case the request
+	// was triaged meanwhile
+	res, err := tx.Exec("UPDATE maintenance_requests SET status = ?, triagedBy = ?, triagedAt = ?, maintenanceId = ? WHERE id = ? AND status = ?",
+		requestStatusConverted, maint.CreatedBy, now, maint.ID, mr.ID, requestStatusOpen)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		http.Error(w, "Maintenance request was already triaged", http.StatusConflict)
+		return
+	}
+	if err := insertMaintenance(tx, &maint, templateID, conflicts); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), stockErrorStatus(err))
+		return
+	}
+	if err := resolveNotification(tx, notificationMaintenanceRequest, mr.ID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(maint)
+}
+
+// rejectMaintenanceRequest serves POST /api/maintenance-requests/{id}/reject
+// with {"reason": ...}, which is required.
+func rejectMaintenanceRequest(w http.ResponseWriter, r *http.Request, mr MaintenanceRequest) {
+	db := tenantDB(r)
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Reason = strings.TrimSpace(body.Reason); body.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mr.Status, mr.Reason = requestStatusRejected, body.Reason
+	mr.TriagedBy, mr.TriagedAt = actorID(r), time.Now().UTC().Format(time.RFC3339)
+	res, err := tx.Exec("UPDATE maintenance_requests SET status = ?, reason = ?, triagedBy = ?, triagedAt = ? WHERE id = ? AND status = ?",
+		mr.Status, mr.Reason, mr.TriagedBy, mr.TriagedAt, mr.ID, requestStatusOpen)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		http.Error(w, "Maintenance request was already triaged", http.StatusConflict)
+		return
+	}
+	if err := resolveNotification(tx, notificationMaintenanceRequest, mr.ID); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mr)
+}
+
+// reopenMaintenanceRequest puts the request a deleted maintenance was
+// converted from back into triage.
+func reopenMaintenanceRequest(tx *sql.Tx, maintenanceID string) error {
+	var mr MaintenanceRequest
+	err := scanMaintenanceRequest(tx.QueryRow("SELECT "+maintenanceRequestColumns+" FROM maintenance_requests WHERE maintenanceId = ?", maintenanceID), &mr)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE maintenance_requests SET status = ?, triagedBy = '', triagedAt = '', maintenanceId = '' WHERE id = ?", requestStatusOpen, mr.ID)
+	if err != nil {
+		return err
+	}
+	var reporter string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", mr.ReportedBy).Scan(&reporter); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return notifyMaintenanceRequest(tx, mr, reporter)
+}
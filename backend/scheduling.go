@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultMaintenanceDuration is the duration of maintenances booked without
+// one or an estimate.
+var defaultMaintenanceDuration = time.Hour
+
+// ScheduleConflict is a booking that overlaps a maintenance: the machine or
+// one of the assignees is already booked by another maintenance.
+type ScheduleConflict struct {
+	MaintenanceID string `json:"maintenanceId"`
+	MachineID     string `json:"machineId,omitempty"`  // set when the machine is double-booked
+	OperatorID    string `json:"operatorId,omitempty"` // set when an assignee is double-booked
+	Start         string `json:"start"`
+	End           string `json:"end"`
+}
+
+func (c ScheduleConflict) String() string {
+	what := "machine " + c.MachineID
+	if c.OperatorID != "" {
+		what = "operator " + c.OperatorID
+	}
+	return fmt.Sprintf("%s is booked by maintenance %s from %s to %s", what, c.MaintenanceID, c.Start, c.End)
+}
+
+// ScheduleOverride records a maintenance booked despite conflicts with
+// ?force=true.
+type ScheduleOverride struct {
+	ID        string             `json:"id"`
+	Conflicts []ScheduleConflict `json:"conflicts"`
+	ForcedBy  string             `json:"forcedBy"`
+	ForcedAt  string             `json:"forcedAt"`
+}
+
+// normalizeMaintenanceSchedule fills the start and duration of a
+// maintenance. Start defaults to Date, which follows Start for the reports
+// and filters that read it. The duration defaults to the estimate, or to
+// defaultMaintenanceDuration.
+func normalizeMaintenanceSchedule(m *Maintenance) error {
+	if m.Start == "" {
+		m.Start = m.Date
+	}
+	if m.Start == "" {
+		return errors.New("start is required")
+	}
+	if _, err := parseTimestamp(m.Start); err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	m.Date = m.Start
+
+	if m.DurationMinutes < 0 {
+		return errors.New("durationMinutes cannot be negative")
+	}
+	if m.DurationMinutes == 0 {
+		m.DurationMinutes = int(defaultMaintenanceDuration / time.Minute)
+		if m.EstimatedHours > 0 {
+			m.DurationMinutes = int(math.Ceil(m.EstimatedHours * 60))
+		}
+	}
+	m.End = maintenanceEnd(m.Start, m.DurationMinutes)
+	return nil
+}
+
+// maintenanceEnd returns the end of a booking, or "" when start is invalid.
+func maintenanceEnd(start string, durationMinutes int) string {
+	t, err := parseTimestamp(start)
+	if err != nil {
+		return ""
+	}
+	return t.Add(time.Duration(durationMinutes) * time.Minute).UTC().Format(time.RFC3339)
+}
+
+// findScheduleConflicts returns the open maintenances that overlap m on its
+// machine or on one of its assignees. Completed maintenances neither
+// conflict nor are checked.
+func findScheduleConflicts(q queryer, m *Maintenance) ([]ScheduleConflict, error) {
+	if m.Status == maintenanceStatusCompleted {
+		return nil, nil
+	}
+	start, err := parseTimestamp(m.Start)
+	if err != nil {
+		return nil, err
+	}
+	end := start.Add(time.Duration(m.DurationMinutes) * time.Minute)
+
+	query := `
+		SELECT m.id, m.machineId, '', m.scheduledStart, m.durationMinutes FROM maintenance m
+		WHERE m.machineId = ? AND m.id != ? AND m.status != ?`
+	args := []interface{}{m.MachineID, m.ID, maintenanceStatusCompleted}
+	if len(m.Assignees) > 0 {
+		query += `
+		UNION ALL
+		SELECT m.id, '', ma.operatorId, m.scheduledStart, m.durationMinutes FROM maintenance m
+		JOIN maintenance_assignees ma ON ma.maintenanceId = m.id
+		WHERE ma.operatorId IN (?` + strings.Repeat(", ?", len(m.Assignees)-1) + `) AND m.id != ? AND m.status != ?`
+		for _, id := range m.Assignees {
+			args = append(args, id)
+		}
+		args = append(args, m.ID, maintenanceStatusCompleted)
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conflicts := []ScheduleConflict{}
+	for rows.Next() {
+		var c ScheduleConflict
+		var duration int
+		if err := rows.Scan(&c.MaintenanceID, &c.MachineID, &c.OperatorID, &c.Start, &duration); err != nil {
+			return nil, err
+		}
+		otherStart, err := parseTimestamp(c.Start)
+		if err != nil {
+			continue
+		}
+		otherEnd := otherStart.Add(time.Duration(duration) * time.Minute)
+		if otherStart.Before(end) && start.Before(otherEnd) {
+			c.End = otherEnd.UTC().Format(time.RFC3339)
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts, rows.Err()
+}
+
+// bookedToday reports whether a maintenance of the machine is booked for
+// part of the day of now, which shows the machine as "Em manutenção".
+func bookedToday(q queryer, machineID string, now time.Time) (bool, error) {
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	rows, err := q.Query("SELECT scheduledStart, durationMinutes FROM maintenance WHERE machineId = ?", machineID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var start string
+		var duration int
+		if err := rows.Scan(&start, &duration); err != nil {
+			return false, err
+		}
+		t, err := parseTimestamp(start)
+		if err != nil {
+			continue
+		}
+		// A booking without a duration still counts on its start day
+		end := t.Add(time.Duration(duration) * time.Minute)
+		if t.Before(dayEnd) && (end.After(dayStart) || !t.Before(dayStart)) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// checkScheduleConflicts returns the bookings m conflicts with, refused
+// with 409 unless forced. It runs on the transaction storing m, with the
+// lock held, so that two overlapping bookings cannot both pass it.
+func checkScheduleConflicts(tx *sql.Tx, m *Maintenance, force bool) ([]ScheduleConflict, int, error) {
+	conflicts, err := findScheduleConflicts(tx, m)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(conflicts) > 0 && !force {
+		return nil, http.StatusConflict, scheduleConflictError(conflicts)
+	}
+	return conflicts, http.StatusOK, nil
+}
+
+// scheduleConflictError describes conflicts for the 409 response.
+func scheduleConflictError(conflicts []ScheduleConflict) error {
+	descriptions := make([]string, len(conflicts))
+	for i, c := range conflicts {
+		descriptions[i] = c.String()
+	}
+	return fmt.Errorf("Scheduling conflict: %s. Send force=true to book it anyway", strings.Join(descriptions, "; "))
+}
+
+// recordScheduleOverride stores the conflicts a maintenance was forced
+// through.
+func recordScheduleOverride(tx *sql.Tx, maintenanceID, userID string, conflicts []ScheduleConflict) error {
+	encoded, err := json.Marshal(conflicts)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO maintenance_schedule_overrides (id, maintenanceId, conflicts, forcedBy, forcedAt) VALUES (?, ?, ?, ?, ?)",
+		uuid.New().String(), maintenanceID, string(encoded), userID, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// loadScheduleOverrides returns the overrides recorded for a maintenance.
+func loadScheduleOverrides(q queryer, maintenanceID string) ([]ScheduleOverride, error) {
+	rows, err := q.Query("SELECT id, conflicts, forcedBy, forcedAt FROM maintenance_schedule_overrides WHERE maintenanceId = ? ORDER BY forcedAt", maintenanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []ScheduleOverride
+	for rows.Next() {
+		var o ScheduleOverride
+		var conflicts string
+		if err := rows.Scan(&o.ID, &conflicts, &o.ForcedBy, &o.ForcedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(conflicts), &o.Conflicts); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMachineInMaintenanceWhileBookedToday(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	id := admin.create("/api/machines", `{"name":"Booked lathe","status":"Operando","model":"BL-1"}`)
+	status := func() string {
+		rec := admin.do("GET", "/api/machines/"+id, "")
+		var m Machine
+		if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+			t.Fatalf("machine: %d %s", rec.Code, rec.Body)
+		}
+		return m.Status
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).UTC().Format(time.RFC3339)
+	admin.create("/api/maintenance", `{"machineId":"`+id+`","start":"`+tomorrow+`","description":"Tomorrow","durationMinutes":30}`)
+	if got := status(); got != "Operando" {
+		t.Errorf("status with a booking tomorrow = %q, want Operando", got)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	admin.create("/api/maintenance", `{"machineId":"`+id+`","start":"`+now+`","description":"Now","durationMinutes":30}`)
+	if got := status(); got != "Em manutenção" {
+		t.Errorf("status with a booking now = %q, want Em manutenção", got)
+	}
+}
+
+func TestConcurrentOverlappingBookings(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	id := admin.create("/api/machines", `{"name":"Contended mill","status":"Operando","model":"CM-1"}`)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 6)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = admin.do("POST", "/api/maintenance", `{"machineId":"`+id+`","start":"2032-03-01T08:00:00Z","description":"Contended","durationMinutes":60}`).Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("codes = %v, want 200 or 409", codes)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d overlapping bookings were created, want 1 (codes %v)", created, codes)
+	}
+}
+
+func TestAssigneeQualifiedOnTheStart(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	machine := admin.create("/api/machines", `{"name":"Certified lathe","status":"Operando","model":"CL-1"}`)
+	skill := admin.create("/api/skills", `{"name":"Lathe safety `+newTestID()+`"}`)
+	if rec := admin.do("PUT", "/api/machines/"+machine+"/skills", `["`+skill+`"]`); rec.Code != http.StatusOK {
+		t.Fatalf("skills: %d %s", rec.Code, rec.Body)
+	}
+	operator := admin.create("/api/operators", `{"name":"Certified operator `+newTestID()+`"}`)
+	admin.create("/api/operators/"+operator+"/certifications", `{"skillId":"`+skill+`","issuedAt":"2033-01-01","expiresAt":"2033-12-31"}`)
+
+	booking := func(start string) string {
+		return `{"machineId":"` + machine + `","start":"` + start + `","description":"Certified","durationMinutes":30,"assignees":["` + operator + `"]}`
+	}
+	rec := admin.do("POST", "/api/maintenance", booking("2033-06-01T08:00:00Z"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("booking within the certification: %d %s", rec.Code, rec.Body)
+	}
+	id := admin.createdID("/api/maintenance", rec)
+	if rec := admin.do("PUT", "/api/maintenance/"+id, booking("2033-06-02T08:00:00Z")); rec.Code != http.StatusOK {
+		t.Errorf("moving within the certification: %d %s", rec.Code, rec.Body)
+	}
+	if rec := admin.do("PUT", "/api/maintenance/"+id, booking("2034-06-02T08:00:00Z")); rec.Code != http.StatusConflict {
+		t.Errorf("moving past the certification: %d %s, want 409", rec.Code, rec.Body)
+	}
+}
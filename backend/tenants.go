@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Tenant is a plant or customer whose data is kept apart from the others'.
+// Every tenant has a database of its own, so all the queries of a request
+// are scoped to its tenant: tenantMiddleware puts the tenant in the context
+// of the request and the handlers query its database, from tenantDB, under
+// its mutex, from tenantMutex. Without TENANTS there is a single tenant,
+// with an empty ID, whose database is m4chinemind.db.
+type Tenant struct {
+	ID    string
+	Hosts []string
+	db    *sql.DB
+
+	// mutex serializes the work done on db, so that the requests of one
+	// tenant never wait for those of another.
+	mutex sync.Mutex
+}
+
+// tenantHeader names the tenant of requests that neither come through one
+// of its hosts nor carry one of its tokens, such as logins.
+const tenantHeader = "X-Tenant"
+
+var (
+	tenants       []*Tenant
+	tenantsByID   = map[string]*Tenant{}
+	tenantsByHost = map[string]*Tenant{}
+
+	// tenantDataDir holds the databases of the tenants listed in TENANTS.
+	tenantDataDir = "tenants"
+)
+
+const tenantContextKey contextKey = "tenant"
+
+// sqliteOptions make a connection wait for the locks held by the others
+// instead of failing with "database is locked", and make transactions take
+// the write lock when they begin, so that two of them cannot deadlock
+// upgrading their read locks.
+const sqliteOptions = "?_busy_timeout=5000&_txlock=immediate"
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// parseTenants reads a comma separated list of tenant IDs, each optionally
+// followed by "=" and the "|" separated hosts it is served on, such as
+// "plant-a=a.example.com,plant-b=b.example.com|b.local".
+func parseTenants(spec string) ([]*Tenant, error) {
+	var parsed []*Tenant
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		id, hosts, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if id == "" {
+			continue
+		}
+		if !tenantIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid tenant ID %q: use lower case letters, digits and dashes", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("tenant %q is listed twice", id)
+		}
+		seen[id] = true
+		t := &Tenant{ID: id}
+		for _, host := range strings.Split(hosts, "|") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				t.Hosts = append(t.Hosts, host)
+			}
+		}
+		parsed = append(parsed, t)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no tenant in %q", spec)
+	}
+	return parsed, nil
+}
+
+// openTenants opens the database of every tenant and runs setup on each,
+// which creates and seeds the tables of new ones.
+func openTenants(setup func(db *sql.DB)) error {
+	tenants = []*Tenant{{}}
+	if spec := os.Getenv("TENANTS"); spec != "" {
+		parsed, err := parseTenants(spec)
+		if err != nil {
+			return err
+		}
+		tenants = parsed
+		if dir := os.Getenv("TENANT_DATA_DIR"); dir != "" {
+			tenantDataDir = dir
+		}
+		if err := os.MkdirAll(tenantDataDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range tenants {
+		path := "./m4chinemind.db"
+		if t.ID != "" {
+			path = filepath.Join(tenantDataDir, t.ID+".db")
+		}
+		var err error
+		if t.db, err = sql.Open("sqlite3", path+sqliteOptions); err != nil {
+			return err
+		}
+		tenantsByID[t.ID] = t
+		for _, host := range t.Hosts {
+			if other, ok := tenantsByHost[host]; ok {
+				return fmt.Errorf("host %q is served by both tenant %q and %q", host, other.ID, t.ID)
+			}
+			tenantsByHost[host] = t
+		}
+	}
+	for _, t := range tenants {
+		setup(t.db)
+	}
+	return nil
+}
+
+func closeTenants() {
+	for _, t := range tenants {
+		t.db.Close()
+	}
+}
+
+// forEachTenant runs fn on each tenant in turn, for work that is not done
+// on behalf of a request.
+func forEachTenant(fn func(t *Tenant)) {
+	for _, t := range tenants {
+		fn(t)
+	}
+}
+
+// resolveTenant returns the tenant of a request: the one served on its
+// host, or else the one of its access or feed token, or else the one named
+// by the X-Tenant header.
+func resolveTenant(r *http.Request) (*Tenant, bool) {
+	if len(tenants) == 1 && tenants[0].ID == "" {
+		return tenants[0], true
+	}
+
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); trustProxyHeaders && forwarded != "" {
+		host, _, _ = strings.Cut(forwarded, ",")
+		host = strings.TrimSpace(host)
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t, ok := tenantsByHost[strings.ToLower(host)]; ok {
+		return t, true
+	}
+
+	token, ok := bearerToken(r)
+	if !ok && r.URL.Path == calendarFeedPath {
+		token = r.URL.Query().Get("token")
+	}
+	if id, _, found := strings.Cut(token, "."); found {
+		t, ok := tenantsByID[id]
+		return t, ok
+	}
+	t, ok := tenantsByID[strings.TrimSpace(r.Header.Get(tenantHeader))]
+	return t, ok
+}
+
+// tenantMiddleware resolves the tenant of every /api/ request and puts it in
+// the context of the request. The requests of different tenants run side by
+// side, each on the database of its own tenant.
+func tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, ok := resolveTenant(r)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown tenant: use the host of a tenant or send its ID in %s", tenantHeader), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey, t)))
+	})
+}
+
+// requestTenant returns the tenant of a request, set by tenantMiddleware.
+func requestTenant(r *http.Request) *Tenant {
+	if t, ok := r.Context().Value(tenantContextKey).(*Tenant); ok {
+		return t
+	}
+	// Every /api/ route is served behind tenantMiddleware; querying no
+	// database is safer than querying another tenant's
+	panic("no tenant resolved for " + r.URL.Path)
+}
+
+// tenantDB returns the database of the tenant of a request.
+func tenantDB(r *http.Request) *sql.DB {
+	return requestTenant(r).db
+}
+
+// tenantMutex returns the mutex of the tenant of a request.
+func tenantMutex(r *http.Request) *sync.Mutex {
+	return &requestTenant(r).mutex
+}
+
+// tenantToken prefixes a token with the ID of its tenant, which resolves
+// the tenant of the requests that carry it. Tokens of the single tenant of
+// an installation without TENANTS are left as they are.
+func tenantToken(t *Tenant, token string) string {
+	if t.ID == "" {
+		return token
+	}
+	return t.ID + "." + token
+}
+
+// tenantStorageKey prefixes an attachment storage key with the ID of its
+// tenant, keeping the files of each tenant apart.
+func tenantStorageKey(t *Tenant, key string) string {
+	if t.ID == "" {
+		return key
+	}
+	return t.ID + "/" + key
+}
+
+// label describes the tenant for log messages.
+func (t *Tenant) label() string {
+	if t.ID == "" {
+		return ""
+	}
+	return fmt.Sprintf(" for tenant %q", t.ID)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTenantsSeeNothingOfEachOther creates every fixture of the role tests
+// in one tenant and reads every GET route of them as the admin of another,
+// which must not see any of it.
+func TestTenantsSeeNothingOfEachOther(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	other := signInAdmin(t, testOtherTenant)
+
+	fixtures := &rbacFixtures{admin: admin, caller: admin, ids: map[string]string{}}
+	names := make([]string, 0, len(rbacFixtureCreators))
+	for name := range rbacFixtureCreators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fixtures.get(name)
+	}
+	admin.create(fixtures.expand("/api/machines/{machine}/sensors/{sensor}/readings"), `{"value":71.5,"unit":"C","notes":"RBAC reading"}`)
+
+	// leaks returns the fixtures found in a response, but for those asked
+	// for by ID, which some routes echo back
+	leaks := func(path, body string) []string {
+		var found []string
+		for name, id := range fixtures.ids {
+			if !strings.Contains(path, id) && strings.Contains(body, id) {
+				found = append(found, name)
+			}
+		}
+		// Every fixture is named or described with it
+		if strings.Contains(body, "RBAC") {
+			found = append(found, "RBAC")
+		}
+		return found
+	}
+
+	for _, c := range rbacCases {
+		if c.method != "GET" {
+			continue
+		}
+		path := fixtures.expand(c.path)
+		rec := other.do("GET", path, "")
+		if found := leaks(path, rec.Body.String()); len(found) > 0 {
+			t.Errorf("GET %s in %s: %d with %v of %s", c.path, testOtherTenant, rec.Code, found, testTenant)
+		}
+		if strings.Contains(c.path, "{") && rec.Code >= 200 && rec.Code <= 299 && rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("GET %s in %s: %d, a %s of %s", c.path, testOtherTenant, rec.Code, rec.Header().Get("Content-Type"), testTenant)
+		}
+	}
+
+	for _, fixture := range []string{"machineAttachment", "maintenanceAttachment", "requestAttachment"} {
+		if rec := other.do("GET", "/api/attachments/"+fixtures.ids[fixture], ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s of %s in %s: got %d, want 404", fixture, testTenant, testOtherTenant, rec.Code)
+		}
+	}
+
+	// The calendar feed opened with a feed token of the other tenant
+	feed := other.do("POST", "/api/calendar/feeds", `{"name":"Other feed"}`)
+	var f CalendarFeed
+	if err := json.Unmarshal(feed.Body.Bytes(), &f); err != nil || f.Token == "" {
+		t.Fatalf("feed: %d %s", feed.Code, feed.Body)
+	}
+	ics := (&testClient{t: t}).do("GET", calendarFeedPath+"?token="+f.Token, "")
+	if ics.Code != http.StatusOK {
+		t.Fatalf("feed: %d %s", ics.Code, ics.Body)
+	}
+	if found := leaks("", ics.Body.String()); len(found) > 0 {
+		t.Errorf("calendar feed of %s: %v of %s", testOtherTenant, found, testTenant)
+	}
+}
+
+// TestTokensOnlyOpenTheirTenant checks that a token is not accepted in
+// another tenant, whatever the X-Tenant header says.
+func TestTokensOnlyOpenTheirTenant(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	id := admin.create("/api/machines", `{"name":"RBAC tenant press","status":"Operando","model":"TP-1"}`)
+
+	header := &testClient{t: t, tenant: testOtherTenant, token: admin.token}
+	if rec := header.do("GET", "/api/machines/"+id, ""); rec.Code != http.StatusOK {
+		t.Errorf("token of %s sent with X-Tenant %s: got %d, want the machine of %s", testTenant, testOtherTenant, rec.Code, testTenant)
+	}
+
+	_, raw, _ := strings.Cut(admin.token, ".")
+	moved := &testClient{t: t, token: testOtherTenant + "." + raw}
+	if rec := moved.do("GET", "/api/machines", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token of %s moved to %s: got %d, want 401", testTenant, testOtherTenant, rec.Code)
+	}
+}
+
+// TestTenantsDoNotWaitForEachOther serves a request of one tenant while the
+// mutex of another is held.
+func TestTenantsDoNotWaitForEachOther(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	other := signInAdmin(t, testOtherTenant)
+
+	busy := &tenantsByID[admin.tenant].mutex
+	busy.Lock()
+	done := make(chan int)
+	go func() {
+		done <- other.do("GET", "/api/machines", "").Code
+	}()
+	select {
+	case code := <-done:
+		busy.Unlock()
+		if code != http.StatusOK {
+			t.Errorf("machines of %s: %d", testOtherTenant, code)
+		}
+	case <-time.After(5 * time.Second):
+		busy.Unlock()
+		<-done
+		t.Errorf("a request of %s waited for %s", testOtherTenant, testTenant)
+	}
+}
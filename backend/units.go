@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// quantityEpsilon absorbs the rounding of decimal quantities when they are
+// compared, e.g. three issues of 0.1 l against 0.3 l on hand.
+const quantityEpsilon = 1e-9
+
+func sameQuantity(a, b float64) bool {
+	return math.Abs(a-b) < quantityEpsilon
+}
+
+// Unit is a unit of measure. Units of the same dimension convert into each
+// other through Factor, the size of the unit in the dimension's base unit
+// (1 for the base unit itself, 0.001 for ml when l is the base).
+type Unit struct {
+	Code      string  `json:"code"`
+	Name      string  `json:"name"`
+	Dimension string  `json:"dimension"`
+	Factor    float64 `json:"factor"`
+}
+
+// defaultUnits seeds the catalog of a new database.
+var defaultUnits = []Unit{
+	{Code: "un", Name: "unit", Dimension: "count", Factor: 1},
+	{Code: "pair", Name: "pair", Dimension: "count", Factor: 2},
+	{Code: "dozen", Name: "dozen", Dimension: "count", Factor: 12},
+	{Code: "l", Name: "liter", Dimension: "volume", Factor: 1},
+	{Code: "ml", Name: "milliliter", Dimension: "volume", Factor: 0.001},
+	{Code: "kg", Name: "kilogram", Dimension: "mass", Factor: 1},
+	{Code: "g", Name: "gram", Dimension: "mass", Factor: 0.001},
+	{Code: "m", Name: "meter", Dimension: "length", Factor: 1},
+	{Code: "cm", Name: "centimeter", Dimension: "length", Factor: 0.01},
+	{Code: "mm", Name: "millimeter", Dimension: "length", Factor: 0.001},
+}
+
+// seedUnits fills an empty catalog with defaultUnits and moves the free-text
+// units of existing stock items onto catalog codes. Units that match no code
+// or name are added to the catalog as their own dimension.
+func seedUnits(db *sql.DB) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM units").Scan(&count); err != nil {
+		log.Fatalf("Failed to seed units: %v", err)
+	}
+	if count == 0 {
+		for _, u := range defaultUnits {
+			if _, err := db.Exec("INSERT INTO units (code, name, dimension, factor) VALUES (?, ?, ?, ?)", u.Code, u.Name, u.Dimension, u.Factor); err != nil {
+				log.Fatalf("Failed to seed units: %v", err)
+			}
+		}
+	}
+
+	rows, err := db.Query("SELECT DISTINCT unit FROM stock WHERE unit NOT IN (SELECT code FROM units)")
+	if err != nil {
+		log.Fatalf("Failed to seed units: %v", err)
+	}
+	var unknown []string
+	for rows.Next() {
+		var unit string
+		if err := rows.Scan(&unit); err != nil {
+			log.Fatalf("Failed to seed units: %v", err)
+		}
+		unknown = append(unknown, unit)
+	}
+	rows.Close()
+
+	for _, text := range unknown {
+		code, err := resolveUnit(db, text)
+		if err != nil {
+			code = strings.TrimSpace(text)
+			if code == "" {
+				code = "un"
+			} else if _, err := db.Exec("INSERT OR IGNORE INTO units (code, name, dimension, factor) VALUES (?, ?, ?, 1)", code, code, code); err != nil {
+				log.Fatalf("Failed to seed units: %v", err)
+			}
+		}
+		if _, err := db.Exec("UPDATE stock SET unit = ? WHERE unit = ?", code, text); err != nil {
+			log.Fatalf("Failed to seed units: %v", err)
+		}
+	}
+}
+
+// resolveUnit returns the catalog code of a unit given by code or name,
+// ignoring case.
+func resolveUnit(q queryer, text string) (string, error) {
+	text = strings.TrimSpace(text)
+	var code string
+	err := q.QueryRow("SELECT code FROM units WHERE code = ? OR LOWER(code) = LOWER(?) OR LOWER(name) = LOWER(?) ORDER BY code = ? DESC LIMIT 1", text, text, text, text).Scan(&code)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("unknown unit %q", text)
+	}
+	return code, err
+}
+
+func loadUnit(q queryer, code string) (Unit, error) {
+	var u Unit
+	err := q.QueryRow("SELECT code, name, dimension, factor FROM units WHERE code = ?", code).Scan(&u.Code, &u.Name, &u.Dimension, &u.Factor)
+	if err == sql.ErrNoRows {
+		return u, fmt.Errorf("unknown unit %q", code)
+	}
+	return u, err
+}
+
+// stockUnitFactor returns how many stock units of the item make up one of the
+// given unit. The item's purchase unit converts with its own factor (a box
+// of 12 pieces); other units convert through the catalog and must share the
+// stock unit's dimension. An empty unit is the stock unit.
+func stockUnitFactor(q queryer, stockID, unit string) (float64, error) {
+	var stockUnit, purchaseUnit string
+	var purchaseFactor float64
+	err := q.QueryRow("SELECT unit, purchaseUnit, purchaseFactor FROM stock WHERE id = ?", stockID).Scan(&stockUnit, &purchaseUnit, &purchaseFactor)
+	if err != nil {
+		return 0, err
+	}
+	if unit == "" || unit == stockUnit {
+		return 1, nil
+	}
+	code, err := resolveUnit(q, unit)
+	if err != nil {
+		return 0, err
+	}
+	if code == stockUnit {
+		return 1, nil
+	}
+	if code == purchaseUnit && purchaseFactor > 0 {
+		return purchaseFactor, nil
+	}
+	return unitConversion(q, code, stockUnit)
+}
+
+// unitConversion returns the number of to units in one from unit. Both units
+// must share a dimension.
+func unitConversion(q queryer, from, to string) (float64, error) {
+	fromUnit, err := loadUnit(q, from)
+	if err != nil {
+		return 0, err
+	}
+	toUnit, err := loadUnit(q, to)
+	if err != nil {
+		return 0, err
+	}
+	if fromUnit.Dimension != toUnit.Dimension || toUnit.Factor <= 0 {
+		return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+	}
+	return fromUnit.Factor / toUnit.Factor, nil
+}
+
+// resolveItemUnits moves the units of a stock item onto catalog codes. Items
+// without a unit are counted in "un". A purchase unit without a factor must
+// convert to the stock unit through the catalog; packaging units such as a
+// box of 12 give their factor explicitly.
+func resolveItemUnits(q queryer, item *StockItem) error {
+	if strings.TrimSpace(item.Unit) == "" {
+		item.Unit = "un"
+	}
+	var err error
+	if item.Unit, err = resolveUnit(q, item.Unit); err != nil {
+		return err
+	}
+	if strings.TrimSpace(item.PurchaseUnit) == "" {
+		item.PurchaseUnit = ""
+		item.PurchaseFactor = 0
+		return nil
+	}
+	if item.PurchaseUnit, err = resolveUnit(q, item.PurchaseUnit); err != nil {
+		return err
+	}
+	if item.PurchaseFactor < 0 {
+		return fmt.Errorf("purchaseFactor cannot be negative")
+	}
+	if item.PurchaseFactor == 0 {
+		if item.PurchaseFactor, err = unitConversion(q, item.PurchaseUnit, item.Unit); err != nil {
+			return fmt.Errorf("purchaseFactor is required: %v", err)
+		}
+	}
+	return nil
+}
+
+// Unit handlers
+func unitsHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listUnits(w, r)
+	case "POST":
+		createUnit(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func unitHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	code := strings.TrimPrefix(r.URL.Path, "/api/units/")
+
+	if _, err := loadUnit(db, code); err != nil {
+		http.Error(w, "Unit not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		updateUnit(w, r, code)
+	case "DELETE":
+		deleteUnit(w, r, code)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listUnits(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT code, name, dimension, factor FROM units ORDER BY dimension, factor")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	units := []Unit{}
+	for rows.Next() {
+		var u Unit
+		if err := rows.Scan(&u.Code, &u.Name, &u.Dimension, &u.Factor); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		units = append(units, u)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(units)
+}
+
+func validateUnit(u *Unit) error {
+	u.Code = strings.TrimSpace(u.Code)
+	if u.Code == "" || strings.Contains(u.Code, "/") {
+		return fmt.Errorf("code is required and cannot contain '/'")
+	}
+	if u.Dimension == "" {
+		u.Dimension = u.Code
+	}
+	if u.Factor <= 0 {
+		return fmt.Errorf("factor must be positive")
+	}
+	return nil
+}
+
+func createUnit(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var u Unit
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateUnit(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := loadUnit(db, u.Code); err == nil {
+		http.Error(w, "Unit already exists", http.StatusConflict)
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO units (code, name, dimension, factor) VALUES (?, ?, ?, ?)", u.Code, u.Name, u.Dimension, u.Factor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+// updateUnit changes the name, dimension or factor of a unit. The code is
+// referenced by stock items and cannot change.
+func updateUnit(w http.ResponseWriter, r *http.Request, code string) {
+	db := tenantDB(r)
+	var u Unit
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.Code = code
+	if err := validateUnit(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec("UPDATE units SET name = ?, dimension = ?, factor = ? WHERE code = ?", u.Name, u.Dimension, u.Factor, code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+func deleteUnit(w http.ResponseWriter, r *http.Request, code string) {
+	db := tenantDB(r)
+	var used bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM stock WHERE unit = ? OR purchaseUnit = ?)", code, code).Scan(&used); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if used {
+		http.Error(w, "Unit is used by stock items", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM units WHERE code = ?", code); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// User is a login account. The password hash is never part of it; passwords
+// are only accepted through userInput and the password endpoint.
+type User struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	Active    bool   `json:"active"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// userInput is the body of user create and update requests.
+type userInput struct {
+	User
+	Password string `json:"password"`
+}
+
+// userColumns is the column list read by scanUser; userColumnsPrefixed is
+// the same list for queries that join users as u.
+const (
+	userColumns         = "id, username, name, email, role, active, createdAt"
+	userColumnsPrefixed = "u.id, u.username, u.name, u.email, u.role, u.active, u.createdAt"
+)
+
+// scanUser scans a row selected with userColumns, followed by any extra
+// columns into extra.
+func scanUser(row rowScanner, u *User, extra ...interface{}) error {
+	dest := append([]interface{}{&u.ID, &u.Username, &u.Name, &u.Email, &u.Role, &u.Active, &u.CreatedAt}, extra...)
+	return row.Scan(dest...)
+}
+
+// User handlers
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listUsers(w, r)
+	case "POST":
+		createUser(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/api/users/")
+
+	var user User
+	err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id), &user)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user)
+	case "PUT":
+		updateUser(w, r, user)
+	case "DELETE":
+		deleteUser(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := scanUser(rows, &u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		users = append(users, u)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func usernameTaken(q queryer, username, exceptID string) (bool, error) {
+	var taken bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? COLLATE NOCASE AND id != ?)", username, exceptID).Scan(&taken)
+	return taken, err
+}
+
+// validateUserRole checks that the role of a user exists, defaulting to
+// operator.
+func validateUserRole(q queryer, u *User) (int, error) {
+	if u.Role == "" {
+		u.Role = roleOperator
+	}
+	exists, err := roleExists(q, u.Role)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !exists {
+		return http.StatusBadRequest, fmt.Errorf("unknown role %q", u.Role)
+	}
+	return 0, nil
+}
+
+// isLastAdmin reports whether id is the only active admin left.
+func isLastAdmin(q queryer, id string) (bool, error) {
+	var others bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE role = ? AND active = 1 AND id != ?)", roleAdmin, id).Scan(&others)
+	return !others, err
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var in userInput
+	in.Active = true
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	in.Username = strings.TrimSpace(in.Username)
+	if in.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if status, err := validateUserRole(db, &in.User); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	hash, err := hashPassword(in.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	taken, err := usernameTaken(db, in.Username, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	}
+
+	user := in.User
+	user.ID = uuid.New().String()
+	user.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	_, err = db.Exec("INSERT INTO users (id, username, passwordHash, name, email, role, active, createdAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		user.ID, user.Username, hash, user.Name, user.Email, user.Role, user.Active, user.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// updateUser changes a user's details. A new password, or deactivation,
+// ends the user's sessions.
+func updateUser(w http.ResponseWriter, r *http.Request, existing User) {
+	db := tenantDB(r)
+	in := userInput{User: existing}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	in.Username = strings.TrimSpace(in.Username)
+	if in.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if self, ok := currentUser(r); ok && self.ID == existing.ID && !in.Active {
+		http.Error(w, "You cannot deactivate your own account", http.StatusConflict)
+		return
+	}
+	if status, err := validateUserRole(db, &in.User); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if existing.Role == roleAdmin && existing.Active && (in.Role != roleAdmin || !in.Active) {
+		last, err := isLastAdmin(db, existing.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if last {
+			http.Error(w, "At least one active admin is required", http.StatusConflict)
+			return
+		}
+	}
+	taken, err := usernameTaken(db, in.Username, existing.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Username is already taken", http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if in.Password != "" {
+		hash, err := hashPassword(in.Password)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := tx.Exec("UPDATE users SET passwordHash = ? WHERE id = ?", hash, existing.ID); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = tx.Exec("UPDATE users SET username = ?, name = ?, email = ?, role = ?, active = ? WHERE id = ?", in.Username, in.Name, in.Email, in.Role, in.Active, existing.ID)
+	if err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if in.Password != "" || !in.Active {
+		if err := revokeSessions(tx, existing.ID, ""); err != nil {
+			tx.Rollback()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	user := in.User
+	user.ID, user.CreatedAt = existing.ID, existing.CreatedAt
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	if self, ok := currentUser(r); ok && self.ID == id {
+		http.Error(w, "You cannot delete your own account", http.StatusConflict)
+		return
+	}
+	last, err := isLastAdmin(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE id = ?", id).Scan(&role); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role == roleAdmin && last {
+		http.Error(w, "At least one active admin is required", http.StatusConflict)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM sessions WHERE userId = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE operators SET userId = '' WHERE userId = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,781 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Valuation methods supported for stock items.
+const (
+	valuationFIFO    = "fifo"
+	valuationAverage = "average"
+)
+
+// Stock movement types. Positive quantities bring stock in at the movement's
+// unit cost, negative quantities take stock out at the cost given by the
+// item's valuation method.
+const (
+	movementOpening    = "opening"
+	movementReceipt    = "receipt"
+	movementIssue      = "issue"
+	movementReturn     = "return"
+	movementAdjustment = "adjustment"
+
+	// Transfers move stock between locations in pairs of movements and are
+	// left out of the valuation.
+	movementTransfer = "transfer"
+)
+
+// stockError is a stock movement that cannot be made as asked, such as the
+// issue of a lot that is not in stock. It is reported with status rather
+// than as a server error.
+type stockError struct {
+	status int
+	err    error
+}
+
+func (e *stockError) Error() string { return e.err.Error() }
+
+func (e *stockError) Unwrap() error { return e.err }
+
+// stockErrorStatus returns the status err is reported with: that of a
+// stockError, or 500 for any other error.
+func stockErrorStatus(err error) int {
+	var se *stockError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return http.StatusInternalServerError
+}
+
+// StockMovement is an entry of the stock ledger.
+type StockMovement struct {
+	ID            string  `json:"id"`
+	StockID       string  `json:"stockId"`
+	Date          string  `json:"date"`
+	Type          string  `json:"type"`
+	Quantity      float64 `json:"quantity"`
+	UnitCost      float64 `json:"unitCost"`
+	Reference     string  `json:"reference,omitempty"`
+	MaintenanceID string  `json:"maintenanceId,omitempty"`
+
+	PurchaseOrderID string `json:"purchaseOrderId,omitempty"`
+
+	// UserID is the user who made the change that caused the movement.
+	UserID string `json:"userId,omitempty"`
+
+	// Unit a receipt's quantity and unit cost are given in, when it is not
+	// the stock unit. They are converted before the movement is recorded.
+	Unit string `json:"unit,omitempty"`
+
+	// Location the quantity enters or leaves.
+	StockLocation
+
+	// Lots or serial numbers moved, for lot and serial tracked items.
+	Lots []LotQuantity `json:"lots,omitempty"`
+}
+
+const movementColumns = "id, stockId, date, type, quantity, unitCost, reference, maintenanceId, purchaseOrderId, warehouseId, binId, userId"
+
+func scanMovement(row rowScanner, m *StockMovement) error {
+	return row.Scan(&m.ID, &m.StockID, &m.Date, &m.Type, &m.Quantity, &m.UnitCost, &m.Reference, &m.MaintenanceID, &m.PurchaseOrderID, &m.WarehouseID, &m.BinID, &m.UserID)
+}
+
+// StockValuationItem is a line of the inventory valuation report.
+type StockValuationItem struct {
+	StockID         string  `json:"stockId"`
+	Name            string  `json:"name"`
+	Unit            string  `json:"unit"`
+	ValuationMethod string  `json:"valuationMethod"`
+	Quantity        float64 `json:"quantity"`
+	UnitCost        float64 `json:"unitCost"`
+	TotalValue      float64 `json:"totalValue"`
+}
+
+type costLayer struct {
+	quantity float64
+	unitCost float64
+}
+
+// inventoryPosition is the quantity and value of a stock item obtained by
+// replaying its movements with the item's valuation method. Only a positive
+// quantity has a value; lastCost values the item while it has none.
+type inventoryPosition struct {
+	method   string
+	quantity float64
+	value    float64
+	layers   []costLayer // FIFO only, oldest first
+	lastCost float64
+}
+
+// receive brings quantity into the position. Goods received against a
+// negative quantity make up for goods already issued, and costed, so only
+// the rest is added to the value.
+func (p *inventoryPosition) receive(quantity, unitCost float64) {
+	onHand := quantity
+	if p.quantity < 0 {
+		onHand += p.quantity
+	}
+	p.quantity += quantity
+	p.lastCost = unitCost
+	if onHand <= 0 {
+		return
+	}
+	p.value += onHand * unitCost
+	if p.method == valuationFIFO {
+		p.layers = append(p.layers, costLayer{quantity: onHand, unitCost: unitCost})
+	}
+}
+
+// issue takes quantity out of the position and returns its total cost.
+// Quantities issued beyond what is on hand are costed at fallbackCost.
+func (p *inventoryPosition) issue(quantity, fallbackCost float64) float64 {
+	var cost float64
+	if p.method == valuationFIFO {
+		remaining := quantity
+		for remaining > 0 && len(p.layers) > 0 {
+			layer := &p.layers[0]
+			taken := remaining
+			if layer.quantity < taken {
+				taken = layer.quantity
+			}
+			cost += taken * layer.unitCost
+			layer.quantity -= taken
+			remaining -= taken
+			if layer.quantity <= 0 {
+				p.layers = p.layers[1:]
+			}
+		}
+		cost += remaining * fallbackCost
+	} else {
+		onHand := quantity
+		if p.quantity < onHand {
+			onHand = p.quantity
+		}
+		if onHand > 0 {
+			cost = onHand * p.value / p.quantity
+		} else {
+			onHand = 0
+		}
+		cost += (quantity - onHand) * fallbackCost
+	}
+
+	p.quantity -= quantity
+	p.value -= cost
+	if p.quantity <= 0 {
+		p.value = 0
+		p.layers = nil
+		p.lastCost = cost / quantity
+	}
+	return cost
+}
+
+// unitCost returns the value of one unit on hand, or the last known cost
+// when nothing is on hand.
+func (p *inventoryPosition) unitCost() float64 {
+	if p.quantity > 0 {
+		return p.value / p.quantity
+	}
+	return p.lastCost
+}
+
+// loadPosition replays the movements of a stock item dated before the given
+// RFC 3339 timestamp, or all of them when before is empty.
+func loadPosition(q queryer, stockID, before string) (*inventoryPosition, error) {
+	pos := &inventoryPosition{}
+	var value float64
+	err := q.QueryRow("SELECT valuationMethod, value FROM stock WHERE id = ?", stockID).Scan(&pos.method, &value)
+	if err != nil {
+		return nil, err
+	}
+	pos.lastCost = value
+
+	query := "SELECT quantity, unitCost FROM stock_movements WHERE stockId = ? AND type != ?"
+	args := []interface{}{stockID, movementTransfer}
+	if before != "" {
+		query += " AND date < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY date, rowid"
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var quantity, unitCost float64
+		if err := rows.Scan(&quantity, &unitCost); err != nil {
+			return nil, err
+		}
+		pos.apply(quantity, unitCost)
+	}
+	return pos, rows.Err()
+}
+
+// apply adds a movement of quantity at unitCost to the position. Goods taken
+// out are costed by the position, whatever the cost on the movement.
+func (p *inventoryPosition) apply(quantity, unitCost float64) {
+	if quantity >= 0 {
+		p.receive(quantity, unitCost)
+	} else {
+		p.issue(-quantity, p.unitCost())
+	}
+}
+
+// currentPosition returns the position a stock item is left in by all of its
+// movements. postMovement keeps it up to date in the stock row and, for FIFO
+// items, in stock_cost_layers, so that the ledger is not replayed on every
+// movement.
+func currentPosition(q queryer, stockID string) (*inventoryPosition, error) {
+	pos := &inventoryPosition{}
+	var unitCost float64
+	err := q.QueryRow("SELECT valuationMethod, quantity, value FROM stock WHERE id = ?", stockID).Scan(&pos.method, &pos.quantity, &unitCost)
+	if err != nil {
+		return nil, err
+	}
+	pos.lastCost = unitCost
+	if pos.quantity <= 0 {
+		return pos, nil
+	}
+	if pos.method != valuationFIFO {
+		pos.value = pos.quantity * unitCost
+		return pos, nil
+	}
+
+	rows, err := q.Query("SELECT quantity, unitCost FROM stock_cost_layers WHERE stockId = ? ORDER BY rowid", stockID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var layer costLayer
+		if err := rows.Scan(&layer.quantity, &layer.unitCost); err != nil {
+			return nil, err
+		}
+		pos.layers = append(pos.layers, layer)
+		pos.value += layer.quantity * layer.unitCost
+	}
+	return pos, rows.Err()
+}
+
+// savePosition stores the position of a stock item for currentPosition.
+func savePosition(tx *sql.Tx, stockID string, pos *inventoryPosition) error {
+	if _, err := tx.Exec("UPDATE stock SET value = ? WHERE id = ?", pos.unitCost(), stockID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM stock_cost_layers WHERE stockId = ?", stockID); err != nil {
+		return err
+	}
+	for _, layer := range pos.layers {
+		if _, err := tx.Exec("INSERT INTO stock_cost_layers (stockId, quantity, unitCost) VALUES (?, ?, ?)", stockID, layer.quantity, layer.unitCost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateMovementDate checks the date of a movement that brings stock in.
+// Movements are valued in date order, and the cost of the goods issued since
+// the date is on record, so a movement may not be dated before the latest
+// valued one, nor in the future, where the issues of the meantime would
+// precede it.
+func validateMovementDate(q queryer, stockID, date string) (int, error) {
+	if date == "" {
+		return 0, nil
+	}
+	if date > time.Now().UTC().Format(time.RFC3339) {
+		return http.StatusBadRequest, errors.New("date cannot be in the future")
+	}
+	var latest string
+	err := q.QueryRow("SELECT COALESCE(MAX(date), '') FROM stock_movements WHERE stockId = ? AND type != ?", stockID, movementTransfer).Scan(&latest)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if date < latest {
+		return http.StatusConflict, fmt.Errorf("date cannot be before the latest stock movement of the item, on %s", latest)
+	}
+	return 0, nil
+}
+
+// postMovement appends a movement to the ledger and applies it to the stock
+// item's quantity at the movement's location, its total quantity and its
+// current position. Movements without a location are resolved with
+// resolveLocation. Transfers leave the position as it is.
+func postMovement(tx *sql.Tx, m *StockMovement) error {
+	m.ID = uuid.New().String()
+	if m.Date == "" {
+		m.Date = time.Now().UTC().Format(time.RFC3339)
+	} else if m.Type != movementTransfer {
+		if status, err := validateMovementDate(tx, m.StockID, m.Date); err != nil {
+			return &stockError{status, err}
+		}
+	}
+	if err := resolveLocation(tx, m.StockID, &m.StockLocation); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("INSERT INTO stock_movements ("+movementColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.ID, m.StockID, m.Date, m.Type, m.Quantity, m.UnitCost, m.Reference, m.MaintenanceID, m.PurchaseOrderID, m.WarehouseID, m.BinID, m.UserID)
+	if err != nil {
+		return err
+	}
+	if err := changeStockLevel(tx, m.StockID, m.StockLocation, m.Quantity); err != nil {
+		return err
+	}
+	if err := applyLots(tx, m); err != nil {
+		return err
+	}
+
+	pos, err := currentPosition(tx, m.StockID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE stock SET quantity = quantity + ? WHERE id = ?", m.Quantity, m.StockID); err != nil {
+		return err
+	}
+	if m.Type == movementTransfer {
+		return nil
+	}
+	pos.apply(m.Quantity, m.UnitCost)
+	return savePosition(tx, m.StockID, pos)
+}
+
+// issueStock takes quantity out of stock at loc for a maintenance and returns
+// the unit cost of the issued goods under the item's valuation method. lots
+// names the lots or serial numbers issued, for tracked items.
+func issueStock(tx *sql.Tx, userID string, stockID string, quantity float64, maintenanceID string, loc StockLocation, lots []LotQuantity) (float64, error) {
+	pos, err := currentPosition(tx, stockID)
+	if err != nil {
+		return 0, err
+	}
+	unitCost := pos.issue(quantity, pos.unitCost()) / quantity
+
+	err = postMovement(tx, &StockMovement{StockID: stockID, Type: movementIssue, Quantity: -quantity, UnitCost: unitCost, MaintenanceID: maintenanceID, StockLocation: loc, Lots: lots, UserID: userID})
+	return unitCost, err
+}
+
+// returnStock puts goods issued to a maintenance back into stock at loc, at
+// the cost they were issued with.
+func returnStock(tx *sql.Tx, userID string, stockID string, quantity float64, unitCost float64, maintenanceID string, loc StockLocation, lots []LotQuantity) error {
+	return postMovement(tx, &StockMovement{StockID: stockID, Type: movementReturn, Quantity: quantity, UnitCost: unitCost, MaintenanceID: maintenanceID, StockLocation: loc, Lots: lots, UserID: userID})
+}
+
+// adjustStock corrects the quantity of a stock item at loc. Increases are
+// valued at the item's current unit cost.
+func adjustStock(tx *sql.Tx, userID string, stockID string, delta float64, reference string, loc StockLocation, lots []LotQuantity) error {
+	pos, err := currentPosition(tx, stockID)
+	if err != nil {
+		return err
+	}
+	unitCost := pos.unitCost()
+	if delta < 0 {
+		unitCost = pos.issue(-delta, pos.unitCost()) / -delta
+	}
+	return postMovement(tx, &StockMovement{StockID: stockID, Type: movementAdjustment, Quantity: delta, UnitCost: unitCost, Reference: reference, StockLocation: loc, Lots: lots, UserID: userID})
+}
+
+// syncUsedStock replaces the stock lines of a maintenance with items. Lines of
+// an open maintenance only reserve stock; when issue is set (the maintenance
+// is completed) the lines are issued from stock. Added quantities are issued
+// and removed quantities returned, so the ledger always matches what the
+// maintenance consumed. The unit cost of an issued line is the weighted cost
+// of everything issued for it.
+//
+// Goods are issued from the line's location, or from the location chosen by
+// resolveLocation when it has none; moving an issued line to another location,
+// or changing its lots, returns it and issues it again.
+func syncUsedStock(tx *sql.Tx, userID string, maintenanceID string, items []UsedStockItem, issue bool) error {
+	type line struct {
+		quantity float64
+		unitCost float64
+		issued   bool
+		location StockLocation
+		lots     []LotQuantity
+	}
+	previous := make(map[string]line)
+	rows, err := tx.Query("SELECT stockId, quantity, unitCost, issued, warehouseId, binId FROM maintenance_stock WHERE maintenanceId = ?", maintenanceID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var stockID string
+		var l line
+		if err := rows.Scan(&stockID, &l.quantity, &l.unitCost, &l.issued, &l.location.WarehouseID, &l.location.BinID); err != nil {
+			rows.Close()
+			return err
+		}
+		previous[stockID] = l
+	}
+	rows.Close()
+
+	lotRows, err := tx.Query("SELECT stockId, lot, quantity FROM maintenance_stock_lots WHERE maintenanceId = ? ORDER BY rowid", maintenanceID)
+	if err != nil {
+		return err
+	}
+	for lotRows.Next() {
+		var stockID string
+		var lot LotQuantity
+		if err := lotRows.Scan(&stockID, &lot.Lot, &lot.Quantity); err != nil {
+			lotRows.Close()
+			return err
+		}
+		l := previous[stockID]
+		l.lots = append(l.lots, lot)
+		previous[stockID] = l
+	}
+	lotRows.Close()
+
+	if _, err := tx.Exec("DELETE FROM maintenance_stock WHERE maintenanceId = ?", maintenanceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM maintenance_stock_lots WHERE maintenanceId = ?", maintenanceID); err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		if item.Quantity <= 0 {
+			return &stockError{http.StatusBadRequest, errors.New("used stock quantities must be positive")}
+		}
+		if item.Unit != "" {
+			factor, err := stockUnitFactor(tx, item.StockID, item.Unit)
+			if err != nil {
+				return &stockError{http.StatusBadRequest, err}
+			}
+			item.Quantity *= factor
+		}
+		if err := tx.QueryRow("SELECT unit FROM stock WHERE id = ?", item.StockID).Scan(&item.Unit); err != nil {
+			return err
+		}
+		old := previous[item.StockID]
+		delete(previous, item.StockID)
+		if !old.issued {
+			old = line{}
+		}
+		if item.WarehouseID != "" || item.BinID != "" {
+			if err := resolveLocation(tx, item.StockID, &item.StockLocation); err != nil {
+				return err
+			}
+		}
+		if len(item.Lots) == 0 && old.issued {
+			item.Lots = old.lots
+		}
+		if len(item.Lots) > 0 {
+			tracking, err := stockTracking(tx, item.StockID)
+			if err != nil {
+				return err
+			}
+			if err := normalizeLots(tracking, item.Quantity, item.Lots); err != nil {
+				return &stockError{http.StatusBadRequest, err}
+			}
+		}
+
+		unitCost := old.unitCost
+		if issue {
+			if item.WarehouseID == "" {
+				if old.issued {
+					item.StockLocation = old.location
+				} else if err := resolveLocation(tx, item.StockID, &item.StockLocation); err != nil {
+					return err
+				}
+			}
+			if old.issued && (old.location != item.StockLocation || !sameLots(old.lots, item.Lots)) {
+				if err := returnStock(tx, userID, item.StockID, old.quantity, old.unitCost, maintenanceID, old.location, old.lots); err != nil {
+					return err
+				}
+				old = line{}
+			}
+
+			switch delta := item.Quantity - old.quantity; {
+			case delta > 0:
+				issuedCost, err := issueStock(tx, userID, item.StockID, delta, maintenanceID, item.StockLocation, item.Lots)
+				if err != nil {
+					return err
+				}
+				unitCost = (old.quantity*old.unitCost + delta*issuedCost) / item.Quantity
+			case delta < 0:
+				if err := returnStock(tx, userID, item.StockID, -delta, old.unitCost, maintenanceID, item.StockLocation, nil); err != nil {
+					return err
+				}
+			}
+		} else if old.issued {
+			if err := returnStock(tx, userID, item.StockID, old.quantity, old.unitCost, maintenanceID, old.location, old.lots); err != nil {
+				return err
+			}
+			unitCost = 0
+		}
+
+		_, err := tx.Exec("INSERT INTO maintenance_stock(maintenanceId, stockId, quantity, unitCost, issued, warehouseId, binId) VALUES(?, ?, ?, ?, ?, ?, ?)",
+			maintenanceID, item.StockID, item.Quantity, unitCost, issue, item.WarehouseID, item.BinID)
+		if err != nil {
+			return err
+		}
+		for _, lot := range item.Lots {
+			_, err := tx.Exec("INSERT INTO maintenance_stock_lots (maintenanceId, stockId, lot, quantity) VALUES (?, ?, ?, ?)", maintenanceID, item.StockID, lot.Lot, lot.Quantity)
+			if err != nil {
+				return err
+			}
+		}
+		items[i].Quantity = item.Quantity
+		items[i].Unit = item.Unit
+		items[i].StockLocation = item.StockLocation
+		items[i].Lots = item.Lots
+		items[i].UnitCost = unitCost
+		items[i].Issued = issue
+	}
+
+	for stockID, old := range previous {
+		if !old.issued {
+			continue
+		}
+		if err := returnStock(tx, userID, stockID, old.quantity, old.unitCost, maintenanceID, old.location, old.lots); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedOpeningBalances records an opening movement for stock items that have
+// a quantity but no ledger yet, valued at their current unit value.
+func seedOpeningBalances(db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT id, quantity, value FROM stock s
+		WHERE quantity != 0 AND NOT EXISTS (SELECT 1 FROM stock_movements sm WHERE sm.stockId = s.id)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to seed opening stock balances: %v", err)
+	}
+	var openings []StockMovement
+	for rows.Next() {
+		m := StockMovement{Type: movementOpening, Reference: "opening balance"}
+		if err := rows.Scan(&m.StockID, &m.Quantity, &m.UnitCost); err != nil {
+			log.Fatalf("Failed to seed opening stock balances: %v", err)
+		}
+		openings = append(openings, m)
+	}
+	rows.Close()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, m := range openings {
+		_, err := db.Exec("INSERT INTO stock_movements ("+movementColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, '', '', '', '', '')",
+			uuid.New().String(), m.StockID, now, m.Type, m.Quantity, m.UnitCost, m.Reference)
+		if err != nil {
+			log.Fatalf("Failed to seed opening stock balances: %v", err)
+		}
+	}
+}
+
+// seedCostLayers stores the cost layers of FIFO items in stock that have
+// none yet, such as those valued before the layers were kept, by replaying
+// their ledger.
+func seedCostLayers(db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT id FROM stock s
+		WHERE valuationMethod = ? AND quantity > 0 AND NOT EXISTS (SELECT 1 FROM stock_cost_layers l WHERE l.stockId = s.id)
+	`, valuationFIFO)
+	if err != nil {
+		log.Fatalf("Failed to seed stock cost layers: %v", err)
+	}
+	var stockIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Fatalf("Failed to seed stock cost layers: %v", err)
+		}
+		stockIDs = append(stockIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range stockIDs {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatalf("Failed to seed stock cost layers: %v", err)
+		}
+		pos, err := loadPosition(tx, id, "")
+		if err == nil {
+			err = savePosition(tx, id, pos)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Fatalf("Failed to seed stock cost layers: %v", err)
+		}
+	}
+}
+
+func validValuationMethod(method string) bool {
+	return method == valuationFIFO || method == valuationAverage
+}
+
+func createStockReceipt(w http.ResponseWriter, r *http.Request, stockID string) {
+	db := tenantDB(r)
+	var m StockMovement
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if m.Quantity <= 0 {
+		http.Error(w, "quantity must be positive", http.StatusBadRequest)
+		return
+	}
+	if m.UnitCost < 0 {
+		http.Error(w, "unitCost cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if m.Unit != "" {
+		factor, err := stockUnitFactor(db, stockID, m.Unit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Quantity *= factor
+		m.UnitCost /= factor
+		m.Unit = ""
+	}
+	if m.Date != "" {
+		t, err := parseTimestamp(m.Date)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Date = t.UTC().Format(time.RFC3339)
+		if status, err := validateMovementDate(db, stockID, m.Date); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	m.StockID = stockID
+	m.Type = movementReceipt
+	m.MaintenanceID = ""
+	m.PurchaseOrderID = ""
+	m.UserID = actorID(r)
+	if m.WarehouseID != "" || m.BinID != "" {
+		if err := resolveLocation(db, stockID, &m.StockLocation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	tracking, err := stockTracking(db, stockID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := normalizeLots(tracking, m.Quantity, m.Lots); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := postMovement(tx, &m); err != nil {
+		tx.Rollback()
+		http.Error(w, err.Error(), stockErrorStatus(err))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+func listStockMovements(w http.ResponseWriter, r *http.Request, stockID string) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT "+movementColumns+" FROM stock_movements WHERE stockId = ? ORDER BY date, rowid", stockID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	movements := []StockMovement{}
+	for rows.Next() {
+		var m StockMovement
+		if err := scanMovement(rows, &m); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		movements = append(movements, m)
+	}
+	rows.Close()
+
+	if err := loadMovementLots(db, stockID, movements); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(movements)
+}
+
+// getInventoryValuationReport values every stock item as of the end of the
+// given date (today by default) by replaying its ledger.
+func getInventoryValuationReport(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	asOf := time.Now().UTC()
+	if v := r.URL.Query().Get("date"); v != "" {
+		t, err := parseTimestamp(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		asOf = t
+	}
+	// The whole day is included.
+	before := time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1).Format(time.RFC3339)
+
+	rows, err := db.Query("SELECT id, name, unit, valuationMethod FROM stock ORDER BY name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []StockValuationItem{}
+	for rows.Next() {
+		var item StockValuationItem
+		if err := rows.Scan(&item.StockID, &item.Name, &item.Unit, &item.ValuationMethod); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+
+	report := struct {
+		Date       string               `json:"date"`
+		TotalValue float64              `json:"totalValue"`
+		Items      []StockValuationItem `json:"items"`
+	}{Date: asOf.Format("2006-01-02"), Items: items}
+
+	for i := range report.Items {
+		item := &report.Items[i]
+		pos, err := loadPosition(db, item.StockID, before)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		item.Quantity = pos.quantity
+		item.UnitCost = pos.unitCost()
+		item.TotalValue = pos.value
+		report.TotalValue += pos.value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
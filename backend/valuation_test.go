@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDeleteStockItemKeepsItsLedger(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+
+	stocked := admin.create("/api/stock", `{"name":"Stocked bearing","unit":"un","quantity":4,"value":8}`)
+	if rec := admin.do("DELETE", "/api/stock/"+stocked, ""); rec.Code != http.StatusConflict {
+		t.Errorf("delete with stock: %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	// Received and then issued to nothing left, but with a history
+	moved := admin.create("/api/stock", `{"name":"Moved bearing","unit":"un","quantity":0,"value":0}`)
+	if rec := admin.do("POST", "/api/stock/"+moved+"/receipts", `{"quantity":2,"unitCost":3}`); rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		t.Fatalf("receipt: %d %s", rec.Code, rec.Body)
+	}
+	if rec := admin.do("PUT", "/api/stock/"+moved, `{"name":"Moved bearing","unit":"un","quantity":0,"value":0}`); rec.Code != http.StatusOK {
+		t.Fatalf("adjust to zero: %d %s", rec.Code, rec.Body)
+	}
+	if rec := admin.do("DELETE", "/api/stock/"+moved, ""); rec.Code != http.StatusConflict {
+		t.Errorf("delete with movements: %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	unused := admin.create("/api/stock", `{"name":"Unused bearing","unit":"un","quantity":0,"value":0}`)
+	if rec := admin.do("DELETE", "/api/stock/"+unused, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete unused: %d %s, want 204", rec.Code, rec.Body)
+	}
+	if rec := admin.do("GET", "/api/stock/"+unused, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted item: %d, want 404", rec.Code)
+	}
+}
+
+func TestUsedStockInUnknownUnit(t *testing.T) {
+	admin := signInAdmin(t, testTenant)
+	machineID := admin.create("/api/machines", `{"name":"Unit press","status":"Operando","model":"UP-2"}`)
+	stockID := admin.create("/api/stock", `{"name":"Unit grease","unit":"un","quantity":4,"value":8}`)
+
+	rec := admin.do("POST", "/api/maintenance", `{"machineId":"`+machineID+`","start":"2033-02-01T08:00:00Z","description":"Grease","usedStock":[{"stockId":"`+stockID+`","quantity":1,"unit":"bogus"}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("used stock in an unknown unit: %d %s, want 400", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Warehouse is a storeroom. Stock is kept either directly in a warehouse or
+// in one of its bins.
+type Warehouse struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Bins    []Bin  `json:"bins"`
+}
+
+type Bin struct {
+	ID          string `json:"id"`
+	WarehouseID string `json:"warehouseId"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// StockLocation identifies where stock is kept: a warehouse and optionally
+// one of its bins.
+type StockLocation struct {
+	WarehouseID string `json:"warehouseId,omitempty"`
+	BinID       string `json:"binId,omitempty"`
+}
+
+// StockLevel is the quantity of a stock item held at one location.
+type StockLevel struct {
+	StockID string `json:"stockId"`
+	StockLocation
+	WarehouseName string  `json:"warehouseName"`
+	BinCode       string  `json:"binCode,omitempty"`
+	Quantity      float64 `json:"quantity"`
+}
+
+// StockTransfer is the body of POST /api/stock/transfers.
+type StockTransfer struct {
+	StockID   string          `json:"stockId"`
+	Quantity  float64         `json:"quantity"`
+	From      StockLocation   `json:"from"`
+	To        StockLocation   `json:"to"`
+	Date      string          `json:"date"`
+	Reference string          `json:"reference"`
+	Movements []StockMovement `json:"movements"`
+}
+
+var errNoWarehouse = errors.New("no warehouse defined")
+
+// resolveLocation validates an explicit location, or picks one for a
+// movement that does not name any: the location holding the most of the item,
+// or else the first warehouse.
+func resolveLocation(q queryer, stockID string, loc *StockLocation) error {
+	if loc.WarehouseID == "" && loc.BinID != "" {
+		err := q.QueryRow("SELECT warehouseId FROM bins WHERE id = ?", loc.BinID).Scan(&loc.WarehouseID)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("bin %s not found", loc.BinID)
+		}
+		return err
+	}
+	if loc.WarehouseID != "" {
+		return validateLocation(q, *loc)
+	}
+
+	err := q.QueryRow("SELECT warehouseId, binId FROM stock_levels WHERE stockId = ? ORDER BY quantity DESC, rowid LIMIT 1", stockID).Scan(&loc.WarehouseID, &loc.BinID)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	err = q.QueryRow("SELECT id FROM warehouses ORDER BY rowid LIMIT 1").Scan(&loc.WarehouseID)
+	if err == sql.ErrNoRows {
+		return errNoWarehouse
+	}
+	return err
+}
+
+func validateLocation(q queryer, loc StockLocation) error {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM warehouses WHERE id = ?)", loc.WarehouseID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("warehouse %s not found", loc.WarehouseID)
+	}
+	if loc.BinID == "" {
+		return nil
+	}
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM bins WHERE id = ? AND warehouseId = ?)", loc.BinID, loc.WarehouseID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bin %s not found in warehouse %s", loc.BinID, loc.WarehouseID)
+	}
+	return nil
+}
+
+// changeStockLevel adds delta to the quantity of the item at the location.
+func changeStockLevel(tx *sql.Tx, stockID string, loc StockLocation, delta float64) error {
+	_, err := tx.Exec(`
+		INSERT INTO stock_levels (stockId, warehouseId, binId, quantity) VALUES (?, ?, ?, ?)
+		ON CONFLICT(stockId, warehouseId, binId) DO UPDATE SET quantity = quantity + excluded.quantity
+	`, stockID, loc.WarehouseID, loc.BinID, delta)
+	return err
+}
+
+// queryStockLevels lists the non-empty stock levels matching the condition,
+// ordered by warehouse and bin.
+func queryStockLevels(q queryer, where string, args ...interface{}) ([]StockLevel, error) {
+	rows, err := q.Query(`
+		SELECT sl.stockId, sl.warehouseId, sl.binId, COALESCE(w.name, ''), COALESCE(b.code, ''), sl.quantity
+		FROM stock_levels sl
+		LEFT JOIN warehouses w ON sl.warehouseId = w.id
+		LEFT JOIN bins b ON sl.binId = b.id
+		WHERE sl.quantity != 0 AND `+where+`
+		ORDER BY w.name, b.code
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := []StockLevel{}
+	for rows.Next() {
+		var l StockLevel
+		if err := rows.Scan(&l.StockID, &l.WarehouseID, &l.BinID, &l.WarehouseName, &l.BinCode, &l.Quantity); err != nil {
+			return nil, err
+		}
+		levels = append(levels, l)
+	}
+	return levels, rows.Err()
+}
+
+// seedStockLevels places stock that predates warehouses. A main warehouse is
+// created when there is none, and the quantity of every unplaced item is put
+// in a bin named after its free-text location.
+func seedStockLevels(db *sql.DB) {
+	var warehouseID string
+	err := db.QueryRow("SELECT id FROM warehouses ORDER BY rowid LIMIT 1").Scan(&warehouseID)
+	if err == sql.ErrNoRows {
+		warehouseID = uuid.New().String()
+		_, err = db.Exec("INSERT INTO warehouses (id, name, address) VALUES (?, 'Main warehouse', '')", warehouseID)
+	}
+	if err != nil {
+		log.Fatalf("Failed to seed stock levels: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, quantity, location FROM stock s
+		WHERE quantity != 0 AND NOT EXISTS (SELECT 1 FROM stock_levels sl WHERE sl.stockId = s.id)
+	`)
+	if err != nil {
+		log.Fatalf("Failed to seed stock levels: %v", err)
+	}
+	type unplaced struct {
+		stockID  string
+		quantity float64
+		location string
+	}
+	var items []unplaced
+	for rows.Next() {
+		var u unplaced
+		if err := rows.Scan(&u.stockID, &u.quantity, &u.location); err != nil {
+			log.Fatalf("Failed to seed stock levels: %v", err)
+		}
+		items = append(items, u)
+	}
+	rows.Close()
+
+	for _, u := range items {
+		var binID string
+		if code := strings.TrimSpace(u.location); code != "" {
+			err := db.QueryRow("SELECT id FROM bins WHERE warehouseId = ? AND code = ?", warehouseID, code).Scan(&binID)
+			if err == sql.ErrNoRows {
+				binID = uuid.New().String()
+				_, err = db.Exec("INSERT INTO bins (id, warehouseId, code, description) VALUES (?, ?, ?, '')", binID, warehouseID, code)
+			}
+			if err != nil {
+				log.Fatalf("Failed to seed stock levels: %v", err)
+			}
+		}
+		_, err := db.Exec("INSERT INTO stock_levels (stockId, warehouseId, binId, quantity) VALUES (?, ?, ?, ?)", u.stockID, warehouseID, binID, u.quantity)
+		if err != nil {
+			log.Fatalf("Failed to seed stock levels: %v", err)
+		}
+	}
+}
+
+// Warehouse handlers
+func warehousesHandler(w http.ResponseWriter, r *http.Request) {
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listWarehouses(w, r)
+	case "POST":
+		createWarehouse(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// warehouseHandler serves /api/warehouses/{id}, its bins under
+// /api/warehouses/{id}/bins and the stock it holds under
+// /api/warehouses/{id}/stock.
+func warehouseHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/warehouses/")
+	id, sub, _ := strings.Cut(path, "/")
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM warehouses WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Warehouse not found", http.StatusNotFound)
+		return
+	}
+
+	if sub == "stock" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		levels, err := queryStockLevels(db, "sl.warehouseId = ?", id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(levels)
+		return
+	}
+	if sub == "bins" || strings.HasPrefix(sub, "bins/") {
+		binHandler(w, r, id, strings.TrimPrefix(strings.TrimPrefix(sub, "bins"), "/"))
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		getWarehouse(w, r, id)
+	case "PUT":
+		updateWarehouse(w, r, id)
+	case "DELETE":
+		deleteWarehouse(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func loadBins(q queryer, warehouseID string) ([]Bin, error) {
+	rows, err := q.Query("SELECT id, warehouseId, code, description FROM bins WHERE warehouseId = ? ORDER BY code", warehouseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bins := []Bin{}
+	for rows.Next() {
+		var b Bin
+		if err := rows.Scan(&b.ID, &b.WarehouseID, &b.Code, &b.Description); err != nil {
+			return nil, err
+		}
+		bins = append(bins, b)
+	}
+	return bins, rows.Err()
+}
+
+func listWarehouses(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT id, name, address FROM warehouses ORDER BY name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	warehouses := []Warehouse{}
+	for rows.Next() {
+		var wh Warehouse
+		if err := rows.Scan(&wh.ID, &wh.Name, &wh.Address); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		warehouses = append(warehouses, wh)
+	}
+	rows.Close()
+
+	for i := range warehouses {
+		if warehouses[i].Bins, err = loadBins(db, warehouses[i].ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warehouses)
+}
+
+func createWarehouse(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	var wh Warehouse
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh.ID = uuid.New().String()
+	wh.Bins = []Bin{}
+
+	_, err := db.Exec("INSERT INTO warehouses (id, name, address) VALUES (?, ?, ?)", wh.ID, wh.Name, wh.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wh)
+}
+
+func getWarehouse(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var wh Warehouse
+	err := db.QueryRow("SELECT id, name, address FROM warehouses WHERE id = ?", id).Scan(&wh.ID, &wh.Name, &wh.Address)
+	if err == nil {
+		wh.Bins, err = loadBins(db, id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wh)
+}
+
+func updateWarehouse(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var wh Warehouse
+	if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh.ID = id
+
+	_, err := db.Exec("UPDATE warehouses SET name = ?, address = ? WHERE id = ?", wh.Name, wh.Address, id)
+	if err == nil {
+		wh.Bins, err = loadBins(db, id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wh)
+}
+
+// deleteWarehouse removes an empty warehouse together with its bins.
+func deleteWarehouse(w http.ResponseWriter, r *http.Request, id string) {
+	db := tenantDB(r)
+	var held bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM stock_levels WHERE warehouseId = ? AND quantity != 0)", id).Scan(&held); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if held {
+		http.Error(w, "Warehouse still holds stock", http.StatusConflict)
+		return
+	}
+
+	for _, query := range []string{
+		"DELETE FROM stock_levels WHERE warehouseId = ?",
+		"DELETE FROM bins WHERE warehouseId = ?",
+		"DELETE FROM warehouses WHERE id = ?",
+	} {
+		if _, err := db.Exec(query, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// binHandler serves /api/warehouses/{id}/bins and /api/warehouses/{id}/bins/{binId}.
+func binHandler(w http.ResponseWriter, r *http.Request, warehouseID, binID string) {
+	db := tenantDB(r)
+	if binID == "" {
+		switch r.Method {
+		case "GET":
+			bins, err := loadBins(db, warehouseID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(bins)
+		case "POST":
+			createBin(w, r, warehouseID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM bins WHERE id = ? AND warehouseId = ?)", binID, warehouseID).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Bin not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		updateBin(w, r, warehouseID, binID)
+	case "DELETE":
+		deleteBin(w, r, binID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createBin(w http.ResponseWriter, r *http.Request, warehouseID string) {
+	db := tenantDB(r)
+	var b Bin
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(b.Code) == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	b.ID = uuid.New().String()
+	b.WarehouseID = warehouseID
+
+	_, err := db.Exec("INSERT INTO bins (id, warehouseId, code, description) VALUES (?, ?, ?, ?)", b.ID, b.WarehouseID, b.Code, b.Description)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+func updateBin(w http.ResponseWriter, r *http.Request, warehouseID, binID string) {
+	db := tenantDB(r)
+	var b Bin
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(b.Code) == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	b.ID = binID
+	b.WarehouseID = warehouseID
+
+	_, err := db.Exec("UPDATE bins SET code = ?, description = ? WHERE id = ?", b.Code, b.Description, binID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+func deleteBin(w http.ResponseWriter, r *http.Request, binID string) {
+	db := tenantDB(r)
+	var held bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM stock_levels WHERE binId = ? AND quantity != 0)", binID).Scan(&held); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if held {
+		http.Error(w, "Bin still holds stock", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM stock_levels WHERE binId = ?", binID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM bins WHERE id = ?", binID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createStockTransfer serves POST /api/stock/transfers. The quantity leaves
+// the source and enters the destination in one transaction, at the item's
+// current unit cost, so the item's valuation is unchanged.
+func createStockTransfer(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var t StockTransfer
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.Quantity <= 0 {
+		http.Error(w, "quantity must be positive", http.StatusBadRequest)
+		return
+	}
+	if t.From.WarehouseID == "" || t.To.WarehouseID == "" {
+		http.Error(w, "from and to must name a warehouse", http.StatusBadRequest)
+		return
+	}
+	if t.From == t.To {
+		http.Error(w, "from and to must be different locations", http.StatusBadRequest)
+		return
+	}
+	if t.Date != "" {
+		date, err := parseTimestamp(t.Date)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Date = date.UTC().Format(time.RFC3339)
+	} else {
+		t.Date = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pos, err := currentPosition(tx, t.StockID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Stock item not found", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, loc := range []StockLocation{t.From, t.To} {
+		if err := validateLocation(tx, loc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var available float64
+	err = tx.QueryRow("SELECT quantity FROM stock_levels WHERE stockId = ? AND warehouseId = ? AND binId = ?", t.StockID, t.From.WarehouseID, t.From.BinID).Scan(&available)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if available < t.Quantity-quantityEpsilon {
+		http.Error(w, fmt.Sprintf("only %g available at the source location", available), http.StatusConflict)
+		return
+	}
+
+	t.Movements = []StockMovement{
+		{StockID: t.StockID, StockLocation: t.From, Date: t.Date, Type: movementTransfer, Quantity: -t.Quantity, UnitCost: pos.unitCost(), Reference: t.Reference, UserID: actorID(r)},
+		{StockID: t.StockID, StockLocation: t.To, Date: t.Date, Type: movementTransfer, Quantity: t.Quantity, UnitCost: pos.unitCost(), Reference: t.Reference, UserID: actorID(r)},
+	}
+	for i := range t.Movements {
+		if err := postMovement(tx, &t.Movements[i]); err != nil {
+			http.Error(w, err.Error(), stockErrorStatus(err))
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
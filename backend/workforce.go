@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const notificationCertificationExpiring = "certification-expiring"
+
+// certificationWarningDays is how many days before expiry a certification is
+// reported and notified as expiring.
+var certificationWarningDays = 30
+
+// Shift is a working pattern: the hours worked on each of Days. A shift
+// whose End is not after its Start runs overnight into the next day.
+type Shift struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Start        string `json:"start"` // "15:04"
+	End          string `json:"end"`   // "15:04"
+	Days         []int  `json:"days"`  // weekdays worked, 0 is Sunday
+	BreakMinutes int    `json:"breakMinutes"`
+}
+
+// Hours is the working time of one occurrence of the shift, breaks excluded.
+func (s Shift) Hours() float64 {
+	start, err1 := time.Parse("15:04", s.Start)
+	end, err2 := time.Parse("15:04", s.End)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	if !end.After(start) {
+		end = end.Add(24 * time.Hour)
+	}
+	return end.Sub(start).Hours() - float64(s.BreakMinutes)/60
+}
+
+func (s Shift) worksOn(day time.Weekday) bool {
+	for _, d := range s.Days {
+		if d == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+const shiftColumns = "id, name, startTime, endTime, days, breakMinutes"
+
+func scanShift(row rowScanner, s *Shift) error {
+	var days string
+	if err := row.Scan(&s.ID, &s.Name, &s.Start, &s.End, &days, &s.BreakMinutes); err != nil {
+		return err
+	}
+	s.Days = []int{}
+	for _, d := range strings.Split(days, ",") {
+		if n, err := strconv.Atoi(d); err == nil {
+			s.Days = append(s.Days, n)
+		}
+	}
+	return nil
+}
+
+func formatShiftDays(days []int) string {
+	parts := make([]string, len(days))
+	for i, d := range days {
+		parts[i] = strconv.Itoa(d)
+	}
+	return strings.Join(parts, ",")
+}
+
+func validateShift(s *Shift) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, err := time.Parse("15:04", s.Start); err != nil {
+		return errors.New("start must be a time such as 06:00")
+	}
+	if _, err := time.Parse("15:04", s.End); err != nil {
+		return errors.New("end must be a time such as 14:00")
+	}
+	seen := make(map[int]bool)
+	days := []int{}
+	for _, d := range s.Days {
+		if d < 0 || d > 6 {
+			return errors.New("days must be weekdays from 0 (Sunday) to 6 (Saturday)")
+		}
+		if !seen[d] {
+			seen[d] = true
+			days = append(days, d)
+		}
+	}
+	sort.Ints(days)
+	s.Days = days
+	if s.BreakMinutes < 0 || s.Hours() <= 0 {
+		return errors.New("breakMinutes must be positive and shorter than the shift")
+	}
+	return nil
+}
+
+// ShiftAssignment puts an operator on a shift from From until To, both
+// inclusive. An empty To leaves the assignment open-ended.
+type ShiftAssignment struct {
+	ID         string `json:"id"`
+	OperatorID string `json:"operatorId"`
+	ShiftID    string `json:"shiftId"`
+	From       string `json:"from"`
+	To         string `json:"to,omitempty"`
+}
+
+// CalendarException changes an operator's calendar on one date: a day off
+// when ShiftID is empty, or a different shift.
+type CalendarException struct {
+	ID         string `json:"id"`
+	OperatorID string `json:"operatorId"`
+	Date       string `json:"date"`
+	ShiftID    string `json:"shiftId,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// CalendarDay is a day of an operator's calendar.
+type CalendarDay struct {
+	Date      string  `json:"date"`
+	Working   bool    `json:"working"`
+	ShiftID   string  `json:"shiftId,omitempty"`
+	ShiftName string  `json:"shiftName,omitempty"`
+	Start     string  `json:"start,omitempty"`
+	End       string  `json:"end,omitempty"`
+	Hours     float64 `json:"hours"`
+	Reason    string  `json:"reason,omitempty"` // of the calendar exception, if any
+}
+
+// Skill is a competence operators can be certified for. A skill with a
+// MachineModel is required to operate or maintain machines of that model;
+// other skills can be required by individual machines.
+type Skill struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	MachineModel string `json:"machineModel,omitempty"`
+}
+
+const skillColumns = "id, name, description, machineModel"
+
+func scanSkill(row rowScanner, s *Skill) error {
+	return row.Scan(&s.ID, &s.Name, &s.Description, &s.MachineModel)
+}
+
+// Certification records that an operator holds a skill, from IssuedAt until
+// ExpiresAt. Certifications without ExpiresAt do not expire.
+type Certification struct {
+	ID         string `json:"id"`
+	OperatorID string `json:"operatorId"`
+	SkillID    string `json:"skillId"`
+	SkillName  string `json:"skillName,omitempty"`
+	IssuedAt   string `json:"issuedAt"`
+	ExpiresAt  string `json:"expiresAt,omitempty"`
+	Reference  string `json:"reference,omitempty"` // certificate number or issuing body
+}
+
+const certificationColumns = "c.id, c.operatorId, c.skillId, COALESCE(s.name, ''), c.issuedAt, c.expiresAt, c.reference"
+
+func scanCertification(row rowScanner, c *Certification) error {
+	return row.Scan(&c.ID, &c.OperatorID, &c.SkillID, &c.SkillName, &c.IssuedAt, &c.ExpiresAt, &c.Reference)
+}
+
+// parseDate parses an optional YYYY-MM-DD date, returning it normalized.
+func parseDate(field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", fmt.Errorf("%s must be a date such as 2024-01-31", field)
+	}
+	return t.Format("2006-01-02"), nil
+}
+
+// Shift handlers
+func shiftsHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		listShifts(w, r)
+	case "POST":
+		var s Shift
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateShift(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID = uuid.New().String()
+		_, err := db.Exec("INSERT INTO shifts ("+shiftColumns+") VALUES (?, ?, ?, ?, ?, ?)", s.ID, s.Name, s.Start, s.End, formatShiftDays(s.Days), s.BreakMinutes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listShifts(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	rows, err := db.Query("SELECT " + shiftColumns + " FROM shifts ORDER BY name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	shifts := []Shift{}
+	for rows.Next() {
+		var s Shift
+		if err := scanShift(rows, &s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		shifts = append(shifts, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shifts)
+}
+
+func shiftHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/api/shifts/")
+
+	var s Shift
+	err := scanShift(db.QueryRow("SELECT "+shiftColumns+" FROM shifts WHERE id = ?", id), &s)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Shift not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "PUT":
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID = id
+		if err := validateShift(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err := db.Exec("UPDATE shifts SET name = ?, startTime = ?, endTime = ?, days = ?, breakMinutes = ? WHERE id = ?", s.Name, s.Start, s.End, formatShiftDays(s.Days), s.BreakMinutes, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "DELETE":
+		var used bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM operator_shifts WHERE shiftId = ?) OR EXISTS(SELECT 1 FROM calendar_exceptions WHERE shiftId = ?)", id, id).Scan(&used)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if used {
+			http.Error(w, "The shift is assigned to operators", http.StatusConflict)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM shifts WHERE id = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func shiftExists(q queryer, id string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM shifts WHERE id = ?)", id).Scan(&exists)
+	return exists, err
+}
+
+// operatorShiftOn returns the shift an operator works on date, and the
+// reason of the calendar exception that applies, if any. ok is false on days
+// off.
+func operatorShiftOn(q queryer, operatorID string, date time.Time) (shift Shift, reason string, ok bool, err error) {
+	day := date.Format("2006-01-02")
+
+	var shiftID string
+	err = q.QueryRow("SELECT shiftId, reason FROM calendar_exceptions WHERE operatorId = ? AND date = ?", operatorID, day).Scan(&shiftID, &reason)
+	switch {
+	case err == nil:
+		if shiftID == "" {
+			return Shift{}, reason, false, nil
+		}
+		err = scanShift(q.QueryRow("SELECT "+shiftColumns+" FROM shifts WHERE id = ?", shiftID), &shift)
+		return shift, reason, err == nil, err
+	case err != sql.ErrNoRows:
+		return Shift{}, "", false, err
+	}
+
+	err = scanShift(q.QueryRow(`
+		SELECT `+shiftColumns+` FROM shifts WHERE id = (
+			SELECT shiftId FROM operator_shifts
+			WHERE operatorId = ? AND validFrom <= ? AND (validTo = '' OR validTo >= ?)
+			ORDER BY validFrom DESC LIMIT 1
+		)`, operatorID, day, day), &shift)
+	if err == sql.ErrNoRows {
+		return Shift{}, "", false, nil
+	}
+	if err != nil {
+		return Shift{}, "", false, err
+	}
+	return shift, "", shift.worksOn(date.Weekday()), nil
+}
+
+// operatorCapacity returns the hours an operator is scheduled to work on
+// date.
+func operatorCapacity(q queryer, operatorID string, date time.Time) (float64, error) {
+	shift, _, ok, err := operatorShiftOn(q, operatorID, date)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return shift.Hours(), nil
+}
+
+// parseCalendarPeriod reads the from and to dates of a calendar request,
+// defaulting to the week starting today. Periods are limited to a year.
+func parseCalendarPeriod(r *http.Request) (time.Time, time.Time, error) {
+	from := time.Now().UTC().Truncate(24 * time.Hour)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("from must be a date such as 2024-01-31")
+		}
+		from = t
+	}
+	to := from.AddDate(0, 0, 6)
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("to must be a date such as 2024-01-31")
+		}
+		to = t
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, errors.New("from must not be after to")
+	}
+	if to.Sub(from) > 366*24*time.Hour {
+		return time.Time{}, time.Time{}, errors.New("the period cannot be longer than a year")
+	}
+	return from, to, nil
+}
+
+// operatorSubHandler serves the shifts, calendar and certifications of an
+// operator, under /api/operators/{id}/.
+func operatorSubHandler(w http.ResponseWriter, r *http.Request, operatorID, sub string) {
+	resource, itemID, _ := strings.Cut(sub, "/")
+	switch resource {
+	case "shifts":
+		operatorShiftsHandler(w, r, operatorID, itemID)
+	case "exceptions":
+		calendarExceptionsHandler(w, r, operatorID, itemID)
+	case "calendar":
+		if r.Method != "GET" || itemID != "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		getOperatorCalendar(w, r, operatorID)
+	case "certifications":
+		certificationsHandler(w, r, operatorID, itemID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func operatorShiftsHandler(w http.ResponseWriter, r *http.Request, operatorID, assignmentID string) {
+	db := tenantDB(r)
+	switch {
+	case assignmentID == "" && r.Method == "GET":
+		assignments, err := loadShiftAssignments(db, operatorID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assignments)
+	case assignmentID == "" && r.Method == "POST":
+		var a ShiftAssignment
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if a.From, err = parseDate("from", a.From); err == nil {
+			a.To, err = parseDate("to", a.To)
+		}
+		if err == nil && a.From == "" {
+			err = errors.New("from is required")
+		}
+		if err == nil && a.To != "" && a.To < a.From {
+			err = errors.New("from must not be after to")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		exists, err := shiftExists(db, a.ShiftID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("unknown shift %q", a.ShiftID), http.StatusBadRequest)
+			return
+		}
+		a.ID = uuid.New().String()
+		a.OperatorID = operatorID
+		_, err = db.Exec("INSERT INTO operator_shifts (id, operatorId, shiftId, validFrom, validTo) VALUES (?, ?, ?, ?, ?)", a.ID, a.OperatorID, a.ShiftID, a.From, a.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	case assignmentID != "" && r.Method == "DELETE":
+		res, err := db.Exec("DELETE FROM operator_shifts WHERE id = ? AND operatorId = ?", assignmentID, operatorID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Shift assignment not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func loadShiftAssignments(q queryer, operatorID string) ([]ShiftAssignment, error) {
+	rows, err := q.Query("SELECT id, operatorId, shiftId, validFrom, validTo FROM operator_shifts WHERE operatorId = ? ORDER BY validFrom", operatorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignments := []ShiftAssignment{}
+	for rows.Next() {
+		var a ShiftAssignment
+		if err := rows.Scan(&a.ID, &a.OperatorID, &a.ShiftID, &a.From, &a.To); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
+
+func calendarExceptionsHandler(w http.ResponseWriter, r *http.Request, operatorID, exceptionID string) {
+	db := tenantDB(r)
+	switch {
+	case exceptionID == "" && r.Method == "GET":
+		rows, err := db.Query("SELECT id, operatorId, date, shiftId, reason FROM calendar_exceptions WHERE operatorId = ? ORDER BY date", operatorID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		exceptions := []CalendarException{}
+		for rows.Next() {
+			var e CalendarException
+			if err := rows.Scan(&e.ID, &e.OperatorID, &e.Date, &e.ShiftID, &e.Reason); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			exceptions = append(exceptions, e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(exceptions)
+	case exceptionID == "" && r.Method == "POST":
+		var e CalendarException
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if e.Date, err = parseDate("date", e.Date); err == nil && e.Date == "" {
+			err = errors.New("date is required")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if e.ShiftID != "" {
+			exists, err := shiftExists(db, e.ShiftID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, fmt.Sprintf("unknown shift %q", e.ShiftID), http.StatusBadRequest)
+				return
+			}
+		}
+		e.OperatorID = operatorID
+
+		// A date has one exception; posting another replaces it
+		err = db.QueryRow("SELECT id FROM calendar_exceptions WHERE operatorId = ? AND date = ?", operatorID, e.Date).Scan(&e.ID)
+		status := http.StatusOK
+		if err == sql.ErrNoRows {
+			e.ID = uuid.New().String()
+			status = http.StatusCreated
+			_, err = db.Exec("INSERT INTO calendar_exceptions (id, operatorId, date, shiftId, reason) VALUES (?, ?, ?, ?, ?)", e.ID, e.OperatorID, e.Date, e.ShiftID, e.Reason)
+		} else if err == nil {
+			_, err = db.Exec("UPDATE calendar_exceptions SET shiftId = ?, reason = ? WHERE id = ?", e.ShiftID, e.Reason, e.ID)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(e)
+	case exceptionID != "" && r.Method == "DELETE":
+		res, err := db.Exec("DELETE FROM calendar_exceptions WHERE id = ? AND operatorId = ?", exceptionID, operatorID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Calendar exception not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getOperatorCalendar serves GET /api/operators/{id}/calendar, the days of
+// the period from to to with the shift worked on each.
+func getOperatorCalendar(w http.ResponseWriter, r *http.Request, operatorID string) {
+	db := tenantDB(r)
+	from, to, err := parseCalendarPeriod(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	days := []CalendarDay{}
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		shift, reason, ok, err := operatorShiftOn(db, operatorID, d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		day := CalendarDay{Date: d.Format("2006-01-02"), Working: ok, Reason: reason}
+		if ok {
+			day.ShiftID, day.ShiftName, day.Start, day.End, day.Hours = shift.ID, shift.Name, shift.Start, shift.End, shift.Hours()
+		}
+		days = append(days, day)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(days)
+}
+
+// Skill handlers
+func skillsHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query("SELECT " + skillColumns + " FROM skills ORDER BY name")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		skills := []Skill{}
+		for rows.Next() {
+			var s Skill
+			if err := scanSkill(rows, &s); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			skills = append(skills, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(skills)
+	case "POST":
+		var s Skill
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Name = strings.TrimSpace(s.Name)
+		if s.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		s.ID = uuid.New().String()
+		_, err := db.Exec("INSERT INTO skills ("+skillColumns+") VALUES (?, ?, ?, ?)", s.ID, s.Name, s.Description, strings.TrimSpace(s.MachineModel))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func skillHandler(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	tenantMutex(r).Lock()
+	defer tenantMutex(r).Unlock()
+	id := strings.TrimPrefix(r.URL.Path, "/api/skills/")
+
+	var s Skill
+	err := scanSkill(db.QueryRow("SELECT "+skillColumns+" FROM skills WHERE id = ?", id), &s)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Skill not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "PUT":
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID = id
+		s.Name, s.MachineModel = strings.TrimSpace(s.Name), strings.TrimSpace(s.MachineModel)
+		if s.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		_, err := db.Exec("UPDATE skills SET name = ?, description = ?, machineModel = ? WHERE id = ?", s.Name, s.Description, s.MachineModel, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "DELETE":
+		var used bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM certifications WHERE skillId = ?) OR EXISTS(SELECT 1 FROM machine_skills WHERE skillId = ?)", id, id).Scan(&used)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if used {
+			http.Error(w, "The skill is held by operators or required by machines", http.StatusConflict)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM skills WHERE id = ?", id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Certification handlers
+func certificationsHandler(w http.ResponseWriter, r *http.Request, operatorID, certificationID string) {
+	db := tenantDB(r)
+	if certificationID == "" {
+		switch r.Method {
+		case "GET":
+			certifications, err := loadCertifications(db, operatorID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(certifications)
+		case "POST":
+			saveCertification(w, r, Certification{OperatorID: operatorID})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	var c Certification
+	err := scanCertification(db.QueryRow("SELECT "+certificationColumns+" FROM certifications c LEFT JOIN skills s ON c.skillId = s.id WHERE c.id = ? AND c.operatorId = ?", certificationID, operatorID), &c)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Certification not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	case "PUT":
+		saveCertification(w, r, c)
+	case "DELETE":
+		if _, err := db.Exec("DELETE FROM certifications WHERE id = ?", c.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := resolveNotification(db, notificationCertificationExpiring, c.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// saveCertification creates a certification, or renews or corrects the
+// existing one c, from the request body.
+func saveCertification(w http.ResponseWriter, r *http.Request, c Certification) {
+	db := tenantDB(r)
+	id, operatorID := c.ID, c.OperatorID
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.ID, c.OperatorID = id, operatorID
+
+	var err error
+	if c.IssuedAt, err = parseDate("issuedAt", c.IssuedAt); err == nil {
+		c.ExpiresAt, err = parseDate("expiresAt", c.ExpiresAt)
+	}
+	if err == nil && c.IssuedAt == "" {
+		c.IssuedAt = time.Now().UTC().Format("2006-01-02")
+	}
+	if err == nil && c.ExpiresAt != "" && c.ExpiresAt < c.IssuedAt {
+		err = errors.New("expiresAt must not be before issuedAt")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.QueryRow("SELECT name FROM skills WHERE id = ?", c.SkillID).Scan(&c.SkillName)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("unknown skill %q", c.SkillID), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var duplicate bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM certifications WHERE operatorId = ? AND skillId = ? AND id != ?)", c.OperatorID, c.SkillID, c.ID).Scan(&duplicate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if duplicate {
+		http.Error(w, "The operator already holds this certification; renew it instead", http.StatusConflict)
+		return
+	}
+
+	status := http.StatusOK
+	if c.ID == "" {
+		c.ID = uuid.New().String()
+		status = http.StatusCreated
+		_, err = db.Exec("INSERT INTO certifications (id, operatorId, skillId, issuedAt, expiresAt, reference) VALUES (?, ?, ?, ?, ?, ?)", c.ID, c.OperatorID, c.SkillID, c.IssuedAt, c.ExpiresAt, c.Reference)
+	} else {
+		_, err = db.Exec("UPDATE certifications SET skillId = ?, issuedAt = ?, expiresAt = ?, reference = ? WHERE id = ?", c.SkillID, c.IssuedAt, c.ExpiresAt, c.Reference, c.ID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A renewed certification may no longer be expiring
+	if err := checkCertification(db, c, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c)
+}
+
+func loadCertifications(q queryer, operatorID string) ([]Certification, error) {
+	rows, err := q.Query("SELECT "+certificationColumns+" FROM certifications c LEFT JOIN skills s ON c.skillId = s.id WHERE c.operatorId = ? ORDER BY s.name", operatorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certifications := []Certification{}
+	for rows.Next() {
+		var c Certification
+		if err := scanCertification(rows, &c); err != nil {
+			return nil, err
+		}
+		certifications = append(certifications, c)
+	}
+	return certifications, rows.Err()
+}
+
+// RequiredSkill is a skill needed to operate or maintain a machine, either
+// because of the machine's model or because the machine requires it.
+type RequiredSkill struct {
+	Skill
+	Source string `json:"source"` // "model" or "machine"
+}
+
+// requiredSkills returns the skills needed for a machine of the given model.
+// machineID may be empty for a machine that does not exist yet.
+func requiredSkills(q queryer, machineID, model string) ([]RequiredSkill, error) {
+	rows, err := q.Query(`
+		SELECT `+skillColumns+`, 'model' FROM skills WHERE machineModel != '' AND machineModel = ? COLLATE NOCASE
+		UNION
+		SELECT s.id, s.name, s.description, s.machineModel, 'machine' FROM machine_skills ms
+		JOIN skills s ON ms.skillId = s.id
+		WHERE ms.machineId = ?
+		ORDER BY 2`, strings.TrimSpace(model), machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skills := []RequiredSkill{}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var s RequiredSkill
+		if err := rows.Scan(&s.ID, &s.Name, &s.Description, &s.MachineModel, &s.Source); err != nil {
+			return nil, err
+		}
+		if !seen[s.ID] {
+			seen[s.ID] = true
+			skills = append(skills, s)
+		}
+	}
+	return skills, rows.Err()
+}
+
+// missingSkills returns the names of the skills in required that the
+// operator holds no certification for valid on date (YYYY-MM-DD).
+func missingSkills(q queryer, operatorID string, required []RequiredSkill, date string) ([]string, error) {
+	missing := []string{}
+	for _, s := range required {
+		var valid bool
+		err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM certifications WHERE operatorId = ? AND skillId = ? AND issuedAt <= ? AND (expiresAt = '' OR expiresAt >= ?))",
+			operatorID, s.ID, date, date).Scan(&valid)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			missing = append(missing, s.Name)
+		}
+	}
+	return missing, nil
+}
+
+// validateOperatorQualified checks that an operator exists and holds valid
+// certifications, on date, for every skill the machine requires. machineID
+// may be empty for a machine that is being created.
+func validateOperatorQualified(q queryer, operatorID, machineID, model, date string) (int, error) {
+	var name string
+	err := q.QueryRow("SELECT name FROM operators WHERE id = ?", operatorID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return http.StatusBadRequest, fmt.Errorf("unknown operator %q", operatorID)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	required, err := requiredSkills(q, machineID, model)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(date) > len("2006-01-02") {
+		date = date[:len("2006-01-02")]
+	}
+	missing, err := missingSkills(q, operatorID, required, date)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(missing) > 0 {
+		return http.StatusConflict, fmt.Errorf("operator %s is not qualified for this machine on %s: missing %s", name, date, strings.Join(missing, ", "))
+	}
+	return 0, nil
+}
+
+// validateMaintenanceOperators checks that every operator assigned to or
+// working on a maintenance is qualified for its machine on the maintenance
+// date.
+func validateMaintenanceOperators(q queryer, maint *Maintenance) (int, error) {
+	var model string
+	err := q.QueryRow("SELECT model FROM machines WHERE id = ?", maint.MachineID).Scan(&model)
+	if err != nil && err != sql.ErrNoRows {
+		return http.StatusInternalServerError, err
+	}
+	operatorIDs := append([]string{}, maint.Assignees...)
+	for _, entry := range maint.Labor {
+		operatorIDs = append(operatorIDs, entry.OperatorID)
+	}
+	checked := make(map[string]bool)
+	for _, operatorID := range operatorIDs {
+		if operatorID == "" || checked[operatorID] {
+			continue
+		}
+		checked[operatorID] = true
+		if status, err := validateOperatorQualified(q, operatorID, maint.MachineID, model, maint.Date); err != nil {
+			return status, err
+		}
+	}
+	return 0, nil
+}
+
+// machineSkillsHandler serves /api/machines/{id}/skills: GET lists the skills
+// the machine requires and PUT replaces those it requires on its own, given
+// as a list of skill IDs.
+func machineSkillsHandler(w http.ResponseWriter, r *http.Request, machineID string) {
+	db := tenantDB(r)
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var skillIDs []string
+		if err := json.NewDecoder(r.Body).Decode(&skillIDs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("DELETE FROM machine_skills WHERE machineId = ?", machineID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, id := range skillIDs {
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM skills WHERE id = ?)", id).Scan(&exists); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, fmt.Sprintf("unknown skill %q", id), http.StatusBadRequest)
+				return
+			}
+			if _, err := tx.Exec("INSERT OR IGNORE INTO machine_skills (machineId, skillId) VALUES (?, ?)", machineID, id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var model string
+	if err := db.QueryRow("SELECT model FROM machines WHERE id = ?", machineID).Scan(&model); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	skills, err := requiredSkills(db, machineID, model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(skills)
+}
+
+// QualifiedOperator is an operator who may be assigned to a machine.
+type QualifiedOperator struct {
+	Operator
+	Qualified bool     `json:"qualified"`
+	Missing   []string `json:"missing,omitempty"`
+}
+
+// getQualifiedOperators serves GET /api/machines/{id}/qualified-operators,
+// every operator with whether they are qualified for the machine on ?date=
+// (today by default).
+func getQualifiedOperators(w http.ResponseWriter, r *http.Request, machineID string) {
+	db := tenantDB(r)
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	date, err := parseDate("date", r.URL.Query().Get("date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if date == "" {
+		date = time.Now().UTC().Format("2006-01-02")
+	}
+
+	var model string
+	if err := db.QueryRow("SELECT model FROM machines WHERE id = ?", machineID).Scan(&model); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	required, err := requiredSkills(db, machineID, model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, name, hourlyRate, userId FROM operators ORDER BY name")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	operators := []QualifiedOperator{}
+	for rows.Next() {
+		var op QualifiedOperator
+		if err := rows.Scan(&op.ID, &op.Name, &op.HourlyRate, &op.UserID); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		operators = append(operators, op)
+	}
+	rows.Close()
+
+	for i := range operators {
+		missing, err := missingSkills(db, operators[i].ID, required, date)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		operators[i].Missing = missing
+		operators[i].Qualified = len(missing) == 0
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(operators)
+}
+
+// ExpiringCertification is a line of the expiring certifications report.
+type ExpiringCertification struct {
+	Certification
+	OperatorName string `json:"operatorName"`
+	DaysLeft     int    `json:"daysLeft"` // negative once expired
+	Expired      bool   `json:"expired"`
+}
+
+// queryExpiringCertifications lists the certifications that expire within
+// days of now, expired ones included, soonest first.
+func queryExpiringCertifications(q queryer, now time.Time, days int) ([]ExpiringCertification, error) {
+	today := now.UTC().Truncate(24 * time.Hour)
+	rows, err := q.Query(`
+		SELECT `+certificationColumns+`, COALESCE(o.name, '')
+		FROM certifications c
+		LEFT JOIN skills s ON c.skillId = s.id
+		LEFT JOIN operators o ON c.operatorId = o.id
+		WHERE c.expiresAt != '' AND c.expiresAt <= ?
+		ORDER BY c.expiresAt`, today.AddDate(0, 0, days).Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ExpiringCertification{}
+	for rows.Next() {
+		var item ExpiringCertification
+		c := &item.Certification
+		if err := rows.Scan(&c.ID, &c.OperatorID, &c.SkillID, &c.SkillName, &c.IssuedAt, &c.ExpiresAt, &c.Reference, &item.OperatorName); err != nil {
+			return nil, err
+		}
+		expires, err := time.Parse("2006-01-02", c.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		item.DaysLeft = int(expires.Sub(today).Hours() / 24)
+		item.Expired = item.DaysLeft < 0
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// getExpiringCertificationsReport serves
+// GET /api/reports/expiring-certifications?days=, the certifications expiring
+// within days (CERTIFICATION_WARNING_DAYS by default) and those expired.
+func getExpiringCertificationsReport(w http.ResponseWriter, r *http.Request) {
+	db := tenantDB(r)
+	days := certificationWarningDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "days must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	items, err := queryExpiringCertifications(db, time.Now(), days)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// checkCertification raises a notification for a certification that expires
+// within certificationWarningDays of now, or resolves it otherwise.
+func checkCertification(q queryer, c Certification, now time.Time) error {
+	warnFrom := now.UTC().AddDate(0, 0, certificationWarningDays).Format("2006-01-02")
+	if c.ExpiresAt == "" || c.ExpiresAt > warnFrom {
+		return resolveNotification(q, notificationCertificationExpiring, c.ID)
+	}
+
+	var operatorName string
+	if err := q.QueryRow("SELECT name FROM operators WHERE id = ?", c.OperatorID).Scan(&operatorName); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	severity, message := "warning", fmt.Sprintf("%s: %s certification expires on %s", operatorName, c.SkillName, c.ExpiresAt)
+	if c.ExpiresAt < now.UTC().Format("2006-01-02") {
+		severity, message = "critical", fmt.Sprintf("%s: %s certification expired on %s", operatorName, c.SkillName, c.ExpiresAt)
+	}
+	return raiseNotification(q, Notification{
+		Kind:       notificationCertificationExpiring,
+		Severity:   severity,
+		EntityType: "certification",
+		EntityID:   c.ID,
+		Message:    message,
+		Audience:   rolePlanner,
+	})
+}
+
+// checkCertifications raises or resolves the expiry notification of every
+// certification with an expiry date.
+func checkCertifications(db *sql.DB) error {
+	rows, err := db.Query("SELECT " + certificationColumns + " FROM certifications c LEFT JOIN skills s ON c.skillId = s.id WHERE c.expiresAt != ''")
+	if err != nil {
+		return err
+	}
+	var certifications []Certification
+	for rows.Next() {
+		var c Certification
+		if err := scanCertification(rows, &c); err != nil {
+			rows.Close()
+			return err
+		}
+		certifications = append(certifications, c)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, c := range certifications {
+		if err := checkCertification(db, c, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startCertificationMonitor runs checkCertifications now and then every
+// interval.
+func startCertificationMonitor(interval time.Duration) {
+	startMonitor("Certification expiry check", interval, checkCertifications)
+}
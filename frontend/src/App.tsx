@@ -1,3 +1,4 @@
+import { useEffect, useState } from 'react';
 import { Routes, Route } from 'react-router-dom';
 import Sidebar from './components/Sidebar';
 import Dashboard from './pages/Dashboard';
@@ -5,11 +6,30 @@ import Stock from './pages/Stock';
 import Operators from './pages/Operators';
 import MaintenancePage from './pages/Maintenance';
 import Reports from './pages/Reports';
+import Login from './pages/Login';
+import { AUTH_EXPIRED_EVENT, getStoredTokens, logout } from './api';
 
 function App() {
+  const [user, setUser] = useState(() => getStoredTokens()?.user ?? null);
+
+  useEffect(() => {
+    const onExpired = () => setUser(null);
+    window.addEventListener(AUTH_EXPIRED_EVENT, onExpired);
+    return () => window.removeEventListener(AUTH_EXPIRED_EVENT, onExpired);
+  }, []);
+
+  if (!user) {
+    return <Login onLogin={(tokens) => setUser(tokens.user)} />;
+  }
+
+  const handleLogout = async () => {
+    await logout();
+    setUser(null);
+  };
+
   return (
     <div className="flex h-screen bg-gray-100">
-      <Sidebar />
+      <Sidebar user={user} onLogout={handleLogout} />
       <div className="flex-1 flex flex-col overflow-hidden">
         <main className="flex-1 overflow-x-hidden overflow-y-auto bg-gray-100 p-4">
           <Routes>
@@ -25,4 +45,4 @@ function App() {
   );
 }
 
-export default App;
\ No newline at end of file
+export default App;
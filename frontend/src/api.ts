@@ -1,10 +1,89 @@
-import { Machine, StockItem, Operator, Sensor, Maintenance } from './types';
+import { Machine, StockItem, Operator, Sensor, Maintenance, AuthTokens, Attachment, CalendarFeed, CalendarImport, MaintenanceRequest, BOMItem, MachineBOM, AssetNode } from './types';
 
 const API_URL = '/api';
 
+// Auth API. Tokens are kept in localStorage; requests carry the access token
+// and refresh it once when the server answers 401.
+const TOKENS_KEY = 'm4m.tokens';
+export const AUTH_EXPIRED_EVENT = 'm4m:auth-expired';
+
+export const getStoredTokens = (): AuthTokens | null => {
+    const raw = localStorage.getItem(TOKENS_KEY);
+    return raw ? JSON.parse(raw) : null;
+};
+
+const storeTokens = (tokens: AuthTokens | null) => {
+    if (tokens) {
+        localStorage.setItem(TOKENS_KEY, JSON.stringify(tokens));
+    } else {
+        localStorage.removeItem(TOKENS_KEY);
+    }
+};
+
+// The tenant is needed to log in when the host the app is served on does not
+// name one; it comes with the tokens afterwards.
+export const login = async (username: string, password: string, tenant?: string): Promise<AuthTokens> => {
+    const response = await fetch(`${API_URL}/auth/login`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            ...(tenant ? { 'X-Tenant': tenant } : {}),
+        },
+        body: JSON.stringify({ username, password }),
+    });
+    if (!response.ok) {
+        throw new Error('Invalid username or password');
+    }
+    const tokens: AuthTokens = await response.json();
+    storeTokens(tokens);
+    return tokens;
+};
+
+export const logout = async () => {
+    await apiFetch(`${API_URL}/auth/logout`, { method: 'POST' }).catch(() => undefined);
+    storeTokens(null);
+};
+
+const refreshTokens = async (): Promise<boolean> => {
+    const tokens = getStoredTokens();
+    if (!tokens) {
+        return false;
+    }
+    const response = await fetch(`${API_URL}/auth/refresh`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            ...(tokens.tenant ? { 'X-Tenant': tokens.tenant } : {}),
+        },
+        body: JSON.stringify({ refreshToken: tokens.refreshToken }),
+    });
+    if (!response.ok) {
+        return false;
+    }
+    storeTokens(await response.json());
+    return true;
+};
+
+const apiFetch = async (url: string, init: RequestInit = {}, retry = true): Promise<Response> => {
+    const headers = new Headers(init.headers);
+    const tokens = getStoredTokens();
+    if (tokens) {
+        headers.set('Authorization', `Bearer ${tokens.accessToken}`);
+    }
+    const response = await fetch(url, { ...init, headers });
+    if (response.status === 401 && retry) {
+        if (await refreshTokens()) {
+            return apiFetch(url, init, false);
+        }
+        storeTokens(null);
+        window.dispatchEvent(new Event(AUTH_EXPIRED_EVENT));
+    }
+    return response;
+};
+
 // Machine API
 export const getMachines = async (): Promise<Machine[]> => {
-    const response = await fetch(`${API_URL}/machines`);
+    const response = await apiFetch(`${API_URL}/machines`);
     if (!response.ok) {
         throw new Error('Failed to fetch machines');
     }
@@ -12,7 +91,7 @@ export const getMachines = async (): Promise<Machine[]> => {
 };
 
 export const createMachine = async (machine: Omit<Machine, 'id'>): Promise<Machine> => {
-    const response = await fetch(`${API_URL}/machines`, {
+    const response = await apiFetch(`${API_URL}/machines`, {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
@@ -26,7 +105,7 @@ export const createMachine = async (machine: Omit<Machine, 'id'>): Promise<Machi
 };
 
 export const updateMachine = async (id: string, machine: Omit<Machine, 'id'>): Promise<Machine> => {
-    const response = await fetch(`${API_URL}/machines/${id}`, {
+    const response = await apiFetch(`${API_URL}/machines/${id}`, {
         method: 'PUT',
         headers: {
             'Content-Type': 'application/json',
@@ -37,7 +116,7 @@ export const updateMachine = async (id: string, machine: Omit<Machine, 'id'>): P
 };
 
 export const deleteMachine = async (id: string): Promise<void> => {
-    const response = await fetch(`${API_URL}/machines/${id}`, {
+    const response = await apiFetch(`${API_URL}/machines/${id}`, {
         method: 'DELETE',
     });
     if (!response.ok) {
@@ -47,15 +126,15 @@ export const deleteMachine = async (id: string): Promise<void> => {
 
 // Maintenance API
 export const getMaintenances = async (month: number, year: number): Promise<Maintenance[]> => {
-    const response = await fetch(`${API_URL}/maintenance?month=${month}&year=${year}`);
+    const response = await apiFetch(`${API_URL}/maintenance?month=${month}&year=${year}`);
     if (!response.ok) {
         throw new Error('Failed to fetch maintenance schedules');
     }
     return response.json();
 };
 
-export const createMaintenance = async (maintenance: Omit<Maintenance, 'id'>): Promise<Maintenance> => {
-    const response = await fetch(`${API_URL}/maintenance`, {
+export const createMaintenance = async (maintenance: Omit<Maintenance, 'id'>, prefillStock = false): Promise<Maintenance> => {
+    const response = await apiFetch(`${API_URL}/maintenance${prefillStock ? '?prefillStock=true' : ''}`, {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
@@ -69,7 +148,7 @@ export const createMaintenance = async (maintenance: Omit<Maintenance, 'id'>): P
 };
 
 export const updateMaintenance = async (id: string, maintenance: Maintenance): Promise<Maintenance> => {
-    const response = await fetch(`${API_URL}/maintenance/${id}`, {
+    const response = await apiFetch(`${API_URL}/maintenance/${id}`, {
         method: 'PUT',
         headers: {
             'Content-Type': 'application/json',
@@ -83,7 +162,7 @@ export const updateMaintenance = async (id: string, maintenance: Maintenance): P
 };
 
 export const deleteMaintenance = async (id: string): Promise<void> => {
-    const response = await fetch(`${API_URL}/maintenance/${id}`, {
+    const response = await apiFetch(`${API_URL}/maintenance/${id}`, {
         method: 'DELETE',
     });
     if (!response.ok) {
@@ -91,12 +170,154 @@ export const deleteMaintenance = async (id: string): Promise<void> => {
     }
 };
 
-export const completeMaintenance = (id: string) => fetch(`${API_URL}/maintenances/${id}/complete`, { method: 'PATCH' });
+export const startMaintenance = (id: string) => apiFetch(`${API_URL}/maintenances/${id}/start`, { method: 'PATCH' });
+export const completeMaintenance = (id: string) => apiFetch(`${API_URL}/maintenances/${id}/complete`, { method: 'PATCH' });
+export const startLabor = (id: string, operatorId?: string) => apiFetch(`${API_URL}/maintenances/${id}/labor/start`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ operatorId }),
+});
+export const stopLabor = (id: string, operatorId?: string) => apiFetch(`${API_URL}/maintenances/${id}/labor/stop`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ operatorId }),
+});
+export const recordChecklistItem = (id: string, itemId: string, record: { result?: 'pass' | 'fail'; value?: number; note?: string }) =>
+    apiFetch(`${API_URL}/maintenances/${id}/checklist/${itemId}`, {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(record),
+    });
+export const uploadAttachment = async (entity: 'machines' | 'maintenance' | 'maintenance-requests', id: string, file: File, description = ''): Promise<Attachment> => {
+    const form = new FormData();
+    form.append('file', file);
+    form.append('description', description);
+    const response = await apiFetch(`${API_URL}/${entity}/${id}/attachments`, { method: 'POST', body: form });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const createMaintenanceRequest = async (request: Pick<MaintenanceRequest, 'machineId' | 'symptom' | 'severity' | 'observedAt'>): Promise<MaintenanceRequest> => {
+    const response = await apiFetch(`${API_URL}/maintenance-requests`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(request),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const convertMaintenanceRequest = async (id: string, maintenance: Partial<Maintenance> = {}, force = false): Promise<Maintenance> => {
+    const response = await apiFetch(`${API_URL}/maintenance-requests/${id}/convert${force ? '?force=true' : ''}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(maintenance),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const rejectMaintenanceRequest = (id: string, reason: string) => apiFetch(`${API_URL}/maintenance-requests/${id}/reject`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ reason }),
+});
+export const createCalendarFeed = async (name: string): Promise<CalendarFeed> => {
+    const response = await apiFetch(`${API_URL}/calendar/feeds`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name }),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const importCalendar = async (file: File, options: { dryRun?: boolean; force?: boolean } = {}): Promise<CalendarImport> => {
+    const params = new URLSearchParams({ dryRun: String(!!options.dryRun), force: String(!!options.force) });
+    const response = await apiFetch(`${API_URL}/calendar/import?${params}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'text/calendar' },
+        body: file,
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+
+export const getMachineBOM = async (machineId: string, type: 'preventive' | 'corrective' = 'preventive'): Promise<MachineBOM> => {
+    const response = await apiFetch(`${API_URL}/machines/${machineId}/bom?type=${type}`);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const getBOMItems = async (model?: string): Promise<BOMItem[]> => {
+    const response = await apiFetch(`${API_URL}/bom${model ? `?model=${encodeURIComponent(model)}` : ''}`);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const createBOMItem = async (item: Omit<BOMItem, 'id' | 'stockName'>): Promise<BOMItem> => {
+    const response = await apiFetch(`${API_URL}/bom`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(item),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const deleteBOMItem = (id: string) => apiFetch(`${API_URL}/bom/${id}`, { method: 'DELETE' });
+
+export const getAssetTree = async (): Promise<AssetNode[]> => {
+    const response = await apiFetch(`${API_URL}/assets`);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const getAssetSubtree = async (id: string): Promise<AssetNode> => {
+    const response = await apiFetch(`${API_URL}/assets/${id}`);
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const createAsset = async (asset: Pick<AssetNode, 'kind' | 'name' | 'code' | 'parentId'>): Promise<AssetNode> => {
+    const response = await apiFetch(`${API_URL}/assets`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(asset),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const moveAsset = async (id: string, parentId: string): Promise<AssetNode> => {
+    const response = await apiFetch(`${API_URL}/assets/${id}/move`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ parentId }),
+    });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    return response.json();
+};
+export const deleteAsset = (id: string) => apiFetch(`${API_URL}/assets/${id}`, { method: 'DELETE' });
 
 
 // Stock API calls
 export const getStockItems = async (): Promise<StockItem[]> => {
-    const response = await fetch(`${API_URL}/stock`);
+    const response = await apiFetch(`${API_URL}/stock`);
     if (!response.ok) {
         throw new Error('Failed to fetch stock items');
     }
@@ -106,7 +327,7 @@ export const getStockItems = async (): Promise<StockItem[]> => {
 
 
 export const createStockItem = async (item: Omit<StockItem, 'id'>): Promise<StockItem> => {
-    const response = await fetch(`${API_URL}/stock`, {
+    const response = await apiFetch(`${API_URL}/stock`, {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
@@ -120,7 +341,7 @@ export const createStockItem = async (item: Omit<StockItem, 'id'>): Promise<Stoc
 }
 
 export const updateStockItem = async (item: StockItem): Promise<StockItem> => {
-    const response = await fetch(`${API_URL}/stock/${item.id}`, {
+    const response = await apiFetch(`${API_URL}/stock/${item.id}`, {
         method: 'PUT',
         headers: {
             'Content-Type': 'application/json',
@@ -134,7 +355,7 @@ export const updateStockItem = async (item: StockItem): Promise<StockItem> => {
 }
 
 export const deleteStockItem = async (id: string): Promise<void> => {
-    const response = await fetch(`${API_URL}/stock/${id}`, {
+    const response = await apiFetch(`${API_URL}/stock/${id}`, {
         method: 'DELETE',
     });
     if (!response.ok) {
@@ -144,7 +365,7 @@ export const deleteStockItem = async (id: string): Promise<void> => {
 
 // Operator API calls
 export const getOperators = async (): Promise<Operator[]> => {
-    const response = await fetch(`${API_URL}/operators`);
+    const response = await apiFetch(`${API_URL}/operators`);
     if (!response.ok) {
         throw new Error('Failed to fetch operators');
     }
@@ -152,7 +373,7 @@ export const getOperators = async (): Promise<Operator[]> => {
 }
 
 export const createOperator = async (operator: Omit<Operator, 'id'>): Promise<Operator> => {
-    const response = await fetch(`${API_URL}/operators`, {
+    const response = await apiFetch(`${API_URL}/operators`, {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
@@ -166,7 +387,7 @@ export const createOperator = async (operator: Omit<Operator, 'id'>): Promise<Op
 }
 
 export const updateOperator = async (id: string, operator: Omit<Operator, 'id'>): Promise<Operator> => {
-    const response = await fetch(`${API_URL}/operators/${id}`, {
+    const response = await apiFetch(`${API_URL}/operators/${id}`, {
         method: 'PUT',
         headers: {
             'Content-Type': 'application/json',
@@ -180,13 +401,13 @@ export const updateOperator = async (id: string, operator: Omit<Operator, 'id'>)
 }
 
 export const deleteOperator = (id: string) => {
-    return fetch(`${API_URL}/operators/${id}`, {
+    return apiFetch(`${API_URL}/operators/${id}`, {
         method: 'DELETE',
     });
 };
 
 export const addSensorToMachine = async (machineId: string, sensor: Omit<Sensor, 'id'>): Promise<Sensor> => {
-    const response = await fetch(`${API_URL}/machines/${machineId}/sensors`, {
+    const response = await apiFetch(`${API_URL}/machines/${machineId}/sensors`, {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
@@ -200,7 +421,7 @@ export const addSensorToMachine = async (machineId: string, sensor: Omit<Sensor,
 };
 
 export const removeSensorFromMachine = async (machineId: string, sensorId: string): Promise<void> => {
-    const response = await fetch(`${API_URL}/machines/${machineId}/sensors/${sensorId}`, {
+    const response = await apiFetch(`${API_URL}/machines/${machineId}/sensors/${sensorId}`, {
         method: 'DELETE',
     });
     if (!response.ok) {
@@ -210,7 +431,7 @@ export const removeSensorFromMachine = async (machineId: string, sensorId: strin
 
 // Reports API
 export const getUsedStockReport = async (month: number, year: number): Promise<any[]> => {
-    const response = await fetch(`${API_URL}/reports/used-stock?month=${month}&year=${year}`);
+    const response = await apiFetch(`${API_URL}/reports/used-stock?month=${month}&year=${year}`);
     if (!response.ok) {
         throw new Error('Failed to fetch used stock report');
     }
@@ -219,7 +440,7 @@ export const getUsedStockReport = async (month: number, year: number): Promise<a
 };
 
 export const getScheduledMaintenancesReport = async (month: number, year: number): Promise<any[]> => {
-    const response = await fetch(`${API_URL}/reports/scheduled-maintenances?month=${month}&year=${year}`);
+    const response = await apiFetch(`${API_URL}/reports/scheduled-maintenances?month=${month}&year=${year}`);
     if (!response.ok) {
         throw new Error('Failed to fetch scheduled maintenances report');
     }
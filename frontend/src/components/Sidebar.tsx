@@ -1,4 +1,5 @@
 import { NavLink } from 'react-router-dom';
+import { User } from '../types';
 
 const navigation = [
     { name: 'Machines', href: '/', icon: 'M' },
@@ -8,7 +9,12 @@ const navigation = [
     { name: 'Reports', href: '/reports', icon: 'R' },
 ]
 
-function Sidebar() {
+interface SidebarProps {
+    user: User;
+    onLogout: () => void;
+}
+
+function Sidebar({ user, onLogout }: SidebarProps) {
     return (
         <div className="flex flex-col w-64 bg-gray-800">
             <div className="flex items-center justify-center h-16 bg-gray-900">
@@ -32,6 +38,12 @@ function Sidebar() {
                     </NavLink>
                 ))}
             </nav>
+            <div className="px-4 py-4 border-t border-gray-700 text-sm text-gray-300">
+                <p className="mb-2">{user.name || user.username}</p>
+                <button onClick={onLogout} className="text-gray-400 hover:text-white">
+                    Log out
+                </button>
+            </div>
         </div>
     );
 }
@@ -0,0 +1,59 @@
+import React, { useState } from 'react';
+import { login } from '../api';
+import { AuthTokens } from '../types';
+
+interface LoginProps {
+    onLogin: (tokens: AuthTokens) => void;
+}
+
+const Login: React.FC<LoginProps> = ({ onLogin }) => {
+    const [username, setUsername] = useState('');
+    const [password, setPassword] = useState('');
+    const [error, setError] = useState('');
+
+    const handleSubmit = async (e: React.FormEvent) => {
+        e.preventDefault();
+        setError('');
+        try {
+            onLogin(await login(username, password));
+        } catch (err) {
+            setError((err as Error).message);
+        }
+    };
+
+    return (
+        <div className="flex h-screen items-center justify-center bg-gray-100">
+            <form onSubmit={handleSubmit} className="bg-white p-6 rounded shadow w-80">
+                <h1 className="text-2xl font-bold mb-4">MachineMind</h1>
+                {error && <p className="text-red-600 mb-4">{error}</p>}
+                <div className="mb-4">
+                    <label className="block text-gray-700">Username</label>
+                    <input
+                        type="text"
+                        value={username}
+                        onChange={(e) => setUsername(e.target.value)}
+                        className="w-full px-3 py-2 border rounded"
+                        autoComplete="username"
+                        required
+                    />
+                </div>
+                <div className="mb-4">
+                    <label className="block text-gray-700">Password</label>
+                    <input
+                        type="password"
+                        value={password}
+                        onChange={(e) => setPassword(e.target.value)}
+                        className="w-full px-3 py-2 border rounded"
+                        autoComplete="current-password"
+                        required
+                    />
+                </div>
+                <button type="submit" className="w-full bg-blue-500 text-white px-4 py-2 rounded">
+                    Log in
+                </button>
+            </form>
+        </div>
+    );
+};
+
+export default Login;
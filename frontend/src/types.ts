@@ -1,9 +1,15 @@
 export interface Machine {
     id: string;
     name: string;
+    model?: string;
+    manufacturer?: string;
+    year?: number;
     status: string;
     operatorId?: string;
     sensors?: Sensor[];
+    lineId?: string;
+    updatedBy?: string;
+    updatedAt?: string;
 }
 
 export interface StockItem {
@@ -13,11 +19,26 @@ export interface StockItem {
     unit: string;
     value: number;
     location: string;
+    purchaseUnit?: string;
+    purchaseFactor?: number;
+    valuationMethod?: 'fifo' | 'average';
+    minLevel?: number;
+    reorderPoint?: number;
+    reorderQuantity?: number;
+    levels?: StockLevel[];
+    tracking?: '' | 'lot' | 'serial';
+    lots?: LotQuantity[];
+    updatedBy?: string;
+    updatedAt?: string;
 }
 
 export interface Operator {
     id: string;
     name: string;
+    hourlyRate?: number;
+    userId?: string;
+    shifts?: ShiftAssignment[];
+    certifications?: Certification[];
 }
 
 export interface Sensor {
@@ -32,10 +53,465 @@ export interface Maintenance {
     date: string;
     description: string;
     status: string;
+    type?: 'preventive' | 'corrective';
     usedStock: UsedStockItem[];
+    labor?: LaborEntry[];
+    assignees?: string[];
+    estimatedHours?: number;
+    laborHours?: number;
+    checklistTemplateId?: string;
+    checklist?: ChecklistItem[];
+    start?: string;
+    durationMinutes?: number;
+    end?: string;
+    scheduleOverrides?: ScheduleOverride[];
+    requestId?: string;
+    warnings?: string[];
+    priority?: MaintenancePriority;
+    dueDate?: string;
+    overdue?: boolean;
+    overdueAt?: string;
+    escalatedAt?: string;
+    externalCost?: number;
+    failureStart?: string;
+    repairStart?: string;
+    repairEnd?: string;
+    createdBy?: string;
+    createdAt?: string;
+    startedBy?: string;
+    startedAt?: string;
+    completedBy?: string;
+    completedAt?: string;
+    updatedBy?: string;
+    updatedAt?: string;
 }
 
 export interface UsedStockItem {
     stockId: string;
     quantity: number;
-}
\ No newline at end of file
+    unit?: string;
+    unitCost?: number;
+    issued?: boolean;
+    warehouseId?: string;
+    binId?: string;
+    lots?: LotQuantity[];
+}
+
+export interface LaborEntry {
+    id?: string;
+    operatorId: string;
+    hours: number;
+    rate?: number;
+    startedAt?: string;
+    stoppedAt?: string;
+}
+export interface Supplier {
+    id: string;
+    name: string;
+    contact: string;
+    email: string;
+    phone: string;
+    leadTimeDays: number;
+    items: SupplierItem[];
+}
+
+export interface SupplierItem {
+    stockId: string;
+    supplierSku: string;
+    unitPrice: number;
+    leadTimeDays: number;
+    preferred: boolean;
+}
+
+export interface PurchaseOrder {
+    id: string;
+    supplierId: string;
+    status: 'draft' | 'sent' | 'partially_received' | 'received' | 'cancelled';
+    createdAt: string;
+    sentAt?: string;
+    expectedDate?: string;
+    notes: string;
+    lines: PurchaseOrderLine[];
+}
+
+export interface PurchaseOrderLine {
+    id?: string;
+    stockId: string;
+    quantity: number;
+    unit?: string;
+    unitFactor?: number;
+    unitPrice: number;
+    receivedQuantity?: number;
+}
+
+export interface Unit {
+    code: string;
+    name: string;
+    dimension: string;
+    factor: number;
+}
+
+export interface Warehouse {
+    id: string;
+    name: string;
+    address: string;
+    bins: Bin[];
+}
+
+export interface Bin {
+    id: string;
+    warehouseId: string;
+    code: string;
+    description: string;
+}
+
+export interface StockLevel {
+    stockId: string;
+    warehouseId: string;
+    binId?: string;
+    warehouseName: string;
+    binCode?: string;
+    quantity: number;
+}
+
+export interface LotQuantity {
+    lot: string;
+    quantity: number;
+}
+
+export interface CountSession {
+    id: string;
+    name: string;
+    status: 'open' | 'submitted' | 'approved' | 'cancelled';
+    warehouseId: string;
+    binId?: string;
+    createdAt: string;
+    submittedAt?: string;
+    approvedAt?: string;
+    reason?: string;
+    lines: CountLine[];
+}
+
+export interface CountLine {
+    id: string;
+    stockId: string;
+    name: string;
+    unit: string;
+    warehouseId: string;
+    binId?: string;
+    expected: number;
+    counted: number | null;
+    variance: number;
+    reason?: string;
+    lots?: LotQuantity[];
+}
+
+export interface ScanResult {
+    kind: 'machine' | 'sensor' | 'stock' | 'warehouse' | 'bin';
+    id: string;
+    name: string;
+    parentId?: string;
+    path: string;
+    code: string;
+}
+
+export interface User {
+    id: string;
+    username: string;
+    name: string;
+    email: string;
+    role: string;
+    active: boolean;
+    createdAt: string;
+    permissions?: string[];
+    operatorId?: string;
+}
+
+export interface Role {
+    name: string;
+    description: string;
+    permissions: string[];
+}
+
+export interface AuthTokens {
+    accessToken: string;
+    tokenType: 'Bearer';
+    expiresAt: string;
+    refreshToken: string;
+    refreshExpiresAt: string;
+    user: User;
+    tenant?: string;
+}
+
+export interface AuditEntry {
+    seq: number;
+    id: string;
+    timestamp: string;
+    actorId: string;
+    actorName: string;
+    action: 'create' | 'update' | 'delete';
+    entityType: string;
+    entityId: string;
+    method: string;
+    path: string;
+    requestId: string;
+    clientIp: string;
+    before: unknown;
+    after: unknown;
+    prevHash: string;
+    hash: string;
+}
+
+export interface Shift {
+    id: string;
+    name: string;
+    start: string;
+    end: string;
+    days: number[];
+    breakMinutes: number;
+}
+
+export interface ShiftAssignment {
+    id: string;
+    operatorId: string;
+    shiftId: string;
+    from: string;
+    to?: string;
+}
+
+export interface CalendarException {
+    id: string;
+    operatorId: string;
+    date: string;
+    shiftId?: string;
+    reason: string;
+}
+
+export interface CalendarDay {
+    date: string;
+    working: boolean;
+    shiftId?: string;
+    shiftName?: string;
+    start?: string;
+    end?: string;
+    hours: number;
+    reason?: string;
+}
+
+export interface Skill {
+    id: string;
+    name: string;
+    description: string;
+    machineModel?: string;
+}
+
+export interface RequiredSkill extends Skill {
+    source: 'model' | 'machine';
+}
+
+export interface Certification {
+    id: string;
+    operatorId: string;
+    skillId: string;
+    skillName?: string;
+    issuedAt: string;
+    expiresAt?: string;
+    reference?: string;
+}
+
+export interface ExpiringCertification extends Certification {
+    operatorName: string;
+    daysLeft: number;
+    expired: boolean;
+}
+
+export interface WorkloadMaintenance {
+    id: string;
+    machineId: string;
+    description: string;
+    status: string;
+    hours: number;
+}
+
+export interface WorkloadDay {
+    operatorId: string;
+    operatorName: string;
+    date: string;
+    capacity: number;
+    allocated: number;
+    logged: number;
+    overAllocated: boolean;
+    maintenances: WorkloadMaintenance[];
+}
+
+export type ChecklistStepKind = 'check' | 'measurement' | 'note';
+
+export interface ChecklistStep {
+    title: string;
+    kind: ChecklistStepKind;
+    unit?: string;
+    min?: number;
+    max?: number;
+    optional?: boolean;
+}
+
+export interface ChecklistTemplate {
+    id: string;
+    name: string;
+    machineModel?: string;
+    maintenanceType?: 'preventive' | 'corrective';
+    steps: ChecklistStep[];
+}
+
+export interface ChecklistItem extends ChecklistStep {
+    id: string;
+    position: number;
+    result?: 'pass' | 'fail';
+    value?: number;
+    note?: string;
+    done: boolean;
+    completedBy?: string;
+    completedAt?: string;
+}
+
+export interface Attachment {
+    id: string;
+    entityType: 'machine' | 'maintenance' | 'maintenance-request';
+    entityId: string;
+    fileName: string;
+    contentType: string;
+    size: number;
+    sha256: string;
+    description?: string;
+    uploadedBy: string;
+    uploadedAt: string;
+}
+
+export interface ScheduleConflict {
+    maintenanceId: string;
+    machineId?: string;
+    operatorId?: string;
+    start: string;
+    end: string;
+}
+
+export interface ScheduleOverride {
+    id: string;
+    conflicts: ScheduleConflict[];
+    forcedBy: string;
+    forcedAt: string;
+}
+
+export interface CalendarFeed {
+    id: string;
+    userId: string;
+    name: string;
+    token?: string;
+    url?: string;
+    createdAt: string;
+    lastUsedAt?: string;
+}
+
+export interface CalendarImportEvent {
+    uid: string;
+    summary: string;
+    start?: string;
+    machineId?: string;
+    maintenanceId?: string;
+    result: 'created' | 'conflict' | 'skipped' | 'valid';
+    reason?: string;
+    conflicts?: ScheduleConflict[];
+}
+
+export interface CalendarImport {
+    dryRun: boolean;
+    created: number;
+    conflict: number;
+    skipped: number;
+    events: CalendarImportEvent[];
+}
+
+export type MaintenancePriority = 'low' | 'medium' | 'high' | 'critical';
+
+export interface SLATarget {
+    priority: MaintenancePriority;
+    resolutionHours: number;
+    escalateAfterHours: number;
+}
+
+export interface MaintenanceRequest {
+    id: string;
+    machineId: string;
+    symptom: string;
+    severity: MaintenancePriority;
+    observedAt?: string;
+    status: 'open' | 'converted' | 'rejected';
+    reportedBy: string;
+    reportedAt: string;
+    operatorId?: string;
+    triagedBy?: string;
+    triagedAt?: string;
+    reason?: string;
+    maintenanceId?: string;
+    attachments?: Attachment[];
+}
+
+export interface BOMItem {
+    id: string;
+    model: string;
+    stockId: string;
+    stockName?: string;
+    maintenanceType?: 'preventive' | 'corrective';
+    quantity: number;
+    unit: string;
+    notes?: string;
+}
+
+export interface MachineBOM {
+    machineId: string;
+    model: string;
+    type: 'preventive' | 'corrective';
+    parts: BOMItem[];
+    suggested: UsedStockItem[];
+}
+
+export type AssetKind = 'site' | 'area' | 'line' | 'machine' | 'component';
+
+export interface AssetKPIs {
+    machines: number;
+    failures: number;
+    repairs: number;
+    periodHours: number;
+    uptimeHours: number;
+    downtimeHours: number;
+    repairHours: number;
+    mtbfHours: number | null;
+    mttrHours: number | null;
+    meanDowntimeHours: number | null;
+    availability: number;
+    requests: number;
+    meanResponseHours: number | null;
+}
+
+export interface AssetRollup {
+    machines: number;
+    machineStatus: Record<string, number>;
+    alarms: number;
+    criticalAlarms: number;
+    openMaintenances: number;
+    overdueMaintenances: number;
+    openRequests: number;
+    kpis: AssetKPIs;
+}
+
+export interface AssetNode {
+    id: string;
+    parentId: string;
+    kind: AssetKind;
+    name: string;
+    code?: string;
+    model?: string;
+    status?: string;
+    rollup?: AssetRollup;
+    children: AssetNode[];
+}